@@ -12,30 +12,41 @@ import (
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 	"github.com/xbanchon/image-processing-service/internal/auth"
+	"github.com/xbanchon/image-processing-service/internal/processor"
 	"github.com/xbanchon/image-processing-service/internal/ratelimiter"
 	"github.com/xbanchon/image-processing-service/internal/store"
+	"github.com/xbanchon/image-processing-service/internal/store/blob"
 	"github.com/xbanchon/image-processing-service/internal/store/cache"
-	"github.com/xbanchon/image-processing-service/internal/store/supabase"
+	"github.com/xbanchon/image-processing-service/internal/worker"
 	"go.uber.org/zap"
 )
 
 type application struct {
 	config        config
 	authenticator auth.Authenticator
+	urlSigner     *auth.URLSigner
 	logger        *zap.SugaredLogger
 	store         store.Storage
-	bucket        supabase.Storage
+	bucket        blob.Storage
+	blobURLs      blob.URLs
 	cacheStorage  cache.Storage
 	rateLimiter   ratelimiter.Limiter
+	workers       *worker.Pool
+	backend       processor.Backend
 }
 
 type config struct {
 	addr        string
+	apiURL      string //public base URL, used in IIIF image identifiers and blob URLs
 	db          dbConfig
 	auth        authConfig
-	bucketCfg   bucketConfig
+	signingCfg  signingConfig
+	blobCfg     blob.Config
 	redisCfg    redisConfig
 	ratelimiter ratelimiter.Config
+	workerCfg   worker.Config
+	processCfg  processConfig
+	uploadCfg   uploadConfig
 }
 
 type dbConfig struct {
@@ -58,9 +69,18 @@ type authConfig struct {
 	iss    string
 }
 
-type bucketConfig struct {
-	bucket_id string
-	api_key   string
+type signingConfig struct {
+	keys []string //first key signs, all keys verify
+}
+
+type uploadConfig struct {
+	maxSize      int64         //bytes per uploaded image
+	expiry       time.Duration //of resumable uploads, from their last chunk
+	chunkTimeout time.Duration //to receive one chunk of a resumable upload
+}
+
+type processConfig struct {
+	backend string //vips or native
 }
 
 func (app *application) mount() http.Handler {
@@ -82,9 +102,68 @@ func (app *application) mount() http.Handler {
 		r.Use(app.AuthTokenMiddleware)
 		r.Get("/", app.getImagesHandler)
 		r.Post("/", app.uploadImageHandler)
-		r.Get("/{imageID}", app.getImageHandler)
-		r.Post("/{imageID}/transform", app.transformImageHandler)
-		r.Post("/metadata", app.testMetadataEndpoint)
+
+		r.Route("/{imageID}", func(r chi.Router) {
+			r.Use(app.imageContextMiddleware)
+			r.Get("/", app.getImageHandler)
+			r.Delete("/", app.deleteImageHandler)
+			r.Get("/metadata", app.getImageMetadataHandler)
+			r.Post("/transform", app.transformImageHandler)
+			r.Get("/render", app.renderImageHandler)
+			r.Get("/sign", app.signImageURLHandler)
+			r.Get("/srcset", app.getSrcsetHandler)
+			r.Post("/srcset", app.createSrcsetHandler)
+			r.Route("/tiles", func(r chi.Router) {
+				r.Get("/", app.getTilesHandler)
+				r.Post("/", app.createTilesHandler)
+				r.Get("/image.dzi", app.getDZIHandler)
+				r.Get("/image_files/{level}/{tile}", app.getDZITileHandler)
+				r.Get("/{z}/{x}/{y}", app.getXYZTileHandler)
+			})
+			r.Get("/versions", app.getImageVersionsHandler)
+			r.Get("/versions/{version}", app.getImageVersionHandler)
+			r.Post("/revert/{version}", app.revertImageHandler)
+		})
+	})
+	r.Route("/uploads", func(r chi.Router) {
+		r.Use(app.tusMiddleware)
+		r.Options("/", app.uploadOptionsHandler)
+		r.Group(func(r chi.Router) {
+			r.Use(app.AuthTokenMiddleware)
+			r.Post("/", app.createUploadHandler)
+			r.Route("/{uploadID}", func(r chi.Router) {
+				r.Use(app.uploadContextMiddleware)
+				r.Head("/", app.headUploadHandler)
+				r.Patch("/", app.patchUploadHandler)
+				r.Delete("/", app.deleteUploadHandler)
+			})
+		})
+	})
+	r.Route("/luts", func(r chi.Router) {
+		r.Use(app.AuthTokenMiddleware)
+		r.Get("/", app.getLUTsHandler)
+		r.Post("/", app.uploadLUTHandler)
+		r.Delete("/{name}", app.deleteLUTHandler)
+	})
+	r.Get("/i/{sig}/{imageID}/{options}", app.signedImageHandler)
+	r.Get("/blobs/*", app.getBlobHandler)
+	r.Route("/iiif/3/{imageID}", func(r chi.Router) {
+		r.Use(app.iiifCORSMiddleware)
+		r.Use(app.AuthTokenMiddleware)
+		r.Use(app.imageContextMiddleware)
+		r.Get("/", app.iiifBaseHandler)
+		r.Get("/info.json", app.iiifInfoHandler)
+		r.Get("/{region}/{size}/{rotation}/{file}", app.iiifImageHandler)
+	})
+	r.Route("/jobs", func(r chi.Router) {
+		r.Use(app.AuthTokenMiddleware)
+		r.Get("/{jobID}", app.getJobHandler)
+	})
+	r.Route("/admin", func(r chi.Router) {
+		r.Use(app.AuthTokenMiddleware)
+		r.Use(app.AdminMiddleware)
+		r.Get("/jobs/dead", app.getDeadJobsHandler)
+		r.Post("/jobs/{jobID}/requeue", app.requeueJobHandler)
 	})
 
 	//test routes
@@ -118,7 +197,12 @@ func (app *application) run(mux http.Handler) error {
 
 		app.logger.Infow("signal caught", "signal", s.String())
 
-		shutdown <- srv.Shutdown(ctx)
+		if err := srv.Shutdown(ctx); err != nil {
+			shutdown <- err
+			return
+		}
+
+		shutdown <- app.workers.Shutdown(ctx)
 	}()
 
 	app.logger.Infow("server started", "addr", app.config.addr)
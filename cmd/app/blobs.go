@@ -0,0 +1,60 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/xbanchon/image-processing-service/internal/store/blob"
+)
+
+// getBlobHandler serves objects of the local and memory blob backends, which
+// have no URLs of their own, to holders of a URL signed by blob.URLs:
+// GET /blobs/{key}?exp=...&sig=...
+func (app *application) getBlobHandler(w http.ResponseWriter, r *http.Request) {
+	key, err := url.PathUnescape(chi.URLParam(r, "*"))
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	q := r.URL.Query()
+
+	if err := app.blobURLs.Verify(key, q.Get("exp"), q.Get("sig")); err != nil {
+		app.forbiddenResponse(w, r, err)
+		return
+	}
+
+	ctx := r.Context()
+
+	info, err := app.bucket.Blobs.Stat(ctx, key)
+	if err != nil {
+		switch {
+		case errors.Is(err, blob.ErrNotFound), errors.Is(err, blob.ErrInvalidKey):
+			app.notFoundResponse(w, r, err)
+		default:
+			app.internalServerError(w, r, err)
+		}
+		return
+	}
+
+	body, err := app.bucket.Blobs.Get(ctx, key)
+	if err != nil {
+		app.internalServerError(w, r, err)
+		return
+	}
+	defer body.Close()
+
+	exp, _ := strconv.ParseInt(q.Get("exp"), 10, 64)
+	maxAge := max(exp-time.Now().Unix(), 0)
+
+	w.Header().Set("Content-Type", info.ContentType)
+	w.Header().Set("Content-Length", strconv.FormatInt(info.Size, 10))
+	w.Header().Set("Cache-Control", fmt.Sprintf("private, max-age=%d", maxAge))
+	w.WriteHeader(http.StatusOK)
+	io.Copy(w, body)
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/xbanchon/image-processing-service/internal/processor"
+)
+
+// IIIF Image API 3.0, served at /iiif/3/{imageID}. The service is level 2
+// compliant, with mirroring, arbitrary rotation and upscaling on top.
+const (
+	iiifContext  = "http://iiif.io/api/image/3/context.json"
+	iiifProtocol = "http://iiif.io/api/image"
+	iiifProfile  = "level2"
+)
+
+var (
+	iiifExtraQualities = []string{processor.IIIFColor, processor.IIIFGray, processor.IIIFBitonal}
+	iiifExtraFormats   = []string{"webp", "gif", "tif"} //advertised when the backend can encode them
+	iiifExtraFeatures  = []string{"mirroring", "rotationArbitrary", "sizeUpscaling"}
+)
+
+type iiifInfo struct {
+	Context        string   `json:"@context"`
+	ID             string   `json:"id"`
+	Type           string   `json:"type"`
+	Protocol       string   `json:"protocol"`
+	Profile        string   `json:"profile"`
+	Width          int      `json:"width"`
+	Height         int      `json:"height"`
+	MaxWidth       int      `json:"maxWidth"`
+	MaxHeight      int      `json:"maxHeight"`
+	MaxArea        int      `json:"maxArea"`
+	ExtraQualities []string `json:"extraQualities"`
+	ExtraFormats   []string `json:"extraFormats"`
+	ExtraFeatures  []string `json:"extraFeatures"`
+}
+
+// iiifCORSMiddleware lets viewers on other origins use the image service, as
+// IIIF clients expect. Preflight requests are answered before authentication,
+// since browsers send them without the Authorization header.
+func (app *application) iiifCORSMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Access-Control-Expose-Headers", "Link")
+
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			w.Header().Set("Access-Control-Allow-Methods", "GET, OPTIONS")
+			w.Header().Set("Access-Control-Allow-Headers", "Authorization")
+			w.Header().Set("Access-Control-Max-Age", "86400")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// iiifBaseHandler redirects the base URI of an image to its info.json.
+func (app *application) iiifBaseHandler(w http.ResponseWriter, r *http.Request) {
+	http.Redirect(w, r, app.iiifID(r)+"/info.json", http.StatusSeeOther)
+}
+
+func (app *application) iiifInfoHandler(w http.ResponseWriter, r *http.Request) {
+	image := getImageFromContext(r)
+
+	// images uploaded before their dimensions were recorded are probed
+	m := image.Metadata
+	if m.Width == 0 || m.Height == 0 {
+		buf, err := app.bucket.Images.StreamImage(image.Filename)
+		if err != nil {
+			app.internalServerError(w, r, err)
+			return
+		}
+
+		if m, err = app.imageMetadata(buf); err != nil {
+			app.processingErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	// the service works on the upright image
+	width, height := processor.UprightSize(m.Width, m.Height, m.Orientation)
+
+	info := iiifInfo{
+		Context:        iiifContext,
+		ID:             app.iiifID(r),
+		Type:           "ImageService3",
+		Protocol:       iiifProtocol,
+		Profile:        iiifProfile,
+		Width:          width,
+		Height:         height,
+		MaxWidth:       processor.IIIFMaxDimension,
+		MaxHeight:      processor.IIIFMaxDimension,
+		MaxArea:        processor.MaxPixels,
+		ExtraQualities: iiifExtraQualities,
+		ExtraFormats:   app.iiifExtraFormats(),
+		ExtraFeatures:  iiifExtraFeatures,
+	}
+
+	w.Header().Set("Content-Type", fmt.Sprintf("application/ld+json;profile=%q", iiifContext))
+	w.Header().Set("Link", iiifProfileLink())
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(info); err != nil {
+		app.logger.Errorw("iiif info", "error", err.Error())
+	}
+}
+
+// iiifImageHandler serves {region}/{size}/{rotation}/{quality}.{format}.
+func (app *application) iiifImageHandler(w http.ResponseWriter, r *http.Request) {
+	image := getImageFromContext(r)
+
+	quality, format, ok := strings.Cut(chi.URLParam(r, "file"), ".")
+	if !ok {
+		app.badRequestResponse(w, r, fmt.Errorf("%w: expected {quality}.{format}", processor.ErrInvalidParam))
+		return
+	}
+
+	req, err := processor.ParseIIIF(
+		chi.URLParam(r, "region"),
+		chi.URLParam(r, "size"),
+		chi.URLParam(r, "rotation"),
+		quality,
+		format,
+	)
+	if err != nil {
+		app.processingErrorResponse(w, r, err)
+		return
+	}
+
+	buf, err := app.bucket.Images.StreamImage(image.Filename)
+	if err != nil {
+		app.internalServerError(w, r, err)
+		return
+	}
+
+	out, err := req.Render(app.backend, buf)
+	if err != nil {
+		app.processingErrorResponse(w, r, err)
+		return
+	}
+
+	w.Header().Set("Link", iiifProfileLink())
+	w.Header().Set("Cache-Control", fmt.Sprintf("private, max-age=%d", renderMaxAge))
+	writeImage(w, http.StatusOK, out)
+}
+
+// iiifExtraFormats returns the formats beyond jpg and png that the processing
+// backend can write.
+func (app *application) iiifExtraFormats() []string {
+	extra := make([]string, 0, len(iiifExtraFormats))
+	for _, format := range iiifExtraFormats {
+		if app.backend.Encodes(format) {
+			extra = append(extra, format)
+		}
+	}
+
+	return extra
+}
+
+// iiifID returns the base URI of the image service in the request.
+func (app *application) iiifID(r *http.Request) string {
+	return fmt.Sprintf("%s/iiif/3/%s", strings.TrimSuffix(app.config.apiURL, "/"), chi.URLParam(r, "imageID"))
+}
+
+func iiifProfileLink() string {
+	return fmt.Sprintf(`<%s/3/%s.json>;rel="profile"`, iiifProtocol, iiifProfile)
+}
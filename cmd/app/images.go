@@ -2,71 +2,193 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"log"
+	"mime/multipart"
 	"net/http"
+	"os"
+	"reflect"
 	"strconv"
-	"time"
 
-	"github.com/go-chi/chi/v5"
-	"github.com/h2non/bimg"
 	"github.com/xbanchon/image-processing-service/internal/processor"
 	"github.com/xbanchon/image-processing-service/internal/store"
+	"github.com/xbanchon/image-processing-service/internal/store/blob"
 )
 
-var ImageTypes = map[string]bimg.ImageType{
-	"jpeg": bimg.JPEG,
-	"png":  bimg.PNG,
-	"webp": bimg.WEBP,
-	"tiff": bimg.TIFF,
-}
+type imageKey string
 
-type Metadata struct {
-	Width  int
-	Height int
-	Format string `json:"format"`
-	Size   int64  `json:"size"`
-}
+const imageCtx imageKey = "image"
 
-type Image struct {
-	URL      string //URL of image in object storage
-	Metadata Metadata
+func getImageFromContext(r *http.Request) *store.Image {
+	image, _ := r.Context().Value(imageCtx).(*store.Image)
+	return image
 }
 
+// RequestPayload carries either an ordered list of operations or the legacy
+// fixed-order transformations, plus options for the whole request.
 type RequestPayload struct {
 	Transformations `json:"transformations"`
+	Operations      []OperationPayload `json:"operations,omitempty"`
+	MetadataParams
+}
+
+// MetadataParams control EXIF orientation and metadata. The image is turned
+// upright first unless AutoOrient is false, and all metadata is kept unless
+// StripMetadata is set, in which case only the KeepMetadata categories (exif,
+// gps, camera, copyright, icc, xmp, iptc) survive.
+type MetadataParams struct {
+	AutoOrient    *bool    `json:"auto_orient,omitempty"` //Default true
+	StripMetadata bool     `json:"strip_metadata,omitempty"`
+	KeepMetadata  []string `json:"keep_metadata,omitempty"` //e.g.: ["copyright", "icc"]
+}
+
+// OperationPayload is a single pipeline step, e.g. {"op":"crop","width":400,"height":300}.
+// Steps run in the order they are given.
+type OperationPayload struct {
+	Op      string  `json:"op"`
+	Width   int     `json:"width,omitempty"`
+	Height  int     `json:"height,omitempty"`
+	Angle   int     `json:"angle,omitempty"`
+	Format  string  `json:"format,omitempty"`
+	Quality int     `json:"quality,omitempty"`
+	Gamma   float32 `json:"gamma,omitempty"`
+	Sigma   float32 `json:"sigma,omitempty"`
+	Frame   int     `json:"frame,omitempty"`
+
+	Amount     float32   `json:"amount,omitempty"`
+	Threshold  float32   `json:"threshold,omitempty"`
+	Hue        float32   `json:"hue,omitempty"`
+	Saturation float32   `json:"saturation,omitempty"`
+	Size       int       `json:"size,omitempty"`
+	Kernel     []float32 `json:"kernel,omitempty"`
+	Normalize  bool      `json:"normalize,omitempty"`
+	LUT        string    `json:"lut,omitempty"`
+
+	Progressive      bool   `json:"progressive,omitempty"`
+	Lossless         bool   `json:"lossless,omitempty"`
+	CompressionLevel int    `json:"compression_level,omitempty"`
+	Subsampling      string `json:"subsampling,omitempty"`
+	TIFFCompression  string `json:"tiff_compression,omitempty"`
+
+	Fit                string  `json:"fit,omitempty"`
+	Background         string  `json:"background,omitempty"`
+	Percent            float32 `json:"percent,omitempty"`
+	WithoutEnlargement bool    `json:"without_enlargement,omitempty"`
+
+	X           *int   `json:"x,omitempty"`
+	Y           *int   `json:"y,omitempty"`
+	AspectRatio string `json:"aspect_ratio,omitempty"`
+	Gravity     string `json:"gravity,omitempty"`
+
+	ImageID int64   `json:"image_id,omitempty"`
+	Text    string  `json:"text,omitempty"`
+	Color   string  `json:"color,omitempty"`
+	Margin  int     `json:"margin,omitempty"`
+	Opacity float32 `json:"opacity,omitempty"`
+	Scale   float32 `json:"scale,omitempty"`
+	Tile    bool    `json:"tile,omitempty"`
 }
 
 type Transformations struct {
-	Resize ResizeParams `json:"resize"`
-	Crop   CropParams   `json:"crop"`
-	// Watermark WatermarkParams `json:"watermark"`
-	Mirror  bool   `json:"mirror"` //Mirror image about Y-axis
-	Flip    bool   `json:"flip"`   //Mirror image about X-axis
-	Rotate  int    `json:"rotate"`
-	Quality int    `json:"quality"` //Compress final image
-	Format  string `json:"format"`  //Image format e.g.: JPG, PNG,...
-	Filters struct {
-		Grayscale    bool    `json:"grayscale"`
-		Sepia        bool    `json:"sepia"`
-		Gamma        float32 `json:"gamma"`
-		GaussianBlur float32 `json:"gaussian_blur"`
-	} `json:"filters"`
+	Resize    ResizeParams    `json:"resize"`
+	Crop      CropParams      `json:"crop"`
+	Watermark WatermarkParams `json:"watermark"`
+	Frame     int             `json:"frame"`  //Keep only this frame (1-based) of an animation
+	Mirror    bool            `json:"mirror"` //Mirror image about Y-axis
+	Flip      bool            `json:"flip"`   //Mirror image about X-axis
+	Rotate    int             `json:"rotate"`
+	Quality   int             `json:"quality"` //Compress final image
+	Format    string          `json:"format"`  //Image format e.g.: JPG, PNG,...
+	Encoder   EncoderParams   `json:"encoder"`
+	Filters   FilterParams    `json:"filters"`
+}
+
+// FilterParams adjust the colours and detail of the image. Zero values leave
+// the image untouched; percentages are relative to the original.
+type FilterParams struct {
+	Grayscale     bool    `json:"grayscale"`
+	Sepia         bool    `json:"sepia"`
+	SepiaStrength float32 `json:"sepia_strength"` //0-100, default 50
+	Gamma         float32 `json:"gamma"`
+	GaussianBlur  float32 `json:"gaussian_blur"`
+	Brightness    float32 `json:"brightness"` //-100 (black) to 100 (white)
+	Contrast      float32 `json:"contrast"`   //-100 (flat grey) to 100
+	Saturation    float32 `json:"saturation"` //-100 (grayscale) to 500
+	Hue           float32 `json:"hue"`        //Rotation in degrees, -180 to 180
+	Sharpen       struct {
+		Sigma     float32 `json:"sigma"`     //Radius is about 3 * sigma, up to 50
+		Amount    float32 `json:"amount"`    //Typically 0.5-1.5, up to 10
+		Threshold float32 `json:"threshold"` //Minimum brightness change to sharpen, 0-1
+	} `json:"sharpen"`
+	Invert   bool `json:"invert"`
+	Colorize struct {
+		Hue        float32 `json:"hue"`        //0-360
+		Saturation float32 `json:"saturation"` //0-100
+		Amount     float32 `json:"amount"`     //Strength 0-100
+	} `json:"colorize"`
+	Pixelate    int `json:"pixelate"` //Block size in pixels, 2-512
+	Convolution struct {
+		Kernel    []float32 `json:"kernel"` //3x3 or 5x5 weights, row by row
+		Normalize bool      `json:"normalize"`
+	} `json:"convolution"`
+	LUT          string   `json:"lut"`           //Name of an uploaded .cube LUT
+	LUTIntensity *float32 `json:"lut_intensity"` //1-100, default 100
 }
 
+// CropParams selects a Width x Height region, or the largest region with the
+// given AspectRatio (e.g. "16:9"). The region starts at X/Y when either is given,
+// otherwise it is placed by Gravity (centre by default) or, with gravity
+// "attention" or "entropy", around the most interesting part of the image.
 type CropParams struct {
-	Width  int `json:"width"`
-	Height int `json:"height"`
+	Width       int    `json:"width"`
+	Height      int    `json:"height"`
+	X           *int   `json:"x"` //0 is the left edge; unset places the region by Gravity
+	Y           *int   `json:"y"`
+	Gravity     string `json:"gravity"`
+	AspectRatio string `json:"aspect_ratio"`
 }
 
+// ResizeParams scales the image by Percent, to a single Width or Height keeping
+// the aspect ratio, or into a Width x Height box according to Fit: fill
+// (default), cover, contain, inside or outside. Contain letterboxes with
+// Background and cover crops the overflow using Gravity.
 type ResizeParams struct {
-	Width  int `json:"width"`
-	Height int `json:"height"`
+	Width              int     `json:"width"`
+	Height             int     `json:"height"`
+	Fit                string  `json:"fit"`
+	Background         string  `json:"background"` //Letterbox color e.g.: #000, #ffffff
+	Gravity            string  `json:"gravity"`
+	Percent            float32 `json:"percent"`
+	WithoutEnlargement bool    `json:"without_enlargement"`
 }
 
+// EncoderParams tune how the final image is written. Options that do not
+// apply to the output format are ignored; those the selected backend cannot
+// honour are rejected.
+type EncoderParams struct {
+	Progressive      bool   `json:"progressive"`       //Progressive JPEG, interlaced PNG/GIF
+	Lossless         bool   `json:"lossless"`          //WebP, AVIF, HEIF
+	CompressionLevel int    `json:"compression_level"` //PNG zlib level 1-9
+	Subsampling      string `json:"subsampling"`       //JPEG chroma: 4:2:0 or 4:4:4
+	TIFFCompression  string `json:"tiff_compression"`  //none or deflate
+}
+
+// WatermarkParams overlays either another of the user's images (ImageID) or
+// a line of text. Scale is the overlay width relative to the image (default
+// 0.25) and Opacity runs from 0 to 1 (default 1).
 type WatermarkParams struct {
+	ImageID int64   `json:"image_id"`
+	Text    string  `json:"text"`
+	Color   string  `json:"color"`   //Text color e.g.: #fff, #ff0000
+	Gravity string  `json:"gravity"` //e.g.: centre, north, south-east (default)
+	Margin  int     `json:"margin"`
+	Opacity float32 `json:"opacity"`
+	Scale   float32 `json:"scale"`
+	Tile    bool    `json:"tile"` //Repeat the overlay across the whole image
 }
 
 // type Filters struct {
@@ -83,57 +205,137 @@ type WatermarkParams struct {
 // }
 
 func (app *application) uploadImageHandler(w http.ResponseWriter, r *http.Request) {
-	buf, filename, _, err := readImageData(r)
+	user := getUserFromContext(r)
+	log.Printf("User [%v] request", user.Username)
+
+	// the form around the file is small, the file itself is checked exactly
+	r.Body = http.MaxBytesReader(w, r.Body, app.config.uploadCfg.maxSize+multipartOverhead)
+
+	part, err := openImagePart(r)
 	if err != nil {
-		app.internalServerError(w, r, err)
+		app.uploadErrorResponse(w, r, err)
 		return
 	}
+	defer part.Close()
 
-	bucketFilename, signedURL, err := app.bucket.Images.UploadImage(filename, buf) //error when uploading to supabase. Returning empty strings as consequence
+	image, err := app.createImage(r.Context(), user, part, part.FileName())
 	if err != nil {
-		log.Println("upload to bucket error")
-		app.internalServerError(w, r, err)
+		app.uploadErrorResponse(w, r, err)
 		return
 	}
-	app.logger.Info("image uploaded succesfully")
+	app.logger.Info("image register added")
 
-	if bucketFilename == "" || signedURL == "" {
-		log.Println("bad upload to bucket")
-		return
+	if err := app.jsonResponse(w, http.StatusCreated, image); err != nil {
+		log.Println("server response error")
+		app.internalServerError(w, r, err)
 	}
+}
 
-	user := getUserFromContext(r)
-	log.Printf("User [%v] request", user.Username)
+// createImage streams an upload into the bucket and records it as a new
+// image of the user. The upload is cut off past the maximum upload size. It
+// only reaches its content key once the image references it, so that uploads
+// failing on the way leave nothing behind.
+func (app *application) createImage(ctx context.Context, user *store.User, body io.Reader, filename string) (*store.Image, error) {
+	staged, err := app.bucket.Images.StageImage(ctx, user.ID, newMaxSizeReader(body, app.config.uploadCfg.maxSize))
+	if err != nil {
+		return nil, err
+	}
 
-	image := &store.Image{
-		URL:      signedURL,
-		Filename: bucketFilename,
-		UserID:   user.ID,
+	image, err := app.recordStagedImage(ctx, user, staged, filename)
+	if err != nil {
+		if discardErr := app.bucket.Images.DiscardImage(staged); discardErr != nil {
+			app.logger.Errorw("discarding staged upload", "key", staged.Staging, "error", discardErr.Error())
+		}
+		return nil, err
 	}
 
-	ctx := r.Context()
+	if err := app.bucket.Images.CommitImage(staged); err != nil {
+		return nil, err
+	}
 
-	if err := app.store.Images.Create(ctx, image); err != nil { //duplicate insertion to database. Investigate why
-		log.Println("insert to database error")
-		app.internalServerError(w, r, err)
-		return
+	// the object is in place only now
+	image.URL, err = app.bucket.Images.GetNewSignedImageURL(image.Filename, signedURLDuration)
+	if err != nil {
+		return nil, err
+	}
+	if err := app.store.Images.SetURL(ctx, image); err != nil {
+		return nil, err
 	}
-	app.logger.Info("image register added")
 
-	if err := app.jsonResponse(w, http.StatusCreated, image); err != nil {
-		log.Println("server response error")
-		app.internalServerError(w, r, err)
+	return image, nil
+}
+
+// recordStagedImage inspects a staged upload and records the image, which
+// takes the reference to its content key.
+func (app *application) recordStagedImage(ctx context.Context, user *store.User, staged *blob.StagedImage, filename string) (*store.Image, error) {
+	metadata, err := app.stagedMetadata(staged)
+	if err != nil {
+		return nil, err
 	}
+
+	image := &store.Image{
+		Filename:     staged.Key,
+		OriginalName: filename,
+		UserID:       user.ID,
+		Metadata:     metadata,
+	}
+
+	if err := app.store.Images.Create(ctx, image); err != nil {
+		return nil, err
+	}
+
+	return image, nil
 }
 
-func (app *application) getImageHandler(w http.ResponseWriter, r *http.Request) {
-	imageID, err := strconv.ParseInt(chi.URLParam(r, "imageID"), 10, 64)
+// stagedMetadata inspects the head of a staged upload, and reads the whole
+// object back only for images whose head is not enough, such as TIFF files
+// with their directory at the end or formats only the backend can decode.
+func (app *application) stagedMetadata(staged *blob.StagedImage) (store.ImageMetadata, error) {
+	metadata, err := app.imageMetadata(staged.Head)
+	if err != nil && !staged.Complete() {
+		buf, streamErr := app.bucket.Images.StreamImage(staged.Staging)
+		if streamErr != nil {
+			return metadata, streamErr
+		}
+		metadata, err = app.imageMetadata(buf)
+	}
 	if err != nil {
+		return metadata, err
+	}
+
+	metadata.Size = staged.Size
+	return metadata, nil
+}
+
+// uploadErrorResponse answers 413 for uploads over the size limit, and like
+// processing errors otherwise.
+func (app *application) uploadErrorResponse(w http.ResponseWriter, r *http.Request, err error) {
+	var maxBytesErr *http.MaxBytesError
+	switch {
+	case errors.Is(err, errUploadTooLarge), errors.As(err, &maxBytesErr):
+		app.payloadTooLargeResponse(w, r, app.config.uploadCfg.maxSize)
+	case errors.Is(err, errMissingImage), errors.Is(err, http.ErrNotMultipart):
 		app.badRequestResponse(w, r, err)
+	default:
+		app.processingErrorResponse(w, r, err)
+	}
+}
+
+// deleteImageHandler removes the image with its versions, derivatives and
+// tiles. Objects other images of the user share are kept until the last one
+// referencing them is deleted.
+func (app *application) deleteImageHandler(w http.ResponseWriter, r *http.Request) {
+	image := getImageFromContext(r)
+
+	ctx := r.Context()
+
+	pyramid, err := app.store.Tiles.GetByImageID(ctx, image.ID)
+	if err != nil && err != store.ErrNotFound {
+		app.internalServerError(w, r, err)
 		return
 	}
 
-	image, err := app.getImage(r.Context(), imageID)
+	orphans, err := app.store.Images.Delete(ctx, image.ID)
 	if err != nil {
 		switch err {
 		case store.ErrNotFound:
@@ -144,23 +346,118 @@ func (app *application) getImageHandler(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	log.Printf("requested image: %+v", image)
-	if image == nil || image.UserID == 0 {
-		app.internalServerError(w, r, errors.New("unknown cache error"))
+	app.invalidateImage(ctx, image.ID)
+	app.collectBlobs(ctx, image.UserID, orphans)
+
+	if pyramid != nil {
+		app.deleteObjects(ctx, pyramid.Prefix+"/")
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// collectBlobs removes the objects left unreferenced by a committed change of
+// the user. Whatever could not be removed stays recorded as unreferenced, and
+// a job retries the collection in the background.
+func (app *application) collectBlobs(ctx context.Context, userID int64, keys []string) {
+	if len(keys) == 0 {
 		return
 	}
 
-	user := getUserFromContext(r)
-	if user.ID != image.UserID {
-		app.unauthorizedErrorResponse(w, r, err)
+	err := app.store.Blobs.Collect(ctx, keys, app.bucket.Images.DeleteImages)
+	if err == nil {
+		return
+	}
+	app.logger.Warnw("collecting unreferenced objects", "error", err.Error())
+
+	if _, err := app.workers.Enqueue(context.WithoutCancel(ctx), jobCollectBlobs, userID, struct{}{}); err != nil {
+		app.logger.Errorw("scheduling object collection", "error", err.Error())
+	}
+}
+
+// collectBlobsJob removes every object still recorded as unreferenced, a
+// batch at a time, and fails for a retry while any removal fails.
+func (app *application) collectBlobsJob(ctx context.Context, job *store.Job) (any, error) {
+	var collected int
+	for {
+		keys, err := app.store.Blobs.GetOrphans(ctx, orphanBatchSize)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := app.store.Blobs.Collect(ctx, keys, app.bucket.Images.DeleteImages); err != nil {
+			return nil, err
+		}
+		collected += len(keys)
+
+		if len(keys) < orphanBatchSize {
+			return map[string]int{"collected": collected}, nil
+		}
+	}
+}
+
+// deleteObjects removes the objects under prefix, such as the tiles of a
+// deleted image. Failures only leave garbage behind, so they are logged.
+func (app *application) deleteObjects(ctx context.Context, prefix string) {
+	objects, err := app.bucket.Blobs.List(ctx, prefix)
+	if err != nil {
+		app.logger.Errorw("listing objects to delete", "prefix", prefix, "error", err.Error())
 		return
 	}
 
+	for _, o := range objects {
+		if err := app.bucket.Blobs.Delete(ctx, o.Key); err != nil {
+			app.logger.Errorw("deleting object", "key", o.Key, "error", err.Error())
+		}
+	}
+}
+
+func (app *application) getImageHandler(w http.ResponseWriter, r *http.Request) {
+	image := getImageFromContext(r)
+
 	if err := app.jsonResponse(w, http.StatusOK, image); err != nil {
 		app.internalServerError(w, r, err)
 	}
 }
 
+func (app *application) getImageMetadataHandler(w http.ResponseWriter, r *http.Request) {
+	image := getImageFromContext(r)
+
+	if err := app.jsonResponse(w, http.StatusOK, image.Metadata); err != nil {
+		app.internalServerError(w, r, err)
+	}
+}
+
+// imageMetadata reads the attributes and EXIF details recorded for an image
+// file. Files that are not images the backend can read are rejected.
+func (app *application) imageMetadata(buf []byte) (store.ImageMetadata, error) {
+	info, err := processor.Inspect(app.backend, buf)
+	if err != nil {
+		if !errors.Is(err, processor.ErrUnsupportedFormat) {
+			err = fmt.Errorf("%w: %v", processor.ErrUnsupportedFormat, err)
+		}
+		return store.ImageMetadata{}, err
+	}
+
+	metadata := store.ImageMetadata{
+		Width:       info.Width,
+		Height:      info.Height,
+		Format:      info.Format,
+		Size:        int64(info.Size),
+		ColorSpace:  info.ColorSpace,
+		HasAlpha:    info.HasAlpha,
+		Orientation: info.Orientation,
+	}
+
+	if info.EXIF != nil {
+		if metadata.EXIF, err = json.Marshal(info.EXIF); err != nil {
+			return store.ImageMetadata{}, err
+		}
+	}
+
+	return metadata, nil
+}
+
 func (app *application) getImagesHandler(w http.ResponseWriter, r *http.Request) {
 	pp := store.PaginationParams{
 		PageID: 1,
@@ -193,34 +490,8 @@ func (app *application) getImagesHandler(w http.ResponseWriter, r *http.Request)
 }
 
 func (app *application) transformImageHandler(w http.ResponseWriter, r *http.Request) {
-	imageID, err := strconv.ParseInt(chi.URLParam(r, "imageID"), 10, 64)
-	if err != nil {
-		app.badRequestResponse(w, r, err)
-		return
-	}
-
-	image, err := app.getImage(r.Context(), imageID)
-	if err != nil {
-		switch err {
-		case store.ErrNotFound:
-			app.notFoundResponse(w, r, err)
-		default:
-			app.internalServerError(w, r, err)
-		}
-		return
-	}
-
+	image := getImageFromContext(r)
 	user := getUserFromContext(r)
-	if image.UserID != user.ID {
-		app.forbiddenResponse(w, r, err)
-		return
-	}
-
-	buf, err := app.bucket.Images.StreamImage(image.Filename)
-	if err != nil {
-		app.internalServerError(w, r, err)
-		return
-	}
 
 	var payload RequestPayload
 
@@ -234,46 +505,26 @@ func (app *application) transformImageHandler(w http.ResponseWriter, r *http.Req
 		return
 	}
 
-	options := processor.Transformer{
-		Resize: struct {
-			Width  int
-			Height int
-		}(payload.Resize),
-		Crop: struct {
-			Width  int
-			Height int
-		}(payload.Crop),
-		Mirror:  payload.Mirror,
-		Flip:    payload.Flip,
-		Rotate:  payload.Rotate,
-		Quality: payload.Quality,
-		Format:  payload.Format,
-		Filters: struct {
-			Grayscale    bool
-			Sepia        bool
-			Gamma        float32
-			GaussianBlur float32
-		}(payload.Filters),
+	if _, err := newPipeline(payload); err != nil {
+		app.badRequestResponse(w, r, err)
+		return
 	}
 
-	log.Printf("user [%v] request -> image [%d] transformation ops: %+v", user.Username, image.ID, payload)
-	ip := processor.NewImageProcessor(buf, options)
-	newBuf, err := ip.Transformer.Process()
-	if err != nil {
-		app.internalServerError(w, r, err)
+	if _, err := newProcessingOptions(payload); err != nil {
+		app.badRequestResponse(w, r, err)
 		return
 	}
 
-	if err := app.bucket.Images.UpdateImage(image.Filename, newBuf); err != nil {
-		app.internalServerError(w, r, err)
+	log.Printf("user [%v] request -> image [%d] transformation ops: %+v", user.Username, image.ID, payload)
+
+	async, _ := strconv.ParseBool(r.URL.Query().Get("async"))
+	if async {
+		app.enqueueTransformJob(w, r, image, payload)
 		return
 	}
 
-	//update image info
-	image.UpdatedAt = time.Now().Format(time.RFC3339)
-
-	if err := app.store.Images.Update(r.Context(), image); err != nil {
-		app.internalServerError(w, r, err)
+	if err := app.transformImage(r.Context(), image, payload); err != nil {
+		app.processingErrorResponse(w, r, err)
 		return
 	}
 
@@ -282,43 +533,167 @@ func (app *application) transformImageHandler(w http.ResponseWriter, r *http.Req
 	}
 }
 
-// Test endpoints
-func (app *application) testMetadataEndpoint(w http.ResponseWriter, r *http.Request) {
-	buf, filename, size, err := readImageData(r)
+// transformImage applies the requested transformations to the current version
+// of the image and stores the result as a new version, leaving earlier
+// versions untouched.
+func (app *application) transformImage(ctx context.Context, image *store.Image, payload RequestPayload) error {
+	newBuf, err := app.renderImage(ctx, image, payload)
 	if err != nil {
-		app.internalServerError(w, r, err)
+		return err
 	}
 
-	metadata, err := getImageMetadata(buf)
+	metadata, err := app.imageMetadata(newBuf)
 	if err != nil {
-		app.internalServerError(w, r, err)
+		return err
+	}
+
+	filename, signedURL, err := app.bucket.Images.UploadImage(image.UserID, newBuf)
+	if err != nil {
+		return err
+	}
+
+	transformations, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	version := &store.ImageVersion{
+		Filename:        filename,
+		URL:             signedURL,
+		Transformations: transformations,
+		AutoOriented:    payload.AutoOrient == nil || *payload.AutoOrient,
+		Metadata:        metadata,
 	}
+	if payload.StripMetadata {
+		version.MetadataKept = append([]string{}, payload.KeepMetadata...)
+	}
+
+	if err := app.store.Versions.Create(ctx, image, version); err != nil {
+		return err
+	}
+
+	app.invalidateImage(ctx, image.ID)
+
+	return app.ensureObject(filename, newBuf)
+}
+
+// ensureObject writes content again when the last image sharing its object
+// was deleted between the upload finding the object and taking a reference
+// to it.
+func (app *application) ensureObject(filename string, buf []byte) error {
+	return app.bucket.Images.EnsureImage(filename, buf)
+}
+
+var errMixedPayload = errors.New("use either operations or transformations, not both")
+
+// newProcessingOptions returns the validated pipeline-wide options of the request.
+func newProcessingOptions(payload RequestPayload) (processor.Options, error) {
+	opts := processor.DefaultOptions()
+	if payload.AutoOrient != nil {
+		opts.AutoOrient = *payload.AutoOrient
+	}
+	opts.Metadata = processor.MetadataOptions{
+		Strip: payload.StripMetadata,
+		Keep:  payload.KeepMetadata,
+	}
+
+	return opts, opts.Validate()
+}
 
-	type CustomMetadata struct {
-		Width   int    `json:"width"`
-		Height  int    `json:"height"`
-		ImgType string `json:"imgtype"`
+// newPipeline turns the request into a validated list of processor operations.
+func newPipeline(payload RequestPayload) ([]processor.Operation, error) {
+	if len(payload.Operations) == 0 {
+		ops := newTransformer(payload).Pipeline()
+		return ops, processor.Validate(ops)
 	}
 
-	type envelope struct {
-		Filename string         `json:"filename"`
-		Size     int64          `json:"size"`
-		Metadata CustomMetadata `json:"metadata"`
+	if !reflect.ValueOf(payload.Transformations).IsZero() {
+		return nil, errMixedPayload
 	}
 
-	newMetadata := CustomMetadata{
-		Width:   metadata.Size.Width,
-		Height:  metadata.Size.Height,
-		ImgType: metadata.Type,
+	ops := make([]processor.Operation, len(payload.Operations))
+	for i, op := range payload.Operations {
+		ops[i] = processor.Operation(op)
 	}
 
-	json.NewEncoder(w).Encode(&envelope{
-		Filename: filename,
-		Size:     size,
-		Metadata: newMetadata,
-	})
+	return ops, processor.Validate(ops)
 }
 
+func newTransformer(payload RequestPayload) processor.Transformer {
+	return processor.Transformer{
+		Resize: struct {
+			Width              int
+			Height             int
+			Fit                string
+			Background         string
+			Gravity            string
+			Percent            float32
+			WithoutEnlargement bool
+		}(payload.Resize),
+		Crop: struct {
+			Width       int
+			Height      int
+			X           *int
+			Y           *int
+			Gravity     string
+			AspectRatio string
+		}(payload.Crop),
+		Frame:   payload.Frame,
+		Mirror:  payload.Mirror,
+		Flip:    payload.Flip,
+		Rotate:  payload.Rotate,
+		Quality: payload.Quality,
+		Format:  payload.Format,
+		Encoder: struct {
+			Progressive      bool
+			Lossless         bool
+			CompressionLevel int
+			Subsampling      string
+			TIFFCompression  string
+		}(payload.Encoder),
+		Filters: struct {
+			Grayscale     bool
+			Sepia         bool
+			SepiaStrength float32
+			Gamma         float32
+			GaussianBlur  float32
+			Brightness    float32
+			Contrast      float32
+			Saturation    float32
+			Hue           float32
+			Sharpen       struct {
+				Sigma     float32
+				Amount    float32
+				Threshold float32
+			}
+			Invert   bool
+			Colorize struct {
+				Hue        float32
+				Saturation float32
+				Amount     float32
+			}
+			Pixelate    int
+			Convolution struct {
+				Kernel    []float32
+				Normalize bool
+			}
+			LUT          string
+			LUTIntensity *float32
+		}(payload.Filters),
+		Watermark: struct {
+			ImageID int64
+			Text    string
+			Color   string
+			Gravity string
+			Margin  int
+			Opacity float32
+			Scale   float32
+			Tile    bool
+		}(payload.Watermark),
+	}
+}
+
+// Test endpoints
 func (app *application) testBasicTransformation(w http.ResponseWriter, r *http.Request) {
 	buf, filename, _, err := readImageData(r)
 	if err != nil {
@@ -327,14 +702,14 @@ func (app *application) testBasicTransformation(w http.ResponseWriter, r *http.R
 		return
 	}
 
-	newImage, err := bimg.NewImage(buf).Rotate(90)
+	newImage, err := processor.NewPipelineProcessor(app.backend, buf, []processor.Operation{{Op: processor.OpRotate, Angle: 90}}, processor.DefaultOptions(), nil).Transformer.Process()
 	if err != nil {
 		app.internalServerError(w, r, err)
 		log.Printf("internal error: %v", err.Error())
 		return
 	}
 
-	err = bimg.Write("/opt/projects/image-processing-service/testdata/out/transform_"+filename, newImage)
+	err = os.WriteFile("/opt/projects/image-processing-service/testdata/out/transform_"+filename, newImage, 0644)
 	if err != nil {
 		app.internalServerError(w, r, err)
 		log.Printf("internal error: %v", err.Error())
@@ -371,27 +746,7 @@ func (app *application) testTransformationReq(w http.ResponseWriter, r *http.Req
 		return
 	}
 
-	trReq := &processor.Transformer{
-		Resize: struct {
-			Width  int
-			Height int
-		}(payload.Resize),
-		Crop: struct {
-			Width  int
-			Height int
-		}(payload.Crop),
-		Mirror:  payload.Mirror,
-		Flip:    payload.Flip,
-		Rotate:  payload.Rotate,
-		Quality: payload.Quality,
-		Format:  payload.Format,
-		Filters: struct {
-			Grayscale    bool
-			Sepia        bool
-			Gamma        float32
-			GaussianBlur float32
-		}(payload.Filters),
-	}
+	trReq := newTransformer(payload)
 
 	if err := app.jsonResponse(w, http.StatusOK, trReq); err != nil {
 		app.internalServerError(w, r, err)
@@ -400,18 +755,8 @@ func (app *application) testTransformationReq(w http.ResponseWriter, r *http.Req
 }
 
 // Utils
-func getImageMetadata(buffer []byte) (bimg.ImageMetadata, error) {
-	metadata, err := bimg.Metadata(buffer)
-
-	if err != nil {
-		return bimg.ImageMetadata{}, err
-	}
-
-	return metadata, nil
-}
-
 func readImageData(r *http.Request) ([]byte, string, int64, error) {
-	r.ParseMultipartForm(10 >> 20) // 10MB
+	r.ParseMultipartForm(10 << 20) // 10MB
 	r.ParseForm()
 	image, header, err := r.FormFile("image")
 
@@ -428,3 +773,67 @@ func readImageData(r *http.Request) ([]byte, string, int64, error) {
 
 	return buf.Bytes(), header.Filename, header.Size, nil
 }
+
+// multipartOverhead allows for the boundaries and fields around the image
+// in a multipart upload.
+const multipartOverhead = 1 << 20
+
+var (
+	errUploadTooLarge = errors.New("upload exceeds the maximum size")
+	errMissingImage   = errors.New("missing image file in the \"image\" field")
+)
+
+// openImagePart returns the "image" file of a multipart upload without
+// reading ahead, so that it can be streamed.
+func openImagePart(r *http.Request) (*multipart.Part, error) {
+	mr, err := r.MultipartReader()
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		part, err := mr.NextPart()
+		switch {
+		case err == io.EOF:
+			return nil, errMissingImage
+		case err != nil:
+			return nil, err
+		}
+
+		if part.FormName() == "image" && part.FileName() != "" {
+			return part, nil
+		}
+		part.Close()
+	}
+}
+
+// maxSizeReader fails with errUploadTooLarge as soon as more than the
+// maximum size has been read, rather than silently truncating like
+// io.LimitReader.
+type maxSizeReader struct {
+	r    io.Reader
+	left int64
+}
+
+func newMaxSizeReader(r io.Reader, max int64) *maxSizeReader {
+	return &maxSizeReader{r: r, left: max}
+}
+
+func (m *maxSizeReader) Read(p []byte) (int, error) {
+	if m.left < 0 {
+		return 0, errUploadTooLarge
+	}
+
+	// read one byte past the limit to tell a full upload from an oversized one
+	if int64(len(p)) > m.left+1 {
+		p = p[:m.left+1]
+	}
+
+	n, err := m.r.Read(p)
+	m.left -= int64(n)
+	if m.left < 0 {
+		return n, errUploadTooLarge
+	}
+
+	return n, err
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/xbanchon/image-processing-service/internal/store/blob"
+)
+
+// uploadImage posts data as the image of a multipart upload by the user.
+func (ta *testApplication) uploadImage(t *testing.T, userID int64, data []byte) *httptest.ResponseRecorder {
+	t.Helper()
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	fw, err := mw.CreateFormFile("image", "scan.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fw.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := mw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/images/", &body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	req.Header.Set("Authorization", "Bearer "+ta.token(t, userID))
+
+	rr := httptest.NewRecorder()
+	ta.handler.ServeHTTP(rr, req)
+
+	return rr
+}
+
+func (ta *testApplication) objects(t *testing.T, userID int64) []blob.ObjectInfo {
+	t.Helper()
+
+	objects, err := ta.blobs.List(context.Background(), blob.UserPrefix(userID))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return objects
+}
+
+func TestUploadImage(t *testing.T) {
+	ta := newTestApplication(t)
+
+	rr := ta.uploadImage(t, 1, testPNG(t))
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("status = %d, want %d: %s", rr.Code, http.StatusCreated, rr.Body)
+	}
+
+	image, err := ta.images.GetByID(context.Background(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if image.URL == "" {
+		t.Errorf("image recorded without a url")
+	}
+
+	objects := ta.objects(t, 1)
+	if len(objects) != 1 || objects[0].Key != image.Filename {
+		t.Fatalf("objects = %v, want only %s", objects, image.Filename)
+	}
+}
+
+// TestUploadImageFailed checks that uploads which are never recorded leave
+// no objects behind, since nothing would ever collect them.
+func TestUploadImageFailed(t *testing.T) {
+	valid := testPNG(t)
+	corrupt := append(append([]byte{}, valid[:12]...), bytes.Repeat([]byte{0xff}, 2000)...) //png signature, broken header
+
+	tests := []struct {
+		name       string
+		data       []byte
+		createErr  error
+		wantStatus int
+	}{
+		{"corrupt image", corrupt, nil, http.StatusBadRequest},
+		{"image not recorded", valid, errors.New("database is down"), http.StatusInternalServerError},
+		{"not an image", bytes.Repeat([]byte("not an image "), 100), nil, http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ta := newTestApplication(t)
+			ta.images.createErr = tt.createErr
+
+			rr := ta.uploadImage(t, 1, tt.data)
+			if rr.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", rr.Code, tt.wantStatus, rr.Body)
+			}
+			if objects := ta.objects(t, 1); len(objects) != 0 {
+				t.Fatalf("objects left behind: %v", objects)
+			}
+		})
+	}
+}
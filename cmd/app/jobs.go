@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/xbanchon/image-processing-service/internal/processor"
+	"github.com/xbanchon/image-processing-service/internal/store"
+	"github.com/xbanchon/image-processing-service/internal/worker"
+)
+
+const (
+	jobTransformImage = "transform_image"
+	jobCollectBlobs   = "collect_blobs"
+
+	orphanBatchSize = 100
+)
+
+type transformJobPayload struct {
+	ImageID int64 `json:"image_id"`
+	RequestPayload
+}
+
+func (app *application) registerJobHandlers() {
+	app.workers.Handle(jobTransformImage, app.transformImageJob)
+	app.workers.Handle(jobTileImage, app.tileImageJob)
+	app.workers.Handle(jobExpireUpload, app.expireUploadJob)
+	app.workers.Handle(jobCollectBlobs, app.collectBlobsJob)
+}
+
+func (app *application) enqueueTransformJob(w http.ResponseWriter, r *http.Request, image *store.Image, payload RequestPayload) {
+	user := getUserFromContext(r)
+
+	job, err := app.workers.Enqueue(r.Context(), jobTransformImage, user.ID, transformJobPayload{
+		ImageID:        image.ID,
+		RequestPayload: payload,
+	})
+	if err != nil {
+		app.internalServerError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Location", fmt.Sprintf("/jobs/%d", job.ID))
+
+	if err := app.jsonResponse(w, http.StatusAccepted, job); err != nil {
+		app.internalServerError(w, r, err)
+	}
+}
+
+func (app *application) transformImageJob(ctx context.Context, job *store.Job) (any, error) {
+	var payload transformJobPayload
+	if err := json.Unmarshal(job.Payload, &payload); err != nil {
+		return nil, worker.Permanent(err)
+	}
+
+	image, err := app.getImage(ctx, payload.ImageID)
+	if err != nil {
+		if err == store.ErrNotFound {
+			return nil, worker.Permanent(err)
+		}
+		return nil, err
+	}
+
+	if image.UserID != job.UserID {
+		return nil, worker.Permanent(errors.New("image does not belong to job owner"))
+	}
+
+	if err := app.transformImage(ctx, image, payload.RequestPayload); err != nil {
+		if errors.Is(err, processor.ErrInvalidParam) || errors.Is(err, processor.ErrUnsupportedFormat) {
+			return nil, worker.Permanent(err)
+		}
+		return nil, err
+	}
+
+	return image, nil
+}
+
+func (app *application) getJobHandler(w http.ResponseWriter, r *http.Request) {
+	jobID, err := strconv.ParseInt(chi.URLParam(r, "jobID"), 10, 64)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	job, err := app.workers.Get(r.Context(), jobID)
+	if err != nil {
+		switch err {
+		case store.ErrNotFound:
+			app.notFoundResponse(w, r, err)
+		default:
+			app.internalServerError(w, r, err)
+		}
+		return
+	}
+
+	user := getUserFromContext(r)
+	if job.UserID != user.ID {
+		app.notFoundResponse(w, r, store.ErrNotFound)
+		return
+	}
+
+	if err := app.jsonResponse(w, http.StatusOK, job); err != nil {
+		app.internalServerError(w, r, err)
+	}
+}
+
+func (app *application) getDeadJobsHandler(w http.ResponseWriter, r *http.Request) {
+	pp := store.PaginationParams{
+		PageID: 1,
+		Limit:  10,
+	}
+	pp, err := pp.Parse(r)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	if err := Validate.Struct(pp); err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	jobs, err := app.store.Jobs.GetByStatus(r.Context(), store.JobDead, pp)
+	if err != nil {
+		app.internalServerError(w, r, err)
+		return
+	}
+
+	if err := app.jsonResponse(w, http.StatusOK, jobs); err != nil {
+		app.internalServerError(w, r, err)
+	}
+}
+
+func (app *application) requeueJobHandler(w http.ResponseWriter, r *http.Request) {
+	jobID, err := strconv.ParseInt(chi.URLParam(r, "jobID"), 10, 64)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	job, err := app.store.Jobs.Requeue(r.Context(), jobID)
+	if err != nil {
+		switch err {
+		case store.ErrNotFound:
+			app.notFoundResponse(w, r, err)
+		default:
+			app.internalServerError(w, r, err)
+		}
+		return
+	}
+
+	app.logger.Infow("dead job requeued", "job_id", job.ID, "admin", getUserFromContext(r).Username)
+
+	if err := app.jsonResponse(w, http.StatusOK, job); err != nil {
+		app.internalServerError(w, r, err)
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/xbanchon/image-processing-service/internal/processor"
+	"github.com/xbanchon/image-processing-service/internal/store"
+)
+
+// maxLUTFileSize fits a 65-point .cube file with generous precision.
+const maxLUTFileSize = 16 << 20
+
+func (app *application) getLUTsHandler(w http.ResponseWriter, r *http.Request) {
+	user := getUserFromContext(r)
+
+	luts, err := app.store.LUTs.GetUserLUTs(r.Context(), user.ID)
+	if err != nil {
+		app.internalServerError(w, r, err)
+		return
+	}
+
+	if err := app.jsonResponse(w, http.StatusOK, luts); err != nil {
+		app.internalServerError(w, r, err)
+	}
+}
+
+// uploadLUTHandler stores a .cube file, sent as the "lut" form file, under
+// the "name" form value. The file is parsed up front so transforms never
+// reference a broken table.
+func (app *application) uploadLUTHandler(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxLUTFileSize+1<<20)
+
+	name := r.FormValue("name")
+	if !processor.ValidLUTName(name) {
+		app.badRequestResponse(w, r, errors.New("name must be 1-64 lowercase letters, digits, dashes or underscores"))
+		return
+	}
+
+	file, _, err := r.FormFile("lut")
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	defer file.Close()
+
+	data, err := io.ReadAll(io.LimitReader(file, maxLUTFileSize+1))
+	if err != nil {
+		app.internalServerError(w, r, err)
+		return
+	}
+	if len(data) > maxLUTFileSize {
+		app.badRequestResponse(w, r, fmt.Errorf("lut files are limited to %d MB", maxLUTFileSize>>20))
+		return
+	}
+
+	parsed, err := processor.ParseCube(bytes.NewReader(data))
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	user := getUserFromContext(r)
+	lut := &store.LUT{
+		UserID: user.ID,
+		Name:   name,
+		Title:  parsed.Title,
+		Size:   parsed.Size,
+		Data:   data,
+	}
+
+	if err := app.store.LUTs.Create(r.Context(), lut); err != nil {
+		switch err {
+		case store.ErrConflict:
+			app.conflictResponse(w, r, fmt.Errorf("a lut named %q already exists", name))
+		default:
+			app.internalServerError(w, r, err)
+		}
+		return
+	}
+
+	if err := app.jsonResponse(w, http.StatusCreated, lut); err != nil {
+		app.internalServerError(w, r, err)
+	}
+}
+
+func (app *application) deleteLUTHandler(w http.ResponseWriter, r *http.Request) {
+	user := getUserFromContext(r)
+
+	if err := app.store.LUTs.Delete(r.Context(), user.ID, chi.URLParam(r, "name")); err != nil {
+		switch err {
+		case store.ErrNotFound:
+			app.notFoundResponse(w, r, err)
+		default:
+			app.internalServerError(w, r, err)
+		}
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
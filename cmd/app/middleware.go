@@ -2,12 +2,14 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"strconv"
 	"strings"
 
+	"github.com/go-chi/chi/v5"
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/xbanchon/image-processing-service/internal/store"
 )
@@ -55,6 +57,58 @@ func (app *application) AuthTokenMiddleware(next http.Handler) http.Handler {
 	})
 }
 
+func (app *application) AdminMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user := getUserFromContext(r)
+		if user == nil || !user.IsAdmin {
+			app.forbiddenResponse(w, r, errors.New("admin privileges required"))
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// imageContextMiddleware loads the image referenced by {imageID} and makes sure
+// it belongs to the authenticated user.
+func (app *application) imageContextMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		imageID, err := strconv.ParseInt(chi.URLParam(r, "imageID"), 10, 64)
+		if err != nil {
+			app.badRequestResponse(w, r, err)
+			return
+		}
+
+		ctx := r.Context()
+
+		image, err := app.getImage(ctx, imageID)
+		if err != nil {
+			switch err {
+			case store.ErrNotFound:
+				app.notFoundResponse(w, r, err)
+			default:
+				app.internalServerError(w, r, err)
+			}
+			return
+		}
+
+		if image == nil || image.UserID == 0 {
+			app.internalServerError(w, r, errors.New("unknown cache error"))
+			return
+		}
+
+		user := getUserFromContext(r)
+		if image.UserID != user.ID {
+			app.forbiddenResponse(w, r, errors.New("image does not belong to user"))
+			return
+		}
+
+		ctx = context.WithValue(ctx, imageCtx, image)
+
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
 func (app *application) getUser(ctx context.Context, userID int64) (*store.User, error) {
 	return app.store.Users.GetByID(ctx, userID)
 }
@@ -87,6 +141,15 @@ func (app *application) getImage(ctx context.Context, imageID int64) (*store.Ima
 	return image, nil
 }
 
+// invalidateImage drops the cached copy of an image record after it changed.
+func (app *application) invalidateImage(ctx context.Context, imageID int64) {
+	if !app.config.redisCfg.enabled {
+		return
+	}
+
+	app.cacheStorage.Images.Delete(ctx, imageID)
+}
+
 func (app *application) RateLimiterMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if app.config.ratelimiter.Enabled {
@@ -0,0 +1,391 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/xbanchon/image-processing-service/internal/processor"
+	"github.com/xbanchon/image-processing-service/internal/store"
+)
+
+const (
+	renderMaxDimension = processor.MaxDimension
+	renderMaxAge       = 3600 // seconds
+)
+
+var errRenderParam = errors.New("invalid render parameter")
+
+// renderImageHandler serves a transformed copy of the image without touching
+// the stored original, e.g. GET /images/1/render?w=400&h=300&fmt=webp&q=80&gray=1
+func (app *application) renderImageHandler(w http.ResponseWriter, r *http.Request) {
+	image := getImageFromContext(r)
+
+	payload, err := parseRenderQuery(r.URL.Query())
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	buf, err := app.renderImage(r.Context(), image, payload)
+	if err != nil {
+		app.processingErrorResponse(w, r, err)
+		return
+	}
+
+	w.Header().Set("Cache-Control", fmt.Sprintf("private, max-age=%d", renderMaxAge))
+	writeImage(w, http.StatusOK, buf)
+}
+
+// renderImage returns the stored image with the transformations applied.
+func (app *application) renderImage(ctx context.Context, image *store.Image, payload RequestPayload) ([]byte, error) {
+	ops, err := newPipeline(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	opts, err := newProcessingOptions(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	buf, err := app.bucket.Images.StreamImage(image.Filename)
+	if err != nil {
+		return nil, err
+	}
+
+	res := imageResources{app: app, ctx: ctx, userID: image.UserID}
+
+	ip := processor.NewPipelineProcessor(app.backend, buf, ops, opts, res)
+	return ip.Transformer.Process()
+}
+
+// processingErrorResponse reports invalid operation parameters, including
+// references to images the user cannot use and formats the backend cannot
+// handle, as a bad request.
+func (app *application) processingErrorResponse(w http.ResponseWriter, r *http.Request, err error) {
+	if errors.Is(err, processor.ErrInvalidParam) || errors.Is(err, processor.ErrUnsupportedFormat) {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	app.internalServerError(w, r, err)
+}
+
+// imageResources loads images and LUTs referenced by operations, such as
+// watermark overlays, restricted to those owned by the same user as the image
+// being processed.
+type imageResources struct {
+	app    *application
+	ctx    context.Context
+	userID int64
+}
+
+func (res imageResources) Image(id int64) ([]byte, error) {
+	image, err := res.app.getImage(res.ctx, id)
+	if err != nil {
+		switch err {
+		case store.ErrNotFound:
+			return nil, fmt.Errorf("%w: image %d not found", processor.ErrInvalidParam, id)
+		default:
+			return nil, err
+		}
+	}
+
+	if image.UserID != res.userID {
+		return nil, fmt.Errorf("%w: image %d not found", processor.ErrInvalidParam, id)
+	}
+
+	return res.app.bucket.Images.StreamImage(image.Filename)
+}
+
+func (res imageResources) LUT(name string) ([]byte, error) {
+	lut, err := res.app.store.LUTs.GetByName(res.ctx, res.userID, name)
+	if err != nil {
+		switch err {
+		case store.ErrNotFound:
+			return nil, fmt.Errorf("%w: lut %q not found", processor.ErrInvalidParam, name)
+		default:
+			return nil, err
+		}
+	}
+
+	return lut.Data, nil
+}
+
+// parseRenderQuery maps render query parameters onto a transformation payload.
+//
+//	w, h     resize box; either one alone keeps the aspect ratio
+//	fit      resize fit: fill, cover, contain, inside, outside
+//	bg       letterbox colour for fit=contain, e.g. fff
+//	pct      resize by percentage, > 0
+//	noup     never enlarge (1/0)
+//	cw, ch   crop box (both required unless ar is set)
+//	cx, cy   crop box offset
+//	cg       crop gravity: centre, north, south-east, ..., attention, entropy
+//	ar       crop to aspect ratio, e.g. 16:9
+//	fmt      output format: jpeg, png, webp, tiff, gif, avif, heif (or an alias such as jpg, heic)
+//	q        output quality, 1-100
+//	prog     progressive JPEG, interlaced PNG/GIF (1/0)
+//	lossless lossless WebP, AVIF, HEIF (1/0)
+//	zl       PNG compression level, 1-9
+//	ss       JPEG chroma subsampling: 4:2:0, 4:4:4
+//	tc       TIFF compression: none, deflate
+//	frame    keep only this frame (1-based) of an animated image
+//	rotate   rotation angle in degrees, multiple of 90
+//	flip     mirror about the X axis (1/0)
+//	mirror   mirror about the Y axis (1/0)
+//	gray     grayscale (1/0)
+//	sepia    sepia (1/0)
+//	gamma    gamma correction, > 0
+//	blur     gaussian blur sigma, > 0
+//	sepiapct sepia strength, 0-100
+//	bri      brightness, -100 to 100
+//	con      contrast, -100 to 100
+//	sat      saturation, -100 to 500
+//	hue      hue rotation in degrees, -180 to 180
+//	sharp    unsharp mask sigma[:amount[:threshold]], amount defaults to 1
+//	inv      invert colours (1/0)
+//	tint     colorize hue:saturation:amount, e.g. 240:50:100
+//	pix      pixelate block size, 2-512
+//	kernel   3x3 or 5x5 convolution weights separated by ":", row by row
+//	knorm    normalize the kernel by the sum of its weights (1/0)
+//	lut      name of an uploaded .cube LUT to grade with
+//	luti     LUT intensity, 1-100, default 100
+//	orient   apply the EXIF orientation first (1/0, default 1)
+//	strip    strip metadata (1/0)
+//	keep     metadata to keep when stripping, dot separated, e.g. copyright.icc
+func parseRenderQuery(q url.Values) (RequestPayload, error) {
+	var payload RequestPayload
+	t := &payload.Transformations
+
+	for key := range q {
+		value := q.Get(key)
+
+		var err error
+		switch key {
+		case "w":
+			t.Resize.Width, err = parseDimension(value)
+		case "h":
+			t.Resize.Height, err = parseDimension(value)
+		case "fit":
+			t.Resize.Fit = value
+		case "bg":
+			t.Resize.Background = value
+		case "pct":
+			t.Resize.Percent, err = parsePositiveFloat(value)
+		case "noup":
+			t.Resize.WithoutEnlargement, err = strconv.ParseBool(value)
+		case "cw":
+			t.Crop.Width, err = parseDimension(value)
+		case "ch":
+			t.Crop.Height, err = parseDimension(value)
+		case "cx":
+			t.Crop.X, err = parseOffset(value)
+		case "cy":
+			t.Crop.Y, err = parseOffset(value)
+		case "cg":
+			t.Crop.Gravity = value
+		case "ar":
+			t.Crop.AspectRatio = value
+		case "fmt":
+			f, ok := processor.LookupFormat(value)
+			if !ok {
+				err = errors.New("unsupported format")
+			}
+			t.Format = f.Name
+		case "q":
+			t.Quality, err = strconv.Atoi(value)
+			if err == nil && (t.Quality < 1 || t.Quality > 100) {
+				err = errors.New("must be between 1 and 100")
+			}
+		case "frame":
+			t.Frame, err = strconv.Atoi(value)
+			if err == nil && t.Frame < 1 {
+				err = errors.New("must be 1 or greater")
+			}
+		case "prog":
+			t.Encoder.Progressive, err = strconv.ParseBool(value)
+		case "lossless":
+			t.Encoder.Lossless, err = strconv.ParseBool(value)
+		case "zl":
+			t.Encoder.CompressionLevel, err = strconv.Atoi(value)
+		case "ss":
+			t.Encoder.Subsampling = value
+		case "tc":
+			t.Encoder.TIFFCompression = value
+		case "rotate":
+			t.Rotate, err = strconv.Atoi(value)
+			if err == nil && t.Rotate%90 != 0 {
+				err = errors.New("must be a multiple of 90")
+			}
+		case "flip":
+			t.Flip, err = strconv.ParseBool(value)
+		case "mirror":
+			t.Mirror, err = strconv.ParseBool(value)
+		case "gray":
+			t.Filters.Grayscale, err = strconv.ParseBool(value)
+		case "sepia":
+			t.Filters.Sepia, err = strconv.ParseBool(value)
+		case "gamma":
+			t.Filters.Gamma, err = parsePositiveFloat(value)
+		case "blur":
+			t.Filters.GaussianBlur, err = parsePositiveFloat(value)
+		case "sepiapct":
+			t.Filters.SepiaStrength, err = parseFloat(value)
+		case "bri":
+			t.Filters.Brightness, err = parseFloat(value)
+		case "con":
+			t.Filters.Contrast, err = parseFloat(value)
+		case "sat":
+			t.Filters.Saturation, err = parseFloat(value)
+		case "hue":
+			t.Filters.Hue, err = parseFloat(value)
+		case "sharp":
+			var v []float32
+			v, err = parseFloats(value, 1, 3)
+			if err == nil {
+				sh := &t.Filters.Sharpen
+				sh.Sigma, sh.Amount = v[0], 1
+				if len(v) > 1 {
+					sh.Amount = v[1]
+				}
+				if len(v) > 2 {
+					sh.Threshold = v[2]
+				}
+			}
+		case "inv":
+			t.Filters.Invert, err = strconv.ParseBool(value)
+		case "tint":
+			var v []float32
+			v, err = parseFloats(value, 3, 3)
+			if err == nil {
+				c := &t.Filters.Colorize
+				c.Hue, c.Saturation, c.Amount = v[0], v[1], v[2]
+			}
+		case "pix":
+			t.Filters.Pixelate, err = strconv.Atoi(value)
+		case "kernel":
+			t.Filters.Convolution.Kernel, err = parseFloats(value, 9, 25)
+		case "knorm":
+			t.Filters.Convolution.Normalize, err = strconv.ParseBool(value)
+		case "lut":
+			t.Filters.LUT = value
+		case "luti":
+			var intensity float32
+			intensity, err = parseFloat(value)
+			t.Filters.LUTIntensity = &intensity
+		case "orient":
+			var orient bool
+			orient, err = strconv.ParseBool(value)
+			payload.AutoOrient = &orient
+		case "strip":
+			payload.StripMetadata, err = strconv.ParseBool(value)
+		case "keep":
+			// commas separate the options of signed URLs
+			payload.KeepMetadata = strings.Split(value, ".")
+		default:
+			err = errors.New("unknown parameter")
+		}
+
+		if err != nil {
+			return payload, fmt.Errorf("%w %q: %v", errRenderParam, key, err)
+		}
+	}
+
+	if t.Crop.AspectRatio == "" && (t.Crop.Width == 0) != (t.Crop.Height == 0) {
+		return payload, fmt.Errorf("%w: cw and ch must be set together", errRenderParam)
+	}
+
+	if _, err := newPipeline(payload); err != nil {
+		return payload, fmt.Errorf("%w: %v", errRenderParam, err)
+	}
+
+	if _, err := newProcessingOptions(payload); err != nil {
+		return payload, fmt.Errorf("%w: %v", errRenderParam, err)
+	}
+
+	return payload, nil
+}
+
+func parseDimension(s string) (int, error) {
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, err
+	}
+
+	if n < 1 || n > renderMaxDimension {
+		return 0, fmt.Errorf("must be between 1 and %d", renderMaxDimension)
+	}
+
+	return n, nil
+}
+
+func parseOffset(s string) (*int, error) {
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return nil, err
+	}
+
+	if n < 0 || n > renderMaxDimension {
+		return nil, fmt.Errorf("must be between 0 and %d", renderMaxDimension)
+	}
+
+	return &n, nil
+}
+
+func parsePositiveFloat(s string) (float32, error) {
+	f, err := strconv.ParseFloat(s, 32)
+	if err != nil {
+		return 0, err
+	}
+
+	if f <= 0 {
+		return 0, errors.New("must be positive")
+	}
+
+	return float32(f), nil
+}
+
+func parseFloat(s string) (float32, error) {
+	f, err := strconv.ParseFloat(s, 32)
+	return float32(f), err
+}
+
+// parseFloats parses a colon separated list of at least n and at most m numbers.
+func parseFloats(s string, n, m int) ([]float32, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) < n || len(parts) > m {
+		if n == m {
+			return nil, fmt.Errorf("expected %d values separated by \":\"", n)
+		}
+		return nil, fmt.Errorf("expected %d to %d values separated by \":\"", n, m)
+	}
+
+	values := make([]float32, len(parts))
+	for i, part := range parts {
+		f, err := parseFloat(part)
+		if err != nil {
+			return nil, err
+		}
+		values[i] = f
+	}
+
+	return values, nil
+}
+
+func writeImage(w http.ResponseWriter, status int, buf []byte) {
+	contentType := processor.MIMEType(processor.DetectFormat(buf))
+	if contentType == "" {
+		contentType = http.DetectContentType(buf)
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(buf)))
+	w.WriteHeader(status)
+	w.Write(buf)
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/xbanchon/image-processing-service/internal/store"
+)
+
+// Signed delivery URLs have the form /i/{sig}/{imageID}/{options}, where options
+// are the render parameters encoded as sorted "key:value" pairs separated by
+// commas (e.g. "fmt:webp,h:300,w:400"), or "_" for the untouched image. Keys
+// and values are query-escaped, so "bg:#fff" is sent as "bg:%23fff", and the
+// signature covers the escaped form found in the path. An optional "exp" pair
+// holds a unix timestamp after which the URL is rejected.
+
+const (
+	noRenderOptions = "_"
+	expiryOption    = "exp"
+)
+
+var (
+	errInvalidSignature = errors.New("invalid signature")
+	errURLExpired       = errors.New("signed url expired")
+)
+
+type signedURL struct {
+	URL       string `json:"url"`
+	ExpiresAt string `json:"expires_at,omitempty"`
+}
+
+// signImageURLHandler returns a signed delivery URL for the render parameters
+// in the query string, e.g. GET /images/1/sign?w=400&h=300&fmt=webp&ttl=3600
+func (app *application) signImageURLHandler(w http.ResponseWriter, r *http.Request) {
+	image := getImageFromContext(r)
+
+	q := r.URL.Query()
+
+	var ttl int64
+	if v := q.Get("ttl"); v != "" {
+		var err error
+		ttl, err = strconv.ParseInt(v, 10, 64)
+		if err != nil || ttl <= 0 {
+			app.badRequestResponse(w, r, fmt.Errorf("%w \"ttl\": must be a positive number of seconds", errRenderParam))
+			return
+		}
+		q.Del("ttl")
+	}
+
+	if _, err := parseRenderQuery(q); err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	res := signedURL{}
+	if ttl > 0 {
+		exp := time.Now().Add(time.Duration(ttl) * time.Second)
+		q.Set(expiryOption, strconv.FormatInt(exp.Unix(), 10))
+		res.ExpiresAt = exp.Format(time.RFC3339)
+	}
+
+	res.URL = app.signedImagePath(image.ID, encodeRenderOptions(q))
+
+	if err := app.jsonResponse(w, http.StatusOK, res); err != nil {
+		app.internalServerError(w, r, err)
+	}
+}
+
+// signedImageHandler serves a transformed image to anyone holding a valid
+// signed URL, without requiring a JWT.
+func (app *application) signedImageHandler(w http.ResponseWriter, r *http.Request) {
+	sig := chi.URLParam(r, "sig")
+	options := chi.URLParam(r, "options")
+
+	imageID, err := strconv.ParseInt(chi.URLParam(r, "imageID"), 10, 64)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	if !app.urlSigner.Verify(signaturePayload(imageID, options), sig) {
+		app.forbiddenResponse(w, r, errInvalidSignature)
+		return
+	}
+
+	q, err := decodeRenderOptions(options)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	maxAge := int64(renderMaxAge)
+	if v := q.Get(expiryOption); v != "" {
+		exp, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			app.badRequestResponse(w, r, err)
+			return
+		}
+
+		remaining := exp - time.Now().Unix()
+		if remaining <= 0 {
+			app.forbiddenResponse(w, r, errURLExpired)
+			return
+		}
+		maxAge = min(maxAge, remaining)
+		q.Del(expiryOption)
+	}
+
+	payload, err := parseRenderQuery(q)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	image, err := app.getImage(r.Context(), imageID)
+	if err != nil {
+		switch err {
+		case store.ErrNotFound:
+			app.notFoundResponse(w, r, err)
+		default:
+			app.internalServerError(w, r, err)
+		}
+		return
+	}
+
+	buf, err := app.renderImage(r.Context(), image, payload)
+	if err != nil {
+		app.processingErrorResponse(w, r, err)
+		return
+	}
+
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", maxAge))
+	writeImage(w, http.StatusOK, buf)
+}
+
+// signedImagePath returns the signed delivery path of the image rendered with
+// the encoded options.
+func (app *application) signedImagePath(imageID int64, options string) string {
+	sig := app.urlSigner.Sign(signaturePayload(imageID, options))
+	return fmt.Sprintf("/i/%s/%d/%s", sig, imageID, options)
+}
+
+func signaturePayload(imageID int64, options string) string {
+	return fmt.Sprintf("%d/%s", imageID, options)
+}
+
+func encodeRenderOptions(q url.Values) string {
+	if len(q) == 0 {
+		return noRenderOptions
+	}
+
+	keys := make([]string, 0, len(q))
+	for k := range q {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	pairs := make([]string, len(keys))
+	for i, k := range keys {
+		pairs[i] = url.QueryEscape(k) + ":" + url.QueryEscape(q.Get(k))
+	}
+
+	return strings.Join(pairs, ",")
+}
+
+func decodeRenderOptions(s string) (url.Values, error) {
+	q := url.Values{}
+	if s == noRenderOptions {
+		return q, nil
+	}
+
+	for _, pair := range strings.Split(s, ",") {
+		k, v, ok := decodeRenderOption(pair)
+		if !ok || q.Has(k) {
+			return nil, fmt.Errorf("%w: malformed option %q", errRenderParam, pair)
+		}
+		q.Set(k, v)
+	}
+
+	return q, nil
+}
+
+// decodeRenderOption splits an escaped "key:value" pair and unescapes both.
+func decodeRenderOption(pair string) (string, string, bool) {
+	k, v, ok := strings.Cut(pair, ":")
+	if !ok {
+		return "", "", false
+	}
+
+	k, err := url.QueryUnescape(k)
+	if err != nil || k == "" {
+		return "", "", false
+	}
+	v, err = url.QueryUnescape(v)
+	if err != nil {
+		return "", "", false
+	}
+
+	return k, v, true
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"image"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// signURL asks the API for a signed delivery URL of image 1 as user 1.
+func (ta *testApplication) signURL(t *testing.T, query string) string {
+	t.Helper()
+
+	req := httptest.NewRequest(http.MethodGet, "/images/1/sign?"+query, nil)
+	req.Header.Set("Authorization", "Bearer "+ta.token(t, 1))
+
+	rr := httptest.NewRecorder()
+	ta.handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("signing: %d %s", rr.Code, rr.Body)
+	}
+
+	var res struct {
+		Data signedURL `json:"data"`
+	}
+	if err := json.NewDecoder(rr.Body).Decode(&res); err != nil {
+		t.Fatal(err)
+	}
+
+	return res.Data.URL
+}
+
+// get requests path anonymously, the way signed URLs are used. The path is
+// parsed like a client would, so anything after a # is not sent.
+func (ta *testApplication) get(t *testing.T, path string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	u, err := url.Parse(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	ta.handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, u.RequestURI(), nil))
+
+	return rr
+}
+
+func TestSignedImage(t *testing.T) {
+	ta := newTestApplication(t)
+	if rr := ta.uploadImage(t, 1, testPNG(t)); rr.Code != http.StatusCreated {
+		t.Fatalf("upload: %d %s", rr.Code, rr.Body)
+	}
+
+	// options that need escaping: # ends the path, : and , separate pairs
+	query := url.Values{
+		"w":   {"20"},
+		"h":   {"20"},
+		"fit": {"contain"},
+		"bg":  {"#336699"},
+		"ar":  {"1:1"},
+	}
+	path := ta.signURL(t, query.Encode())
+
+	sign := func(imageID int64, options string) string {
+		sig := ta.urlSigner.Sign(signaturePayload(imageID, options))
+		return fmt.Sprintf("/i/%s/%d/%s", sig, imageID, options)
+	}
+	withOptions := func(options string) string {
+		return sign(1, encodeRenderOptions(url.Values{"w": {"10"}, expiryOption: {options}}))
+	}
+	sig, rest, _ := strings.Cut(strings.TrimPrefix(path, "/i/"), "/")
+
+	tests := []struct {
+		name       string
+		path       string
+		wantStatus int
+		wantSize   image.Point
+	}{
+		{"signed by the api", path, http.StatusOK, image.Pt(20, 20)},
+		{"untouched image", sign(1, noRenderOptions), http.StatusOK, image.Pt(48, 32)},
+		{"not yet expired", withOptions(strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10)), http.StatusOK, image.Pt(10, 7)},
+		{"expired", withOptions(strconv.FormatInt(time.Now().Add(-time.Minute).Unix(), 10)), http.StatusForbidden, image.Point{}},
+		{"tampered signature", "/i/" + tamperSignature(sig) + "/" + rest, http.StatusForbidden, image.Point{}},
+		{"tampered options", strings.Replace(path, "w:20", "w:40", 1), http.StatusForbidden, image.Point{}},
+		{"other image", strings.Replace(path, "/1/", "/2/", 1), http.StatusForbidden, image.Point{}},
+		{"same options escaped differently", strings.Replace(path, "ar:1%3A1", "ar:1:1", 1), http.StatusForbidden, image.Point{}},
+		{"missing image", sign(99, noRenderOptions), http.StatusNotFound, image.Point{}},
+		{"malformed options", sign(1, "w20"), http.StatusBadRequest, image.Point{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := ta.get(t, tt.path)
+			if rr.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", rr.Code, tt.wantStatus, rr.Body)
+			}
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+
+			cfg, _, err := image.DecodeConfig(rr.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := image.Pt(cfg.Width, cfg.Height); got != tt.wantSize {
+				t.Fatalf("size = %v, want %v", got, tt.wantSize)
+			}
+		})
+	}
+}
+
+func TestRenderOptionsRoundTrip(t *testing.T) {
+	tests := []url.Values{
+		{"w": {"400"}, "fmt": {"webp"}},
+		{"bg": {"#fff"}, "fit": {"contain"}},
+		{"ar": {"16:9"}, "kernel": {"0:-1:0:-1:5:-1:0:-1:0"}},
+		{"keep": {"copyright.icc"}, "lut": {"teal, orange/50% ?v=2"}},
+	}
+
+	for _, q := range tests {
+		options := encodeRenderOptions(q)
+		if strings.ContainsAny(options, "#?/ ") {
+			t.Errorf("%q holds characters that end or split a path segment", options)
+		}
+		if n := len(strings.Split(options, ",")); len(q) > 0 && n != len(q) {
+			t.Errorf("%q splits into %d pairs, want %d", options, n, len(q))
+		}
+
+		got, err := decodeRenderOptions(options)
+		if err != nil {
+			t.Fatalf("decoding %q: %v", options, err)
+		}
+		if len(got) != len(q) {
+			t.Fatalf("decoded %v from %q, want %v", got, options, q)
+		}
+		for k := range q {
+			if got.Get(k) != q.Get(k) {
+				t.Errorf("%s = %q, want %q (options %q)", k, got.Get(k), q.Get(k), options)
+			}
+		}
+	}
+}
+
+func tamperSignature(sig string) string {
+	if sig[0] == 'A' {
+		return "B" + sig[1:]
+	}
+
+	return "A" + sig[1:]
+}
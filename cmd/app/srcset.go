@@ -0,0 +1,315 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"html"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/xbanchon/image-processing-service/internal/processor"
+	"github.com/xbanchon/image-processing-service/internal/store"
+)
+
+const (
+	defaultSrcsetSizes = "100vw"
+	maxSrcsetSizes     = 1000
+)
+
+// SrcsetPayload requests a responsive image set, e.g.
+// {"widths":[320,640,1280],"formats":["avif","webp","jpeg"],"sizes":"(max-width: 600px) 100vw, 600px"}.
+// Formats are listed by preference; the last one is the <img> fallback.
+type SrcsetPayload struct {
+	Widths  []int    `json:"widths"`  //Widths above the image width are clamped to it
+	Formats []string `json:"formats"` //e.g.: avif, webp, jpeg
+	Quality int      `json:"quality"` //1-100, encoder default when 0
+	Sizes   string   `json:"sizes"`   //sizes attribute, default 100vw
+	MetadataParams
+}
+
+// srcsetResponse describes a responsive image set ready to paste into a page,
+// as a <picture> element and as its parts. The markup points at signed
+// delivery URLs without expiry, so it keeps working; the derivatives carry
+// short-lived bucket URLs.
+type srcsetResponse struct {
+	ImageID     int64              `json:"image_id"`
+	Version     int                `json:"version"` //image version the set was generated from
+	Derivatives []store.Derivative `json:"derivatives"`
+	Picture     picture            `json:"picture"`
+	HTML        string             `json:"html"`
+}
+
+type picture struct {
+	Sources []pictureSource `json:"sources"`
+	Img     pictureImg      `json:"img"`
+}
+
+type pictureSource struct {
+	Type   string `json:"type"`
+	Srcset string `json:"srcset"`
+	Sizes  string `json:"sizes"`
+}
+
+type pictureImg struct {
+	Src    string `json:"src"`
+	Srcset string `json:"srcset"`
+	Sizes  string `json:"sizes"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+}
+
+// createSrcsetHandler renders the current version of the image at every
+// requested width and format, replacing any earlier set of derivatives.
+func (app *application) createSrcsetHandler(w http.ResponseWriter, r *http.Request) {
+	image := getImageFromContext(r)
+
+	var payload SrcsetPayload
+	if err := readJSON(w, r, &payload); err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	if payload.Sizes == "" {
+		payload.Sizes = defaultSrcsetSizes
+	}
+	if len(payload.Sizes) > maxSrcsetSizes {
+		app.badRequestResponse(w, r, fmt.Errorf("sizes must be at most %d characters", maxSrcsetSizes))
+		return
+	}
+
+	opts, err := newProcessingOptions(RequestPayload{MetadataParams: payload.MetadataParams})
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	ctx := r.Context()
+
+	derivatives, err := app.createSrcset(ctx, image, payload, opts)
+	if err != nil {
+		app.processingErrorResponse(w, r, err)
+		return
+	}
+
+	res, err := app.newSrcsetResponse(image, derivatives, payload.Sizes)
+	if err != nil {
+		app.internalServerError(w, r, err)
+		return
+	}
+
+	if err := app.jsonResponse(w, http.StatusCreated, res); err != nil {
+		app.internalServerError(w, r, err)
+	}
+}
+
+// getSrcsetHandler describes the stored set, with fresh bucket URLs for the
+// derivatives. The sizes attribute can be given in the query string.
+func (app *application) getSrcsetHandler(w http.ResponseWriter, r *http.Request) {
+	image := getImageFromContext(r)
+
+	sizes := r.URL.Query().Get("sizes")
+	if sizes == "" {
+		sizes = defaultSrcsetSizes
+	}
+
+	ctx := r.Context()
+
+	derivatives, err := app.store.Derivatives.GetByImageID(ctx, image.ID)
+	if err != nil {
+		app.internalServerError(w, r, err)
+		return
+	}
+	if len(derivatives) == 0 {
+		app.notFoundResponse(w, r, store.ErrNotFound)
+		return
+	}
+
+	// stored URLs are short-lived, hand out fresh ones
+	for i := range derivatives {
+		url, err := app.bucket.Images.GetNewSignedImageURL(derivatives[i].Filename, signedURLDuration)
+		if err != nil {
+			app.internalServerError(w, r, err)
+			return
+		}
+		derivatives[i].URL = url
+	}
+
+	res, err := app.newSrcsetResponse(image, derivatives, sizes)
+	if err != nil {
+		app.internalServerError(w, r, err)
+		return
+	}
+
+	if err := app.jsonResponse(w, http.StatusOK, res); err != nil {
+		app.internalServerError(w, r, err)
+	}
+}
+
+// createSrcset renders, uploads and records the derivatives of the image.
+func (app *application) createSrcset(ctx context.Context, image *store.Image, payload SrcsetPayload, opts processor.Options) ([]store.Derivative, error) {
+	buf, err := app.bucket.Images.StreamImage(image.Filename)
+	if err != nil {
+		return nil, err
+	}
+
+	renditions, err := processor.Srcset(
+		app.backend,
+		buf,
+		payload.Widths,
+		payload.Formats,
+		processor.EncodeOptions{Quality: payload.Quality},
+		opts,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	derivatives := make([]store.Derivative, 0, len(renditions))
+	for _, rendition := range renditions {
+		filename, signedURL, err := app.bucket.Images.UploadImage(image.UserID, rendition.Buf)
+		if err != nil {
+			return nil, err
+		}
+
+		derivatives = append(derivatives, store.Derivative{
+			Version:  image.Version,
+			Width:    rendition.Width,
+			Height:   rendition.Height,
+			Format:   rendition.Format,
+			Size:     int64(len(rendition.Buf)),
+			Filename: filename,
+			URL:      signedURL,
+			Options:  srcsetOptions(rendition, payload),
+		})
+	}
+
+	orphans, err := app.store.Derivatives.Replace(ctx, image.ID, derivatives)
+	if err != nil {
+		return nil, err
+	}
+	app.collectBlobs(ctx, image.UserID, orphans)
+
+	for i, rendition := range renditions {
+		if err := app.ensureObject(derivatives[i].Filename, rendition.Buf); err != nil {
+			return nil, err
+		}
+	}
+
+	return derivatives, nil
+}
+
+// srcsetOptions returns the render options of the signed delivery URL that
+// reproduces a rendition of the set.
+func srcsetOptions(rendition processor.Rendition, payload SrcsetPayload) string {
+	q := url.Values{}
+	q.Set("w", strconv.Itoa(rendition.Width))
+	q.Set("fmt", rendition.Format)
+	if payload.Quality > 0 {
+		q.Set("q", strconv.Itoa(payload.Quality))
+	}
+	if payload.AutoOrient != nil {
+		q.Set("orient", boolOption(*payload.AutoOrient))
+	}
+	if payload.StripMetadata {
+		q.Set("strip", "1")
+	}
+	if len(payload.KeepMetadata) > 0 {
+		q.Set("keep", strings.Join(payload.KeepMetadata, "."))
+	}
+
+	return encodeRenderOptions(q)
+}
+
+func boolOption(b bool) string {
+	if b {
+		return "1"
+	}
+
+	return "0"
+}
+
+// derivativeURL returns the signed delivery URL of a derivative, which unlike
+// its bucket URL does not expire.
+func (app *application) derivativeURL(imageID int64, d store.Derivative) string {
+	options := d.Options
+	if options == "" {
+		// sets generated before the options were recorded
+		options = encodeRenderOptions(url.Values{"w": {strconv.Itoa(d.Width)}, "fmt": {d.Format}})
+	}
+
+	return strings.TrimSuffix(app.config.apiURL, "/") + app.signedImagePath(imageID, options)
+}
+
+// newSrcsetResponse groups derivatives, sorted by width, into one <source>
+// per format in the order they were generated; the last format is the <img>.
+func (app *application) newSrcsetResponse(image *store.Image, derivatives []store.Derivative, sizes string) (srcsetResponse, error) {
+	if len(derivatives) == 0 {
+		return srcsetResponse{}, errors.New("image has no derivatives")
+	}
+
+	var formats []string
+	byFormat := map[string][]store.Derivative{}
+	for _, d := range derivatives {
+		if _, ok := byFormat[d.Format]; !ok {
+			formats = append(formats, d.Format)
+		}
+		byFormat[d.Format] = append(byFormat[d.Format], d)
+	}
+
+	res := srcsetResponse{
+		ImageID:     image.ID,
+		Version:     derivatives[0].Version,
+		Derivatives: derivatives,
+		Picture:     picture{Sources: []pictureSource{}},
+	}
+
+	fallback := formats[len(formats)-1]
+	for _, format := range formats[:len(formats)-1] {
+		res.Picture.Sources = append(res.Picture.Sources, pictureSource{
+			Type:   processor.MIMEType(format),
+			Srcset: app.srcsetAttr(image.ID, byFormat[format]),
+			Sizes:  sizes,
+		})
+	}
+
+	set := byFormat[fallback]
+	largest := set[len(set)-1]
+	res.Picture.Img = pictureImg{
+		Src:    app.derivativeURL(image.ID, largest),
+		Srcset: app.srcsetAttr(image.ID, set),
+		Sizes:  sizes,
+		Width:  largest.Width,
+		Height: largest.Height,
+	}
+
+	res.HTML = res.Picture.html()
+
+	return res, nil
+}
+
+func (app *application) srcsetAttr(imageID int64, derivatives []store.Derivative) string {
+	candidates := make([]string, len(derivatives))
+	for i, d := range derivatives {
+		candidates[i] = fmt.Sprintf("%s %dw", app.derivativeURL(imageID, d), d.Width)
+	}
+
+	return strings.Join(candidates, ", ")
+}
+
+func (p picture) html() string {
+	var b strings.Builder
+
+	b.WriteString("<picture>")
+	for _, s := range p.Sources {
+		fmt.Fprintf(&b, `<source type="%s" srcset="%s" sizes="%s">`,
+			html.EscapeString(s.Type), html.EscapeString(s.Srcset), html.EscapeString(s.Sizes))
+	}
+	fmt.Fprintf(&b, `<img src="%s" srcset="%s" sizes="%s" width="%d" height="%d" alt="">`,
+		html.EscapeString(p.Img.Src), html.EscapeString(p.Img.Srcset), html.EscapeString(p.Img.Sizes), p.Img.Width, p.Img.Height)
+	b.WriteString("</picture>")
+
+	return b.String()
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"image"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/xbanchon/image-processing-service/internal/processor"
+)
+
+func (ta *testApplication) srcset(t *testing.T, method, body string) srcsetResponse {
+	t.Helper()
+
+	req := httptest.NewRequest(method, "/images/1/srcset", strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+ta.token(t, 1))
+
+	rr := httptest.NewRecorder()
+	ta.handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusCreated && rr.Code != http.StatusOK {
+		t.Fatalf("%s srcset: %d %s", method, rr.Code, rr.Body)
+	}
+
+	var res struct {
+		Data srcsetResponse `json:"data"`
+	}
+	if err := json.NewDecoder(rr.Body).Decode(&res); err != nil {
+		t.Fatal(err)
+	}
+
+	return res.Data
+}
+
+var srcsetCandidate = regexp.MustCompile(`^(\S+) (\d+)w$`)
+
+func TestSrcset(t *testing.T) {
+	ta := newTestApplication(t)
+	if rr := ta.uploadImage(t, 1, testPNG(t)); rr.Code != http.StatusCreated {
+		t.Fatalf("upload: %d %s", rr.Code, rr.Body)
+	}
+
+	// the 48px wide image is never enlarged, 100 and 48 collapse
+	res := ta.srcset(t, http.MethodPost, `{"widths":[32,100,8,48,16],"formats":["png","jpg"],"quality":80,"sizes":"50vw"}`)
+
+	wantWidths := []int{8, 16, 32, 48}
+	wantFormats := []string{"png", "jpeg"}
+
+	if got, want := len(res.Derivatives), len(wantWidths)*len(wantFormats); got != want {
+		t.Fatalf("%d derivatives, want %d", got, want)
+	}
+	for i, d := range res.Derivatives {
+		if w, f := wantWidths[i/len(wantFormats)], wantFormats[i%len(wantFormats)]; d.Width != w || d.Format != f {
+			t.Errorf("derivative %d is %dw %s, want %dw %s", i, d.Width, d.Format, w, f)
+		}
+	}
+
+	if len(res.Picture.Sources) != 1 || res.Picture.Sources[0].Type != "image/png" {
+		t.Fatalf("sources = %+v, want one image/png source", res.Picture.Sources)
+	}
+	if res.Picture.Img.Width != 48 || res.Picture.Img.Height != 32 {
+		t.Errorf("img is %dx%d, want 48x32", res.Picture.Img.Width, res.Picture.Img.Height)
+	}
+
+	sets := []struct {
+		format string
+		srcset string
+	}{
+		{"png", res.Picture.Sources[0].Srcset},
+		{"jpeg", res.Picture.Img.Srcset},
+	}
+	for _, set := range sets {
+		candidates := strings.Split(set.srcset, ", ")
+		if len(candidates) != len(wantWidths) {
+			t.Fatalf("%s srcset has %d candidates, want %d: %s", set.format, len(candidates), len(wantWidths), set.srcset)
+		}
+
+		for i, c := range candidates {
+			m := srcsetCandidate.FindStringSubmatch(c)
+			if m == nil {
+				t.Fatalf("malformed candidate %q", c)
+			}
+			if w, _ := strconv.Atoi(m[2]); w != wantWidths[i] {
+				t.Errorf("%s candidate %d has descriptor %dw, want %dw", set.format, i, w, wantWidths[i])
+			}
+
+			// stable delivery URLs, served without authentication
+			path, ok := strings.CutPrefix(m[1], testAPIURL+"/i/")
+			if !ok || strings.Contains(path, expiryOption+":") {
+				t.Fatalf("candidate url %q is not a delivery url without expiry", m[1])
+			}
+
+			rr := ta.get(t, "/i/"+path)
+			if rr.Code != http.StatusOK {
+				t.Fatalf("%s: %d %s", m[1], rr.Code, rr.Body)
+			}
+			cfg, format, err := image.DecodeConfig(bytes.NewReader(rr.Body.Bytes()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cfg.Width != wantWidths[i] || processor.MIMEType(format) != processor.MIMEType(set.format) {
+				t.Errorf("%s serves a %dw %s, want %dw %s", m[1], cfg.Width, format, wantWidths[i], set.format)
+			}
+		}
+	}
+	if src := res.Picture.Img.Src; !strings.HasSuffix(res.Picture.Img.Srcset, src+" 48w") {
+		t.Errorf("img src %q is not the largest candidate", src)
+	}
+
+	// the stored set describes itself with the same markup
+	if again := ta.srcset(t, http.MethodGet, ""); again.HTML != strings.ReplaceAll(res.HTML, `sizes="50vw"`, `sizes="100vw"`) {
+		t.Errorf("markup changed between requests:\n%s\n%s", res.HTML, again.HTML)
+	}
+}
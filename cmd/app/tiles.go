@@ -0,0 +1,321 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/xbanchon/image-processing-service/internal/processor"
+	"github.com/xbanchon/image-processing-service/internal/store"
+	"github.com/xbanchon/image-processing-service/internal/store/blob"
+	"github.com/xbanchon/image-processing-service/internal/worker"
+)
+
+const jobTileImage = "tile_image"
+
+// TilesPayload configures a tile pyramid. Deep Zoom (dzi) pyramids are read
+// by viewers such as OpenSeadragon from /images/{id}/tiles/image.dzi, xyz
+// ones by map viewers from /images/{id}/tiles/{z}/{x}/{y}.{ext}.
+type TilesPayload struct {
+	Layout   string `json:"layout"`    //dzi (default) or xyz
+	TileSize int    `json:"tile_size"` //64-2048, default 254
+	Overlap  *int   `json:"overlap"`   //0-32, default 1 for dzi; xyz tiles never overlap
+	Format   string `json:"format"`    //jpeg (default), png or webp
+	Quality  int    `json:"quality"`
+}
+
+func (p TilesPayload) options() processor.TileOptions {
+	o := processor.TileOptions{
+		Layout:  p.Layout,
+		Size:    p.TileSize,
+		Format:  p.Format,
+		Quality: p.Quality,
+	}.WithDefaults()
+
+	if p.Overlap != nil {
+		o.Overlap = *p.Overlap
+	} else if o.Layout == processor.TileLayoutDZI {
+		o.Overlap = processor.DefaultTileOverlap
+	}
+
+	return o
+}
+
+type tileJobPayload struct {
+	ImageID int64 `json:"image_id"`
+	TilesPayload
+}
+
+// createTilesHandler queues a job cutting the current version of the image
+// into a tile pyramid, replacing any earlier one once it is done.
+func (app *application) createTilesHandler(w http.ResponseWriter, r *http.Request) {
+	image := getImageFromContext(r)
+	user := getUserFromContext(r)
+
+	var payload TilesPayload
+	if err := readJSON(w, r, &payload); err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	if err := payload.options().Validate(); err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	job, err := app.workers.Enqueue(r.Context(), jobTileImage, user.ID, tileJobPayload{
+		ImageID:      image.ID,
+		TilesPayload: payload,
+	})
+	if err != nil {
+		app.internalServerError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Location", fmt.Sprintf("/jobs/%d", job.ID))
+
+	if err := app.jsonResponse(w, http.StatusAccepted, job); err != nil {
+		app.internalServerError(w, r, err)
+	}
+}
+
+func (app *application) tileImageJob(ctx context.Context, job *store.Job) (any, error) {
+	var payload tileJobPayload
+	if err := json.Unmarshal(job.Payload, &payload); err != nil {
+		return nil, worker.Permanent(err)
+	}
+
+	image, err := app.getImage(ctx, payload.ImageID)
+	if err != nil {
+		if err == store.ErrNotFound {
+			return nil, worker.Permanent(err)
+		}
+		return nil, err
+	}
+
+	if image.UserID != job.UserID {
+		return nil, worker.Permanent(errors.New("image does not belong to job owner"))
+	}
+
+	pyramid, err := app.createTiles(ctx, image, payload.options())
+	if err != nil {
+		if errors.Is(err, processor.ErrInvalidParam) || errors.Is(err, processor.ErrUnsupportedFormat) {
+			return nil, worker.Permanent(err)
+		}
+		return nil, err
+	}
+
+	return pyramid, nil
+}
+
+// createTiles uploads every tile of the image under a fresh prefix, so a
+// pyramid being replaced keeps serving until the new one is recorded. The
+// replaced tiles are removed afterwards, and partial ones on failure.
+func (app *application) createTiles(ctx context.Context, image *store.Image, o processor.TileOptions) (*store.TilePyramid, error) {
+	buf, err := app.bucket.Images.StreamImage(image.Filename)
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := fmt.Sprintf("%s%d", blob.TilePrefix(image.UserID, image.ID), time.Now().UnixNano())
+
+	p, err := processor.Tiles(app.backend, buf, o, func(t processor.Tile) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		return app.bucket.Images.WriteImage(tileFilename(prefix, o.Layout, t.Level, t.Col, t.Row, o.Format), t.Buf)
+	})
+	if err != nil {
+		app.deleteObjects(context.WithoutCancel(ctx), prefix+"/")
+		return nil, err
+	}
+
+	pyramid := &store.TilePyramid{
+		ImageID:  image.ID,
+		Version:  image.Version,
+		Layout:   p.Layout,
+		TileSize: p.Size,
+		Overlap:  p.Overlap,
+		Format:   p.Format,
+		Width:    p.Width,
+		Height:   p.Height,
+		MaxLevel: p.MaxLevel,
+		Tiles:    p.Tiles,
+		Prefix:   prefix,
+	}
+
+	replaced, err := app.store.Tiles.Save(ctx, pyramid)
+	if err != nil {
+		app.deleteObjects(context.WithoutCancel(ctx), prefix+"/")
+		return nil, err
+	}
+
+	if replaced != "" && replaced != prefix {
+		app.deleteObjects(ctx, replaced+"/")
+	}
+
+	return pyramid, nil
+}
+
+// tileFilename lays tiles out the way viewers request them: Deep Zoom tiles
+// in the image_files folder next to the descriptor, xyz tiles by zoom and x.
+func tileFilename(prefix, layout string, level, col, row int, format string) string {
+	ext := tileExtension(format)
+	if layout == processor.TileLayoutXYZ {
+		return fmt.Sprintf("%s/%d/%d/%d.%s", prefix, level, col, row, ext)
+	}
+
+	return fmt.Sprintf("%s/image_files/%d/%d_%d.%s", prefix, level, col, row, ext)
+}
+
+func tileExtension(format string) string {
+	if f, ok := processor.LookupFormat(format); ok {
+		return f.Extension
+	}
+
+	return format
+}
+
+func (app *application) getTilesHandler(w http.ResponseWriter, r *http.Request) {
+	pyramid, ok := app.getPyramid(w, r, "")
+	if !ok {
+		return
+	}
+
+	if err := app.jsonResponse(w, http.StatusOK, pyramid); err != nil {
+		app.internalServerError(w, r, err)
+	}
+}
+
+type dziImage struct {
+	XMLName  xml.Name `xml:"http://schemas.microsoft.com/deepzoom/2008 Image"`
+	TileSize int      `xml:"TileSize,attr"`
+	Overlap  int      `xml:"Overlap,attr"`
+	Format   string   `xml:"Format,attr"`
+	Size     struct {
+		Width  int `xml:"Width,attr"`
+		Height int `xml:"Height,attr"`
+	} `xml:"Size"`
+}
+
+// getDZIHandler serves the Deep Zoom descriptor. Viewers resolve tiles
+// relative to it, from image_files/{level}/{col}_{row}.{ext}.
+func (app *application) getDZIHandler(w http.ResponseWriter, r *http.Request) {
+	pyramid, ok := app.getPyramid(w, r, processor.TileLayoutDZI)
+	if !ok {
+		return
+	}
+
+	dzi := dziImage{
+		TileSize: pyramid.TileSize,
+		Overlap:  pyramid.Overlap,
+		Format:   tileExtension(pyramid.Format),
+	}
+	dzi.Size.Width, dzi.Size.Height = pyramid.Width, pyramid.Height
+
+	out, err := xml.Marshal(dzi)
+	if err != nil {
+		app.internalServerError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(xml.Header))
+	w.Write(out)
+}
+
+func (app *application) getDZITileHandler(w http.ResponseWriter, r *http.Request) {
+	pyramid, ok := app.getPyramid(w, r, processor.TileLayoutDZI)
+	if !ok {
+		return
+	}
+
+	name, ok := strings.CutSuffix(chi.URLParam(r, "tile"), "."+tileExtension(pyramid.Format))
+	col, row, found := strings.Cut(name, "_")
+	if !ok || !found {
+		app.notFoundResponse(w, r, store.ErrNotFound)
+		return
+	}
+
+	app.serveTile(w, r, pyramid, chi.URLParam(r, "level"), col, row)
+}
+
+func (app *application) getXYZTileHandler(w http.ResponseWriter, r *http.Request) {
+	pyramid, ok := app.getPyramid(w, r, processor.TileLayoutXYZ)
+	if !ok {
+		return
+	}
+
+	y, ok := strings.CutSuffix(chi.URLParam(r, "y"), "."+tileExtension(pyramid.Format))
+	if !ok {
+		app.notFoundResponse(w, r, store.ErrNotFound)
+		return
+	}
+
+	app.serveTile(w, r, pyramid, chi.URLParam(r, "z"), chi.URLParam(r, "x"), y)
+}
+
+// serveTile streams a tile after checking it lies within the pyramid, so
+// requests outside of it are not found rather than failing in the bucket.
+func (app *application) serveTile(w http.ResponseWriter, r *http.Request, pyramid *store.TilePyramid, level, col, row string) {
+	l, errL := strconv.Atoi(level)
+	c, errC := strconv.Atoi(col)
+	rw, errR := strconv.Atoi(row)
+	if errL != nil || errC != nil || errR != nil || l < 0 || l > pyramid.MaxLevel || c < 0 || rw < 0 {
+		app.notFoundResponse(w, r, store.ErrNotFound)
+		return
+	}
+
+	p := processor.Pyramid{
+		TileOptions: processor.TileOptions{Size: pyramid.TileSize},
+		Width:       pyramid.Width,
+		Height:      pyramid.Height,
+		MaxLevel:    pyramid.MaxLevel,
+	}
+	if cols, rows := p.Grid(l); c >= cols || rw >= rows {
+		app.notFoundResponse(w, r, store.ErrNotFound)
+		return
+	}
+
+	buf, err := app.bucket.Images.StreamImage(tileFilename(pyramid.Prefix, pyramid.Layout, l, c, rw, pyramid.Format))
+	if err != nil {
+		app.internalServerError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Cache-Control", fmt.Sprintf("private, max-age=%d", renderMaxAge))
+	writeImage(w, http.StatusOK, buf)
+}
+
+// getPyramid loads the tile pyramid of the image in the request, reporting
+// it as not found when there is none or it has another layout.
+func (app *application) getPyramid(w http.ResponseWriter, r *http.Request, layout string) (*store.TilePyramid, bool) {
+	image := getImageFromContext(r)
+
+	pyramid, err := app.store.Tiles.GetByImageID(r.Context(), image.ID)
+	if err != nil {
+		switch err {
+		case store.ErrNotFound:
+			app.notFoundResponse(w, r, err)
+		default:
+			app.internalServerError(w, r, err)
+		}
+		return nil, false
+	}
+
+	if layout != "" && pyramid.Layout != layout {
+		app.notFoundResponse(w, r, fmt.Errorf("image tiles use the %s layout", pyramid.Layout))
+		return nil, false
+	}
+
+	return pyramid, true
+}
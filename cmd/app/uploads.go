@@ -0,0 +1,487 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/xbanchon/image-processing-service/internal/processor"
+	"github.com/xbanchon/image-processing-service/internal/store"
+	"github.com/xbanchon/image-processing-service/internal/store/blob"
+	"github.com/xbanchon/image-processing-service/internal/worker"
+)
+
+// Resumable uploads follow the tus 1.0 protocol (https://tus.io/protocols/resumable-upload)
+// with the creation, termination and expiration extensions. Every PATCH is
+// stored as its own chunk, and the chunks are streamed into an image once
+// the upload is complete.
+const (
+	tusVersion     = "1.0.0"
+	tusExtensions  = "creation,termination,expiration"
+	tusContentType = "application/offset+octet-stream"
+)
+
+const jobExpireUpload = "expire_upload"
+
+type uploadKey string
+
+const uploadCtx uploadKey = "upload"
+
+type expireUploadPayload struct {
+	UploadID int64 `json:"upload_id"`
+}
+
+func getUploadFromContext(r *http.Request) *store.Upload {
+	upload, _ := r.Context().Value(uploadCtx).(*store.Upload)
+	return upload
+}
+
+// tusMiddleware answers with the protocol version and turns away clients
+// speaking another one. OPTIONS requests are exempt, as they are how clients
+// discover the version.
+func (app *application) tusMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Tus-Resumable", tusVersion)
+
+		if r.Method != http.MethodOptions && r.Header.Get("Tus-Resumable") != tusVersion {
+			w.Header().Set("Tus-Version", tusVersion)
+			app.preconditionFailedResponse(w, r, fmt.Errorf("unsupported tus version %q", r.Header.Get("Tus-Resumable")))
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// uploadContextMiddleware loads the upload referenced by {uploadID} and makes
+// sure it belongs to the authenticated user and has not expired.
+func (app *application) uploadContextMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		uploadID, err := strconv.ParseInt(chi.URLParam(r, "uploadID"), 10, 64)
+		if err != nil {
+			app.badRequestResponse(w, r, err)
+			return
+		}
+
+		ctx := r.Context()
+
+		upload, err := app.store.Uploads.GetByID(ctx, uploadID)
+		if err != nil {
+			switch err {
+			case store.ErrNotFound:
+				app.notFoundResponse(w, r, err)
+			default:
+				app.internalServerError(w, r, err)
+			}
+			return
+		}
+
+		user := getUserFromContext(r)
+		if upload.UserID != user.ID {
+			app.forbiddenResponse(w, r, errors.New("upload does not belong to user"))
+			return
+		}
+
+		if time.Now().After(upload.ExpiresAt) {
+			app.notFoundResponse(w, r, errors.New("upload expired"))
+			return
+		}
+
+		ctx = context.WithValue(ctx, uploadCtx, upload)
+
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+func (app *application) uploadOptionsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Tus-Version", tusVersion)
+	w.Header().Set("Tus-Extension", tusExtensions)
+	w.Header().Set("Tus-Max-Size", strconv.FormatInt(app.config.uploadCfg.maxSize, 10))
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// createUploadHandler starts a resumable upload of Upload-Length bytes. The
+// original filename is read from the filename (or name) key of
+// Upload-Metadata.
+func (app *application) createUploadHandler(w http.ResponseWriter, r *http.Request) {
+	user := getUserFromContext(r)
+
+	if r.Header.Get("Upload-Defer-Length") != "" {
+		app.badRequestResponse(w, r, errors.New("Upload-Defer-Length is not supported, send Upload-Length"))
+		return
+	}
+
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length <= 0 {
+		app.badRequestResponse(w, r, errors.New("Upload-Length must be a positive number of bytes"))
+		return
+	}
+	if length > app.config.uploadCfg.maxSize {
+		app.payloadTooLargeResponse(w, r, app.config.uploadCfg.maxSize)
+		return
+	}
+
+	metadata, err := parseUploadMetadata(r.Header.Get("Upload-Metadata"))
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	filename := metadata["filename"]
+	if filename == "" {
+		filename = metadata["name"]
+	}
+
+	upload := &store.Upload{
+		UserID:    user.ID,
+		Length:    length,
+		Metadata:  r.Header.Get("Upload-Metadata"),
+		Filename:  filename,
+		ExpiresAt: time.Now().Add(app.config.uploadCfg.expiry),
+	}
+
+	ctx := r.Context()
+
+	if err := app.store.Uploads.Create(ctx, upload); err != nil {
+		app.internalServerError(w, r, err)
+		return
+	}
+
+	payload := expireUploadPayload{UploadID: upload.ID}
+	if _, err := app.workers.EnqueueAt(ctx, jobExpireUpload, user.ID, payload, upload.ExpiresAt); err != nil {
+		if err := app.store.Uploads.Delete(ctx, upload.ID); err != nil {
+			app.logger.Errorw("deleting unscheduled upload", "upload_id", upload.ID, "error", err.Error())
+		}
+		app.internalServerError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Location", fmt.Sprintf("%s/uploads/%d", strings.TrimSuffix(app.config.apiURL, "/"), upload.ID))
+	w.Header().Set("Upload-Expires", upload.ExpiresAt.UTC().Format(http.TimeFormat))
+	w.WriteHeader(http.StatusCreated)
+}
+
+// headUploadHandler reports how much of the upload was received, so that the
+// client resumes from there. Completed uploads also carry the ID of the image
+// they became.
+func (app *application) headUploadHandler(w http.ResponseWriter, r *http.Request) {
+	upload := getUploadFromContext(r)
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Upload-Length", strconv.FormatInt(upload.Length, 10))
+	if upload.Metadata != "" {
+		w.Header().Set("Upload-Metadata", upload.Metadata)
+	}
+	app.setUploadHeaders(w, upload)
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// patchUploadHandler appends the body at Upload-Offset, which must be the
+// current offset of the upload. The chunk completing the upload turns it
+// into an image the same way a direct upload does; should that fail, an
+// empty PATCH at the final offset tries again.
+func (app *application) patchUploadHandler(w http.ResponseWriter, r *http.Request) {
+	user := getUserFromContext(r)
+	upload := getUploadFromContext(r)
+
+	if ct := r.Header.Get("Content-Type"); ct != tusContentType {
+		app.unsupportedMediaTypeResponse(w, r, fmt.Errorf("Content-Type must be %s, got %q", tusContentType, ct))
+		return
+	}
+
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		app.badRequestResponse(w, r, errors.New("Upload-Offset must be a non-negative number of bytes"))
+		return
+	}
+	if offset != upload.Offset {
+		app.conflictResponse(w, r, fmt.Errorf("upload is at offset %d, not %d", upload.Offset, offset))
+		return
+	}
+
+	// slow connections get longer than the server timeouts to send a chunk,
+	// and what was received is stored even if the client is gone by then
+	deadline := time.Now().Add(app.config.uploadCfg.chunkTimeout)
+	rc := http.NewResponseController(w)
+	if err := errors.Join(rc.SetReadDeadline(deadline), rc.SetWriteDeadline(deadline)); err != nil {
+		app.logger.Warnw("extending upload deadlines", "error", err.Error())
+	}
+	ctx := context.WithoutCancel(r.Context())
+
+	if upload.ImageID == nil && upload.Offset < upload.Length {
+		if err := app.appendChunk(ctx, upload, r.Body); err != nil {
+			switch {
+			case errors.Is(err, store.ErrConflict):
+				app.conflictResponse(w, r, errors.New("upload was moved on by another request, check its offset"))
+			default:
+				app.uploadErrorResponse(w, r, err)
+			}
+			return
+		}
+	}
+
+	if upload.ImageID == nil && upload.Offset == upload.Length {
+		if err := app.completeUpload(ctx, user, upload); err != nil {
+			switch {
+			case errors.Is(err, store.ErrConflict):
+				app.conflictResponse(w, r, errors.New("upload was completed by another request"))
+			default:
+				app.uploadErrorResponse(w, r, err)
+			}
+			return
+		}
+	}
+
+	app.setUploadHeaders(w, upload)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// deleteUploadHandler terminates an upload and drops the chunks received so
+// far. The image of a completed upload is kept.
+func (app *application) deleteUploadHandler(w http.ResponseWriter, r *http.Request) {
+	upload := getUploadFromContext(r)
+	ctx := r.Context()
+
+	if err := app.store.Uploads.Delete(ctx, upload.ID); err != nil {
+		switch err {
+		case store.ErrNotFound:
+			app.notFoundResponse(w, r, err)
+		default:
+			app.internalServerError(w, r, err)
+		}
+		return
+	}
+
+	app.deleteObjects(ctx, blob.UploadPrefix(upload.UserID, upload.ID))
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (app *application) setUploadHeaders(w http.ResponseWriter, upload *store.Upload) {
+	w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	w.Header().Set("Upload-Expires", upload.ExpiresAt.UTC().Format(http.TimeFormat))
+	if upload.ImageID != nil {
+		w.Header().Set("Image-ID", strconv.FormatInt(*upload.ImageID, 10))
+	}
+}
+
+// appendChunk stores body as the next chunk of the upload. A body cut short
+// by the client is kept up to where it broke off, for the client to resume
+// from there. The first chunk is checked to be an image before anything
+// else is sent.
+func (app *application) appendChunk(ctx context.Context, upload *store.Upload, body io.Reader) error {
+	chunk := &chunkReader{r: newMaxSizeReader(body, upload.Length-upload.Offset)}
+
+	var r io.Reader = chunk
+	if upload.Offset == 0 {
+		br := bufio.NewReaderSize(chunk, 512)
+		head, err := br.Peek(512)
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if len(head) >= int(min(512, upload.Length)) {
+			if _, ok := processor.LookupFormat(processor.DetectFormat(head)); !ok {
+				return processor.ErrUnsupportedFormat
+			}
+		}
+		r = br
+	}
+
+	var id [4]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return err
+	}
+	// parts are named after their offset, and told apart from parts racing
+	// for the same offset by a random suffix
+	part := fmt.Sprintf("%s%020d-%s", blob.UploadPrefix(upload.UserID, upload.ID), upload.Offset, hex.EncodeToString(id[:]))
+
+	if err := app.bucket.Blobs.Put(ctx, part, r, -1, tusContentType); err != nil {
+		app.deleteChunk(ctx, part)
+		return err
+	}
+	if chunk.err != nil {
+		app.logger.Infow("upload chunk interrupted", "upload_id", upload.ID, "received", chunk.n, "error", chunk.err.Error())
+	}
+	if chunk.n == 0 {
+		app.deleteChunk(ctx, part)
+		return nil
+	}
+
+	if err := app.store.Uploads.Append(ctx, upload, part, chunk.n, time.Now().Add(app.config.uploadCfg.expiry)); err != nil {
+		app.deleteChunk(ctx, part)
+		return err
+	}
+
+	return nil
+}
+
+func (app *application) deleteChunk(ctx context.Context, key string) {
+	if err := app.bucket.Blobs.Delete(ctx, key); err != nil {
+		app.logger.Errorw("deleting upload chunk", "key", key, "error", err.Error())
+	}
+}
+
+// completeUpload streams the chunks of a complete upload into a new image of
+// the user, then drops them.
+func (app *application) completeUpload(ctx context.Context, user *store.User, upload *store.Upload) error {
+	parts := &partsReader{ctx: ctx, blobs: app.bucket.Blobs, parts: upload.Parts}
+	defer parts.Close()
+
+	image, err := app.createImage(ctx, user, parts, upload.Filename)
+	if err != nil {
+		return err
+	}
+
+	if err := app.store.Uploads.Complete(ctx, upload, image.ID); err != nil {
+		// completed concurrently, keep a single image
+		orphans, err := app.store.Images.Delete(ctx, image.ID)
+		if err != nil {
+			app.logger.Errorw("deleting duplicate upload image", "image_id", image.ID, "error", err.Error())
+		}
+		app.collectBlobs(ctx, image.UserID, orphans)
+		return err
+	}
+	app.logger.Infow("upload completed", "upload_id", upload.ID, "image_id", image.ID)
+
+	app.deleteObjects(ctx, blob.UploadPrefix(upload.UserID, upload.ID))
+
+	return nil
+}
+
+// expireUploadJob removes an upload once it expires, along with its chunks.
+// Uploads still receiving chunks have had their expiry pushed back, and are
+// checked again then.
+func (app *application) expireUploadJob(ctx context.Context, job *store.Job) (any, error) {
+	var payload expireUploadPayload
+	if err := json.Unmarshal(job.Payload, &payload); err != nil {
+		return nil, worker.Permanent(err)
+	}
+
+	upload, err := app.store.Uploads.GetByID(ctx, payload.UploadID)
+	if err != nil {
+		if err == store.ErrNotFound {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	if time.Now().Before(upload.ExpiresAt) {
+		if _, err := app.workers.EnqueueAt(ctx, jobExpireUpload, job.UserID, payload, upload.ExpiresAt); err != nil {
+			return nil, err
+		}
+		return upload, nil
+	}
+
+	if err := app.store.Uploads.Delete(ctx, upload.ID); err != nil && err != store.ErrNotFound {
+		return nil, err
+	}
+	app.deleteObjects(ctx, blob.UploadPrefix(upload.UserID, upload.ID))
+
+	return upload, nil
+}
+
+// parseUploadMetadata decodes an Upload-Metadata header: comma separated
+// keys, each followed by a space and its base64 encoded value unless empty.
+func parseUploadMetadata(header string) (map[string]string, error) {
+	metadata := map[string]string{}
+	if strings.TrimSpace(header) == "" {
+		return metadata, nil
+	}
+
+	for _, pair := range strings.Split(header, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(pair), " ")
+		if key == "" {
+			return nil, errors.New("Upload-Metadata has an empty key")
+		}
+		if _, ok := metadata[key]; ok {
+			return nil, fmt.Errorf("Upload-Metadata repeats key %q", key)
+		}
+
+		decoded, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return nil, fmt.Errorf("Upload-Metadata value of %q is not base64", key)
+		}
+		metadata[key] = string(decoded)
+	}
+
+	return metadata, nil
+}
+
+// chunkReader ends the body of a PATCH at the first read error other than the
+// upload growing past its length, so that what arrived before a dropped
+// connection is still stored. It counts the bytes read.
+type chunkReader struct {
+	r   io.Reader
+	n   int64
+	err error //why the body ended early
+}
+
+func (c *chunkReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+
+	if err != nil && err != io.EOF && !errors.Is(err, errUploadTooLarge) {
+		c.err = err
+		return n, io.EOF
+	}
+
+	return n, err
+}
+
+// partsReader reads the chunks of an upload one after the other, opening
+// each only once the previous one is exhausted.
+type partsReader struct {
+	ctx   context.Context
+	blobs blob.Store
+	parts []string
+	cur   io.ReadCloser
+}
+
+func (p *partsReader) Read(b []byte) (int, error) {
+	for {
+		if p.cur == nil {
+			if len(p.parts) == 0 {
+				return 0, io.EOF
+			}
+
+			rc, err := p.blobs.Get(p.ctx, p.parts[0])
+			if err != nil {
+				return 0, err
+			}
+			p.cur, p.parts = rc, p.parts[1:]
+		}
+
+		n, err := p.cur.Read(b)
+		if err == io.EOF {
+			p.cur.Close()
+			p.cur = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+
+		return n, err
+	}
+}
+
+func (p *partsReader) Close() error {
+	if p.cur == nil {
+		return nil
+	}
+
+	return p.cur.Close()
+}
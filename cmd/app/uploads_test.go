@@ -0,0 +1,817 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/xbanchon/image-processing-service/internal/auth"
+	"github.com/xbanchon/image-processing-service/internal/processor"
+	"github.com/xbanchon/image-processing-service/internal/store"
+	"github.com/xbanchon/image-processing-service/internal/store/blob"
+	"github.com/xbanchon/image-processing-service/internal/worker"
+	"go.uber.org/zap"
+)
+
+const testAPIURL = "http://localhost:8080"
+
+// testApplication serves the API with in-memory stores and the memory blob
+// backend. Users 1 and 2 exist.
+type testApplication struct {
+	*application
+	handler http.Handler
+	blobs   *blob.Memory
+	images  *memoryImageStore
+	uploads *memoryUploadStore
+	jobs    *memoryJobStore
+}
+
+func newTestApplication(t *testing.T) *testApplication {
+	t.Helper()
+
+	logger := zap.NewNop().Sugar()
+	signer := auth.NewURLSigner("test-signing-key")
+	blobs := blob.NewMemory(blob.URLs{BaseURL: testAPIURL + "/blobs", Signer: signer})
+
+	ta := &testApplication{
+		blobs:   blobs,
+		images:  &memoryImageStore{images: map[int64]*store.Image{}},
+		uploads: &memoryUploadStore{uploads: map[int64]*store.Upload{}},
+		jobs:    &memoryJobStore{},
+	}
+
+	ta.application = &application{
+		config: config{
+			apiURL: testAPIURL,
+			auth:   authConfig{secret: "test-secret", exp: time.Hour, iss: "test"},
+			uploadCfg: uploadConfig{
+				maxSize:      1 << 20,
+				expiry:       time.Hour,
+				chunkTimeout: time.Minute,
+			},
+		},
+		authenticator: auth.NewJWTAuth("test-secret", "test", "test"),
+		urlSigner:     signer,
+		logger:        logger,
+		store: store.Storage{
+			Users: memoryUserStore{
+				1: {ID: 1, Username: "alice"},
+				2: {ID: 2, Username: "bob"},
+			},
+			Images:      ta.images,
+			Uploads:     ta.uploads,
+			Jobs:        ta.jobs,
+			Derivatives: &memoryDerivativeStore{derivatives: map[int64][]store.Derivative{}},
+		},
+		bucket:   blob.NewStorage(blobs),
+		blobURLs: blob.URLs{BaseURL: testAPIURL + "/blobs", Signer: signer},
+		workers:  worker.NewPool(ta.jobs, worker.Config{MaxAttempts: 3}, logger),
+		backend:  processor.NativeBackend{},
+	}
+	ta.registerJobHandlers()
+	ta.handler = ta.mount()
+
+	return ta
+}
+
+func (ta *testApplication) token(t *testing.T, userID int64) string {
+	t.Helper()
+
+	token, err := ta.authenticator.GenerateToken(jwt.MapClaims{
+		"sub": userID,
+		"exp": time.Now().Add(time.Hour).Unix(),
+		"iss": "test",
+		"aud": "test",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return token
+}
+
+// tus sends a tus request as the user, or anonymously when userID is 0.
+// Headers with an empty value are removed from the defaults.
+func (ta *testApplication) tus(t *testing.T, userID int64, method, path string, body io.Reader, header map[string]string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	req := httptest.NewRequest(method, path, body)
+	req.Header.Set("Tus-Resumable", tusVersion)
+	if method == http.MethodPatch {
+		req.Header.Set("Content-Type", tusContentType)
+	}
+	if userID != 0 {
+		req.Header.Set("Authorization", "Bearer "+ta.token(t, userID))
+	}
+	for k, v := range header {
+		if v == "" {
+			req.Header.Del(k)
+			continue
+		}
+		req.Header.Set(k, v)
+	}
+
+	rr := httptest.NewRecorder()
+	ta.handler.ServeHTTP(rr, req)
+
+	return rr
+}
+
+// createUpload starts an upload of length bytes for the user and returns its path.
+func (ta *testApplication) createUpload(t *testing.T, userID int64, length int) string {
+	t.Helper()
+
+	rr := ta.tus(t, userID, http.MethodPost, "/uploads/", nil, map[string]string{
+		"Upload-Length":   strconv.Itoa(length),
+		"Upload-Metadata": "filename " + base64.StdEncoding.EncodeToString([]byte("scan.png")),
+	})
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("creating upload: %d %s", rr.Code, rr.Body)
+	}
+
+	return strings.TrimPrefix(rr.Header().Get("Location"), testAPIURL)
+}
+
+func (ta *testApplication) patch(t *testing.T, userID int64, path string, offset int, body io.Reader) *httptest.ResponseRecorder {
+	t.Helper()
+
+	return ta.tus(t, userID, http.MethodPatch, path, body, map[string]string{"Upload-Offset": strconv.Itoa(offset)})
+}
+
+func (ta *testApplication) chunks(t *testing.T, userID, uploadID int64) []blob.ObjectInfo {
+	t.Helper()
+
+	objects, err := ta.blobs.List(context.Background(), blob.UploadPrefix(userID, uploadID))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return objects
+}
+
+func uploadIDFromPath(t *testing.T, path string) int64 {
+	t.Helper()
+
+	id, err := strconv.ParseInt(strings.TrimPrefix(path, "/uploads/"), 10, 64)
+	if err != nil {
+		t.Fatalf("upload path %q: %v", path, err)
+	}
+
+	return id
+}
+
+// testPNG returns a PNG of noise, large enough to be sent in several chunks.
+func testPNG(t *testing.T) []byte {
+	t.Helper()
+
+	rnd := rand.New(rand.NewSource(1))
+	img := image.NewNRGBA(image.Rect(0, 0, 48, 32))
+	for y := 0; y < 32; y++ {
+		for x := 0; x < 48; x++ {
+			img.SetNRGBA(x, y, color.NRGBA{R: uint8(rnd.Intn(256)), G: uint8(rnd.Intn(256)), B: uint8(rnd.Intn(256)), A: 0xff})
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
+
+// brokenReader yields data, then fails the way a dropped connection does.
+type brokenReader struct {
+	data []byte
+}
+
+func (b *brokenReader) Read(p []byte) (int, error) {
+	if len(b.data) == 0 {
+		return 0, io.ErrUnexpectedEOF
+	}
+
+	n := copy(p, b.data)
+	b.data = b.data[n:]
+
+	return n, nil
+}
+
+func TestCreateUpload(t *testing.T) {
+	metadata := "filename " + base64.StdEncoding.EncodeToString([]byte("scan.png")) + ",is_private"
+
+	tests := []struct {
+		name       string
+		userID     int64
+		header     map[string]string
+		wantStatus int
+	}{
+		{"created", 1, map[string]string{"Upload-Length": "1000", "Upload-Metadata": metadata}, http.StatusCreated},
+		{"without metadata", 1, map[string]string{"Upload-Length": "1000"}, http.StatusCreated},
+		{"anonymous", 0, map[string]string{"Upload-Length": "1000"}, http.StatusUnauthorized},
+		{"other tus version", 1, map[string]string{"Upload-Length": "1000", "Tus-Resumable": "0.2.2"}, http.StatusPreconditionFailed},
+		{"missing length", 1, nil, http.StatusBadRequest},
+		{"zero length", 1, map[string]string{"Upload-Length": "0"}, http.StatusBadRequest},
+		{"deferred length", 1, map[string]string{"Upload-Defer-Length": "1"}, http.StatusBadRequest},
+		{"too large", 1, map[string]string{"Upload-Length": strconv.Itoa(1<<20 + 1)}, http.StatusRequestEntityTooLarge},
+		{"bad metadata", 1, map[string]string{"Upload-Length": "1000", "Upload-Metadata": "filename not-base64!"}, http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ta := newTestApplication(t)
+
+			rr := ta.tus(t, tt.userID, http.MethodPost, "/uploads/", nil, tt.header)
+			if rr.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", rr.Code, tt.wantStatus, rr.Body)
+			}
+			if got := rr.Header().Get("Tus-Resumable"); got != tusVersion {
+				t.Errorf("Tus-Resumable = %q, want %q", got, tusVersion)
+			}
+			if rr.Code != http.StatusCreated {
+				if len(ta.uploads.uploads) != 0 {
+					t.Fatalf("upload recorded on failure")
+				}
+				return
+			}
+
+			id := uploadIDFromPath(t, strings.TrimPrefix(rr.Header().Get("Location"), testAPIURL))
+			upload, err := ta.uploads.GetByID(context.Background(), id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if upload.UserID != tt.userID || upload.Length != 1000 || upload.Offset != 0 {
+				t.Errorf("upload = %+v", upload)
+			}
+			if tt.header["Upload-Metadata"] != "" && upload.Filename != "scan.png" {
+				t.Errorf("filename = %q, want scan.png", upload.Filename)
+			}
+
+			if _, err := http.ParseTime(rr.Header().Get("Upload-Expires")); err != nil {
+				t.Errorf("Upload-Expires: %v", err)
+			}
+
+			jobs := ta.jobs.byType(jobExpireUpload)
+			if len(jobs) != 1 || jobs[0].RunAt == "" {
+				t.Fatalf("expected one scheduled %s job, got %+v", jobExpireUpload, jobs)
+			}
+		})
+	}
+}
+
+func TestUploadOptions(t *testing.T) {
+	ta := newTestApplication(t)
+
+	rr := ta.tus(t, 0, http.MethodOptions, "/uploads/", nil, map[string]string{"Tus-Resumable": ""})
+	if rr.Code != http.StatusNoContent {
+		t.Fatalf("status = %d, want %d", rr.Code, http.StatusNoContent)
+	}
+	if got := rr.Header().Get("Tus-Extension"); got != tusExtensions {
+		t.Errorf("Tus-Extension = %q, want %q", got, tusExtensions)
+	}
+	if got := rr.Header().Get("Tus-Max-Size"); got != strconv.Itoa(1<<20) {
+		t.Errorf("Tus-Max-Size = %q", got)
+	}
+}
+
+// TestUploadResume sends an image over three PATCH requests, the first cut
+// short by a dropped connection, and checks the client can pick up from the
+// offset the server reports until the upload becomes an image.
+func TestUploadResume(t *testing.T) {
+	ta := newTestApplication(t)
+	data := testPNG(t)
+
+	path := ta.createUpload(t, 1, len(data))
+	id := uploadIDFromPath(t, path)
+
+	// the connection drops after 1000 bytes of the first chunk
+	rr := ta.patch(t, 1, path, 0, &brokenReader{data: data[:1000]})
+	if rr.Code != http.StatusNoContent {
+		t.Fatalf("interrupted patch: %d %s", rr.Code, rr.Body)
+	}
+	if got := rr.Header().Get("Upload-Offset"); got != "1000" {
+		t.Fatalf("Upload-Offset = %q, want 1000", got)
+	}
+
+	rr = ta.tus(t, 1, http.MethodHead, path, nil, nil)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("head: %d %s", rr.Code, rr.Body)
+	}
+	if got := rr.Header().Get("Upload-Offset"); got != "1000" {
+		t.Fatalf("HEAD Upload-Offset = %q, want 1000", got)
+	}
+	if got := rr.Header().Get("Upload-Length"); got != strconv.Itoa(len(data)) {
+		t.Fatalf("HEAD Upload-Length = %q, want %d", got, len(data))
+	}
+	if rr.Header().Get("Image-ID") != "" {
+		t.Fatal("incomplete upload reports an image")
+	}
+
+	// resumed from the reported offset
+	half := len(data) / 2
+	rr = ta.patch(t, 1, path, 1000, bytes.NewReader(data[1000:half]))
+	if rr.Code != http.StatusNoContent {
+		t.Fatalf("resumed patch: %d %s", rr.Code, rr.Body)
+	}
+	if got := rr.Header().Get("Upload-Offset"); got != strconv.Itoa(half) {
+		t.Fatalf("Upload-Offset = %q, want %d", got, half)
+	}
+	if n := len(ta.chunks(t, 1, id)); n != 2 {
+		t.Fatalf("%d chunks stored, want 2", n)
+	}
+
+	// the last chunk completes the upload
+	rr = ta.patch(t, 1, path, half, bytes.NewReader(data[half:]))
+	if rr.Code != http.StatusNoContent {
+		t.Fatalf("final patch: %d %s", rr.Code, rr.Body)
+	}
+	if got := rr.Header().Get("Upload-Offset"); got != strconv.Itoa(len(data)) {
+		t.Fatalf("Upload-Offset = %q, want %d", got, len(data))
+	}
+
+	imageID, err := strconv.ParseInt(rr.Header().Get("Image-ID"), 10, 64)
+	if err != nil {
+		t.Fatalf("Image-ID = %q", rr.Header().Get("Image-ID"))
+	}
+
+	image, err := ta.images.GetByID(context.Background(), imageID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if image.UserID != 1 || image.OriginalName != "scan.png" {
+		t.Errorf("image = %+v", image)
+	}
+	if image.Metadata.Width != 48 || image.Metadata.Height != 32 || image.Metadata.Size != int64(len(data)) {
+		t.Errorf("metadata = %+v", image.Metadata)
+	}
+	if !strings.HasPrefix(image.Filename, blob.UserPrefix(1)) {
+		t.Errorf("image key %q is outside the user prefix", image.Filename)
+	}
+
+	rc, err := ta.blobs.Get(context.Background(), image.Filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored, _ := io.ReadAll(rc)
+	rc.Close()
+	if !bytes.Equal(stored, data) {
+		t.Fatal("stored image differs from the upload")
+	}
+
+	if n := len(ta.chunks(t, 1, id)); n != 0 {
+		t.Fatalf("%d chunks left after completion", n)
+	}
+
+	// a completed upload reports its image, and takes no more data
+	rr = ta.tus(t, 1, http.MethodHead, path, nil, nil)
+	if got := rr.Header().Get("Image-ID"); got != strconv.FormatInt(imageID, 10) {
+		t.Fatalf("HEAD Image-ID = %q, want %d", got, imageID)
+	}
+	rr = ta.patch(t, 1, path, len(data), bytes.NewReader([]byte("more")))
+	if rr.Code != http.StatusNoContent || rr.Header().Get("Upload-Offset") != strconv.Itoa(len(data)) {
+		t.Fatalf("patch after completion: %d offset %s", rr.Code, rr.Header().Get("Upload-Offset"))
+	}
+	if len(ta.images.images) != 1 {
+		t.Fatalf("%d images, want 1", len(ta.images.images))
+	}
+}
+
+func TestPatchUploadRejected(t *testing.T) {
+	data := testPNG(t)
+
+	tests := []struct {
+		name       string
+		userID     int64
+		offset     string
+		header     map[string]string
+		body       []byte
+		wantStatus int
+	}{
+		{"offset behind", 1, "0", nil, data[600:700], http.StatusConflict},
+		{"offset ahead", 1, "700", nil, data[600:700], http.StatusConflict},
+		{"missing offset", 1, "", nil, data[600:700], http.StatusBadRequest},
+		{"negative offset", 1, "-1", nil, data[600:700], http.StatusBadRequest},
+		{"wrong content type", 1, "600", map[string]string{"Content-Type": "image/png"}, data[600:700], http.StatusUnsupportedMediaType},
+		{"past the length", 1, "600", nil, append(data[600:len(data):len(data)], 0), http.StatusRequestEntityTooLarge},
+		{"other user", 2, "600", nil, data[600:700], http.StatusForbidden},
+		{"anonymous", 0, "600", nil, data[600:700], http.StatusUnauthorized},
+		{"other tus version", 1, "600", map[string]string{"Tus-Resumable": "0.2.2"}, data[600:700], http.StatusPreconditionFailed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ta := newTestApplication(t)
+
+			path := ta.createUpload(t, 1, len(data))
+			if rr := ta.patch(t, 1, path, 0, bytes.NewReader(data[:600])); rr.Code != http.StatusNoContent {
+				t.Fatalf("first patch: %d %s", rr.Code, rr.Body)
+			}
+
+			header := map[string]string{"Upload-Offset": tt.offset}
+			for k, v := range tt.header {
+				header[k] = v
+			}
+
+			rr := ta.tus(t, tt.userID, http.MethodPatch, path, bytes.NewReader(tt.body), header)
+			if rr.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", rr.Code, tt.wantStatus, rr.Body)
+			}
+
+			upload, err := ta.uploads.GetByID(context.Background(), uploadIDFromPath(t, path))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if upload.Offset != 600 || len(upload.Parts) != 1 {
+				t.Fatalf("upload moved to offset %d with %d parts", upload.Offset, len(upload.Parts))
+			}
+			if n := len(ta.chunks(t, 1, upload.ID)); n != 1 {
+				t.Fatalf("%d chunks stored, want 1", n)
+			}
+		})
+	}
+}
+
+func TestPatchUploadNotAnImage(t *testing.T) {
+	ta := newTestApplication(t)
+	data := bytes.Repeat([]byte("not an image "), 100)
+
+	path := ta.createUpload(t, 1, len(data))
+
+	rr := ta.patch(t, 1, path, 0, bytes.NewReader(data))
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("status = %d, want %d: %s", rr.Code, http.StatusBadRequest, rr.Body)
+	}
+	if n := len(ta.chunks(t, 1, uploadIDFromPath(t, path))); n != 0 {
+		t.Fatalf("%d chunks stored, want 0", n)
+	}
+}
+
+func TestDeleteUpload(t *testing.T) {
+	data := testPNG(t)
+
+	tests := []struct {
+		name       string
+		userID     int64
+		path       func(string) string
+		wantStatus int
+		wantGone   bool
+	}{
+		{"owner", 1, func(p string) string { return p }, http.StatusNoContent, true},
+		{"other user", 2, func(p string) string { return p }, http.StatusForbidden, false},
+		{"anonymous", 0, func(p string) string { return p }, http.StatusUnauthorized, false},
+		{"missing upload", 1, func(string) string { return "/uploads/999" }, http.StatusNotFound, false},
+		{"bad id", 1, func(string) string { return "/uploads/abc" }, http.StatusBadRequest, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ta := newTestApplication(t)
+
+			path := ta.createUpload(t, 1, len(data))
+			id := uploadIDFromPath(t, path)
+			if rr := ta.patch(t, 1, path, 0, bytes.NewReader(data[:1000])); rr.Code != http.StatusNoContent {
+				t.Fatalf("patch: %d %s", rr.Code, rr.Body)
+			}
+
+			rr := ta.tus(t, tt.userID, http.MethodDelete, tt.path(path), nil, nil)
+			if rr.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", rr.Code, tt.wantStatus, rr.Body)
+			}
+
+			_, err := ta.uploads.GetByID(context.Background(), id)
+			if gone := errors.Is(err, store.ErrNotFound); gone != tt.wantGone {
+				t.Fatalf("upload gone = %v, want %v", gone, tt.wantGone)
+			}
+
+			wantChunks := 1
+			if tt.wantGone {
+				wantChunks = 0
+			}
+			if n := len(ta.chunks(t, 1, id)); n != wantChunks {
+				t.Fatalf("%d chunks left, want %d", n, wantChunks)
+			}
+
+			if tt.wantGone {
+				if rr := ta.tus(t, 1, http.MethodHead, path, nil, nil); rr.Code != http.StatusNotFound {
+					t.Fatalf("HEAD after delete: %d, want %d", rr.Code, http.StatusNotFound)
+				}
+			}
+		})
+	}
+}
+
+type memoryUserStore map[int64]*store.User
+
+func (s memoryUserStore) Create(ctx context.Context, user *store.User) error {
+	return errors.New("not implemented")
+}
+
+func (s memoryUserStore) GetByUsername(ctx context.Context, username string) (*store.User, error) {
+	for _, user := range s {
+		if user.Username == username {
+			return user, nil
+		}
+	}
+
+	return nil, store.ErrNotFound
+}
+
+func (s memoryUserStore) GetByID(ctx context.Context, id int64) (*store.User, error) {
+	user, ok := s[id]
+	if !ok {
+		return nil, store.ErrNotFound
+	}
+
+	return user, nil
+}
+
+type memoryImageStore struct {
+	mu        sync.Mutex
+	images    map[int64]*store.Image
+	nextID    int64
+	createErr error //returned by Create when set
+}
+
+func (s *memoryImageStore) Create(ctx context.Context, image *store.Image) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.createErr != nil {
+		return s.createErr
+	}
+
+	s.nextID++
+	image.ID = s.nextID
+	image.Version = 1
+	stored := *image
+	s.images[image.ID] = &stored
+
+	return nil
+}
+
+func (s *memoryImageStore) GetUserImages(ctx context.Context, userID int64, pp store.PaginationParams) ([]store.Image, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var images []store.Image
+	for _, image := range s.images {
+		if image.UserID == userID {
+			images = append(images, *image)
+		}
+	}
+
+	return images, nil
+}
+
+func (s *memoryImageStore) GetByID(ctx context.Context, id int64) (*store.Image, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	image, ok := s.images[id]
+	if !ok {
+		return nil, store.ErrNotFound
+	}
+	found := *image
+
+	return &found, nil
+}
+
+func (s *memoryImageStore) Update(ctx context.Context, image *store.Image) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.images[image.ID]; !ok {
+		return store.ErrNotFound
+	}
+	stored := *image
+	s.images[image.ID] = &stored
+
+	return nil
+}
+
+func (s *memoryImageStore) SetURL(ctx context.Context, image *store.Image) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored, ok := s.images[image.ID]
+	if !ok {
+		return store.ErrNotFound
+	}
+	stored.URL = image.URL
+
+	return nil
+}
+
+func (s *memoryImageStore) Delete(ctx context.Context, id int64) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.images[id]; !ok {
+		return nil, store.ErrNotFound
+	}
+	delete(s.images, id)
+
+	return nil, nil
+}
+
+// memoryUploadStore mirrors the optimistic offset checks of store.UploadStore.
+type memoryUploadStore struct {
+	mu      sync.Mutex
+	uploads map[int64]*store.Upload
+	nextID  int64
+}
+
+func copyUpload(upload *store.Upload) *store.Upload {
+	c := *upload
+	c.Parts = append([]string(nil), upload.Parts...)
+
+	return &c
+}
+
+func (s *memoryUploadStore) Create(ctx context.Context, upload *store.Upload) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.nextID++
+	upload.ID = s.nextID
+	upload.CreatedAt = time.Now().Format(time.RFC3339)
+	s.uploads[upload.ID] = copyUpload(upload)
+
+	return nil
+}
+
+func (s *memoryUploadStore) GetByID(ctx context.Context, id int64) (*store.Upload, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	upload, ok := s.uploads[id]
+	if !ok {
+		return nil, store.ErrNotFound
+	}
+
+	return copyUpload(upload), nil
+}
+
+func (s *memoryUploadStore) Append(ctx context.Context, upload *store.Upload, part string, size int64, expiresAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored, ok := s.uploads[upload.ID]
+	if !ok || stored.Offset != upload.Offset || stored.ImageID != nil {
+		return store.ErrConflict
+	}
+
+	stored.Offset += size
+	stored.Parts = append(stored.Parts, part)
+	stored.ExpiresAt = expiresAt
+	*upload = *copyUpload(stored)
+
+	return nil
+}
+
+func (s *memoryUploadStore) Complete(ctx context.Context, upload *store.Upload, imageID int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored, ok := s.uploads[upload.ID]
+	if !ok || stored.ImageID != nil {
+		return store.ErrConflict
+	}
+
+	stored.ImageID = &imageID
+	stored.Parts = nil
+	upload.ImageID = &imageID
+	upload.Parts = nil
+
+	return nil
+}
+
+func (s *memoryUploadStore) Delete(ctx context.Context, id int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.uploads[id]; !ok {
+		return store.ErrNotFound
+	}
+	delete(s.uploads, id)
+
+	return nil
+}
+
+type memoryDerivativeStore struct {
+	mu          sync.Mutex
+	derivatives map[int64][]store.Derivative
+	nextID      int64
+}
+
+func (s *memoryDerivativeStore) Replace(ctx context.Context, imageID int64, derivatives []store.Derivative) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// objects are not reference counted here, none is reported as orphaned
+	for i := range derivatives {
+		s.nextID++
+		derivatives[i].ID = s.nextID
+		derivatives[i].ImageID = imageID
+	}
+	s.derivatives[imageID] = append([]store.Derivative(nil), derivatives...)
+
+	return nil, nil
+}
+
+func (s *memoryDerivativeStore) GetByImageID(ctx context.Context, imageID int64) ([]store.Derivative, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	derivatives := append([]store.Derivative(nil), s.derivatives[imageID]...)
+	sort.SliceStable(derivatives, func(i, j int) bool { return derivatives[i].Width < derivatives[j].Width })
+
+	return derivatives, nil
+}
+
+// memoryJobStore records enqueued jobs; nothing runs them.
+type memoryJobStore struct {
+	mu   sync.Mutex
+	jobs []*store.Job
+}
+
+func (s *memoryJobStore) byType(jobType string) []store.Job {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var jobs []store.Job
+	for _, job := range s.jobs {
+		if job.Type == jobType {
+			jobs = append(jobs, *job)
+		}
+	}
+
+	return jobs
+}
+
+func (s *memoryJobStore) Create(ctx context.Context, job *store.Job) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	job.ID = int64(len(s.jobs) + 1)
+	job.Status = store.JobQueued
+	stored := *job
+	s.jobs = append(s.jobs, &stored)
+
+	return nil
+}
+
+func (s *memoryJobStore) GetByID(ctx context.Context, id int64) (*store.Job, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if id < 1 || id > int64(len(s.jobs)) {
+		return nil, store.ErrNotFound
+	}
+	job := *s.jobs[id-1]
+
+	return &job, nil
+}
+
+func (s *memoryJobStore) GetByStatus(ctx context.Context, status store.JobStatus, pp store.PaginationParams) ([]store.Job, error) {
+	return nil, nil
+}
+
+func (s *memoryJobStore) Claim(ctx context.Context, lease time.Duration) (*store.Job, error) {
+	return nil, store.ErrNotFound
+}
+
+func (s *memoryJobStore) Extend(ctx context.Context, job *store.Job, lease time.Duration) error {
+	return store.ErrNotFound
+}
+
+func (s *memoryJobStore) Succeed(ctx context.Context, job *store.Job, result json.RawMessage) error {
+	return store.ErrNotFound
+}
+
+func (s *memoryJobStore) Retry(ctx context.Context, job *store.Job, msg string, runAt time.Time) error {
+	return store.ErrNotFound
+}
+
+func (s *memoryJobStore) Bury(ctx context.Context, job *store.Job, msg string) error {
+	return store.ErrNotFound
+}
+
+func (s *memoryJobStore) Requeue(ctx context.Context, id int64) (*store.Job, error) {
+	return nil, store.ErrNotFound
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/xbanchon/image-processing-service/internal/store"
+)
+
+const signedURLDuration = 6 * 3600 // 6 hours
+
+func (app *application) getImageVersionsHandler(w http.ResponseWriter, r *http.Request) {
+	image := getImageFromContext(r)
+
+	versions, err := app.store.Versions.GetByImageID(r.Context(), image.ID)
+	if err != nil {
+		app.internalServerError(w, r, err)
+		return
+	}
+
+	if err := app.jsonResponse(w, http.StatusOK, versions); err != nil {
+		app.internalServerError(w, r, err)
+	}
+}
+
+func (app *application) getImageVersionHandler(w http.ResponseWriter, r *http.Request) {
+	version, ok := app.getVersion(w, r)
+	if !ok {
+		return
+	}
+
+	// stored URLs are short-lived, hand out a fresh one
+	url, err := app.bucket.Images.GetNewSignedImageURL(version.Filename, signedURLDuration)
+	if err != nil {
+		app.internalServerError(w, r, err)
+		return
+	}
+	version.URL = url
+
+	if err := app.jsonResponse(w, http.StatusOK, version); err != nil {
+		app.internalServerError(w, r, err)
+	}
+}
+
+// revertImageHandler makes an earlier version current again. The revert is
+// recorded as a new version pointing at the same bucket object, so history
+// is never rewritten.
+func (app *application) revertImageHandler(w http.ResponseWriter, r *http.Request) {
+	image := getImageFromContext(r)
+
+	target, ok := app.getVersion(w, r)
+	if !ok {
+		return
+	}
+
+	version := &store.ImageVersion{
+		Filename:     target.Filename,
+		URL:          target.URL,
+		RevertedFrom: &target.Version,
+		AutoOriented: target.AutoOriented,
+		MetadataKept: target.MetadataKept,
+		Metadata:     target.Metadata,
+	}
+
+	ctx := r.Context()
+
+	if err := app.store.Versions.Create(ctx, image, version); err != nil {
+		app.internalServerError(w, r, err)
+		return
+	}
+
+	app.invalidateImage(ctx, image.ID)
+
+	if err := app.jsonResponse(w, http.StatusOK, image); err != nil {
+		app.internalServerError(w, r, err)
+	}
+}
+
+func (app *application) getVersion(w http.ResponseWriter, r *http.Request) (*store.ImageVersion, bool) {
+	image := getImageFromContext(r)
+
+	n, err := strconv.Atoi(chi.URLParam(r, "version"))
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return nil, false
+	}
+
+	version, err := app.store.Versions.Get(r.Context(), image.ID, n)
+	if err != nil {
+		switch err {
+		case store.ErrNotFound:
+			app.notFoundResponse(w, r, err)
+		default:
+			app.internalServerError(w, r, err)
+		}
+		return nil, false
+	}
+
+	return version, true
+}
@@ -0,0 +1,17 @@
+CREATE TABLE IF NOT EXISTS jobs(
+    id bigserial PRIMARY KEY,
+    type varchar(50) NOT NULL,
+    user_id bigint REFERENCES users ON DELETE CASCADE,
+    status varchar(20) NOT NULL DEFAULT 'queued',
+    payload jsonb NOT NULL DEFAULT '{}',
+    result jsonb,
+    error text NOT NULL DEFAULT '',
+    attempts int NOT NULL DEFAULT 0,
+    max_attempts int NOT NULL DEFAULT 5,
+    run_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    locked_until timestamp(0) with time zone,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    updated_at timestamp(0) with time zone NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_jobs_status_run_at ON jobs (status, run_at);
@@ -0,0 +1,3 @@
+ALTER TABLE images DROP COLUMN IF EXISTS version;
+
+DROP TABLE IF EXISTS image_versions;
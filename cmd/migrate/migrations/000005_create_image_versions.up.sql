@@ -0,0 +1,18 @@
+CREATE TABLE IF NOT EXISTS image_versions(
+    id bigserial PRIMARY KEY,
+    image_id bigint NOT NULL REFERENCES images ON DELETE CASCADE,
+    version int NOT NULL,
+    filename VARCHAR(255) NOT NULL,
+    url text NOT NULL,
+    transformations jsonb,
+    reverted_from int,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    UNIQUE (image_id, version)
+);
+
+ALTER TABLE images ADD COLUMN IF NOT EXISTS version int NOT NULL DEFAULT 1;
+
+-- existing uploads become the first version of their image
+INSERT INTO image_versions (image_id, version, filename, url, created_at)
+SELECT id, 1, filename, url, created_at FROM images
+ON CONFLICT DO NOTHING;
@@ -0,0 +1,5 @@
+ALTER TABLE image_versions DROP COLUMN IF EXISTS metadata_kept;
+ALTER TABLE image_versions DROP COLUMN IF EXISTS auto_oriented;
+
+ALTER TABLE images DROP COLUMN IF EXISTS metadata_kept;
+ALTER TABLE images DROP COLUMN IF EXISTS auto_oriented;
@@ -0,0 +1,7 @@
+-- metadata_kept is NULL when all metadata was kept and lists the categories
+-- that survived when it was stripped
+ALTER TABLE images ADD COLUMN IF NOT EXISTS auto_oriented boolean NOT NULL DEFAULT false;
+ALTER TABLE images ADD COLUMN IF NOT EXISTS metadata_kept text[];
+
+ALTER TABLE image_versions ADD COLUMN IF NOT EXISTS auto_oriented boolean NOT NULL DEFAULT false;
+ALTER TABLE image_versions ADD COLUMN IF NOT EXISTS metadata_kept text[];
@@ -0,0 +1,19 @@
+ALTER TABLE image_versions
+    DROP COLUMN IF EXISTS exif,
+    DROP COLUMN IF EXISTS orientation,
+    DROP COLUMN IF EXISTS has_alpha,
+    DROP COLUMN IF EXISTS color_space,
+    DROP COLUMN IF EXISTS size,
+    DROP COLUMN IF EXISTS format,
+    DROP COLUMN IF EXISTS height,
+    DROP COLUMN IF EXISTS width;
+
+ALTER TABLE images
+    DROP COLUMN IF EXISTS exif,
+    DROP COLUMN IF EXISTS orientation,
+    DROP COLUMN IF EXISTS has_alpha,
+    DROP COLUMN IF EXISTS color_space,
+    DROP COLUMN IF EXISTS size,
+    DROP COLUMN IF EXISTS format,
+    DROP COLUMN IF EXISTS height,
+    DROP COLUMN IF EXISTS width;
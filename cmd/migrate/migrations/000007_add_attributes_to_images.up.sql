@@ -0,0 +1,19 @@
+ALTER TABLE images
+    ADD COLUMN IF NOT EXISTS width int NOT NULL DEFAULT 0,
+    ADD COLUMN IF NOT EXISTS height int NOT NULL DEFAULT 0,
+    ADD COLUMN IF NOT EXISTS format VARCHAR(16) NOT NULL DEFAULT '',
+    ADD COLUMN IF NOT EXISTS size bigint NOT NULL DEFAULT 0,
+    ADD COLUMN IF NOT EXISTS color_space VARCHAR(16) NOT NULL DEFAULT '',
+    ADD COLUMN IF NOT EXISTS has_alpha boolean NOT NULL DEFAULT false,
+    ADD COLUMN IF NOT EXISTS orientation smallint NOT NULL DEFAULT 1,
+    ADD COLUMN IF NOT EXISTS exif jsonb;
+
+ALTER TABLE image_versions
+    ADD COLUMN IF NOT EXISTS width int NOT NULL DEFAULT 0,
+    ADD COLUMN IF NOT EXISTS height int NOT NULL DEFAULT 0,
+    ADD COLUMN IF NOT EXISTS format VARCHAR(16) NOT NULL DEFAULT '',
+    ADD COLUMN IF NOT EXISTS size bigint NOT NULL DEFAULT 0,
+    ADD COLUMN IF NOT EXISTS color_space VARCHAR(16) NOT NULL DEFAULT '',
+    ADD COLUMN IF NOT EXISTS has_alpha boolean NOT NULL DEFAULT false,
+    ADD COLUMN IF NOT EXISTS orientation smallint NOT NULL DEFAULT 1,
+    ADD COLUMN IF NOT EXISTS exif jsonb;
@@ -0,0 +1,10 @@
+CREATE TABLE IF NOT EXISTS luts(
+    id bigserial PRIMARY KEY,
+    user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+    name VARCHAR(64) NOT NULL,
+    title text NOT NULL DEFAULT '',
+    size int NOT NULL,
+    data text NOT NULL,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    UNIQUE (user_id, name)
+);
@@ -0,0 +1,13 @@
+CREATE TABLE IF NOT EXISTS image_derivatives(
+    id bigserial PRIMARY KEY,
+    image_id bigint NOT NULL REFERENCES images ON DELETE CASCADE,
+    version int NOT NULL,
+    width int NOT NULL,
+    height int NOT NULL,
+    format VARCHAR(16) NOT NULL,
+    size bigint NOT NULL,
+    filename VARCHAR(255) NOT NULL,
+    url text NOT NULL,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    UNIQUE (image_id, width, format)
+);
@@ -0,0 +1,14 @@
+CREATE TABLE IF NOT EXISTS image_tiles(
+    image_id bigint PRIMARY KEY REFERENCES images ON DELETE CASCADE,
+    version int NOT NULL,
+    layout VARCHAR(8) NOT NULL,
+    tile_size int NOT NULL,
+    overlap int NOT NULL,
+    format VARCHAR(16) NOT NULL,
+    width int NOT NULL,
+    height int NOT NULL,
+    max_level int NOT NULL,
+    tiles int NOT NULL,
+    prefix VARCHAR(255) NOT NULL,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW()
+);
@@ -0,0 +1,7 @@
+ALTER TABLE images ADD COLUMN IF NOT EXISTS original_filename text NOT NULL DEFAULT '';
+
+-- uploads used to be stored as uploaded_<original filename>
+UPDATE images i
+SET original_filename = substr(v.filename, length('uploaded_') + 1)
+FROM image_versions v
+WHERE v.image_id = i.id AND v.version = 1 AND v.filename LIKE 'uploaded\_%';
@@ -0,0 +1,16 @@
+CREATE TABLE IF NOT EXISTS blobs(
+    key VARCHAR(255) PRIMARY KEY,
+    refs int NOT NULL CHECK (refs >= 0),
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW()
+);
+
+-- count the references existing objects already have
+INSERT INTO blobs (key, refs)
+SELECT filename, count(*)
+FROM (
+    SELECT filename FROM image_versions
+    UNION ALL
+    SELECT filename FROM image_derivatives
+) AS refs
+GROUP BY filename
+ON CONFLICT DO NOTHING;
@@ -0,0 +1,12 @@
+CREATE TABLE IF NOT EXISTS uploads(
+    id bigserial PRIMARY KEY,
+    user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+    upload_length bigint NOT NULL CHECK (upload_length > 0),
+    upload_offset bigint NOT NULL DEFAULT 0 CHECK (upload_offset <= upload_length),
+    metadata text NOT NULL DEFAULT '',
+    filename text NOT NULL DEFAULT '',
+    parts text[] NOT NULL DEFAULT '{}',
+    image_id bigint REFERENCES images ON DELETE CASCADE,
+    expires_at timestamp(0) with time zone NOT NULL,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW()
+);
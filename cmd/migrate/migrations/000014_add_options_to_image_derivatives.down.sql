@@ -0,0 +1 @@
+ALTER TABLE image_derivatives DROP COLUMN IF EXISTS options;
@@ -0,0 +1,2 @@
+-- render options of the signed delivery URL that reproduces the derivative
+ALTER TABLE image_derivatives ADD COLUMN IF NOT EXISTS options text NOT NULL DEFAULT '';
@@ -0,0 +1,68 @@
+package auth
+
+import "testing"
+
+func TestURLSigner(t *testing.T) {
+	const payload = "1/fmt:webp,w:400"
+
+	current := NewURLSigner("current-key")
+	sig := current.Sign(payload)
+
+	tests := []struct {
+		name    string
+		signer  *URLSigner
+		payload string
+		sig     string
+		want    bool
+	}{
+		{"round trip", current, payload, sig, true},
+		{"tampered payload", current, "1/fmt:webp,w:800", sig, false},
+		{"other image", current, "2/fmt:webp,w:400", sig, false},
+		{"tampered signature", current, payload, tamper(sig), false},
+		{"truncated signature", current, payload, sig[:len(sig)-2], false},
+		{"signature not base64", current, payload, "not*base64", false},
+		{"empty signature", current, payload, "", false},
+		{"other key", NewURLSigner("other-key"), payload, sig, false},
+		{"key rotated in, old still accepted", NewURLSigner("next-key", "current-key"), payload, sig, true},
+		{"key rotated out", NewURLSigner("next-key"), payload, sig, false},
+		{"empty keys are ignored", NewURLSigner("", "current-key"), payload, sig, true},
+		{"no keys", NewURLSigner(), payload, sig, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.signer.Verify(tt.payload, tt.sig); got != tt.want {
+				t.Fatalf("Verify() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestURLSignerSignsWithFirstKey(t *testing.T) {
+	const payload = "1/_"
+
+	rotated := NewURLSigner("next-key", "current-key")
+	sig := rotated.Sign(payload)
+
+	if sig != NewURLSigner("next-key").Sign(payload) {
+		t.Fatalf("signed with another key than the first")
+	}
+	if NewURLSigner("current-key").Verify(payload, sig) {
+		t.Fatalf("signature of the new key accepted by the old one")
+	}
+	if got := NewURLSigner().Sign(payload); got != "" {
+		t.Fatalf("Sign() without keys = %q, want empty", got)
+	}
+}
+
+// tamper flips a character of a base64url signature, keeping it decodable.
+func tamper(sig string) string {
+	b := []byte(sig)
+	if b[0] == 'A' {
+		b[0] = 'B'
+	} else {
+		b[0] = 'A'
+	}
+
+	return string(b)
+}
@@ -0,0 +1,387 @@
+package processor
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/color/palette"
+	"image/draw"
+	"image/gif"
+	"io"
+
+	"golang.org/x/image/webp"
+)
+
+var errBadWebP = errors.New("malformed webp container")
+
+// maxAnimationPixels bounds the pixels of all the frames of an animation
+// together, since every frame is kept at canvas size: about 320 MB as NRGBA.
+const maxAnimationPixels = 2 * MaxPixels
+
+// checkAnimationSize rejects animations that would take more than
+// maxAnimationPixels once decoded.
+func checkAnimationSize(width, height, frames int) error {
+	if int64(width)*int64(height)*int64(frames) > maxAnimationPixels {
+		return fmt.Errorf("%w: %d frames of %dx%d exceed the limit of %d decoded pixels", ErrInvalidParam, frames, width, height, maxAnimationPixels)
+	}
+
+	return nil
+}
+
+// frame is one fully composited frame of an animation. Frames are kept at
+// canvas size so every operation can treat them as independent images.
+type frame struct {
+	img   image.Image
+	delay int //milliseconds
+}
+
+// isAnimatedFormat reports whether format can be written with several frames.
+func isAnimatedFormat(format string) bool {
+	return format == "gif" || format == "webp"
+}
+
+// decodeAnimation decodes buf frame by frame when it is an animated GIF or
+// WebP. ok is false for still images, which callers decode as usual.
+func decodeAnimation(buf []byte) (c *nativeCanvas, ok bool, err error) {
+	switch DetectFormat(buf) {
+	case "gif":
+		c, err = decodeGIF(buf)
+	case "webp":
+		if !isAnimatedWebP(buf) {
+			return nil, false, nil
+		}
+		c, err = decodeAnimatedWebP(buf)
+	default:
+		return nil, false, nil
+	}
+
+	if err != nil {
+		return nil, true, err
+	}
+
+	return c, len(c.frames) > 1, nil
+}
+
+func decodeGIF(buf []byte) (*nativeCanvas, error) {
+	// the paletted frames alone take a byte per pixel
+	cfg, err := gif.DecodeConfig(bytes.NewReader(buf))
+	if err != nil {
+		return nil, err
+	}
+	if err := checkAnimationSize(cfg.Width, cfg.Height, 1); err != nil {
+		return nil, err
+	}
+
+	g, err := gif.DecodeAll(bytes.NewReader(buf))
+	if err != nil {
+		return nil, err
+	}
+
+	bounds := image.Rect(0, 0, g.Config.Width, g.Config.Height)
+	if bounds.Empty() {
+		for _, p := range g.Image {
+			bounds = bounds.Union(p.Bounds())
+		}
+	}
+	if err := checkAnimationSize(bounds.Dx(), bounds.Dy(), len(g.Image)); err != nil {
+		return nil, err
+	}
+
+	dst := image.NewNRGBA(bounds)
+	frames := make([]frame, 0, len(g.Image))
+
+	for i, p := range g.Image {
+		var disposal byte
+		if i < len(g.Disposal) {
+			disposal = g.Disposal[i]
+		}
+
+		var previous *image.NRGBA
+		if disposal == gif.DisposalPrevious {
+			previous = cloneNRGBA(dst)
+		}
+
+		draw.Draw(dst, p.Bounds(), p, p.Bounds().Min, draw.Over)
+		frames = append(frames, frame{img: cloneNRGBA(dst), delay: g.Delay[i] * 10})
+
+		switch disposal {
+		case gif.DisposalBackground:
+			draw.Draw(dst, p.Bounds(), image.Transparent, image.Point{}, draw.Src)
+		case gif.DisposalPrevious:
+			dst = previous
+		}
+	}
+
+	// GIF counts repeats after the first play and uses -1 for "play once"
+	loop := g.LoopCount
+	switch {
+	case loop < 0:
+		loop = 1
+	case loop > 0:
+		loop++
+	}
+
+	return &nativeCanvas{frames: frames, loop: loop, format: "gif"}, nil
+}
+
+func encodeAnimatedGIF(w io.Writer, frames []frame, loop int) error {
+	// reserve the last palette entry for transparency
+	pal := append(color.Palette{}, palette.Plan9[:255]...)
+	pal = append(pal, color.Transparent)
+
+	g := &gif.GIF{}
+	switch {
+	case loop == 1:
+		g.LoopCount = -1
+	case loop > 1:
+		g.LoopCount = loop - 1
+	}
+
+	for _, f := range frames {
+		b := f.img.Bounds()
+		p := image.NewPaletted(image.Rect(0, 0, b.Dx(), b.Dy()), pal)
+		draw.FloydSteinberg.Draw(p, p.Bounds(), f.img, b.Min)
+
+		g.Image = append(g.Image, p)
+		g.Delay = append(g.Delay, (f.delay+5)/10)
+		g.Disposal = append(g.Disposal, gif.DisposalBackground)
+	}
+
+	return gif.EncodeAll(w, g)
+}
+
+// WebP container layout, see
+// https://developers.google.com/speed/webp/docs/riff_container
+const (
+	webpFlagAlpha     = 0x10
+	webpFlagAnimation = 0x02
+	webpFrameNoBlend  = 0x02
+	webpFrameDispose  = 0x01
+)
+
+type riffChunk struct {
+	id   string
+	data []byte
+}
+
+func readChunks(buf []byte) ([]riffChunk, error) {
+	var chunks []riffChunk
+	for len(buf) > 0 {
+		if len(buf) < 8 {
+			return nil, errBadWebP
+		}
+
+		size := int(binary.LittleEndian.Uint32(buf[4:8]))
+		if size > len(buf)-8 {
+			return nil, errBadWebP
+		}
+
+		chunks = append(chunks, riffChunk{id: string(buf[:4]), data: buf[8 : 8+size]})
+
+		next := 8 + size + size&1 //chunks are padded to an even size
+		buf = buf[min(next, len(buf)):]
+	}
+
+	return chunks, nil
+}
+
+func webpChunks(buf []byte) ([]riffChunk, error) {
+	if len(buf) < 12 || string(buf[:4]) != "RIFF" || string(buf[8:12]) != "WEBP" {
+		return nil, errBadWebP
+	}
+
+	return readChunks(buf[12:])
+}
+
+func writeChunk(w *bytes.Buffer, id string, data []byte) {
+	w.WriteString(id)
+	binary.Write(w, binary.LittleEndian, uint32(len(data)))
+	w.Write(data)
+	if len(data)&1 == 1 {
+		w.WriteByte(0)
+	}
+}
+
+func putUint24(b []byte, v int) {
+	b[0], b[1], b[2] = byte(v), byte(v>>8), byte(v>>16)
+}
+
+func uint24(b []byte) int {
+	return int(b[0]) | int(b[1])<<8 | int(b[2])<<16
+}
+
+func isAnimatedWebP(buf []byte) bool {
+	// the VP8X chunk, when present, always comes first
+	return len(buf) >= 21 && string(buf[12:16]) == "VP8X" && buf[20]&webpFlagAnimation != 0
+}
+
+func decodeAnimatedWebP(buf []byte) (*nativeCanvas, error) {
+	chunks, err := webpChunks(buf)
+	if err != nil {
+		return nil, err
+	}
+
+	var count int
+	for _, chunk := range chunks {
+		if chunk.id == "ANMF" {
+			count++
+		}
+	}
+
+	var (
+		dst    *image.NRGBA
+		loop   int
+		frames []frame
+	)
+
+	for _, chunk := range chunks {
+		switch chunk.id {
+		case "VP8X":
+			if len(chunk.data) < 10 {
+				return nil, errBadWebP
+			}
+			width, height := uint24(chunk.data[4:])+1, uint24(chunk.data[7:])+1
+			if err := checkAnimationSize(width, height, max(count, 1)); err != nil {
+				return nil, err
+			}
+			dst = image.NewNRGBA(image.Rect(0, 0, width, height))
+		case "ANIM":
+			if len(chunk.data) < 6 {
+				return nil, errBadWebP
+			}
+			loop = int(binary.LittleEndian.Uint16(chunk.data[4:6]))
+		case "ANMF":
+			if dst == nil || len(chunk.data) < 16 {
+				return nil, errBadWebP
+			}
+
+			d := chunk.data
+			x, y := uint24(d[0:])*2, uint24(d[3:])*2
+			w, h := uint24(d[6:])+1, uint24(d[9:])+1
+			delay, flags := uint24(d[12:]), d[15]
+
+			img, err := decodeWebPFrame(d[16:], w, h)
+			if err != nil {
+				return nil, fmt.Errorf("webp frame %d: %w", len(frames), err)
+			}
+
+			r := image.Rect(x, y, x+w, y+h)
+			op := draw.Over
+			if flags&webpFrameNoBlend != 0 {
+				op = draw.Src
+			}
+			draw.Draw(dst, r, img, img.Bounds().Min, op)
+
+			frames = append(frames, frame{img: cloneNRGBA(dst), delay: delay})
+
+			if flags&webpFrameDispose != 0 {
+				draw.Draw(dst, r, image.Transparent, image.Point{}, draw.Src)
+			}
+		}
+	}
+
+	if len(frames) == 0 {
+		return nil, errBadWebP
+	}
+
+	return &nativeCanvas{frames: frames, loop: loop, format: "webp"}, nil
+}
+
+// decodeWebPFrame wraps the bitstream chunks of an animation frame in a
+// standalone container and decodes it.
+func decodeWebPFrame(data []byte, w, h int) (image.Image, error) {
+	chunks, err := readChunks(data)
+	if err != nil {
+		return nil, err
+	}
+
+	var body bytes.Buffer
+	for _, chunk := range chunks {
+		if chunk.id == "ALPH" {
+			vp8x := make([]byte, 10)
+			vp8x[0] = webpFlagAlpha
+			putUint24(vp8x[4:], w-1)
+			putUint24(vp8x[7:], h-1)
+			writeChunk(&body, "VP8X", vp8x)
+			break
+		}
+	}
+	for _, chunk := range chunks {
+		switch chunk.id {
+		case "ALPH", "VP8 ", "VP8L":
+			writeChunk(&body, chunk.id, chunk.data)
+		}
+	}
+
+	return webp.Decode(bytes.NewReader(riffWebP(body.Bytes())))
+}
+
+func riffWebP(body []byte) []byte {
+	var out bytes.Buffer
+	out.WriteString("RIFF")
+	binary.Write(&out, binary.LittleEndian, uint32(4+len(body)))
+	out.WriteString("WEBP")
+	out.Write(body)
+
+	return out.Bytes()
+}
+
+// encodeAnimatedWebP encodes every frame as a still WebP and muxes the
+// resulting bitstreams into an animation.
+func encodeAnimatedWebP(w io.Writer, frames []frame, loop int, opts EncodeOptions) error {
+	size := frames[0].img.Bounds().Size()
+
+	var body bytes.Buffer
+
+	vp8x := make([]byte, 10)
+	vp8x[0] = webpFlagAnimation | webpFlagAlpha
+	putUint24(vp8x[4:], size.X-1)
+	putUint24(vp8x[7:], size.Y-1)
+	writeChunk(&body, "VP8X", vp8x)
+
+	anim := make([]byte, 6)
+	binary.LittleEndian.PutUint16(anim[4:], uint16(min(loop, 0xffff)))
+	writeChunk(&body, "ANIM", anim)
+
+	for i, f := range frames {
+		var still bytes.Buffer
+		if err := encodeWebP(&still, f.img, opts); err != nil {
+			return err
+		}
+
+		chunks, err := webpChunks(still.Bytes())
+		if err != nil {
+			return fmt.Errorf("webp frame %d: %w", i, err)
+		}
+
+		b := f.img.Bounds()
+		anmf := make([]byte, 16)
+		putUint24(anmf[6:], b.Dx()-1)
+		putUint24(anmf[9:], b.Dy()-1)
+		putUint24(anmf[12:], min(f.delay, 0xffffff))
+		anmf[15] = webpFrameNoBlend
+
+		var data bytes.Buffer
+		data.Write(anmf)
+		for _, chunk := range chunks {
+			switch chunk.id {
+			case "ALPH", "VP8 ", "VP8L":
+				writeChunk(&data, chunk.id, chunk.data)
+			}
+		}
+		writeChunk(&body, "ANMF", data.Bytes())
+	}
+
+	_, err := w.Write(riffWebP(body.Bytes()))
+	return err
+}
+
+func cloneNRGBA(src *image.NRGBA) *image.NRGBA {
+	dst := image.NewNRGBA(src.Bounds())
+	copy(dst.Pix, src.Pix)
+
+	return dst
+}
@@ -0,0 +1,76 @@
+package processor
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"sort"
+)
+
+// Backend names accepted by NewBackend.
+const (
+	BackendVips   = "vips"
+	BackendNative = "native"
+)
+
+// DefaultBackend is libvips when the binary was built with it, otherwise the
+// pure-Go backend.
+var DefaultBackend = BackendNative
+
+// Backend decodes images into canvases that pipeline operations work on.
+type Backend interface {
+	Name() string
+	Encodes(format string) bool //whether canvases can be encoded to the format
+	Decode(buf []byte) (Canvas, error)
+}
+
+// Canvas is a decoded image. Operations modify it in place and Encode writes
+// the result once at the end of the pipeline. Animated images keep all their
+// frames and every operation applies to each of them.
+type Canvas interface {
+	Size() image.Point
+	Format() string //format of the source image
+	Frames() int    //1 for still images
+	Resize(width, height int) error
+	Extract(r image.Rectangle) error
+	Embed(width, height int, background color.NRGBA) error
+	Rotate(angle int) error                                   //clockwise, multiple of 90
+	Flip() error                                              //about the X axis
+	Mirror() error                                            //about the Y axis
+	Image() (image.Image, error)                              //first frame
+	Each(fn func(image.Image) (image.Image, error)) error     //replaces every frame with fn(frame)
+	KeepFrame(n int) error                                    //drops all frames but the nth, 0-based
+	Encode(format string, opts EncodeOptions) ([]byte, error) //"" keeps the source format
+	Clone() Canvas                                            //independent copy, to derive several results from one decode
+}
+
+// checkEncodes rejects a format the backend cannot write before any work is
+// done on its behalf.
+func checkEncodes(backend Backend, format string) error {
+	if !backend.Encodes(format) {
+		return fmt.Errorf("%w: the %s backend cannot encode %s", ErrUnsupportedFormat, backend.Name(), format)
+	}
+
+	return nil
+}
+
+var backends = map[string]func() Backend{
+	BackendNative: func() Backend { return NativeBackend{} },
+}
+
+// NewBackend returns the named backend, or an error if it was not compiled
+// into this binary (libvips needs cgo and is left out with -tags novips).
+func NewBackend(name string) (Backend, error) {
+	newBackend, ok := backends[name]
+	if !ok {
+		available := make([]string, 0, len(backends))
+		for name := range backends {
+			available = append(available, name)
+		}
+		sort.Strings(available)
+
+		return nil, fmt.Errorf("processor backend %q is not available (have %v)", name, available)
+	}
+
+	return newBackend(), nil
+}
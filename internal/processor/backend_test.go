@@ -0,0 +1,395 @@
+package processor
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"image/png"
+	"sort"
+	"testing"
+)
+
+var (
+	red   = color.NRGBA{R: 0xff, A: 0xff}
+	green = color.NRGBA{G: 0xff, A: 0xff}
+	blue  = color.NRGBA{B: 0xff, A: 0xff}
+	white = color.NRGBA{R: 0xff, G: 0xff, B: 0xff, A: 0xff}
+	black = color.NRGBA{A: 0xff}
+)
+
+// testBackends returns every backend compiled into the test binary, so the
+// same cases run against libvips when it is available.
+func testBackends(t *testing.T) []Backend {
+	t.Helper()
+
+	names := make([]string, 0, len(backends))
+	for name := range backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var list []Backend
+	for _, name := range names {
+		b, err := NewBackend(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		list = append(list, b)
+	}
+
+	return list
+}
+
+// quadrantsPNG returns a w x h PNG with red, green, blue and white quadrants,
+// from the top left in reading order, so any turn or flip shows in its corners.
+func quadrantsPNG(t *testing.T, w, h int) []byte {
+	t.Helper()
+
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			c := red
+			switch {
+			case x >= w/2 && y >= h/2:
+				c = white
+			case y >= h/2:
+				c = blue
+			case x >= w/2:
+				c = green
+			}
+			img.SetNRGBA(x, y, c)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
+
+// decodeResult decodes output with the native backend, which reads every
+// format the backends write.
+func decodeResult(t *testing.T, buf []byte) image.Image {
+	t.Helper()
+
+	c, err := NativeBackend{}.Decode(buf)
+	if err != nil {
+		t.Fatalf("decoding result: %v", err)
+	}
+	img, err := c.Image()
+	if err != nil {
+		t.Fatalf("decoding result: %v", err)
+	}
+
+	return img
+}
+
+// near reports whether every channel of a is within tolerance of b.
+func near(a color.Color, b color.NRGBA, tolerance int) bool {
+	n := color.NRGBAModel.Convert(a).(color.NRGBA)
+	for _, d := range []int{int(n.R) - int(b.R), int(n.G) - int(b.G), int(n.B) - int(b.B), int(n.A) - int(b.A)} {
+		if d < -tolerance || d > tolerance {
+			return false
+		}
+	}
+
+	return true
+}
+
+// meanDiff is the mean absolute difference per channel of two images of the
+// same size.
+func meanDiff(a, b image.Image) float64 {
+	var sum, n float64
+	bounds := a.Bounds()
+	for y := 0; y < bounds.Dy(); y++ {
+		for x := 0; x < bounds.Dx(); x++ {
+			ca := color.NRGBAModel.Convert(a.At(bounds.Min.X+x, bounds.Min.Y+y)).(color.NRGBA)
+			cb := color.NRGBAModel.Convert(b.At(b.Bounds().Min.X+x, b.Bounds().Min.Y+y)).(color.NRGBA)
+			for _, d := range []int{int(ca.R) - int(cb.R), int(ca.G) - int(cb.G), int(ca.B) - int(cb.B), int(ca.A) - int(cb.A)} {
+				sum += float64(max(d, -d))
+				n++
+			}
+		}
+	}
+
+	return sum / n
+}
+
+func intPtr(v int) *int {
+	return &v
+}
+
+// TestBackendParity runs the core operations on every backend against a
+// 64x48 image and checks the size, format and orientation of each result.
+// With more than one backend compiled in, their results must also agree.
+func TestBackendParity(t *testing.T) {
+	src := quadrantsPNG(t, 64, 48)
+
+	tests := []struct {
+		name       string
+		ops        []Operation
+		wantSize   image.Point
+		wantFormat string
+		corners    []color.NRGBA //top left, top right, bottom left, bottom right
+	}{
+		{
+			name:       "resize width",
+			ops:        []Operation{{Op: OpResize, Width: 32}},
+			wantSize:   image.Pt(32, 24),
+			wantFormat: "png",
+			corners:    []color.NRGBA{red, green, blue, white},
+		},
+		{
+			name:       "resize percent",
+			ops:        []Operation{{Op: OpResize, Percent: 200}},
+			wantSize:   image.Pt(128, 96),
+			wantFormat: "png",
+			corners:    []color.NRGBA{red, green, blue, white},
+		},
+		{
+			name:       "resize fill",
+			ops:        []Operation{{Op: OpResize, Width: 20, Height: 40}},
+			wantSize:   image.Pt(20, 40),
+			wantFormat: "png",
+			corners:    []color.NRGBA{red, green, blue, white},
+		},
+		{
+			name:       "resize cover",
+			ops:        []Operation{{Op: OpResize, Width: 32, Height: 32, Fit: FitCover}},
+			wantSize:   image.Pt(32, 32),
+			wantFormat: "png",
+			corners:    []color.NRGBA{red, green, blue, white},
+		},
+		{
+			name:       "resize contain letterboxes",
+			ops:        []Operation{{Op: OpResize, Width: 32, Height: 40, Fit: FitContain}},
+			wantSize:   image.Pt(32, 40),
+			wantFormat: "png",
+			corners:    []color.NRGBA{black, black, black, black},
+		},
+		{
+			name:       "resize inside",
+			ops:        []Operation{{Op: OpResize, Width: 32, Height: 32, Fit: FitInside}},
+			wantSize:   image.Pt(32, 24),
+			wantFormat: "png",
+			corners:    []color.NRGBA{red, green, blue, white},
+		},
+		{
+			name:       "resize without enlargement",
+			ops:        []Operation{{Op: OpResize, Width: 200, WithoutEnlargement: true}},
+			wantSize:   image.Pt(64, 48),
+			wantFormat: "png",
+			corners:    []color.NRGBA{red, green, blue, white},
+		},
+		{
+			name:       "crop at the origin",
+			ops:        []Operation{{Op: OpCrop, Width: 32, Height: 24, X: intPtr(0), Y: intPtr(0)}},
+			wantSize:   image.Pt(32, 24),
+			wantFormat: "png",
+			corners:    []color.NRGBA{red, red, red, red},
+		},
+		{
+			name:       "crop at an offset",
+			ops:        []Operation{{Op: OpCrop, Width: 32, Height: 24, X: intPtr(32), Y: intPtr(24)}},
+			wantSize:   image.Pt(32, 24),
+			wantFormat: "png",
+			corners:    []color.NRGBA{white, white, white, white},
+		},
+		{
+			name:       "crop centre",
+			ops:        []Operation{{Op: OpCrop, Width: 16, Height: 16}},
+			wantSize:   image.Pt(16, 16),
+			wantFormat: "png",
+			corners:    []color.NRGBA{red, green, blue, white},
+		},
+		{
+			name:       "crop gravity",
+			ops:        []Operation{{Op: OpCrop, Width: 16, Height: 16, Gravity: GravitySouthEast}},
+			wantSize:   image.Pt(16, 16),
+			wantFormat: "png",
+			corners:    []color.NRGBA{white, white, white, white},
+		},
+		{
+			name:       "crop aspect ratio",
+			ops:        []Operation{{Op: OpCrop, AspectRatio: "1:1"}},
+			wantSize:   image.Pt(48, 48),
+			wantFormat: "png",
+			corners:    []color.NRGBA{red, green, blue, white},
+		},
+		{
+			name:       "rotate 90",
+			ops:        []Operation{{Op: OpRotate, Angle: 90}},
+			wantSize:   image.Pt(48, 64),
+			wantFormat: "png",
+			corners:    []color.NRGBA{blue, red, white, green},
+		},
+		{
+			name:       "rotate 180",
+			ops:        []Operation{{Op: OpRotate, Angle: 180}},
+			wantSize:   image.Pt(64, 48),
+			wantFormat: "png",
+			corners:    []color.NRGBA{white, blue, green, red},
+		},
+		{
+			name:       "rotate 270",
+			ops:        []Operation{{Op: OpRotate, Angle: 270}},
+			wantSize:   image.Pt(48, 64),
+			wantFormat: "png",
+			corners:    []color.NRGBA{green, white, red, blue},
+		},
+		{
+			name:       "rotate -90",
+			ops:        []Operation{{Op: OpRotate, Angle: -90}},
+			wantSize:   image.Pt(48, 64),
+			wantFormat: "png",
+			corners:    []color.NRGBA{green, white, red, blue},
+		},
+		{
+			name:       "flip",
+			ops:        []Operation{{Op: OpFlip}},
+			wantSize:   image.Pt(64, 48),
+			wantFormat: "png",
+			corners:    []color.NRGBA{blue, white, red, green},
+		},
+		{
+			name:       "mirror",
+			ops:        []Operation{{Op: OpMirror}},
+			wantSize:   image.Pt(64, 48),
+			wantFormat: "png",
+			corners:    []color.NRGBA{green, red, white, blue},
+		},
+		{
+			name:       "convert jpeg",
+			ops:        []Operation{{Op: OpConvert, Format: "jpeg", Quality: 90}},
+			wantSize:   image.Pt(64, 48),
+			wantFormat: "jpeg",
+			corners:    []color.NRGBA{red, green, blue, white},
+		},
+		{
+			name:       "convert gif",
+			ops:        []Operation{{Op: OpConvert, Format: "gif"}},
+			wantSize:   image.Pt(64, 48),
+			wantFormat: "gif",
+			corners:    []color.NRGBA{red, green, blue, white},
+		},
+		{
+			name:       "convert tiff",
+			ops:        []Operation{{Op: OpConvert, Format: "tif"}},
+			wantSize:   image.Pt(64, 48),
+			wantFormat: "tiff",
+			corners:    []color.NRGBA{red, green, blue, white},
+		},
+		{
+			name: "pipeline",
+			ops: []Operation{
+				{Op: OpCrop, Width: 32, Height: 48, X: intPtr(0), Y: intPtr(0)},
+				{Op: OpRotate, Angle: 90},
+				{Op: OpResize, Width: 24},
+				{Op: OpConvert, Format: "jpeg"},
+			},
+			wantSize:   image.Pt(24, 16),
+			wantFormat: "jpeg",
+			corners:    []color.NRGBA{blue, red, blue, red},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var (
+				first     image.Image
+				firstName string
+			)
+			for _, backend := range testBackends(t) {
+				out, err := NewPipelineProcessor(backend, src, tt.ops, DefaultOptions(), nil).Transformer.Process()
+				if err != nil {
+					t.Fatalf("%s: %v", backend.Name(), err)
+				}
+
+				if got := DetectFormat(out); got != tt.wantFormat {
+					t.Errorf("%s: format = %s, want %s", backend.Name(), got, tt.wantFormat)
+				}
+
+				img := decodeResult(t, out)
+				b := img.Bounds()
+				if got := b.Size(); got != tt.wantSize {
+					t.Fatalf("%s: size = %v, want %v", backend.Name(), got, tt.wantSize)
+				}
+
+				// sampled away from the edges, which resampling blends
+				inset := 3
+				points := []image.Point{
+					{b.Min.X + inset, b.Min.Y + inset},
+					{b.Max.X - 1 - inset, b.Min.Y + inset},
+					{b.Min.X + inset, b.Max.Y - 1 - inset},
+					{b.Max.X - 1 - inset, b.Max.Y - 1 - inset},
+				}
+				for i, p := range points {
+					if got := img.At(p.X, p.Y); !near(got, tt.corners[i], 48) {
+						t.Errorf("%s: pixel at %v = %v, want %v", backend.Name(), p, got, tt.corners[i])
+					}
+				}
+
+				if first == nil {
+					first, firstName = img, backend.Name()
+					continue
+				}
+				if d := meanDiff(first, img); d > 12 {
+					t.Errorf("%s and %s differ by %.1f per channel on average", firstName, backend.Name(), d)
+				}
+			}
+		})
+	}
+}
+
+func TestBackendOutputLimits(t *testing.T) {
+	src := quadrantsPNG(t, 64, 48)
+
+	tests := []struct {
+		name string
+		op   Operation
+	}{
+		{"height scales width past the maximum", Operation{Op: OpResize, Height: MaxDimension}},
+		{"cover of an odd box", Operation{Op: OpResize, Width: 1, Height: MaxDimension, Fit: FitCover}},
+		{"crop larger than the image", Operation{Op: OpCrop, Width: 65, Height: 48}},
+		{"crop past the edge", Operation{Op: OpCrop, Width: 32, Height: 24, X: intPtr(40), Y: intPtr(0)}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, backend := range testBackends(t) {
+				_, err := NewPipelineProcessor(backend, src, []Operation{tt.op}, DefaultOptions(), nil).Transformer.Process()
+				if !errors.Is(err, ErrInvalidParam) {
+					t.Errorf("%s: expected ErrInvalidParam, got %v", backend.Name(), err)
+				}
+			}
+		})
+	}
+}
+
+// TestBackendEncodes checks that a backend claims exactly the formats its
+// canvases can be encoded to.
+func TestBackendEncodes(t *testing.T) {
+	src := quadrantsPNG(t, 16, 16)
+
+	for _, backend := range testBackends(t) {
+		for _, f := range formats {
+			t.Run(backend.Name()+"/"+f.Name, func(t *testing.T) {
+				c, err := backend.Decode(src)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				_, err = c.Encode(f.Name, EncodeOptions{})
+				if err != nil && !errors.Is(err, ErrUnsupportedFormat) {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if got, want := backend.Encodes(f.Name), err == nil; got != want {
+					t.Fatalf("Encodes(%q) = %v, but Encode returned %v", f.Name, got, err)
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,260 @@
+package processor
+
+import (
+	"fmt"
+	"image"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/disintegration/gift"
+)
+
+// Smart crop strategies, accepted in place of a gravity.
+const (
+	GravityAttention = "attention"
+	GravityEntropy   = "entropy"
+)
+
+const (
+	smartCropAnalysisSize = 256 //longest side of the copy the smart crop inspects
+	smartCropSteps        = 16  //candidate positions per axis
+)
+
+func validateCrop(op Operation) error {
+	if op.AspectRatio != "" {
+		if op.Width != 0 || op.Height != 0 {
+			return fmt.Errorf("%w: aspect_ratio cannot be combined with width and height", ErrInvalidParam)
+		}
+		if _, _, err := parseAspectRatio(op.AspectRatio); err != nil {
+			return err
+		}
+	} else if op.Width <= 0 || op.Height <= 0 {
+		return fmt.Errorf("%w: width and height must be positive", ErrInvalidParam)
+	}
+
+	origin, placed := op.cropOrigin()
+	if origin.X < 0 || origin.Y < 0 {
+		return fmt.Errorf("%w: x and y must not be negative", ErrInvalidParam)
+	}
+
+	if placed && op.Gravity != "" {
+		return fmt.Errorf("%w: x and y cannot be combined with gravity", ErrInvalidParam)
+	}
+
+	if !validGravity(op.Gravity) && !isSmartGravity(op.Gravity) {
+		return fmt.Errorf("%w: unknown gravity %q", ErrInvalidParam, op.Gravity)
+	}
+
+	return nil
+}
+
+// crop cuts a region out of the canvas. The region is Width x Height, or the
+// largest box with the given AspectRatio, placed at X/Y when either is given,
+// otherwise by Gravity (centre by default) or by a smart crop strategy. The
+// region must fit inside the source image.
+func crop(c Canvas, op Operation) error {
+	bounds := image.Rectangle{Max: c.Size()}
+
+	r, err := cropRect(op, bounds, c.Image)
+	if err != nil {
+		return err
+	}
+
+	if r == bounds {
+		return nil
+	}
+
+	return c.Extract(r)
+}
+
+// cropRect resolves op to a rectangle inside bounds. decode is only called
+// for smart crops, which need the pixels.
+func cropRect(op Operation, bounds image.Rectangle, decode func() (image.Image, error)) (image.Rectangle, error) {
+	w, h := op.Width, op.Height
+	if op.AspectRatio != "" {
+		rw, rh, err := parseAspectRatio(op.AspectRatio)
+		if err != nil {
+			return image.Rectangle{}, err
+		}
+
+		if bounds.Dx()*rh >= bounds.Dy()*rw {
+			w, h = bounds.Dy()*rw/rh, bounds.Dy()
+		} else {
+			w, h = bounds.Dx(), bounds.Dx()*rh/rw
+		}
+
+		if w < 1 || h < 1 {
+			return image.Rectangle{}, fmt.Errorf("%w: aspect ratio %s is too extreme for a %dx%d image", ErrInvalidParam, op.AspectRatio, bounds.Dx(), bounds.Dy())
+		}
+	}
+
+	var r image.Rectangle
+	switch origin, placed := op.cropOrigin(); {
+	case placed:
+		r = image.Rectangle{Min: origin, Max: origin.Add(image.Pt(w, h))}
+	case w > bounds.Dx() || h > bounds.Dy():
+		// reported below
+		r = image.Rect(0, 0, w, h)
+	case isSmartGravity(op.Gravity):
+		src, err := decode()
+		if err != nil {
+			return image.Rectangle{}, err
+		}
+		r = smartCrop(src, w, h, op.Gravity)
+	default:
+		pt := anchor(op.Gravity, bounds, w, h, 0)
+		r = image.Rectangle{Min: pt, Max: pt.Add(image.Pt(w, h))}
+	}
+
+	if !r.In(bounds) {
+		return image.Rectangle{}, fmt.Errorf("%w: crop %dx%d+%d+%d exceeds the %dx%d image", ErrInvalidParam, r.Dx(), r.Dy(), r.Min.X, r.Min.Y, bounds.Dx(), bounds.Dy())
+	}
+
+	return r, nil
+}
+
+// cropOrigin returns the top-left corner given by X and Y, and whether either
+// was given at all; 0 is a valid origin.
+func (op Operation) cropOrigin() (image.Point, bool) {
+	var pt image.Point
+	if op.X != nil {
+		pt.X = *op.X
+	}
+	if op.Y != nil {
+		pt.Y = *op.Y
+	}
+
+	return pt, op.X != nil || op.Y != nil
+}
+
+// parseAspectRatio parses ratios such as "16:9" or "1.91:1".
+func parseAspectRatio(s string) (int, int, error) {
+	a, b, ok := strings.Cut(s, ":")
+	if !ok {
+		return 0, 0, fmt.Errorf("%w: aspect ratio must look like 16:9, got %q", ErrInvalidParam, s)
+	}
+
+	x, errX := strconv.ParseFloat(a, 64)
+	y, errY := strconv.ParseFloat(b, 64)
+	if errX != nil || errY != nil || x <= 0 || y <= 0 || x/y > 100 || y/x > 100 {
+		return 0, 0, fmt.Errorf("%w: bad aspect ratio %q", ErrInvalidParam, s)
+	}
+
+	// scale fractional ratios to integers so box sizes stay exact
+	return int(math.Round(x * 100)), int(math.Round(y * 100)), nil
+}
+
+func isSmartGravity(g string) bool {
+	return g == GravityAttention || g == GravityEntropy
+}
+
+// smartCrop picks the w x h window of src with the highest score. Candidates
+// are evaluated on a downscaled copy: "entropy" prefers the window with the
+// most varied luminance, "attention" the one with the most edges, saturated
+// colour and skin tones.
+func smartCrop(src image.Image, w, h int, strategy string) image.Rectangle {
+	b := src.Bounds()
+
+	scale := min(1, float64(smartCropAnalysisSize)/float64(max(b.Dx(), b.Dy())))
+	aw := max(1, int(float64(b.Dx())*scale))
+	ah := max(1, int(float64(b.Dy())*scale))
+
+	g := gift.New(gift.Resize(aw, ah, gift.LinearResampling))
+	small := image.NewNRGBA(g.Bounds(b))
+	g.Draw(small, src)
+
+	cw := min(aw, max(1, int(float64(w)*scale)))
+	ch := min(ah, max(1, int(float64(h)*scale)))
+
+	var score func(r image.Rectangle) float64
+	if strategy == GravityEntropy {
+		score = entropyScore(small)
+	} else {
+		score = attentionScore(small)
+	}
+
+	stepX := max(1, (aw-cw)/smartCropSteps)
+	stepY := max(1, (ah-ch)/smartCropSteps)
+
+	best, bestScore := image.Point{}, math.Inf(-1)
+	for y := 0; y <= ah-ch; y += stepY {
+		for x := 0; x <= aw-cw; x += stepX {
+			if s := score(image.Rect(x, y, x+cw, y+ch)); s > bestScore {
+				best, bestScore = image.Pt(x, y), s
+			}
+		}
+	}
+
+	x := min(int(float64(best.X)/scale), b.Dx()-w)
+	y := min(int(float64(best.Y)/scale), b.Dy()-h)
+
+	return image.Rect(x, y, x+w, y+h)
+}
+
+func luminance(img *image.NRGBA, x, y int) float64 {
+	c := img.NRGBAAt(x, y)
+	return (0.299*float64(c.R) + 0.587*float64(c.G) + 0.114*float64(c.B)) / 255
+}
+
+func entropyScore(img *image.NRGBA) func(image.Rectangle) float64 {
+	const bins = 32
+
+	return func(r image.Rectangle) float64 {
+		var hist [bins]int
+		for y := r.Min.Y; y < r.Max.Y; y++ {
+			for x := r.Min.X; x < r.Max.X; x++ {
+				hist[min(bins-1, int(luminance(img, x, y)*bins))]++
+			}
+		}
+
+		total := float64(r.Dx() * r.Dy())
+		var e float64
+		for _, n := range hist {
+			if n > 0 {
+				p := float64(n) / total
+				e -= p * math.Log2(p)
+			}
+		}
+
+		return e
+	}
+}
+
+func attentionScore(img *image.NRGBA) func(image.Rectangle) float64 {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+
+	// summed-area table of per-pixel saliency, so each window costs O(1)
+	sat := make([]float64, (w+1)*(h+1))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			l := luminance(img, x, y)
+			edge := 4 * l
+			edge -= luminance(img, max(x-1, 0), y) + luminance(img, min(x+1, w-1), y)
+			edge -= luminance(img, x, max(y-1, 0)) + luminance(img, x, min(y+1, h-1))
+
+			c := img.NRGBAAt(x, y)
+			hi := max(c.R, c.G, c.B)
+			lo := min(c.R, c.G, c.B)
+
+			var saturation float64
+			if hi > 0 {
+				saturation = float64(hi-lo) / float64(hi)
+			}
+
+			var skin float64
+			if c.R > 95 && c.G > 40 && c.B > 20 && c.R > c.G && c.R > c.B && hi-lo > 15 {
+				skin = 1
+			}
+
+			v := math.Abs(edge)*4 + saturation*0.5 + skin
+			sat[(y+1)*(w+1)+x+1] = v + sat[y*(w+1)+x+1] + sat[(y+1)*(w+1)+x] - sat[y*(w+1)+x]
+		}
+	}
+
+	return func(r image.Rectangle) float64 {
+		at := func(x, y int) float64 { return sat[y*(w+1)+x] }
+		return at(r.Max.X, r.Max.Y) - at(r.Min.X, r.Max.Y) - at(r.Max.X, r.Min.Y) + at(r.Min.X, r.Min.Y)
+	}
+}
@@ -0,0 +1,154 @@
+package processor
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+
+	"golang.org/x/image/tiff"
+)
+
+const defaultQuality = 75
+
+// Chroma subsampling modes for JPEG output.
+const (
+	Subsampling420 = "4:2:0"
+	Subsampling444 = "4:4:4"
+)
+
+// TIFF compression schemes.
+const (
+	TIFFCompressionNone    = "none"
+	TIFFCompressionDeflate = "deflate"
+)
+
+// EncodeOptions controls how the final image is written. Zero values select
+// the encoder defaults and options that do not apply to the output format are
+// ignored.
+type EncodeOptions struct {
+	Quality          int    //jpeg, webp, avif, heif: 1-100
+	Progressive      bool   //progressive jpeg, interlaced png and gif
+	Lossless         bool   //webp, avif, heif
+	CompressionLevel int    //png zlib level: 1 fastest to 9 smallest
+	Subsampling      string //jpeg chroma subsampling: 4:2:0 or 4:4:4
+	TIFFCompression  string //none or deflate
+	StripMetadata    bool   //set by the pipeline when the output must not carry the source metadata
+}
+
+// merge overrides the options set in o with those set in other, so later
+// convert steps refine earlier ones.
+func (o EncodeOptions) merge(other EncodeOptions) EncodeOptions {
+	if other.Quality > 0 {
+		o.Quality = other.Quality
+	}
+	if other.CompressionLevel > 0 {
+		o.CompressionLevel = other.CompressionLevel
+	}
+	if other.Subsampling != "" {
+		o.Subsampling = other.Subsampling
+	}
+	if other.TIFFCompression != "" {
+		o.TIFFCompression = other.TIFFCompression
+	}
+	o.Progressive = o.Progressive || other.Progressive
+	o.Lossless = o.Lossless || other.Lossless
+
+	return o
+}
+
+func (o EncodeOptions) quality() int {
+	if o.Quality == 0 {
+		return defaultQuality
+	}
+
+	return o.Quality
+}
+
+func (o EncodeOptions) validate() error {
+	if o.Quality < 0 || o.Quality > 100 {
+		return fmt.Errorf("%w: quality must be between 1 and 100", ErrInvalidParam)
+	}
+	if o.CompressionLevel < 0 || o.CompressionLevel > 9 {
+		return fmt.Errorf("%w: compression_level must be between 1 and 9", ErrInvalidParam)
+	}
+
+	switch o.Subsampling {
+	case "", Subsampling420, Subsampling444:
+	default:
+		return fmt.Errorf("%w: subsampling must be %s or %s", ErrInvalidParam, Subsampling420, Subsampling444)
+	}
+
+	switch o.TIFFCompression {
+	case "", TIFFCompressionNone, TIFFCompressionDeflate:
+	default:
+		return fmt.Errorf("%w: tiff_compression must be %s or %s", ErrInvalidParam, TIFFCompressionNone, TIFFCompressionDeflate)
+	}
+
+	return nil
+}
+
+// encodeImage writes img with the pure-Go encoders. Options the Go encoders
+// cannot honour are rejected rather than silently dropped.
+func encodeImage(img image.Image, format string, opts EncodeOptions) ([]byte, error) {
+	format = normalizeFormat(format)
+
+	if opts.Progressive && (format == "jpeg" || format == "png" || format == "gif") {
+		return nil, fmt.Errorf("%w: progressive %s output requires the %s backend", ErrInvalidParam, format, BackendVips)
+	}
+
+	bufWriter := new(bytes.Buffer)
+
+	switch format {
+	case "jpeg":
+		if opts.Subsampling == Subsampling444 {
+			return nil, fmt.Errorf("%w: the Go jpeg encoder always subsamples chroma to %s", ErrInvalidParam, Subsampling420)
+		}
+		if err := jpeg.Encode(bufWriter, img, &jpeg.Options{Quality: opts.quality()}); err != nil {
+			return nil, err
+		}
+	case "png":
+		enc := png.Encoder{CompressionLevel: pngCompressionLevel(opts.CompressionLevel)}
+		if err := enc.Encode(bufWriter, img); err != nil {
+			return nil, err
+		}
+	case "webp":
+		if err := encodeWebP(bufWriter, img, opts); err != nil {
+			return nil, err
+		}
+	case "tiff":
+		var tiffOpts *tiff.Options
+		if opts.TIFFCompression == TIFFCompressionDeflate {
+			tiffOpts = &tiff.Options{Compression: tiff.Deflate}
+		}
+		if err := tiff.Encode(bufWriter, img, tiffOpts); err != nil {
+			return nil, err
+		}
+	case "gif":
+		if err := gif.Encode(bufWriter, img, nil); err != nil {
+			return nil, err
+		}
+	case "avif", "heif":
+		return nil, fmt.Errorf("%w: %s encoding requires the %s backend", ErrUnsupportedFormat, format, BackendVips)
+	default:
+		return nil, ErrUnsupportedFormat
+	}
+
+	return bufWriter.Bytes(), nil
+}
+
+// pngCompressionLevel maps a zlib level onto the few presets image/png offers.
+func pngCompressionLevel(level int) png.CompressionLevel {
+	switch {
+	case level == 0:
+		return png.DefaultCompression
+	case level <= 3:
+		return png.BestSpeed
+	case level <= 6:
+		return png.DefaultCompression
+	}
+
+	return png.BestCompression
+}
@@ -0,0 +1,301 @@
+package processor
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"sort"
+)
+
+var errBadEXIF = errors.New("malformed exif data")
+
+// EXIF tags the service reads or filters on.
+const (
+	tagOrientation = 0x0112
+	tagMake        = 0x010f
+	tagModel       = 0x0110
+	tagArtist      = 0x013b
+	tagCopyright   = 0x8298
+	tagExifIFD     = 0x8769
+	tagGPSIFD      = 0x8825
+	tagInteropIFD  = 0xa005
+	tagPixelX      = 0xa002
+	tagPixelY      = 0xa003
+	tagBodySerial  = 0xa431
+	tagLensSpec    = 0xa432
+	tagLensMake    = 0xa433
+	tagLensModel   = 0xa434
+)
+
+// exifTypeSizes holds the byte size of each TIFF field type.
+var exifTypeSizes = [...]int{0, 1, 1, 2, 4, 8, 1, 1, 2, 4, 8, 4, 8}
+
+type exifEntry struct {
+	tag   uint16
+	typ   uint16
+	count uint32
+	value []byte //in the byte order of the source
+}
+
+// exifData is the subset of a TIFF-structured EXIF block the service keeps:
+// the primary image directory, the Exif sub-directory and the GPS directory.
+// Thumbnails and interoperability data are dropped.
+type exifData struct {
+	order binary.ByteOrder
+	ifd0  []exifEntry
+	exif  []exifEntry
+	gps   []exifEntry
+}
+
+func parseEXIF(buf []byte) (*exifData, error) {
+	if len(buf) < 8 {
+		return nil, errBadEXIF
+	}
+
+	e := &exifData{}
+	switch string(buf[:4]) {
+	case "II*\x00":
+		e.order = binary.LittleEndian
+	case "MM\x00*":
+		e.order = binary.BigEndian
+	default:
+		return nil, errBadEXIF
+	}
+
+	var err error
+	if e.ifd0, err = e.readIFD(buf, e.order.Uint32(buf[4:8])); err != nil {
+		return nil, err
+	}
+
+	for _, entry := range e.ifd0 {
+		switch entry.tag {
+		case tagExifIFD:
+			if e.exif, err = e.readIFD(buf, e.uint32(entry)); err != nil {
+				return nil, err
+			}
+		case tagGPSIFD:
+			if e.gps, err = e.readIFD(buf, e.uint32(entry)); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	e.ifd0 = filterEntries(e.ifd0, func(tag uint16) bool {
+		return tag != tagExifIFD && tag != tagGPSIFD && !isStructuralTag(tag)
+	})
+	e.exif = filterEntries(e.exif, func(tag uint16) bool {
+		// pixel dimensions go stale as soon as the image is resized
+		return tag != tagInteropIFD && tag != tagPixelX && tag != tagPixelY
+	})
+
+	return e, nil
+}
+
+// isStructuralTag reports tags describing how a TIFF file lays out its pixels,
+// which are meaningless once the EXIF block is attached to another image.
+func isStructuralTag(tag uint16) bool {
+	switch {
+	case tag >= 0x00fe && tag <= 0x0118 && tag != tagMake && tag != tagModel && tag != tagOrientation && tag != 0x010e:
+		return true
+	case tag >= 0x011c && tag <= 0x0153 && tag != 0x0131 && tag != 0x0132 && tag != tagArtist:
+		return true
+	case tag == 0x0201, tag == 0x0202, tag == 0x0211, tag == 0x0212, tag == 0x0213, tag == 0x0214:
+		return true
+	}
+
+	return false
+}
+
+func (e *exifData) readIFD(buf []byte, offset uint32) ([]exifEntry, error) {
+	off := int(offset)
+	if off < 8 || off+2 > len(buf) {
+		return nil, errBadEXIF
+	}
+
+	n := int(e.order.Uint16(buf[off:]))
+	if off+2+12*n > len(buf) {
+		return nil, errBadEXIF
+	}
+
+	entries := make([]exifEntry, 0, n)
+	for i := 0; i < n; i++ {
+		p := buf[off+2+12*i:]
+		entry := exifEntry{
+			tag:   e.order.Uint16(p[0:]),
+			typ:   e.order.Uint16(p[2:]),
+			count: e.order.Uint32(p[4:]),
+		}
+
+		if int(entry.typ) >= len(exifTypeSizes) || entry.typ == 0 {
+			continue //unknown types are skipped, as the spec asks
+		}
+
+		size := int(entry.count) * exifTypeSizes[entry.typ]
+		if size < 0 || entry.count > uint32(len(buf)) {
+			return nil, errBadEXIF
+		}
+
+		if size <= 4 {
+			entry.value = append([]byte(nil), p[8:8+size]...)
+		} else {
+			start := int(e.order.Uint32(p[8:]))
+			if start < 0 || start+size > len(buf) {
+				continue //dangling offsets are common in edited files
+			}
+			entry.value = append([]byte(nil), buf[start:start+size]...)
+		}
+
+		entries = append(entries, entry)
+	}
+
+	return entries, nil
+}
+
+func (e *exifData) uint32(entry exifEntry) uint32 {
+	switch {
+	case entry.typ == 4 && len(entry.value) >= 4:
+		return e.order.Uint32(entry.value)
+	case entry.typ == 3 && len(entry.value) >= 2:
+		return uint32(e.order.Uint16(entry.value))
+	}
+
+	return 0
+}
+
+func (e *exifData) find(entries []exifEntry, tag uint16) (exifEntry, bool) {
+	for _, entry := range entries {
+		if entry.tag == tag {
+			return entry, true
+		}
+	}
+
+	return exifEntry{}, false
+}
+
+// orientation returns the EXIF orientation (1-8), or 1 when it is missing.
+func (e *exifData) orientation() int {
+	entry, ok := e.find(e.ifd0, tagOrientation)
+	if !ok {
+		return 1
+	}
+
+	if o := int(e.uint32(entry)); o >= 1 && o <= 8 {
+		return o
+	}
+
+	return 1
+}
+
+// setOrientation overwrites the orientation tag if there is one.
+func (e *exifData) setOrientation(o int) {
+	for i, entry := range e.ifd0 {
+		if entry.tag == tagOrientation && entry.typ == 3 && len(entry.value) >= 2 {
+			value := make([]byte, 2)
+			e.order.PutUint16(value, uint16(o))
+			e.ifd0[i].value = value
+		}
+	}
+}
+
+func (e *exifData) empty() bool {
+	return len(e.ifd0) == 0 && len(e.exif) == 0 && len(e.gps) == 0
+}
+
+func filterEntries(entries []exifEntry, keep func(tag uint16) bool) []exifEntry {
+	var kept []exifEntry
+	for _, entry := range entries {
+		if keep(entry.tag) {
+			kept = append(kept, entry)
+		}
+	}
+
+	return kept
+}
+
+// encode writes the directories back out as a TIFF-structured EXIF block:
+// IFD0, then the Exif and GPS sub-directories, each followed by the values
+// that do not fit in their entries.
+func (e *exifData) encode() []byte {
+	ifd0 := append([]exifEntry(nil), e.ifd0...)
+	if len(e.exif) > 0 {
+		ifd0 = append(ifd0, exifEntry{tag: tagExifIFD, typ: 4, count: 1, value: make([]byte, 4)})
+	}
+	if len(e.gps) > 0 {
+		ifd0 = append(ifd0, exifEntry{tag: tagGPSIFD, typ: 4, count: 1, value: make([]byte, 4)})
+	}
+
+	exifOffset := 8 + ifdLen(ifd0)
+	gpsOffset := exifOffset
+	if len(e.exif) > 0 {
+		gpsOffset += ifdLen(e.exif)
+	}
+
+	for i := range ifd0 {
+		switch ifd0[i].tag {
+		case tagExifIFD:
+			e.order.PutUint32(ifd0[i].value, uint32(exifOffset))
+		case tagGPSIFD:
+			e.order.PutUint32(ifd0[i].value, uint32(gpsOffset))
+		}
+	}
+
+	var buf bytes.Buffer
+	if e.order == binary.LittleEndian {
+		buf.WriteString("II*\x00")
+	} else {
+		buf.WriteString("MM\x00*")
+	}
+	binary.Write(&buf, e.order, uint32(8))
+
+	e.writeIFD(&buf, ifd0)
+	if len(e.exif) > 0 {
+		e.writeIFD(&buf, e.exif)
+	}
+	if len(e.gps) > 0 {
+		e.writeIFD(&buf, e.gps)
+	}
+
+	return buf.Bytes()
+}
+
+// ifdLen is the size of a directory together with its out-of-line values.
+func ifdLen(entries []exifEntry) int {
+	n := 2 + 12*len(entries) + 4
+	for _, entry := range entries {
+		if len(entry.value) > 4 {
+			n += len(entry.value) + len(entry.value)&1
+		}
+	}
+
+	return n
+}
+
+func (e *exifData) writeIFD(buf *bytes.Buffer, entries []exifEntry) {
+	entries = append([]exifEntry(nil), entries...)
+	sort.Slice(entries, func(i, j int) bool { return entries[i].tag < entries[j].tag })
+
+	dataOffset := buf.Len() + 2 + 12*len(entries) + 4
+
+	var data bytes.Buffer
+	binary.Write(buf, e.order, uint16(len(entries)))
+	for _, entry := range entries {
+		binary.Write(buf, e.order, entry.tag)
+		binary.Write(buf, e.order, entry.typ)
+		binary.Write(buf, e.order, entry.count)
+
+		if len(entry.value) <= 4 {
+			field := make([]byte, 4)
+			copy(field, entry.value)
+			buf.Write(field)
+			continue
+		}
+
+		binary.Write(buf, e.order, uint32(dataOffset+data.Len()))
+		data.Write(entry.value)
+		if len(entry.value)&1 == 1 {
+			data.WriteByte(0)
+		}
+	}
+	binary.Write(buf, e.order, uint32(0)) //no next directory
+	buf.Write(data.Bytes())
+}
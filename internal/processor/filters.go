@@ -0,0 +1,159 @@
+package processor
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/disintegration/gift"
+)
+
+const (
+	defaultSepia     = 50
+	maxBlurSigma     = 100
+	maxSharpenSigma  = 50
+	maxSharpenAmount = 10
+	maxPixelSize     = 512
+	maxKernelWeight  = 1000
+)
+
+// filterOps lists the per-pixel adjustments. Consecutive filters share a
+// single pass over the image.
+var filterOps = []string{
+	OpGrayscale,
+	OpSepia,
+	OpGamma,
+	OpBlur,
+	OpBrightness,
+	OpContrast,
+	OpSaturation,
+	OpHue,
+	OpSharpen,
+	OpInvert,
+	OpColorize,
+	OpPixelate,
+	OpConvolve,
+}
+
+func isFilter(op string) bool {
+	for _, f := range filterOps {
+		if f == op {
+			return true
+		}
+	}
+
+	return false
+}
+
+// validateFilter checks the parameters of a filter against the ranges gift
+// accepts, rather than letting it clamp them silently.
+func validateFilter(op Operation) error {
+	switch op.Op {
+	case OpSepia:
+		return inRange("amount", op.Amount, 0, 100)
+	case OpGamma:
+		if op.Gamma <= 0 {
+			return fmt.Errorf("%w: gamma must be positive", ErrInvalidParam)
+		}
+	case OpBlur:
+		if op.Sigma <= 0 || op.Sigma > maxBlurSigma {
+			return fmt.Errorf("%w: sigma must be greater than 0 and at most %d", ErrInvalidParam, maxBlurSigma)
+		}
+	case OpBrightness, OpContrast:
+		return inRange("amount", op.Amount, -100, 100)
+	case OpSaturation:
+		return inRange("amount", op.Amount, -100, 500)
+	case OpHue:
+		return inRange("amount", op.Amount, -180, 180)
+	case OpSharpen:
+		if op.Sigma <= 0 || op.Sigma > maxSharpenSigma {
+			return fmt.Errorf("%w: sigma must be greater than 0 and at most %d", ErrInvalidParam, maxSharpenSigma)
+		}
+		if op.Amount <= 0 || op.Amount > maxSharpenAmount {
+			return fmt.Errorf("%w: amount must be greater than 0 and at most %d", ErrInvalidParam, maxSharpenAmount)
+		}
+		return inRange("threshold", op.Threshold, 0, 1)
+	case OpColorize:
+		if err := inRange("hue", op.Hue, 0, 360); err != nil {
+			return err
+		}
+		if err := inRange("saturation", op.Saturation, 0, 100); err != nil {
+			return err
+		}
+		if op.Amount <= 0 || op.Amount > 100 {
+			return fmt.Errorf("%w: amount must be greater than 0 and at most 100", ErrInvalidParam)
+		}
+	case OpPixelate:
+		if op.Size < 2 || op.Size > maxPixelSize {
+			return fmt.Errorf("%w: size must be between 2 and %d", ErrInvalidParam, maxPixelSize)
+		}
+	case OpConvolve:
+		return validateKernel(op.Kernel)
+	}
+
+	return nil
+}
+
+func inRange(name string, v, lo, hi float32) error {
+	if v < lo || v > hi || math.IsNaN(float64(v)) {
+		return fmt.Errorf("%w: %s must be between %g and %g", ErrInvalidParam, name, lo, hi)
+	}
+
+	return nil
+}
+
+// validateKernel accepts square 3x3 and 5x5 kernels in row-major order.
+func validateKernel(kernel []float32) error {
+	if len(kernel) != 9 && len(kernel) != 25 {
+		return fmt.Errorf("%w: kernel must have 9 (3x3) or 25 (5x5) weights, got %d", ErrInvalidParam, len(kernel))
+	}
+
+	var nonZero bool
+	for _, w := range kernel {
+		if err := inRange("kernel weights", w, -maxKernelWeight, maxKernelWeight); err != nil {
+			return err
+		}
+		nonZero = nonZero || w != 0
+	}
+	if !nonZero {
+		return fmt.Errorf("%w: kernel must have a non-zero weight", ErrInvalidParam)
+	}
+
+	return nil
+}
+
+func giftFilter(op Operation) gift.Filter {
+	switch op.Op {
+	case OpGrayscale:
+		return gift.Grayscale()
+	case OpSepia:
+		amount := op.Amount
+		if amount == 0 {
+			amount = defaultSepia
+		}
+		return gift.Sepia(amount)
+	case OpGamma:
+		return gift.Gamma(op.Gamma)
+	case OpBlur:
+		return gift.GaussianBlur(op.Sigma)
+	case OpBrightness:
+		return gift.Brightness(op.Amount)
+	case OpContrast:
+		return gift.Contrast(op.Amount)
+	case OpSaturation:
+		return gift.Saturation(op.Amount)
+	case OpHue:
+		return gift.Hue(op.Amount)
+	case OpSharpen:
+		return gift.UnsharpMask(op.Sigma, op.Amount, op.Threshold)
+	case OpInvert:
+		return gift.Invert()
+	case OpColorize:
+		return gift.Colorize(op.Hue, op.Saturation, op.Amount)
+	case OpPixelate:
+		return gift.Pixelate(op.Size)
+	case OpConvolve:
+		return gift.Convolution(op.Kernel, op.Normalize, false, false, 0)
+	}
+
+	return nil
+}
@@ -0,0 +1,115 @@
+package processor
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"strings"
+)
+
+var ErrUnsupportedFormat = errors.New("unsupported image format")
+
+// Format describes an image format the service can read and write. It is the
+// single source for format names, MIME types and file extensions.
+type Format struct {
+	Name         string //canonical name, as returned by DetectFormat
+	MIMEType     string
+	Extension    string   //preferred file extension, without the dot
+	Aliases      []string //other names accepted in requests and filenames
+	NativeDecode bool     //the pure-Go backend can decode it
+	NativeEncode bool     //the pure-Go backend can encode it; others need libvips
+}
+
+var formats = []Format{
+	{Name: "jpeg", MIMEType: "image/jpeg", Extension: "jpg", Aliases: []string{"jpg", "jpe"}, NativeDecode: true, NativeEncode: true},
+	{Name: "png", MIMEType: "image/png", Extension: "png", NativeDecode: true, NativeEncode: true},
+	{Name: "webp", MIMEType: "image/webp", Extension: "webp", NativeDecode: true, NativeEncode: nativeWebPEncoder},
+	{Name: "tiff", MIMEType: "image/tiff", Extension: "tiff", Aliases: []string{"tif"}, NativeDecode: true, NativeEncode: true},
+	{Name: "gif", MIMEType: "image/gif", Extension: "gif", NativeDecode: true, NativeEncode: true},
+	{Name: "avif", MIMEType: "image/avif", Extension: "avif"},
+	{Name: "heif", MIMEType: "image/heif", Extension: "heic", Aliases: []string{"heic", "hif"}},
+}
+
+// LookupFormat finds a format by name, alias or file extension (with or
+// without the leading dot), ignoring case.
+func LookupFormat(name string) (Format, bool) {
+	name = strings.ToLower(strings.TrimPrefix(name, "."))
+
+	for _, f := range formats {
+		if f.Name == name {
+			return f, true
+		}
+		for _, alias := range f.Aliases {
+			if alias == name {
+				return f, true
+			}
+		}
+	}
+
+	return Format{}, false
+}
+
+// MIMEType returns the MIME type of the named format, or "" if it is unknown.
+func MIMEType(name string) string {
+	f, _ := LookupFormat(name)
+	return f.MIMEType
+}
+
+// DetectFormat sniffs the image format from the leading bytes of buf and
+// returns "" when it is not recognised.
+func DetectFormat(buf []byte) string {
+	switch {
+	case bytes.HasPrefix(buf, []byte{0xff, 0xd8, 0xff}):
+		return "jpeg"
+	case bytes.HasPrefix(buf, []byte("\x89PNG\r\n\x1a\n")):
+		return "png"
+	case len(buf) >= 12 && bytes.Equal(buf[:4], []byte("RIFF")) && bytes.Equal(buf[8:12], []byte("WEBP")):
+		return "webp"
+	case bytes.HasPrefix(buf, []byte("II*\x00")), bytes.HasPrefix(buf, []byte("MM\x00*")):
+		return "tiff"
+	case bytes.HasPrefix(buf, []byte("GIF8")):
+		return "gif"
+	case len(buf) >= 12 && bytes.Equal(buf[4:8], []byte("ftyp")):
+		return detectISOBMFF(buf)
+	}
+
+	return ""
+}
+
+// detectISOBMFF tells AVIF from HEIF by the brands listed in the leading ftyp
+// box. AVIF files often carry the generic "mif1" major brand, so compatible
+// brands are checked too.
+func detectISOBMFF(buf []byte) string {
+	size := int(binary.BigEndian.Uint32(buf[:4]))
+	if size < 16 || size > len(buf) {
+		size = min(len(buf), 64)
+	}
+
+	var heif bool
+	for i := 8; i+4 <= size; i += 4 {
+		if i == 12 {
+			continue //minor version
+		}
+
+		switch string(buf[i : i+4]) {
+		case "avif", "avis":
+			return "avif"
+		case "heic", "heix", "hevc", "hevx", "heim", "heis", "mif1", "msf1":
+			heif = true
+		}
+	}
+
+	if heif {
+		return "heif"
+	}
+
+	return ""
+}
+
+func normalizeFormat(format string) string {
+	if f, ok := LookupFormat(format); ok {
+		return f.Name
+	}
+
+	return format
+}
@@ -0,0 +1,73 @@
+package processor
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"strconv"
+	"strings"
+)
+
+// Gravity names used to anchor crops and overlays.
+const (
+	GravityCentre    = "centre"
+	GravityNorth     = "north"
+	GravityNorthEast = "north-east"
+	GravityEast      = "east"
+	GravitySouthEast = "south-east"
+	GravitySouth     = "south"
+	GravitySouthWest = "south-west"
+	GravityWest      = "west"
+	GravityNorthWest = "north-west"
+)
+
+func validGravity(g string) bool {
+	switch g {
+	case "", "center", GravityCentre, GravityNorth, GravityNorthEast, GravityEast,
+		GravitySouthEast, GravitySouth, GravitySouthWest, GravityWest, GravityNorthWest:
+		return true
+	}
+
+	return false
+}
+
+// anchor returns the top-left corner of a w x h box placed inside bounds
+// according to gravity, keeping margin pixels away from the edges it touches.
+func anchor(gravity string, bounds image.Rectangle, w, h, margin int) image.Point {
+	x := bounds.Min.X + (bounds.Dx()-w)/2
+	y := bounds.Min.Y + (bounds.Dy()-h)/2
+
+	if strings.Contains(gravity, "west") {
+		x = bounds.Min.X + margin
+	}
+	if strings.Contains(gravity, "east") {
+		x = bounds.Max.X - w - margin
+	}
+	if strings.HasPrefix(gravity, "north") {
+		y = bounds.Min.Y + margin
+	}
+	if strings.HasPrefix(gravity, "south") {
+		y = bounds.Max.Y - h - margin
+	}
+
+	return image.Pt(x, y)
+}
+
+// parseColor parses "#rgb" or "#rrggbb" (leading "#" optional).
+func parseColor(s string) (color.NRGBA, error) {
+	s = strings.TrimPrefix(s, "#")
+	if len(s) == 3 {
+		s = string([]byte{s[0], s[0], s[1], s[1], s[2], s[2]})
+	}
+
+	if len(s) != 6 {
+		return color.NRGBA{}, fmt.Errorf("%w: bad colour %q", ErrInvalidParam, s)
+	}
+
+	v, err := strconv.ParseUint(s, 16, 32)
+	if err != nil {
+		return color.NRGBA{}, fmt.Errorf("%w: bad colour %q", ErrInvalidParam, s)
+	}
+
+	return color.NRGBA{R: uint8(v >> 16), G: uint8(v >> 8), B: uint8(v), A: 0xff}, nil
+}
@@ -0,0 +1,384 @@
+package processor
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/disintegration/gift"
+)
+
+// IIIFMaxDimension bounds the width and height of IIIF responses; "max"
+// sizes are scaled down to fit, also within MaxPixels.
+const IIIFMaxDimension = MaxDimension
+
+// IIIF Image API 3.0 qualities.
+const (
+	IIIFDefault = "default"
+	IIIFColor   = "color"
+	IIIFGray    = "gray"
+	IIIFBitonal = "bitonal"
+)
+
+// IIIFRequest is a parsed IIIF Image API 3.0 request:
+// {region}/{size}/{rotation}/{quality}.{format}. Region and size are resolved
+// against the image when it is rendered.
+type IIIFRequest struct {
+	region   string
+	size     string
+	upscale  bool //size prefixed with ^
+	Mirror   bool
+	Rotation float64 //clockwise degrees, after mirroring
+	Quality  string
+	Format   string
+}
+
+// ParseIIIF checks the syntax of the path parameters of a IIIF image request.
+func ParseIIIF(region, size, rotation, quality, format string) (IIIFRequest, error) {
+	req := IIIFRequest{region: region, Quality: quality}
+
+	if err := checkIIIFRegion(region); err != nil {
+		return req, err
+	}
+
+	req.size, req.upscale = strings.CutPrefix(size, "^")
+	if err := checkIIIFSize(req.size); err != nil {
+		return req, err
+	}
+
+	angle, mirror := strings.CutPrefix(rotation, "!")
+	n, err := strconv.ParseFloat(angle, 64)
+	if err != nil || n < 0 || n > 360 || angle != strings.TrimSpace(angle) {
+		return req, fmt.Errorf("%w: rotation must be a number of degrees between 0 and 360, optionally prefixed with !", ErrInvalidParam)
+	}
+	req.Mirror, req.Rotation = mirror, math.Mod(n, 360)
+
+	switch quality {
+	case IIIFDefault, IIIFColor, IIIFGray, IIIFBitonal:
+	default:
+		return req, fmt.Errorf("%w: unknown quality %q", ErrInvalidParam, quality)
+	}
+
+	f, ok := LookupFormat(format)
+	if !ok {
+		return req, fmt.Errorf("%w: %q", ErrUnsupportedFormat, format)
+	}
+	req.Format = f.Name
+
+	return req, nil
+}
+
+func checkIIIFRegion(region string) error {
+	if region == "full" || region == "square" {
+		return nil
+	}
+
+	values, pct := strings.CutPrefix(region, "pct:")
+	if _, err := parseIIIFNumbers(values, 4, pct); err != nil {
+		return fmt.Errorf("%w: region must be full, square, x,y,w,h or pct:x,y,w,h", ErrInvalidParam)
+	}
+
+	return nil
+}
+
+func checkIIIFSize(size string) error {
+	if size == "max" {
+		return nil
+	}
+
+	if n, ok := strings.CutPrefix(size, "pct:"); ok {
+		if _, err := parseIIIFNumbers(n, 1, true); err != nil {
+			return fmt.Errorf("%w: size percentage must be a number", ErrInvalidParam)
+		}
+		return nil
+	}
+
+	w, h, ok := strings.Cut(strings.TrimPrefix(size, "!"), ",")
+	if ok && (w != "" || h != "") && (w == "" || isIIIFInt(w)) && (h == "" || isIIIFInt(h)) &&
+		(!strings.HasPrefix(size, "!") || (w != "" && h != "")) {
+		return nil
+	}
+
+	return fmt.Errorf("%w: size must be max, w,, ,h, pct:n, w,h or !w,h, optionally prefixed with ^", ErrInvalidParam)
+}
+
+// parseIIIFNumbers parses n comma separated non-negative values, which must
+// be integers unless decimals are allowed.
+func parseIIIFNumbers(s string, n int, decimals bool) ([]float64, error) {
+	parts := strings.Split(s, ",")
+	if len(parts) != n {
+		return nil, fmt.Errorf("expected %d values", n)
+	}
+
+	values := make([]float64, n)
+	for i, p := range parts {
+		if !decimals && !isIIIFInt(p) {
+			return nil, fmt.Errorf("%q is not an integer", p)
+		}
+
+		v, err := strconv.ParseFloat(p, 64)
+		if err != nil || v < 0 || p != strings.TrimSpace(p) {
+			return nil, fmt.Errorf("%q is not a positive number", p)
+		}
+		values[i] = v
+	}
+
+	return values, nil
+}
+
+func isIIIFInt(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Region resolves the requested region within an image of the given size.
+// Regions reaching past the edges are cut to the image.
+func (req IIIFRequest) Region(size image.Point) (image.Rectangle, error) {
+	bounds := image.Rectangle{Max: size}
+
+	var r image.Rectangle
+	switch req.region {
+	case "full":
+		return bounds, nil
+	case "square":
+		side := min(size.X, size.Y)
+		pt := anchor(GravityCentre, bounds, side, side, 0)
+		return image.Rectangle{Min: pt, Max: pt.Add(image.Pt(side, side))}, nil
+	default:
+		values, pct := strings.CutPrefix(req.region, "pct:")
+		v, err := parseIIIFNumbers(values, 4, pct)
+		if err != nil {
+			return r, fmt.Errorf("%w: %v", ErrInvalidParam, err)
+		}
+
+		if pct {
+			sx, sy := float64(size.X)/100, float64(size.Y)/100
+			r = image.Rect(
+				int(math.Round(v[0]*sx)),
+				int(math.Round(v[1]*sy)),
+				int(math.Round((v[0]+v[2])*sx)),
+				int(math.Round((v[1]+v[3])*sy)),
+			)
+		} else {
+			r = image.Rect(int(v[0]), int(v[1]), int(v[0]+v[2]), int(v[1]+v[3]))
+		}
+	}
+
+	r = r.Intersect(bounds)
+	if r.Empty() {
+		return r, fmt.Errorf("%w: region %s is empty or outside the %dx%d image", ErrInvalidParam, req.region, size.X, size.Y)
+	}
+
+	return r, nil
+}
+
+// Size resolves the requested size for a region. Without ^ the region is
+// never enlarged, and no side may exceed IIIFMaxDimension. The result must
+// still fit once rotated: max is scaled down further for it, other sizes are
+// rejected.
+func (req IIIFRequest) Size(region image.Point) (image.Point, error) {
+	rw, rh := float64(region.X), float64(region.Y)
+
+	var w, h float64
+	switch {
+	case req.size == "max":
+		scale := math.Min(math.Min(IIIFMaxDimension/rw, IIIFMaxDimension/rh), math.Sqrt(MaxPixels/(rw*rh)))
+		if !req.upscale {
+			scale = math.Min(scale, 1)
+		}
+		w, h = rw*scale, rh*scale
+	case strings.HasPrefix(req.size, "pct:"):
+		n, _ := strconv.ParseFloat(strings.TrimPrefix(req.size, "pct:"), 64)
+		w, h = rw*n/100, rh*n/100
+	default:
+		confined := strings.HasPrefix(req.size, "!")
+		ws, hs, _ := strings.Cut(strings.TrimPrefix(req.size, "!"), ",")
+		w, _ = strconv.ParseFloat(ws, 64)
+		h, _ = strconv.ParseFloat(hs, 64)
+
+		switch {
+		case confined:
+			scale := math.Min(w/rw, h/rh)
+			if !req.upscale {
+				scale = math.Min(scale, 1)
+			}
+			w, h = rw*scale, rh*scale
+		case hs == "":
+			h = rh * w / rw
+		case ws == "":
+			w = rw * h / rh
+		}
+	}
+
+	size := image.Pt(int(math.Round(w)), int(math.Round(h)))
+	switch {
+	case size.X < 1 || size.Y < 1:
+		return size, fmt.Errorf("%w: size %s of a %dx%d region is empty", ErrInvalidParam, req.size, region.X, region.Y)
+	case !req.upscale && (size.X > region.X || size.Y > region.Y):
+		return size, fmt.Errorf("%w: size %s enlarges the %dx%d region, prefix it with ^ to allow upscaling", ErrInvalidParam, req.size, region.X, region.Y)
+	case size.X > IIIFMaxDimension || size.Y > IIIFMaxDimension:
+		return size, fmt.Errorf("%w: size %s exceeds the maximum of %d pixels per side", ErrInvalidParam, req.size, IIIFMaxDimension)
+	case size.X*size.Y > MaxPixels:
+		return size, fmt.Errorf("%w: size %s exceeds the maximum of %d pixels", ErrInvalidParam, req.size, MaxPixels)
+	}
+
+	// arbitrary angles grow the canvas to hold the corners
+	rotated := req.rotatedSize(size)
+	for req.size == "max" && checkOutputSize(rotated) != nil {
+		rx, ry := float64(rotated.X), float64(rotated.Y)
+		scale := math.Min(math.Min(IIIFMaxDimension/rx, IIIFMaxDimension/ry), math.Sqrt(MaxPixels/(rx*ry)))
+		size = image.Pt(max(1, int(float64(size.X)*scale)), max(1, int(float64(size.Y)*scale)))
+		rotated = req.rotatedSize(size)
+	}
+	if err := checkOutputSize(rotated); err != nil {
+		return size, fmt.Errorf("size %s rotated by %g degrees: %w", req.size, req.Rotation, err)
+	}
+
+	return size, nil
+}
+
+// Render applies the request to buf: the upright image is cut to the region,
+// scaled, mirrored, rotated and reduced to the quality, in that order. The
+// result carries no metadata.
+func (req IIIFRequest) Render(backend Backend, buf []byte) ([]byte, error) {
+	if err := checkEncodes(backend, req.Format); err != nil {
+		return nil, err
+	}
+
+	c, err := backend.Decode(buf)
+	if err != nil {
+		return nil, err
+	}
+
+	if orientation := readMetadata(buf).orientation(); orientation > 1 {
+		if err := autoOrient(c, orientation); err != nil {
+			return nil, err
+		}
+	}
+
+	region, err := req.Region(c.Size())
+	if err != nil {
+		return nil, err
+	}
+	size, err := req.Size(region.Size())
+	if err != nil {
+		return nil, err
+	}
+
+	if region != (image.Rectangle{Max: c.Size()}) {
+		if err := c.Extract(region); err != nil {
+			return nil, err
+		}
+	}
+	if size != region.Size() {
+		if err := c.Resize(size.X, size.Y); err != nil {
+			return nil, err
+		}
+	}
+
+	if req.Mirror {
+		if err := c.Mirror(); err != nil {
+			return nil, err
+		}
+	}
+	if err := req.rotate(c); err != nil {
+		return nil, err
+	}
+
+	switch req.Quality {
+	case IIIFGray:
+		err = addFilters(c, []Operation{{Op: OpGrayscale}})
+	case IIIFBitonal:
+		err = c.Each(func(src image.Image) (image.Image, error) {
+			g := gift.New(gift.Grayscale(), bitonal())
+			dst := image.NewNRGBA(g.Bounds(src.Bounds()))
+			g.Draw(dst, src)
+			return dst, nil
+		})
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return c.Encode(req.Format, EncodeOptions{StripMetadata: true})
+}
+
+// rotate turns the canvas clockwise. Other angles than multiples of 90 grow
+// the canvas to hold the rotated image, the corners being transparent where
+// the format allows it and white otherwise.
+func (req IIIFRequest) rotate(c Canvas) error {
+	if math.Mod(req.Rotation, 90) == 0 {
+		if req.Rotation == 0 {
+			return nil
+		}
+		return c.Rotate(int(req.Rotation))
+	}
+
+	background := color.Color(color.White)
+	switch req.Format {
+	case "png", "webp", "gif", "tiff", "avif", "heif":
+		background = color.Transparent
+	}
+
+	g := gift.New(req.rotation(background))
+
+	return c.Each(func(src image.Image) (image.Image, error) {
+		bounds := g.Bounds(src.Bounds())
+		if err := checkOutputSize(bounds.Size()); err != nil {
+			return nil, err
+		}
+
+		dst := image.NewNRGBA(bounds)
+		g.Draw(dst, src)
+		return dst, nil
+	})
+}
+
+// rotation is the filter turning images by the requested angle.
+func (req IIIFRequest) rotation(background color.Color) gift.Filter {
+	// gift rotates counter-clockwise
+	return gift.Rotate(float32(360-req.Rotation), background, gift.CubicInterpolation)
+}
+
+// rotatedSize returns the size of an image of the given size once rotated.
+func (req IIIFRequest) rotatedSize(size image.Point) image.Point {
+	switch {
+	case math.Mod(req.Rotation, 180) == 0:
+		return size
+	case math.Mod(req.Rotation, 90) == 0:
+		return image.Pt(size.Y, size.X)
+	}
+
+	return req.rotation(color.Transparent).Bounds(image.Rectangle{Max: size}).Size()
+}
+
+// bitonal maps grey levels to black or white at the midpoint.
+func bitonal() gift.Filter {
+	return gift.ColorFunc(func(r, g, b, a float32) (float32, float32, float32, float32) {
+		if r < 0.5 {
+			return 0, 0, 0, a
+		}
+		return 1, 1, 1, a
+	})
+}
+
+// UprightSize returns the size of an image once its EXIF orientation is
+// applied.
+func UprightSize(width, height, orientation int) (int, int) {
+	if orientation >= 5 && orientation <= 8 {
+		return height, width
+	}
+
+	return width, height
+}
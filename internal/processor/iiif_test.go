@@ -0,0 +1,54 @@
+package processor
+
+import (
+	"errors"
+	"image"
+	"testing"
+)
+
+func TestIIIFSizeRotated(t *testing.T) {
+	tests := []struct {
+		name     string
+		size     string
+		rotation string
+		region   image.Point
+		want     image.Point //zero when any fitting size will do
+		wantErr  bool
+	}{
+		{"max unrotated", "max", "0", image.Pt(8000, 5000), image.Pt(8000, 5000), false},
+		{"max quarter turn", "max", "90", image.Pt(8000, 5000), image.Pt(8000, 5000), false},
+		{"max at 45 degrees", "max", "45", image.Pt(8000, 5000), image.Point{}, false},
+		{"max at 30 degrees of a strip", "max", "30", image.Pt(8192, 100), image.Point{}, false},
+		{"max of a small image", "max", "45", image.Pt(100, 100), image.Pt(100, 100), false},
+		{"explicit size at 45 degrees", "8000,5000", "45", image.Pt(8000, 5000), image.Point{}, true},
+		{"explicit side at 10 degrees", "8000,", "10", image.Pt(8000, 2000), image.Point{}, true},
+		{"explicit size that fits rotated", "1000,", "45", image.Pt(8000, 5000), image.Pt(1000, 625), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := ParseIIIF("full", tt.size, tt.rotation, IIIFDefault, "png")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			size, err := req.Size(tt.region)
+			if tt.wantErr {
+				if !errors.Is(err, ErrInvalidParam) {
+					t.Fatalf("expected ErrInvalidParam, got %v (size %v)", err, size)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if tt.want != (image.Point{}) && size != tt.want {
+				t.Errorf("size = %v, want %v", size, tt.want)
+			}
+			if err := checkOutputSize(req.rotatedSize(size)); err != nil {
+				t.Errorf("size %v does not fit once rotated: %v", size, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,271 @@
+package processor
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"strings"
+	"time"
+)
+
+// EXIF tags read by Inspect.
+const (
+	tagDateTime           = 0x0132
+	tagDateTimeOriginal   = 0x9003
+	tagOffsetTimeOriginal = 0x9011
+	tagGPSLatitudeRef     = 0x0001
+	tagGPSLatitude        = 0x0002
+	tagGPSLongitudeRef    = 0x0003
+	tagGPSLongitude       = 0x0004
+	tagGPSAltitudeRef     = 0x0005
+	tagGPSAltitude        = 0x0006
+)
+
+// ImageInfo describes an encoded image. Width and Height are those of the
+// stored pixels, before Orientation is applied.
+type ImageInfo struct {
+	Width       int
+	Height      int
+	Format      string
+	Size        int
+	ColorSpace  string //srgb, gray, cmyk or lab
+	HasAlpha    bool
+	Orientation int //EXIF orientation, 1 when missing
+	EXIF        *EXIFInfo
+}
+
+// EXIFInfo holds the capture details found in the EXIF block.
+type EXIFInfo struct {
+	Make      string     `json:"make,omitempty"`
+	Model     string     `json:"model,omitempty"`
+	LensMake  string     `json:"lens_make,omitempty"`
+	LensModel string     `json:"lens_model,omitempty"`
+	TakenAt   *time.Time `json:"taken_at,omitempty"` //UTC unless the camera recorded its offset
+	GPS       *GPSInfo   `json:"gps,omitempty"`
+}
+
+// GPSInfo is a position in decimal degrees, and metres above sea level.
+type GPSInfo struct {
+	Latitude  float64  `json:"latitude"`
+	Longitude float64  `json:"longitude"`
+	Altitude  *float64 `json:"altitude,omitempty"`
+}
+
+// Inspect reads the attributes of buf. Only the header is parsed for the
+// formats Go can read, others are decoded with backend.
+func Inspect(backend Backend, buf []byte) (ImageInfo, error) {
+	meta := readMetadata(buf)
+
+	info := ImageInfo{
+		Format:      DetectFormat(buf),
+		Size:        len(buf),
+		Orientation: meta.orientation(),
+		EXIF:        meta.exifInfo(),
+	}
+
+	var model color.Model
+	if cfg, _, err := image.DecodeConfig(bytes.NewReader(buf)); err == nil {
+		info.Width, info.Height = cfg.Width, cfg.Height
+		model = cfg.ColorModel
+	} else {
+		c, err := backend.Decode(buf)
+		if err != nil {
+			return info, err
+		}
+
+		img, err := c.Image()
+		if err != nil {
+			return info, err
+		}
+
+		size := c.Size()
+		info.Width, info.Height = size.X, size.Y
+		info.Format = c.Format()
+		model = img.ColorModel()
+	}
+
+	info.ColorSpace, info.HasAlpha = describeColorModel(model)
+	if info.Format == "webp" {
+		// x/image reports every lossless file as NRGBA
+		info.HasAlpha = webpHasAlpha(buf)
+	}
+	if space := iccColorSpace(meta.icc); space != "" {
+		info.ColorSpace = space
+	}
+
+	return info, nil
+}
+
+func describeColorModel(m color.Model) (space string, alpha bool) {
+	switch m {
+	case color.GrayModel, color.Gray16Model:
+		return "gray", false
+	case color.CMYKModel:
+		return "cmyk", false
+	case color.YCbCrModel:
+		return "srgb", false
+	case color.NRGBAModel, color.RGBAModel, color.NRGBA64Model, color.RGBA64Model, color.NYCbCrAModel:
+		return "srgb", true
+	}
+
+	if p, ok := m.(color.Palette); ok {
+		for _, c := range p {
+			if _, _, _, a := c.RGBA(); a != 0xffff {
+				return "srgb", true
+			}
+		}
+	}
+
+	return "srgb", false
+}
+
+func webpHasAlpha(buf []byte) bool {
+	chunks, err := webpChunks(buf)
+	if err != nil || len(chunks) == 0 {
+		return false
+	}
+
+	c := chunks[0]
+	switch {
+	case c.id == "VP8X" && len(c.data) > 0:
+		return c.data[0]&webpFlagAlpha != 0
+	case c.id == "VP8L" && len(c.data) >= 5:
+		return c.data[4]&0x10 != 0 //alpha_is_used, bit 28 of the header
+	}
+
+	return false
+}
+
+// iccColorSpace returns the data colour space of an ICC profile when it is not
+// RGB, which the colour model alone already tells apart.
+func iccColorSpace(icc []byte) string {
+	if len(icc) < 20 {
+		return ""
+	}
+
+	switch string(icc[16:20]) {
+	case "GRAY":
+		return "gray"
+	case "CMYK":
+		return "cmyk"
+	case "Lab ":
+		return "lab"
+	}
+
+	return ""
+}
+
+func (m metadataBlocks) exifInfo() *EXIFInfo {
+	e := m.exif
+	if e == nil {
+		return nil
+	}
+
+	info := &EXIFInfo{
+		Make:      e.ascii(e.ifd0, tagMake),
+		Model:     e.ascii(e.ifd0, tagModel),
+		LensMake:  e.ascii(e.exif, tagLensMake),
+		LensModel: e.ascii(e.exif, tagLensModel),
+		TakenAt:   e.takenAt(),
+		GPS:       e.position(),
+	}
+
+	if *info == (EXIFInfo{}) {
+		return nil
+	}
+
+	return info
+}
+
+func (e *exifData) ascii(entries []exifEntry, tag uint16) string {
+	entry, ok := e.find(entries, tag)
+	if !ok || entry.typ != 2 {
+		return ""
+	}
+
+	return strings.TrimSpace(strings.TrimRight(string(entry.value), "\x00"))
+}
+
+// rationals returns the values of an unsigned or signed rational entry.
+func (e *exifData) rationals(entries []exifEntry, tag uint16) []float64 {
+	entry, ok := e.find(entries, tag)
+	if !ok || (entry.typ != 5 && entry.typ != 10) {
+		return nil
+	}
+
+	values := make([]float64, 0, len(entry.value)/8)
+	for p := 0; p+8 <= len(entry.value); p += 8 {
+		num, den := e.order.Uint32(entry.value[p:]), e.order.Uint32(entry.value[p+4:])
+		if den == 0 {
+			return nil
+		}
+
+		if entry.typ == 10 {
+			values = append(values, float64(int32(num))/float64(int32(den)))
+		} else {
+			values = append(values, float64(num)/float64(den))
+		}
+	}
+
+	return values
+}
+
+func (e *exifData) takenAt() *time.Time {
+	s := e.ascii(e.exif, tagDateTimeOriginal)
+	if s == "" {
+		s = e.ascii(e.ifd0, tagDateTime)
+	}
+	if s == "" {
+		return nil
+	}
+
+	const layout = "2006:01:02 15:04:05"
+
+	t, err := time.Parse(layout, s)
+	if offset := e.ascii(e.exif, tagOffsetTimeOriginal); offset != "" {
+		if withOffset, err2 := time.Parse(layout+"-07:00", s+offset); err2 == nil {
+			t, err = withOffset, nil
+		}
+	}
+	if err != nil {
+		return nil
+	}
+
+	return &t
+}
+
+func (e *exifData) position() *GPSInfo {
+	lat := degrees(e.rationals(e.gps, tagGPSLatitude))
+	lon := degrees(e.rationals(e.gps, tagGPSLongitude))
+	if lat == nil || lon == nil {
+		return nil
+	}
+
+	gps := &GPSInfo{Latitude: *lat, Longitude: *lon}
+	if e.ascii(e.gps, tagGPSLatitudeRef) == "S" {
+		gps.Latitude = -gps.Latitude
+	}
+	if e.ascii(e.gps, tagGPSLongitudeRef) == "W" {
+		gps.Longitude = -gps.Longitude
+	}
+
+	if alt := e.rationals(e.gps, tagGPSAltitude); len(alt) == 1 {
+		// reference 1 means below sea level
+		if ref, ok := e.find(e.gps, tagGPSAltitudeRef); ok && len(ref.value) == 1 && ref.value[0] == 1 {
+			alt[0] = -alt[0]
+		}
+		gps.Altitude = &alt[0]
+	}
+
+	return gps
+}
+
+// degrees converts degrees, minutes and seconds to decimal degrees.
+func degrees(dms []float64) *float64 {
+	if len(dms) != 3 {
+		return nil
+	}
+
+	d := dms[0] + dms[1]/60 + dms[2]/3600
+	return &d
+}
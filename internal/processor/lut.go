@@ -0,0 +1,239 @@
+package processor
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/disintegration/gift"
+)
+
+const (
+	// MaxLUTSize bounds the grid size of uploaded LUTs; 65 is the largest
+	// size common grading tools export.
+	MaxLUTSize = 65
+	maxLUTName = 64
+)
+
+var ErrInvalidLUT = errors.New("invalid cube lut")
+
+// LUT is a 3D colour lookup table parsed from an Adobe/Resolve .cube file.
+type LUT struct {
+	Title     string
+	Size      int
+	domainMin [3]float32
+	domainMax [3]float32
+	table     [][3]float32 //red varies fastest, then green, then blue
+}
+
+// ParseCube reads a 3D LUT in the .cube format. 1D LUTs are rejected.
+func ParseCube(r io.Reader) (*LUT, error) {
+	lut := &LUT{domainMax: [3]float32{1, 1, 1}}
+
+	sc := bufio.NewScanner(r)
+	for line := 1; sc.Scan(); line++ {
+		text := strings.TrimSpace(sc.Text())
+		if text == "" || text[0] == '#' {
+			continue
+		}
+
+		fields := strings.Fields(text)
+		switch fields[0] {
+		case "TITLE":
+			lut.Title = strings.Trim(strings.TrimSpace(strings.TrimPrefix(text, "TITLE")), `"`)
+		case "LUT_3D_SIZE":
+			if len(fields) != 2 || lut.Size != 0 {
+				return nil, fmt.Errorf("%w: line %d: malformed LUT_3D_SIZE", ErrInvalidLUT, line)
+			}
+			size, err := strconv.Atoi(fields[1])
+			if err != nil || size < 2 || size > MaxLUTSize {
+				return nil, fmt.Errorf("%w: line %d: LUT_3D_SIZE must be between 2 and %d", ErrInvalidLUT, line, MaxLUTSize)
+			}
+			lut.Size = size
+			lut.table = make([][3]float32, 0, size*size*size)
+		case "LUT_1D_SIZE":
+			return nil, fmt.Errorf("%w: 1D LUTs are not supported", ErrInvalidLUT)
+		case "DOMAIN_MIN", "DOMAIN_MAX":
+			v, err := parseTriple(fields[1:])
+			if err != nil {
+				return nil, fmt.Errorf("%w: line %d: %v", ErrInvalidLUT, line, err)
+			}
+			if fields[0] == "DOMAIN_MIN" {
+				lut.domainMin = v
+			} else {
+				lut.domainMax = v
+			}
+		case "LUT_3D_INPUT_RANGE":
+			// Resolve's variant of the domain, the same range on every channel
+			if len(fields) != 3 {
+				return nil, fmt.Errorf("%w: line %d: malformed LUT_3D_INPUT_RANGE", ErrInvalidLUT, line)
+			}
+			v, err := parseTriple([]string{fields[1], fields[2], fields[2]})
+			if err != nil {
+				return nil, fmt.Errorf("%w: line %d: %v", ErrInvalidLUT, line, err)
+			}
+			lut.domainMin = [3]float32{v[0], v[0], v[0]}
+			lut.domainMax = [3]float32{v[1], v[1], v[1]}
+		default:
+			if c := fields[0][0]; c >= 'A' && c <= 'Z' {
+				continue //keywords this service has no use for
+			}
+			if lut.Size == 0 {
+				return nil, fmt.Errorf("%w: line %d: data before LUT_3D_SIZE", ErrInvalidLUT, line)
+			}
+			v, err := parseTriple(fields)
+			if err != nil {
+				return nil, fmt.Errorf("%w: line %d: %v", ErrInvalidLUT, line, err)
+			}
+			if len(lut.table) == cap(lut.table) {
+				return nil, fmt.Errorf("%w: line %d: more entries than LUT_3D_SIZE allows", ErrInvalidLUT, line)
+			}
+			lut.table = append(lut.table, v)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+
+	if lut.Size == 0 {
+		return nil, fmt.Errorf("%w: missing LUT_3D_SIZE", ErrInvalidLUT)
+	}
+	if len(lut.table) != cap(lut.table) {
+		return nil, fmt.Errorf("%w: expected %d entries, got %d", ErrInvalidLUT, cap(lut.table), len(lut.table))
+	}
+	for i := range lut.domainMin {
+		if lut.domainMax[i] <= lut.domainMin[i] {
+			return nil, fmt.Errorf("%w: DOMAIN_MAX must be greater than DOMAIN_MIN", ErrInvalidLUT)
+		}
+	}
+
+	return lut, nil
+}
+
+func parseTriple(fields []string) ([3]float32, error) {
+	var v [3]float32
+	if len(fields) != 3 {
+		return v, errors.New("expected 3 values")
+	}
+
+	for i, f := range fields {
+		n, err := strconv.ParseFloat(f, 32)
+		if err != nil {
+			return v, err
+		}
+		v[i] = float32(n)
+	}
+
+	return v, nil
+}
+
+// ValidLUTName reports whether name can identify a LUT: lowercase letters,
+// digits, dashes and underscores, starting with a letter or digit.
+func ValidLUTName(name string) bool {
+	if name == "" || len(name) > maxLUTName || name[0] == '-' || name[0] == '_' {
+		return false
+	}
+
+	for _, r := range name {
+		if (r < 'a' || r > 'z') && (r < '0' || r > '9') && r != '-' && r != '_' {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (l *LUT) at(r, g, b int) [3]float32 {
+	return l.table[(b*l.Size+g)*l.Size+r]
+}
+
+// Lookup maps a colour through the table with trilinear interpolation
+// between the eight surrounding grid points.
+func (l *LUT) Lookup(r, g, b float32) (float32, float32, float32) {
+	in := [3]float32{r, g, b}
+
+	var (
+		lo   [3]int
+		frac [3]float32
+	)
+	top := float32(l.Size - 1)
+	for i, v := range in {
+		v = (v - l.domainMin[i]) / (l.domainMax[i] - l.domainMin[i]) * top
+		v = min(max(v, 0), top)
+
+		lo[i] = min(int(v), l.Size-2)
+		frac[i] = v - float32(lo[i])
+	}
+
+	var out [3]float32
+	for c := 0; c < 3; c++ {
+		lerp := func(a, b, t float32) float32 { return a + (b-a)*t }
+
+		c000 := l.at(lo[0], lo[1], lo[2])[c]
+		c100 := l.at(lo[0]+1, lo[1], lo[2])[c]
+		c010 := l.at(lo[0], lo[1]+1, lo[2])[c]
+		c110 := l.at(lo[0]+1, lo[1]+1, lo[2])[c]
+		c001 := l.at(lo[0], lo[1], lo[2]+1)[c]
+		c101 := l.at(lo[0]+1, lo[1], lo[2]+1)[c]
+		c011 := l.at(lo[0], lo[1]+1, lo[2]+1)[c]
+		c111 := l.at(lo[0]+1, lo[1]+1, lo[2]+1)[c]
+
+		c00 := lerp(c000, c100, frac[0])
+		c10 := lerp(c010, c110, frac[0])
+		c01 := lerp(c001, c101, frac[0])
+		c11 := lerp(c011, c111, frac[0])
+
+		out[c] = lerp(lerp(c00, c10, frac[1]), lerp(c01, c11, frac[1]), frac[2])
+	}
+
+	return out[0], out[1], out[2]
+}
+
+// filter grades the image through the table, blending the result with the
+// original by intensity (0-1).
+func (l *LUT) filter(intensity float32) gift.Filter {
+	return gift.ColorFunc(func(r0, g0, b0, a0 float32) (float32, float32, float32, float32) {
+		r, g, b := l.Lookup(r0, g0, b0)
+		return r0 + (r-r0)*intensity, g0 + (g-g0)*intensity, b0 + (b-b0)*intensity, a0
+	})
+}
+
+func validateLUT(op Operation) error {
+	if !ValidLUTName(op.LUT) {
+		return fmt.Errorf("%w: lut must be the name of an uploaded lut", ErrInvalidParam)
+	}
+
+	// 0 would grade nothing and is rejected rather than read as "unset"
+	return inRange("amount", op.Amount, 1, 100)
+}
+
+// applyLUT grades the canvas with a LUT uploaded by the user. Amount is the
+// intensity in percent.
+func applyLUT(c Canvas, op Operation, res Resources) error {
+	if res == nil {
+		return ErrNoResources
+	}
+
+	data, err := res.LUT(op.LUT)
+	if err != nil {
+		return err
+	}
+
+	lut, err := ParseCube(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+
+	g := gift.New(lut.filter(op.Amount / 100))
+
+	return c.Each(func(src image.Image) (image.Image, error) {
+		dst := image.NewNRGBA(g.Bounds(src.Bounds()))
+		g.Draw(dst, src)
+		return dst, nil
+	})
+}
@@ -0,0 +1,255 @@
+package processor
+
+import (
+	"errors"
+	"math"
+	"strings"
+	"testing"
+)
+
+// identityCube is a 2x2x2 identity LUT; red varies fastest.
+const identityCube = `
+0 0 0
+1 0 0
+0 1 0
+1 1 0
+0 0 1
+1 0 1
+0 1 1
+1 1 1
+`
+
+func TestParseCube(t *testing.T) {
+	tests := []struct {
+		name      string
+		input     string
+		wantSize  int
+		wantTitle string
+		wantMin   [3]float32
+		wantMax   [3]float32
+		wantErr   bool
+	}{
+		{
+			name:      "identity",
+			input:     "TITLE \"Identity\"\nLUT_3D_SIZE 2\n" + identityCube,
+			wantSize:  2,
+			wantTitle: "Identity",
+			wantMax:   [3]float32{1, 1, 1},
+		},
+		{
+			name:     "comments and unknown keywords",
+			input:    "# exported\nLUT_3D_SIZE 2\nLUT_IN_VIDEO_RANGE\n\n" + identityCube,
+			wantSize: 2,
+			wantMax:  [3]float32{1, 1, 1},
+		},
+		{
+			name:     "domain",
+			input:    "LUT_3D_SIZE 2\nDOMAIN_MIN 0 0 0\nDOMAIN_MAX 2 4 8\n" + identityCube,
+			wantSize: 2,
+			wantMax:  [3]float32{2, 4, 8},
+		},
+		{
+			name:     "input range",
+			input:    "LUT_3D_SIZE 2\nLUT_3D_INPUT_RANGE -1 1\n" + identityCube,
+			wantSize: 2,
+			wantMin:  [3]float32{-1, -1, -1},
+			wantMax:  [3]float32{1, 1, 1},
+		},
+		{
+			name:    "missing size",
+			input:   "TITLE \"x\"\n",
+			wantErr: true,
+		},
+		{
+			name:    "size too small",
+			input:   "LUT_3D_SIZE 1\n0 0 0\n",
+			wantErr: true,
+		},
+		{
+			name:    "size too large",
+			input:   "LUT_3D_SIZE 66\n",
+			wantErr: true,
+		},
+		{
+			name:    "size not a number",
+			input:   "LUT_3D_SIZE two\n",
+			wantErr: true,
+		},
+		{
+			name:    "size repeated",
+			input:   "LUT_3D_SIZE 2\nLUT_3D_SIZE 2\n" + identityCube,
+			wantErr: true,
+		},
+		{
+			name:    "1D lut",
+			input:   "LUT_1D_SIZE 2\n0 0 0\n1 1 1\n",
+			wantErr: true,
+		},
+		{
+			name:    "data before size",
+			input:   "0 0 0\nLUT_3D_SIZE 2\n" + identityCube,
+			wantErr: true,
+		},
+		{
+			name:    "too few entries",
+			input:   "LUT_3D_SIZE 2\n0 0 0\n1 1 1\n",
+			wantErr: true,
+		},
+		{
+			name:    "too many entries",
+			input:   "LUT_3D_SIZE 2\n" + identityCube + "1 1 1\n",
+			wantErr: true,
+		},
+		{
+			name:    "short data line",
+			input:   "LUT_3D_SIZE 2\n0 0\n" + identityCube,
+			wantErr: true,
+		},
+		{
+			name:    "non numeric data",
+			input:   "LUT_3D_SIZE 2\n0 x 0\n" + identityCube,
+			wantErr: true,
+		},
+		{
+			name:    "malformed domain",
+			input:   "LUT_3D_SIZE 2\nDOMAIN_MAX 1 1\n" + identityCube,
+			wantErr: true,
+		},
+		{
+			name:    "empty domain",
+			input:   "LUT_3D_SIZE 2\nDOMAIN_MIN 1 0 0\nDOMAIN_MAX 1 1 1\n" + identityCube,
+			wantErr: true,
+		},
+		{
+			name:    "malformed input range",
+			input:   "LUT_3D_SIZE 2\nLUT_3D_INPUT_RANGE 0\n" + identityCube,
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lut, err := ParseCube(strings.NewReader(tt.input))
+			if tt.wantErr {
+				if !errors.Is(err, ErrInvalidLUT) {
+					t.Fatalf("expected ErrInvalidLUT, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if lut.Size != tt.wantSize {
+				t.Errorf("size = %d, want %d", lut.Size, tt.wantSize)
+			}
+			if lut.Title != tt.wantTitle {
+				t.Errorf("title = %q, want %q", lut.Title, tt.wantTitle)
+			}
+			if lut.domainMin != tt.wantMin || lut.domainMax != tt.wantMax {
+				t.Errorf("domain = %v-%v, want %v-%v", lut.domainMin, lut.domainMax, tt.wantMin, tt.wantMax)
+			}
+		})
+	}
+}
+
+func TestLUTLookup(t *testing.T) {
+	identity, err := ParseCube(strings.NewReader("LUT_3D_SIZE 2\n" + identityCube))
+	if err != nil {
+		t.Fatal(err)
+	}
+	scaled, err := ParseCube(strings.NewReader("LUT_3D_SIZE 2\nDOMAIN_MAX 2 2 2\n" + identityCube))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		lut  *LUT
+		in   [3]float32
+		want [3]float32
+	}{
+		{"identity corner", identity, [3]float32{1, 0, 1}, [3]float32{1, 0, 1}},
+		{"identity interpolated", identity, [3]float32{0.25, 0.5, 0.75}, [3]float32{0.25, 0.5, 0.75}},
+		{"clamped below domain", identity, [3]float32{-1, 0.5, 0.5}, [3]float32{0, 0.5, 0.5}},
+		{"clamped above domain", identity, [3]float32{2, 0.5, 0.5}, [3]float32{1, 0.5, 0.5}},
+		{"scaled domain", scaled, [3]float32{1, 2, 0}, [3]float32{0.5, 1, 0}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, g, b := tt.lut.Lookup(tt.in[0], tt.in[1], tt.in[2])
+			got := [3]float32{r, g, b}
+			for i := range got {
+				if math.Abs(float64(got[i]-tt.want[i])) > 1e-5 {
+					t.Fatalf("Lookup(%v) = %v, want %v", tt.in, got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestValidateLUT(t *testing.T) {
+	tests := []struct {
+		name    string
+		op      Operation
+		wantErr bool
+	}{
+		{"full intensity", Operation{Op: OpLUT, LUT: "teal-orange", Amount: 100}, false},
+		{"partial intensity", Operation{Op: OpLUT, LUT: "film_1", Amount: 35}, false},
+		{"zero intensity", Operation{Op: OpLUT, LUT: "film", Amount: 0}, true},
+		{"intensity above 100", Operation{Op: OpLUT, LUT: "film", Amount: 101}, true},
+		{"negative intensity", Operation{Op: OpLUT, LUT: "film", Amount: -5}, true},
+		{"missing name", Operation{Op: OpLUT, Amount: 100}, true},
+		{"uppercase name", Operation{Op: OpLUT, LUT: "Film", Amount: 100}, true},
+		{"path in name", Operation{Op: OpLUT, LUT: "../film", Amount: 100}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateLUT(tt.op)
+			if tt.wantErr != (err != nil) {
+				t.Fatalf("validateLUT() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil && !errors.Is(err, ErrInvalidParam) {
+				t.Fatalf("expected ErrInvalidParam, got %v", err)
+			}
+		})
+	}
+}
+
+func TestPipelineLUTIntensity(t *testing.T) {
+	zero, half := float32(0), float32(50)
+
+	tests := []struct {
+		name      string
+		intensity *float32
+		want      float32
+	}{
+		{"unset grades fully", nil, 100},
+		{"explicit intensity", &half, 50},
+		{"explicit zero is kept", &zero, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var tr Transformer
+			tr.Filters.LUT = "film"
+			tr.Filters.LUTIntensity = tt.intensity
+
+			var found bool
+			for _, op := range tr.Pipeline() {
+				if op.Op != OpLUT {
+					continue
+				}
+				found = true
+				if op.Amount != tt.want {
+					t.Errorf("amount = %v, want %v", op.Amount, tt.want)
+				}
+			}
+			if !found {
+				t.Fatal("pipeline has no lut step")
+			}
+		})
+	}
+}
@@ -0,0 +1,680 @@
+package processor
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"slices"
+	"sort"
+)
+
+// Metadata categories that can be kept when stripping.
+const (
+	MetadataEXIF      = "exif"      //capture settings, dates, software and any other EXIF tag
+	MetadataGPS       = "gps"       //location
+	MetadataCamera    = "camera"    //make, model, lens and body serial number
+	MetadataCopyright = "copyright" //copyright notice and artist
+	MetadataICC       = "icc"       //colour profile
+	MetadataXMP       = "xmp"
+	MetadataIPTC      = "iptc"
+)
+
+var metadataCategories = []string{
+	MetadataEXIF,
+	MetadataGPS,
+	MetadataCamera,
+	MetadataCopyright,
+	MetadataICC,
+	MetadataXMP,
+	MetadataIPTC,
+}
+
+var (
+	errBadJPEG = errors.New("malformed jpeg")
+	errBadPNG  = errors.New("malformed png")
+)
+
+// Options apply to the whole pipeline rather than to a single operation.
+type Options struct {
+	AutoOrient bool //turn the image upright according to its EXIF orientation first
+	Metadata   MetadataOptions
+}
+
+// DefaultOptions auto-orients and keeps all metadata.
+func DefaultOptions() Options {
+	return Options{AutoOrient: true}
+}
+
+func (o Options) Validate() error {
+	return o.Metadata.validate()
+}
+
+// MetadataOptions selects the metadata copied to the output. Everything is
+// kept by default; with Strip only the Keep categories survive. Metadata is
+// carried over into JPEG, PNG and WebP output, other formats lose it.
+type MetadataOptions struct {
+	Strip bool
+	Keep  []string
+}
+
+func (o MetadataOptions) validate() error {
+	if len(o.Keep) > 0 && !o.Strip {
+		return fmt.Errorf("%w: keep_metadata requires strip_metadata", ErrInvalidParam)
+	}
+
+	for _, category := range o.Keep {
+		if !slices.Contains(metadataCategories, category) {
+			return fmt.Errorf("%w: unknown metadata category %q, have %v", ErrInvalidParam, category, metadataCategories)
+		}
+	}
+
+	return nil
+}
+
+func (o MetadataOptions) keeps(category string) bool {
+	return !o.Strip || slices.Contains(o.Keep, category)
+}
+
+// metadataBlocks holds the metadata read from a source image, independent of
+// the container it came in.
+type metadataBlocks struct {
+	exif *exifData
+	icc  []byte
+	xmp  []byte
+	iptc []byte //Photoshop image resources, as stored in JPEG APP13
+}
+
+func (m metadataBlocks) orientation() int {
+	if m.exif == nil {
+		return 1
+	}
+
+	return m.exif.orientation()
+}
+
+// filter returns the blocks allowed by o, with the EXIF orientation set to
+// orientation. A non-default orientation is always kept since the pixels
+// depend on it.
+func (m metadataBlocks) filter(o MetadataOptions, orientation int) metadataBlocks {
+	var out metadataBlocks
+
+	if m.exif != nil {
+		e := &exifData{order: m.exif.order}
+
+		keep := func(tag uint16) bool {
+			switch tag {
+			case tagOrientation:
+				return orientation != 1 || o.keeps(MetadataEXIF)
+			case tagMake, tagModel, tagLensMake, tagLensModel, tagLensSpec, tagBodySerial:
+				return o.keeps(MetadataCamera)
+			case tagCopyright, tagArtist:
+				return o.keeps(MetadataCopyright)
+			}
+			return o.keeps(MetadataEXIF)
+		}
+
+		e.ifd0 = filterEntries(m.exif.ifd0, keep)
+		e.exif = filterEntries(m.exif.exif, keep)
+		if o.keeps(MetadataGPS) {
+			e.gps = m.exif.gps
+		}
+		e.setOrientation(orientation)
+
+		if !e.empty() {
+			out.exif = e
+		}
+	}
+
+	if o.keeps(MetadataICC) {
+		out.icc = m.icc
+	}
+	if o.keeps(MetadataXMP) {
+		out.xmp = m.xmp
+	}
+	if o.keeps(MetadataIPTC) {
+		out.iptc = m.iptc
+	}
+
+	return out
+}
+
+// canWriteMetadata reports whether writeMetadata can rewrite format.
+func canWriteMetadata(format string) bool {
+	return format == "jpeg" || format == "png" || format == "webp"
+}
+
+// readMetadata collects the metadata of buf. Metadata that cannot be parsed
+// is ignored rather than failing the request.
+func readMetadata(buf []byte) metadataBlocks {
+	var m metadataBlocks
+
+	switch DetectFormat(buf) {
+	case "jpeg":
+		m = readJPEGMetadata(buf)
+	case "png":
+		m = readPNGMetadata(buf)
+	case "webp":
+		m = readWebPMetadata(buf)
+	case "tiff":
+		m = readTIFFMetadata(buf)
+	}
+
+	return m
+}
+
+// writeMetadata replaces the metadata of an encoded image with m. Formats it
+// cannot rewrite are returned unchanged.
+func writeMetadata(buf []byte, m metadataBlocks) ([]byte, error) {
+	switch DetectFormat(buf) {
+	case "jpeg":
+		return writeJPEGMetadata(buf, m)
+	case "png":
+		return writePNGMetadata(buf, m)
+	case "webp":
+		return writeWebPMetadata(buf, m)
+	}
+
+	return buf, nil
+}
+
+// JPEG keeps metadata in APPn segments identified by a signature.
+var (
+	jpegEXIF = []byte("Exif\x00\x00")
+	jpegXMP  = []byte("http://ns.adobe.com/xap/1.0/\x00")
+	jpegICC  = []byte("ICC_PROFILE\x00")
+	jpegIPTC = []byte("Photoshop 3.0\x00")
+)
+
+const (
+	jpegAPP0  = 0xe0
+	jpegAPP1  = 0xe1
+	jpegAPP2  = 0xe2
+	jpegAPP13 = 0xed
+	jpegSOS   = 0xda
+
+	jpegMaxSegment = 0xffff - 2          //the length includes itself
+	jpegICCChunk   = jpegMaxSegment - 14 //signature, sequence number and count
+)
+
+type jpegSegment struct {
+	marker byte
+	data   []byte //without the marker and length
+}
+
+func (s jpegSegment) is(marker byte, signature []byte) bool {
+	return s.marker == marker && bytes.HasPrefix(s.data, signature)
+}
+
+func (s jpegSegment) isMetadata() bool {
+	return s.is(jpegAPP1, jpegEXIF) || s.is(jpegAPP1, jpegXMP) || s.is(jpegAPP2, jpegICC) || s.is(jpegAPP13, jpegIPTC)
+}
+
+// jpegSegments splits the header of a JPEG file into segments and returns
+// them together with the rest of the file, from the start of scan onwards.
+func jpegSegments(buf []byte) ([]jpegSegment, []byte, error) {
+	if len(buf) < 4 || buf[0] != 0xff || buf[1] != 0xd8 {
+		return nil, nil, errBadJPEG
+	}
+
+	var segments []jpegSegment
+	for p := 2; ; {
+		if p+4 > len(buf) || buf[p] != 0xff {
+			return nil, nil, errBadJPEG
+		}
+
+		marker := buf[p+1]
+		switch marker {
+		case 0xff:
+			p++ //fill byte
+			continue
+		case jpegSOS:
+			return segments, buf[p:], nil
+		}
+
+		n := int(binary.BigEndian.Uint16(buf[p+2:]))
+		if n < 2 || p+2+n > len(buf) {
+			return nil, nil, errBadJPEG
+		}
+
+		segments = append(segments, jpegSegment{marker: marker, data: buf[p+4 : p+2+n]})
+		p += 2 + n
+	}
+}
+
+func writeJPEGSegment(w *bytes.Buffer, marker byte, parts ...[]byte) {
+	n := 0
+	for _, part := range parts {
+		n += len(part)
+	}
+	if n > jpegMaxSegment {
+		return //too large for a single segment, dropped
+	}
+
+	w.Write([]byte{0xff, marker})
+	binary.Write(w, binary.BigEndian, uint16(n+2))
+	for _, part := range parts {
+		w.Write(part)
+	}
+}
+
+func readJPEGMetadata(buf []byte) metadataBlocks {
+	var m metadataBlocks
+
+	segments, _, err := jpegSegments(buf)
+	if err != nil {
+		return m
+	}
+
+	var icc []jpegSegment
+	for _, s := range segments {
+		switch {
+		case s.is(jpegAPP1, jpegEXIF) && m.exif == nil:
+			m.exif, _ = parseEXIF(s.data[len(jpegEXIF):])
+		case s.is(jpegAPP1, jpegXMP):
+			m.xmp = s.data[len(jpegXMP):]
+		case s.is(jpegAPP2, jpegICC) && len(s.data) > len(jpegICC)+2:
+			icc = append(icc, s)
+		case s.is(jpegAPP13, jpegIPTC):
+			m.iptc = s.data[len(jpegIPTC):]
+		}
+	}
+
+	// profiles larger than a segment are split into numbered chunks
+	sort.SliceStable(icc, func(i, j int) bool {
+		return icc[i].data[len(jpegICC)] < icc[j].data[len(jpegICC)]
+	})
+	for _, s := range icc {
+		m.icc = append(m.icc, s.data[len(jpegICC)+2:]...)
+	}
+
+	return m
+}
+
+func writeJPEGMetadata(buf []byte, m metadataBlocks) ([]byte, error) {
+	segments, scan, err := jpegSegments(buf)
+	if err != nil {
+		return nil, err
+	}
+
+	var out bytes.Buffer
+	out.Write([]byte{0xff, 0xd8})
+
+	// JFIF must stay the first segment
+	i := 0
+	for ; i < len(segments) && segments[i].marker == jpegAPP0; i++ {
+		writeJPEGSegment(&out, jpegAPP0, segments[i].data)
+	}
+
+	if m.exif != nil {
+		writeJPEGSegment(&out, jpegAPP1, jpegEXIF, m.exif.encode())
+	}
+	if len(m.xmp) > 0 {
+		writeJPEGSegment(&out, jpegAPP1, jpegXMP, m.xmp)
+	}
+	if len(m.icc) > 0 {
+		count := (len(m.icc) + jpegICCChunk - 1) / jpegICCChunk
+		for n := 0; n < count && count < 256; n++ {
+			chunk := m.icc[n*jpegICCChunk : min((n+1)*jpegICCChunk, len(m.icc))]
+			writeJPEGSegment(&out, jpegAPP2, jpegICC, []byte{byte(n + 1), byte(count)}, chunk)
+		}
+	}
+	if len(m.iptc) > 0 {
+		writeJPEGSegment(&out, jpegAPP13, jpegIPTC, m.iptc)
+	}
+
+	for _, s := range segments[i:] {
+		if !s.isMetadata() {
+			writeJPEGSegment(&out, s.marker, s.data)
+		}
+	}
+	out.Write(scan)
+
+	return out.Bytes(), nil
+}
+
+// PNG stores metadata in eXIf, iCCP and iTXt chunks.
+const (
+	pngSignature = "\x89PNG\r\n\x1a\n"
+	pngXMPKey    = "XML:com.adobe.xmp"
+)
+
+type pngChunk struct {
+	typ  string
+	data []byte
+}
+
+func (c pngChunk) isXMP() bool {
+	return c.typ == "iTXt" && bytes.HasPrefix(c.data, []byte(pngXMPKey+"\x00"))
+}
+
+func pngChunks(buf []byte) ([]pngChunk, error) {
+	if !bytes.HasPrefix(buf, []byte(pngSignature)) {
+		return nil, errBadPNG
+	}
+
+	var chunks []pngChunk
+	for p := len(pngSignature); p < len(buf); {
+		if p+12 > len(buf) {
+			return nil, errBadPNG
+		}
+
+		n := int(binary.BigEndian.Uint32(buf[p:]))
+		if n < 0 || p+12+n > len(buf) {
+			return nil, errBadPNG
+		}
+
+		chunks = append(chunks, pngChunk{typ: string(buf[p+4 : p+8]), data: buf[p+8 : p+8+n]})
+		p += 12 + n
+	}
+
+	return chunks, nil
+}
+
+func writePNGChunk(w *bytes.Buffer, typ string, data []byte) {
+	binary.Write(w, binary.BigEndian, uint32(len(data)))
+	w.WriteString(typ)
+	w.Write(data)
+
+	crc := crc32.NewIEEE()
+	crc.Write([]byte(typ))
+	crc.Write(data)
+	binary.Write(w, binary.BigEndian, crc.Sum32())
+}
+
+func readPNGMetadata(buf []byte) metadataBlocks {
+	var m metadataBlocks
+
+	chunks, err := pngChunks(buf)
+	if err != nil {
+		return m
+	}
+
+	for _, c := range chunks {
+		switch {
+		case c.typ == "eXIf":
+			m.exif, _ = parseEXIF(c.data)
+		case c.typ == "iCCP":
+			// profile name, compression method, zlib stream
+			if i := bytes.IndexByte(c.data, 0); i >= 0 && i+2 <= len(c.data) {
+				m.icc, _ = inflate(c.data[i+2:])
+			}
+		case c.isXMP():
+			m.xmp = readPNGText(c.data[len(pngXMPKey)+1:])
+		}
+	}
+
+	return m
+}
+
+// readPNGText returns the text of an iTXt chunk following its keyword.
+func readPNGText(data []byte) []byte {
+	if len(data) < 2 {
+		return nil
+	}
+	compressed := data[0] == 1
+
+	// skip the language tag and translated keyword
+	rest := data[2:]
+	for i := 0; i < 2; i++ {
+		n := bytes.IndexByte(rest, 0)
+		if n < 0 {
+			return nil
+		}
+		rest = rest[n+1:]
+	}
+
+	if compressed {
+		text, _ := inflate(rest)
+		return text
+	}
+
+	return rest
+}
+
+func writePNGMetadata(buf []byte, m metadataBlocks) ([]byte, error) {
+	chunks, err := pngChunks(buf)
+	if err != nil {
+		return nil, err
+	}
+
+	var out bytes.Buffer
+	out.WriteString(pngSignature)
+
+	for _, c := range chunks {
+		switch {
+		case c.typ == "eXIf", c.typ == "iCCP", c.isXMP():
+			continue
+		case c.typ == "sRGB" && len(m.icc) > 0:
+			continue //only one colour space chunk is allowed
+		}
+
+		writePNGChunk(&out, c.typ, c.data)
+		if c.typ != "IHDR" {
+			continue
+		}
+
+		// iCCP must come before PLTE and IDAT, so write everything up front
+		if len(m.icc) > 0 {
+			var data bytes.Buffer
+			data.WriteString("icc\x00\x00")
+			zw := zlib.NewWriter(&data)
+			zw.Write(m.icc)
+			zw.Close()
+			writePNGChunk(&out, "iCCP", data.Bytes())
+		}
+		if m.exif != nil {
+			writePNGChunk(&out, "eXIf", m.exif.encode())
+		}
+		if len(m.xmp) > 0 {
+			// uncompressed, no language tag or translated keyword
+			writePNGChunk(&out, "iTXt", append([]byte(pngXMPKey+"\x00\x00\x00\x00\x00"), m.xmp...))
+		}
+	}
+
+	return out.Bytes(), nil
+}
+
+func inflate(data []byte) ([]byte, error) {
+	r, err := zlib.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	return io.ReadAll(r)
+}
+
+// WebP keeps metadata in ICCP, EXIF and "XMP " chunks flagged in VP8X.
+const (
+	webpFlagICC  = 0x20
+	webpFlagEXIF = 0x08
+	webpFlagXMP  = 0x04
+)
+
+func readWebPMetadata(buf []byte) metadataBlocks {
+	var m metadataBlocks
+
+	chunks, err := webpChunks(buf)
+	if err != nil {
+		return m
+	}
+
+	for _, c := range chunks {
+		switch c.id {
+		case "EXIF":
+			// some writers keep the JPEG signature
+			m.exif, _ = parseEXIF(bytes.TrimPrefix(c.data, jpegEXIF))
+		case "ICCP":
+			m.icc = c.data
+		case "XMP ":
+			m.xmp = c.data
+		}
+	}
+
+	return m
+}
+
+func writeWebPMetadata(buf []byte, m metadataBlocks) ([]byte, error) {
+	chunks, err := webpChunks(buf)
+	if err != nil {
+		return nil, err
+	}
+
+	var vp8x []byte
+	if len(chunks) > 0 && chunks[0].id == "VP8X" && len(chunks[0].data) >= 10 {
+		vp8x = append([]byte(nil), chunks[0].data...)
+	} else if m.exif == nil && len(m.icc) == 0 && len(m.xmp) == 0 {
+		return buf, nil //a simple file without VP8X has no metadata
+	} else if vp8x, err = webpExtendedHeader(chunks); err != nil {
+		return nil, err
+	}
+
+	vp8x[0] &^= webpFlagICC | webpFlagEXIF | webpFlagXMP
+
+	var exif []byte
+	if m.exif != nil {
+		exif = m.exif.encode()
+		vp8x[0] |= webpFlagEXIF
+	}
+	if len(m.icc) > 0 {
+		vp8x[0] |= webpFlagICC
+	}
+	if len(m.xmp) > 0 {
+		vp8x[0] |= webpFlagXMP
+	}
+
+	var body bytes.Buffer
+	writeChunk(&body, "VP8X", vp8x)
+	if len(m.icc) > 0 {
+		writeChunk(&body, "ICCP", m.icc)
+	}
+	for _, c := range chunks {
+		switch c.id {
+		case "VP8X", "ICCP", "EXIF", "XMP ":
+			continue
+		}
+		writeChunk(&body, c.id, c.data)
+	}
+	if exif != nil {
+		writeChunk(&body, "EXIF", exif)
+	}
+	if len(m.xmp) > 0 {
+		writeChunk(&body, "XMP ", m.xmp)
+	}
+
+	return riffWebP(body.Bytes()), nil
+}
+
+// webpExtendedHeader builds the VP8X chunk a simple lossy or lossless file
+// needs before metadata can be added, taking the canvas size from the
+// bitstream header.
+func webpExtendedHeader(chunks []riffChunk) ([]byte, error) {
+	vp8x := make([]byte, 10)
+
+	for _, c := range chunks {
+		var w, h int
+		switch {
+		case c.id == "VP8 " && len(c.data) >= 10 && bytes.Equal(c.data[3:6], []byte{0x9d, 0x01, 0x2a}):
+			w = int(binary.LittleEndian.Uint16(c.data[6:]) & 0x3fff)
+			h = int(binary.LittleEndian.Uint16(c.data[8:]) & 0x3fff)
+		case c.id == "VP8L" && len(c.data) >= 5 && c.data[0] == 0x2f:
+			bits := binary.LittleEndian.Uint32(c.data[1:])
+			w = int(bits&0x3fff) + 1
+			h = int(bits>>14&0x3fff) + 1
+			if bits>>28&1 == 1 {
+				vp8x[0] |= webpFlagAlpha
+			}
+		default:
+			continue
+		}
+
+		putUint24(vp8x[4:], w-1)
+		putUint24(vp8x[7:], h-1)
+		return vp8x, nil
+	}
+
+	return nil, errBadWebP
+}
+
+// TIFF tags holding metadata other than EXIF.
+const (
+	tagXMP  = 0x02bc
+	tagIPTC = 0x83bb
+	tagICC  = 0x8773
+)
+
+func readTIFFMetadata(buf []byte) metadataBlocks {
+	var m metadataBlocks
+
+	e, err := parseEXIF(buf)
+	if err != nil {
+		return m
+	}
+
+	for _, entry := range e.ifd0 {
+		switch entry.tag {
+		case tagXMP:
+			m.xmp = entry.value
+		case tagICC:
+			m.icc = entry.value
+		case tagIPTC:
+			m.iptc = photoshopIPTC(entry.value)
+		}
+	}
+
+	e.ifd0 = filterEntries(e.ifd0, func(tag uint16) bool {
+		return tag != tagXMP && tag != tagICC && tag != tagIPTC
+	})
+	m.exif = e
+
+	return m
+}
+
+// photoshopIPTC wraps raw IPTC records in the Photoshop image resource JPEG
+// files carry them in.
+func photoshopIPTC(iptc []byte) []byte {
+	var b bytes.Buffer
+	b.WriteString("8BIM")
+	binary.Write(&b, binary.BigEndian, uint16(0x0404))
+	b.Write([]byte{0, 0}) //empty, padded name
+	binary.Write(&b, binary.BigEndian, uint32(len(iptc)))
+	b.Write(iptc)
+	if len(iptc)&1 == 1 {
+		b.WriteByte(0)
+	}
+
+	return b.Bytes()
+}
+
+// autoOrient turns the canvas upright according to an EXIF orientation.
+func autoOrient(c Canvas, orientation int) error {
+	var steps []func() error
+	switch orientation {
+	case 2:
+		steps = append(steps, c.Mirror)
+	case 3:
+		steps = append(steps, func() error { return c.Rotate(180) })
+	case 4:
+		steps = append(steps, c.Flip)
+	case 5: //transposed
+		steps = append(steps, func() error { return c.Rotate(90) }, c.Mirror)
+	case 6:
+		steps = append(steps, func() error { return c.Rotate(90) })
+	case 7: //transversed
+		steps = append(steps, func() error { return c.Rotate(90) }, c.Flip)
+	case 8:
+		steps = append(steps, func() error { return c.Rotate(270) })
+	}
+
+	for _, step := range steps {
+		if err := step(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
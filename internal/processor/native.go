@@ -0,0 +1,173 @@
+package processor
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+
+	"github.com/disintegration/gift"
+)
+
+// NativeBackend processes images in pure Go with image/draw, gift and
+// x/image, so it runs without cgo or libvips.
+type NativeBackend struct{}
+
+func (NativeBackend) Name() string {
+	return BackendNative
+}
+
+func (NativeBackend) Encodes(format string) bool {
+	f, ok := LookupFormat(format)
+	return ok && f.NativeEncode
+}
+
+func (NativeBackend) Decode(buf []byte) (Canvas, error) {
+	if c, ok, err := decodeAnimation(buf); ok || err != nil {
+		return c, err
+	}
+
+	img, format, err := image.Decode(bytes.NewReader(buf))
+	if err != nil {
+		if f, ok := LookupFormat(DetectFormat(buf)); ok && !f.NativeDecode {
+			return nil, fmt.Errorf("%w: %s decoding requires the %s backend", ErrUnsupportedFormat, f.Name, BackendVips)
+		}
+		return nil, err
+	}
+
+	return &nativeCanvas{frames: []frame{{img: img}}, format: normalizeFormat(format)}, nil
+}
+
+// nativeCanvas holds one frame for still images and every composited frame
+// for animations. Operations are applied to each frame in turn.
+type nativeCanvas struct {
+	frames []frame
+	loop   int //times an animation plays, 0 forever
+	format string
+}
+
+func (c *nativeCanvas) Size() image.Point {
+	return c.frames[0].img.Bounds().Size()
+}
+
+func (c *nativeCanvas) Format() string {
+	return c.format
+}
+
+func (c *nativeCanvas) Frames() int {
+	return len(c.frames)
+}
+
+func (c *nativeCanvas) Each(fn func(image.Image) (image.Image, error)) error {
+	for i := range c.frames {
+		img, err := fn(c.frames[i].img)
+		if err != nil {
+			return err
+		}
+		c.frames[i].img = img
+	}
+
+	return nil
+}
+
+func (c *nativeCanvas) KeepFrame(n int) error {
+	if n < 0 || n >= len(c.frames) {
+		return fmt.Errorf("%w: frame %d out of range, image has %d", ErrInvalidParam, n+1, len(c.frames))
+	}
+
+	c.frames = c.frames[n : n+1]
+	return nil
+}
+
+func (c *nativeCanvas) apply(filters ...gift.Filter) error {
+	g := gift.New(filters...)
+
+	return c.Each(func(src image.Image) (image.Image, error) {
+		dst := image.NewNRGBA(g.Bounds(src.Bounds()))
+		g.Draw(dst, src)
+		return dst, nil
+	})
+}
+
+func (c *nativeCanvas) Resize(width, height int) error {
+	return c.apply(gift.Resize(width, height, gift.LanczosResampling))
+}
+
+func (c *nativeCanvas) Extract(r image.Rectangle) error {
+	return c.apply(gift.Crop(r.Add(c.frames[0].img.Bounds().Min)))
+}
+
+func (c *nativeCanvas) Embed(width, height int, background color.NRGBA) error {
+	return c.Each(func(src image.Image) (image.Image, error) {
+		dst := image.NewNRGBA(image.Rect(0, 0, width, height))
+		draw.Draw(dst, dst.Bounds(), image.NewUniform(background), image.Point{}, draw.Src)
+
+		b := src.Bounds()
+		pt := anchor(GravityCentre, dst.Bounds(), b.Dx(), b.Dy(), 0)
+		draw.Draw(dst, image.Rectangle{Min: pt, Max: pt.Add(b.Size())}, src, b.Min, draw.Over)
+
+		return dst, nil
+	})
+}
+
+func (c *nativeCanvas) Rotate(angle int) error {
+	// gift rotates counter-clockwise
+	switch (angle%360 + 360) % 360 {
+	case 90:
+		return c.apply(gift.Rotate270())
+	case 180:
+		return c.apply(gift.Rotate180())
+	case 270:
+		return c.apply(gift.Rotate90())
+	}
+
+	return nil
+}
+
+func (c *nativeCanvas) Flip() error {
+	return c.apply(gift.FlipVertical())
+}
+
+func (c *nativeCanvas) Mirror() error {
+	return c.apply(gift.FlipHorizontal())
+}
+
+// Clone copies the frame list only: operations always draw into new images,
+// so the frames themselves can be shared.
+func (c *nativeCanvas) Clone() Canvas {
+	clone := *c
+	clone.frames = append([]frame(nil), c.frames...)
+	return &clone
+}
+
+func (c *nativeCanvas) Image() (image.Image, error) {
+	return c.frames[0].img, nil
+}
+
+// Encode writes every frame when the target format supports animation and
+// only the first one otherwise.
+func (c *nativeCanvas) Encode(format string, opts EncodeOptions) ([]byte, error) {
+	if format == "" {
+		format = c.format
+	}
+	format = normalizeFormat(format)
+
+	if len(c.frames) > 1 && isAnimatedFormat(format) {
+		var buf bytes.Buffer
+
+		var err error
+		if format == "gif" {
+			err = encodeAnimatedGIF(&buf, c.frames, c.loop)
+		} else {
+			err = encodeAnimatedWebP(&buf, c.frames, c.loop, opts)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		return buf.Bytes(), nil
+	}
+
+	return encodeImage(c.frames[0].img, format, opts)
+}
@@ -0,0 +1,288 @@
+package processor
+
+import (
+	"fmt"
+)
+
+// Operation names accepted in a pipeline.
+const (
+	OpResize    = "resize"
+	OpCrop      = "crop"
+	OpRotate    = "rotate"
+	OpFlip      = "flip"
+	OpMirror    = "mirror"
+	OpConvert   = "convert"
+	OpGrayscale = "grayscale"
+	OpSepia     = "sepia"
+	OpGamma     = "gamma"
+	OpBlur      = "blur"
+	OpWatermark = "watermark"
+	OpFrame     = "frame"
+
+	OpBrightness = "brightness"
+	OpContrast   = "contrast"
+	OpSaturation = "saturation"
+	OpHue        = "hue"
+	OpSharpen    = "sharpen"
+	OpInvert     = "invert"
+	OpColorize   = "colorize"
+	OpPixelate   = "pixelate"
+	OpConvolve   = "convolve"
+	OpLUT        = "lut"
+)
+
+// Operation is a single pipeline step. Only the fields relevant to Op are
+// read; the rest are ignored.
+type Operation struct {
+	Op      string
+	Width   int
+	Height  int
+	Angle   int
+	Format  string
+	Quality int
+	Gamma   float32
+	Sigma   float32
+	Frame   int //1-based frame of an animation to keep as a still
+
+	// filters
+	Amount     float32 //strength of sepia, brightness, contrast, saturation, colorize and sharpen; degrees for hue
+	Threshold  float32 //sharpen
+	Hue        float32 //colorize
+	Saturation float32 //colorize
+	Size       int     //pixelate block size
+	Kernel     []float32
+	Normalize  bool   //divide the kernel by the sum of its weights
+	LUT        string //name of an uploaded .cube lut, graded at Amount percent (1-100)
+
+	// convert
+	Progressive      bool
+	Lossless         bool
+	CompressionLevel int
+	Subsampling      string
+	TIFFCompression  string
+
+	// resize
+	Fit                string
+	Background         string
+	Percent            float32
+	WithoutEnlargement bool
+
+	// crop
+	X           *int //top-left corner of the crop, 0 when only the other is set
+	Y           *int
+	AspectRatio string
+	Gravity     string // also positions cover resizes and watermarks
+
+	// watermark
+	ImageID int64
+	Text    string
+	Color   string
+	Margin  int
+	Opacity float32
+	Scale   float32
+	Tile    bool
+}
+
+// StepError reports which pipeline step failed.
+type StepError struct {
+	Index int
+	Op    string
+	Err   error
+}
+
+func (e *StepError) Error() string {
+	return fmt.Sprintf("operations[%d] (%s): %v", e.Index, e.Op, e.Err)
+}
+
+func (e *StepError) Unwrap() error {
+	return e.Err
+}
+
+// Pipeline converts the fixed-order transformations into the equivalent
+// ordered operation list: frame -> rotate/flip -> resize -> crop -> convert
+// -> filters -> lut -> watermark. Colour adjustments run before blur, sharpen
+// and convolution, and pixelation comes last.
+func (t Transformer) Pipeline() []Operation {
+	var ops []Operation
+
+	if t.Frame > 0 {
+		ops = append(ops, Operation{Op: OpFrame, Frame: t.Frame})
+	}
+
+	if t.Rotate != 0 {
+		ops = append(ops, Operation{Op: OpRotate, Angle: t.Rotate})
+	}
+	if t.Flip {
+		ops = append(ops, Operation{Op: OpFlip})
+	}
+	if t.Mirror {
+		ops = append(ops, Operation{Op: OpMirror})
+	}
+
+	if r := t.Resize; r.Width > 0 || r.Height > 0 || r.Percent > 0 {
+		ops = append(ops, Operation{
+			Op:                 OpResize,
+			Width:              r.Width,
+			Height:             r.Height,
+			Fit:                r.Fit,
+			Background:         r.Background,
+			Gravity:            r.Gravity,
+			Percent:            r.Percent,
+			WithoutEnlargement: r.WithoutEnlargement,
+		})
+	}
+
+	if c := t.Crop; c.Width > 0 || c.Height > 0 || c.AspectRatio != "" {
+		ops = append(ops, Operation{
+			Op:          OpCrop,
+			Width:       c.Width,
+			Height:      c.Height,
+			X:           c.X,
+			Y:           c.Y,
+			AspectRatio: c.AspectRatio,
+			Gravity:     c.Gravity,
+		})
+	}
+
+	if e := t.Encoder; t.Format != "" || t.Quality > 0 || e.Progressive || e.Lossless ||
+		e.CompressionLevel > 0 || e.Subsampling != "" || e.TIFFCompression != "" {
+		ops = append(ops, Operation{
+			Op:               OpConvert,
+			Format:           t.Format,
+			Quality:          t.Quality,
+			Progressive:      e.Progressive,
+			Lossless:         e.Lossless,
+			CompressionLevel: e.CompressionLevel,
+			Subsampling:      e.Subsampling,
+			TIFFCompression:  e.TIFFCompression,
+		})
+	}
+
+	f := t.Filters
+	if f.Grayscale {
+		ops = append(ops, Operation{Op: OpGrayscale})
+	}
+	if f.Sepia || f.SepiaStrength != 0 {
+		ops = append(ops, Operation{Op: OpSepia, Amount: f.SepiaStrength})
+	}
+	if f.Brightness != 0 {
+		ops = append(ops, Operation{Op: OpBrightness, Amount: f.Brightness})
+	}
+	if f.Contrast != 0 {
+		ops = append(ops, Operation{Op: OpContrast, Amount: f.Contrast})
+	}
+	if f.Saturation != 0 {
+		ops = append(ops, Operation{Op: OpSaturation, Amount: f.Saturation})
+	}
+	if f.Hue != 0 {
+		ops = append(ops, Operation{Op: OpHue, Amount: f.Hue})
+	}
+	if c := f.Colorize; c.Hue != 0 || c.Saturation != 0 || c.Amount != 0 {
+		ops = append(ops, Operation{Op: OpColorize, Hue: c.Hue, Saturation: c.Saturation, Amount: c.Amount})
+	}
+	if f.Invert {
+		ops = append(ops, Operation{Op: OpInvert})
+	}
+	if f.Gamma > 0 {
+		ops = append(ops, Operation{Op: OpGamma, Gamma: f.Gamma})
+	}
+	if f.GaussianBlur > 0 {
+		ops = append(ops, Operation{Op: OpBlur, Sigma: f.GaussianBlur})
+	}
+	if sh := f.Sharpen; sh.Sigma != 0 || sh.Amount != 0 || sh.Threshold != 0 {
+		ops = append(ops, Operation{Op: OpSharpen, Sigma: sh.Sigma, Amount: sh.Amount, Threshold: sh.Threshold})
+	}
+	if len(f.Convolution.Kernel) > 0 {
+		ops = append(ops, Operation{Op: OpConvolve, Kernel: f.Convolution.Kernel, Normalize: f.Convolution.Normalize})
+	}
+	if f.Pixelate != 0 {
+		ops = append(ops, Operation{Op: OpPixelate, Size: f.Pixelate})
+	}
+
+	if f.LUT != "" {
+		intensity := float32(100)
+		if f.LUTIntensity != nil {
+			intensity = *f.LUTIntensity
+		}
+		ops = append(ops, Operation{Op: OpLUT, LUT: f.LUT, Amount: intensity})
+	}
+
+	if wm := t.Watermark; wm.ImageID > 0 || wm.Text != "" {
+		ops = append(ops, Operation{
+			Op:      OpWatermark,
+			ImageID: wm.ImageID,
+			Text:    wm.Text,
+			Color:   wm.Color,
+			Gravity: wm.Gravity,
+			Margin:  wm.Margin,
+			Opacity: wm.Opacity,
+			Scale:   wm.Scale,
+			Tile:    wm.Tile,
+		})
+	}
+
+	return ops
+}
+
+// Validate checks every step and returns a *StepError for the first invalid one.
+func Validate(ops []Operation) error {
+	for i, op := range ops {
+		if err := op.Validate(); err != nil {
+			return &StepError{Index: i, Op: op.Op, Err: err}
+		}
+	}
+
+	return nil
+}
+
+func (op Operation) Validate() error {
+	switch op.Op {
+	case OpCrop:
+		return validateCrop(op)
+	case OpResize:
+		return validateResize(op)
+	case OpRotate:
+		if op.Angle%90 != 0 {
+			return fmt.Errorf("%w: angle must be a multiple of 90", ErrInvalidParam)
+		}
+	case OpConvert:
+		if op.Format == "" && op.encodeOptions() == (EncodeOptions{}) {
+			return fmt.Errorf("%w: format or an encoder option is required", ErrInvalidParam)
+		}
+		if op.Format != "" {
+			if _, ok := LookupFormat(op.Format); !ok {
+				return fmt.Errorf("%w: unsupported format %q", ErrInvalidParam, op.Format)
+			}
+		}
+		return op.encodeOptions().validate()
+	case OpWatermark:
+		return validateWatermark(op)
+	case OpLUT:
+		return validateLUT(op)
+	case OpFrame:
+		if op.Frame < 1 {
+			return fmt.Errorf("%w: frame must be 1 or greater", ErrInvalidParam)
+		}
+	case OpFlip, OpMirror:
+	case "":
+		return fmt.Errorf("%w: op is required", ErrInvalidParam)
+	default:
+		if isFilter(op.Op) {
+			return validateFilter(op)
+		}
+		return fmt.Errorf("%w: unknown op %q", ErrInvalidParam, op.Op)
+	}
+
+	return nil
+}
+
+func (op Operation) encodeOptions() EncodeOptions {
+	return EncodeOptions{
+		Quality:          op.Quality,
+		Progressive:      op.Progressive,
+		Lossless:         op.Lossless,
+		CompressionLevel: op.CompressionLevel,
+		Subsampling:      op.Subsampling,
+		TIFFCompression:  op.TIFFCompression,
+	}
+}
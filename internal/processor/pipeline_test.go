@@ -0,0 +1,112 @@
+package processor
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestOperationValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		op      Operation
+		wantErr bool
+	}{
+		{"missing op", Operation{}, true},
+		{"unknown op", Operation{Op: "explode"}, true},
+
+		{"resize width", Operation{Op: OpResize, Width: 100}, false},
+		{"resize height", Operation{Op: OpResize, Height: 100}, false},
+		{"resize box", Operation{Op: OpResize, Width: 100, Height: 50, Fit: FitCover, Gravity: GravityNorth}, false},
+		{"resize percent", Operation{Op: OpResize, Percent: 50}, false},
+		{"resize largest percent", Operation{Op: OpResize, Percent: resizeMaxPercent}, false},
+		{"resize largest side", Operation{Op: OpResize, Width: MaxDimension}, false},
+		{"resize without size", Operation{Op: OpResize}, true},
+		{"resize negative width", Operation{Op: OpResize, Width: -1, Height: 10}, true},
+		{"resize width past maximum", Operation{Op: OpResize, Width: MaxDimension + 1}, true},
+		{"resize height past maximum", Operation{Op: OpResize, Height: MaxDimension + 1}, true},
+		{"resize box past pixel budget", Operation{Op: OpResize, Width: 8000, Height: 8000}, true},
+		{"resize percent past maximum", Operation{Op: OpResize, Percent: resizeMaxPercent + 1}, true},
+		{"resize negative percent", Operation{Op: OpResize, Percent: -10}, true},
+		{"resize percent and width", Operation{Op: OpResize, Percent: 50, Width: 10}, true},
+		{"resize unknown fit", Operation{Op: OpResize, Width: 10, Height: 10, Fit: "stretch"}, true},
+		{"resize bad background", Operation{Op: OpResize, Width: 10, Height: 10, Fit: FitContain, Background: "#12"}, true},
+		{"resize unknown gravity", Operation{Op: OpResize, Width: 10, Height: 10, Gravity: "up"}, true},
+
+		{"crop", Operation{Op: OpCrop, Width: 10, Height: 10}, false},
+		{"crop at the origin", Operation{Op: OpCrop, Width: 10, Height: 10, X: intPtr(0), Y: intPtr(0)}, false},
+		{"crop with x only", Operation{Op: OpCrop, Width: 10, Height: 10, X: intPtr(5)}, false},
+		{"crop smart", Operation{Op: OpCrop, Width: 10, Height: 10, Gravity: GravityEntropy}, false},
+		{"crop aspect ratio", Operation{Op: OpCrop, AspectRatio: "16:9"}, false},
+		{"crop without size", Operation{Op: OpCrop}, true},
+		{"crop zero height", Operation{Op: OpCrop, Width: 10}, true},
+		{"crop negative x", Operation{Op: OpCrop, Width: 10, Height: 10, X: intPtr(-1)}, true},
+		{"crop origin and gravity", Operation{Op: OpCrop, Width: 10, Height: 10, X: intPtr(0), Gravity: GravityNorth}, true},
+		{"crop aspect ratio and width", Operation{Op: OpCrop, AspectRatio: "1:1", Width: 10}, true},
+		{"crop bad aspect ratio", Operation{Op: OpCrop, AspectRatio: "wide"}, true},
+		{"crop unknown gravity", Operation{Op: OpCrop, Width: 10, Height: 10, Gravity: "up"}, true},
+
+		{"rotate", Operation{Op: OpRotate, Angle: 270}, false},
+		{"rotate backwards", Operation{Op: OpRotate, Angle: -90}, false},
+		{"rotate off the right angle", Operation{Op: OpRotate, Angle: 45}, true},
+		{"flip", Operation{Op: OpFlip}, false},
+		{"mirror", Operation{Op: OpMirror}, false},
+
+		{"convert", Operation{Op: OpConvert, Format: "png"}, false},
+		{"convert alias", Operation{Op: OpConvert, Format: "jpg", Quality: 80}, false},
+		{"convert options only", Operation{Op: OpConvert, Quality: 80}, false},
+		{"convert nothing", Operation{Op: OpConvert}, true},
+		{"convert unknown format", Operation{Op: OpConvert, Format: "bmp2"}, true},
+		{"convert quality past maximum", Operation{Op: OpConvert, Format: "jpeg", Quality: 101}, true},
+		{"convert bad subsampling", Operation{Op: OpConvert, Format: "jpeg", Subsampling: "4:1:1"}, true},
+
+		{"frame", Operation{Op: OpFrame, Frame: 1}, false},
+		{"frame zero", Operation{Op: OpFrame}, true},
+
+		{"blur", Operation{Op: OpBlur, Sigma: 2}, false},
+		{"blur largest sigma", Operation{Op: OpBlur, Sigma: maxBlurSigma}, false},
+		{"blur zero sigma", Operation{Op: OpBlur}, true},
+		{"blur sigma past maximum", Operation{Op: OpBlur, Sigma: maxBlurSigma + 1}, true},
+		{"gamma", Operation{Op: OpGamma, Gamma: 1.5}, false},
+		{"gamma zero", Operation{Op: OpGamma}, true},
+		{"brightness", Operation{Op: OpBrightness, Amount: -50}, false},
+		{"brightness out of range", Operation{Op: OpBrightness, Amount: 150}, true},
+		{"hue out of range", Operation{Op: OpHue, Amount: 190}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.op.Validate()
+			if tt.wantErr != (err != nil) {
+				t.Fatalf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil && !errors.Is(err, ErrInvalidParam) {
+				t.Fatalf("expected ErrInvalidParam, got %v", err)
+			}
+		})
+	}
+}
+
+func TestValidateReportsStep(t *testing.T) {
+	ops := []Operation{
+		{Op: OpResize, Width: 100},
+		{Op: OpRotate, Angle: 90},
+		{Op: OpCrop, Width: 10},
+	}
+
+	err := Validate(ops)
+
+	var stepErr *StepError
+	if !errors.As(err, &stepErr) {
+		t.Fatalf("expected a *StepError, got %v", err)
+	}
+	if stepErr.Index != 2 || stepErr.Op != OpCrop {
+		t.Fatalf("step = %d (%s), want 2 (%s)", stepErr.Index, stepErr.Op, OpCrop)
+	}
+	if !errors.Is(err, ErrInvalidParam) {
+		t.Fatalf("expected ErrInvalidParam, got %v", err)
+	}
+
+	if err := Validate(ops[:2]); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
@@ -1,16 +1,5 @@
 package processor
 
-import (
-	"github.com/h2non/bimg"
-)
-
-var ImageTypes = map[string]bimg.ImageType{
-	"jpeg": bimg.JPEG,
-	"png":  bimg.PNG,
-	"webp": bimg.WEBP,
-	"tiff": bimg.TIFF,
-}
-
 type ImageProcessor struct {
 	Transformer interface {
 		Process() ([]byte, error)
@@ -18,17 +7,27 @@ type ImageProcessor struct {
 		Crop(width, height int) ([]byte, error)
 		Convert(t string) ([]byte, error)
 		Compress(value int) ([]byte, error)
-		Rotate(a bimg.Angle) ([]byte, error)
+		Rotate(angle int) ([]byte, error)
 		Mirror() ([]byte, error)
 		Flip() ([]byte, error)
 	}
 }
 
-func NewImageProcessor(buf []byte, options Transformer) *ImageProcessor {
+func NewImageProcessor(backend Backend, buf []byte, options Transformer) *ImageProcessor {
+	return NewPipelineProcessor(backend, buf, options.Pipeline(), DefaultOptions(), nil)
+}
+
+// NewPipelineProcessor runs ops against buf. opts apply to the whole pipeline
+// and res resolves images referenced by operations such as watermark; it may
+// be nil when none are used.
+func NewPipelineProcessor(backend Backend, buf []byte, ops []Operation, opts Options, res Resources) *ImageProcessor {
 	return &ImageProcessor{
 		Transformer: &ImageTransformer{
-			buf:     buf,
-			options: options,
+			backend:   backend,
+			buf:       buf,
+			ops:       ops,
+			opts:      opts,
+			resources: res,
 		},
 	}
 }
@@ -0,0 +1,143 @@
+package processor
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+)
+
+// Resize fit modes, following CSS object-fit.
+const (
+	FitCover   = "cover"   //fill the box, cropping the overflow
+	FitContain = "contain" //fit inside the box, letterboxed with Background
+	FitFill    = "fill"    //stretch to the box, ignoring aspect ratio
+	FitInside  = "inside"  //fit inside the box, without letterboxing
+	FitOutside = "outside" //cover the box, without cropping
+)
+
+const resizeMaxPercent = 400
+
+func validateResize(op Operation) error {
+	if op.Width < 0 || op.Height < 0 {
+		return fmt.Errorf("%w: width and height must not be negative", ErrInvalidParam)
+	}
+	if err := checkOutputSize(image.Pt(op.Width, op.Height)); err != nil {
+		return err
+	}
+
+	if op.Percent != 0 {
+		if op.Width != 0 || op.Height != 0 {
+			return fmt.Errorf("%w: percent cannot be combined with width and height", ErrInvalidParam)
+		}
+		if op.Percent < 0 || op.Percent > resizeMaxPercent {
+			return fmt.Errorf("%w: percent must be between 0 and %d", ErrInvalidParam, resizeMaxPercent)
+		}
+	} else if op.Width == 0 && op.Height == 0 {
+		return fmt.Errorf("%w: width, height or percent is required", ErrInvalidParam)
+	}
+
+	switch op.Fit {
+	case "", FitCover, FitContain, FitFill, FitInside, FitOutside:
+	default:
+		return fmt.Errorf("%w: unknown fit %q", ErrInvalidParam, op.Fit)
+	}
+
+	if op.Background != "" {
+		if _, err := parseColor(op.Background); err != nil {
+			return err
+		}
+	}
+
+	if !validGravity(op.Gravity) && !isSmartGravity(op.Gravity) {
+		return fmt.Errorf("%w: unknown gravity %q", ErrInvalidParam, op.Gravity)
+	}
+
+	return nil
+}
+
+// resize scales the canvas by Percent, to a single Width or Height keeping the
+// aspect ratio, or into a Width x Height box according to Fit (fill by
+// default). Cover crops the overflow using Gravity. With WithoutEnlargement
+// the image is never scaled up. Results beyond MaxDimension or MaxPixels are
+// rejected.
+func resize(c Canvas, op Operation) error {
+	src := c.Size()
+	dst := resizeDimensions(op, src)
+
+	// a single side, a percentage or a cover fit of an odd aspect ratio can
+	// still scale far past the box
+	if err := checkOutputSize(dst); err != nil {
+		return err
+	}
+
+	if dst != src {
+		if err := c.Resize(dst.X, dst.Y); err != nil {
+			return err
+		}
+	}
+
+	if op.Width == 0 || op.Height == 0 {
+		return nil
+	}
+
+	switch op.Fit {
+	case FitCover:
+		// after WithoutEnlargement the image may be smaller than the box
+		return crop(c, Operation{
+			Op:      OpCrop,
+			Width:   min(op.Width, dst.X),
+			Height:  min(op.Height, dst.Y),
+			Gravity: op.Gravity,
+		})
+	case FitContain:
+		background := color.NRGBA{A: 0xff}
+		if op.Background != "" {
+			var err error
+			if background, err = parseColor(op.Background); err != nil {
+				return err
+			}
+		}
+
+		return c.Embed(op.Width, op.Height, background)
+	}
+
+	return nil
+}
+
+// resizeDimensions returns the size the source is scaled to before any crop or
+// letterboxing.
+func resizeDimensions(op Operation, src image.Point) image.Point {
+	sw, sh := float64(src.X), float64(src.Y)
+	w, h := float64(op.Width), float64(op.Height)
+
+	var fx, fy float64
+	switch {
+	case op.Percent > 0:
+		fx = float64(op.Percent) / 100
+		fy = fx
+	case op.Height == 0:
+		fx = w / sw
+		fy = fx
+	case op.Width == 0:
+		fy = h / sh
+		fx = fy
+	case op.Fit == FitCover || op.Fit == FitOutside:
+		fx = math.Max(w/sw, h/sh)
+		fy = fx
+	case op.Fit == FitContain || op.Fit == FitInside:
+		fx = math.Min(w/sw, h/sh)
+		fy = fx
+	default:
+		fx, fy = w/sw, h/sh
+	}
+
+	if op.WithoutEnlargement {
+		fx, fy = math.Min(fx, 1), math.Min(fy, 1)
+	}
+
+	return image.Pt(
+		max(1, int(math.Round(sw*fx))),
+		max(1, int(math.Round(sh*fy))),
+	)
+}
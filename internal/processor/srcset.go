@@ -0,0 +1,140 @@
+package processor
+
+import (
+	"fmt"
+	"math"
+	"slices"
+)
+
+const (
+	MaxSrcsetWidths  = 10
+	MaxSrcsetFormats = 4
+	maxSrcsetWidth   = MaxDimension
+)
+
+// Rendition is one image of a responsive set.
+type Rendition struct {
+	Width  int
+	Height int
+	Format string
+	Buf    []byte
+}
+
+// Srcset renders buf at each of widths in each of formats from a single
+// decode, keeping the aspect ratio. Widths above that of the source are
+// clamped to it, so images are never enlarged. Renditions are returned by
+// ascending width, then in the order of formats.
+func Srcset(backend Backend, buf []byte, widths []int, formats []string, enc EncodeOptions, opts Options) ([]Rendition, error) {
+	formats, err := validateSrcset(widths, formats)
+	if err != nil {
+		return nil, err
+	}
+	for _, format := range formats {
+		if err := checkEncodes(backend, format); err != nil {
+			return nil, err
+		}
+	}
+	if err := enc.validate(); err != nil {
+		return nil, err
+	}
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+
+	meta := readMetadata(buf)
+
+	orientation := meta.orientation()
+	orient := opts.AutoOrient && orientation > 1
+	if orient {
+		orientation = 1
+	}
+
+	c, err := backend.Decode(buf)
+	if err != nil {
+		return nil, err
+	}
+
+	if orient {
+		if err := autoOrient(c, meta.orientation()); err != nil {
+			return nil, err
+		}
+	}
+
+	size := c.Size()
+	widths = srcsetWidths(widths, size.X)
+
+	enc.StripMetadata = opts.Metadata.Strip || orient
+	keep := meta.filter(opts.Metadata, orientation)
+
+	renditions := make([]Rendition, 0, len(widths)*len(formats))
+	for _, width := range widths {
+		variant := c
+		height := size.Y
+		if width != size.X {
+			height = max(1, int(math.Round(float64(size.Y)*float64(width)/float64(size.X))))
+
+			variant = c.Clone()
+			if err := variant.Resize(width, height); err != nil {
+				return nil, err
+			}
+		}
+
+		for _, format := range formats {
+			out, err := variant.Encode(format, enc)
+			if err != nil {
+				return nil, fmt.Errorf("%s at %dw: %w", format, width, err)
+			}
+
+			if out, err = writeMetadata(out, keep); err != nil {
+				return nil, err
+			}
+
+			renditions = append(renditions, Rendition{Width: width, Height: height, Format: format, Buf: out})
+		}
+	}
+
+	return renditions, nil
+}
+
+// validateSrcset checks the requested widths and formats and returns the
+// canonical names of the formats, without duplicates.
+func validateSrcset(widths []int, formats []string) ([]string, error) {
+	if len(widths) == 0 || len(widths) > MaxSrcsetWidths {
+		return nil, fmt.Errorf("%w: between 1 and %d widths are required", ErrInvalidParam, MaxSrcsetWidths)
+	}
+	for _, w := range widths {
+		if w < 1 || w > maxSrcsetWidth {
+			return nil, fmt.Errorf("%w: widths must be between 1 and %d", ErrInvalidParam, maxSrcsetWidth)
+		}
+	}
+
+	if len(formats) == 0 || len(formats) > MaxSrcsetFormats {
+		return nil, fmt.Errorf("%w: between 1 and %d formats are required", ErrInvalidParam, MaxSrcsetFormats)
+	}
+
+	names := make([]string, 0, len(formats))
+	for _, name := range formats {
+		f, ok := LookupFormat(name)
+		if !ok {
+			return nil, fmt.Errorf("%w: unsupported format %q", ErrInvalidParam, name)
+		}
+
+		if !slices.Contains(names, f.Name) {
+			names = append(names, f.Name)
+		}
+	}
+
+	return names, nil
+}
+
+// srcsetWidths clamps widths to the source width and sorts them, dropping
+// duplicates.
+func srcsetWidths(widths []int, sourceWidth int) []int {
+	clamped := make([]int, 0, len(widths))
+	for _, w := range widths {
+		clamped = append(clamped, min(w, sourceWidth))
+	}
+	slices.Sort(clamped)
+
+	return slices.Compact(clamped)
+}
@@ -0,0 +1,190 @@
+package processor
+
+import (
+	"fmt"
+	"image"
+	"math"
+)
+
+// Tile pyramid layouts.
+const (
+	TileLayoutDZI = "dzi" //Deep Zoom: level 0 is 1x1, tiles named col_row
+	TileLayoutXYZ = "xyz" //slippy map: zoom 0 fits in one tile, tiles named x/y
+)
+
+const (
+	DefaultTileSize    = 254
+	DefaultTileOverlap = 1 //for Deep Zoom, XYZ tiles never overlap
+	DefaultTileFormat  = "jpeg"
+	minTileSize        = 64
+	maxTileSize        = 2048
+	maxTileOverlap     = 32
+)
+
+// TileOptions configure a tile pyramid. Zero values take the defaults of
+// 254px jpeg Deep Zoom tiles; Overlap is left as given.
+type TileOptions struct {
+	Layout  string
+	Size    int
+	Overlap int
+	Format  string
+	Quality int
+}
+
+// WithDefaults fills in the unset options.
+func (o TileOptions) WithDefaults() TileOptions {
+	if o.Layout == "" {
+		o.Layout = TileLayoutDZI
+	}
+	if o.Size == 0 {
+		o.Size = DefaultTileSize
+	}
+	if o.Format == "" {
+		o.Format = DefaultTileFormat
+	}
+	o.Format = normalizeFormat(o.Format)
+
+	return o
+}
+
+func (o TileOptions) Validate() error {
+	switch o.Layout {
+	case TileLayoutDZI:
+	case TileLayoutXYZ:
+		if o.Overlap != 0 {
+			return fmt.Errorf("%w: xyz tiles cannot overlap", ErrInvalidParam)
+		}
+	default:
+		return fmt.Errorf("%w: unknown tile layout %q", ErrInvalidParam, o.Layout)
+	}
+
+	if o.Size < minTileSize || o.Size > maxTileSize {
+		return fmt.Errorf("%w: tile size must be between %d and %d", ErrInvalidParam, minTileSize, maxTileSize)
+	}
+	if o.Overlap < 0 || o.Overlap > maxTileOverlap || o.Overlap*2 >= o.Size {
+		return fmt.Errorf("%w: tile overlap must be between 0 and %d, and less than half the tile size", ErrInvalidParam, maxTileOverlap)
+	}
+
+	switch normalizeFormat(o.Format) {
+	case "jpeg", "png", "webp":
+	default:
+		return fmt.Errorf("%w: tiles must be jpeg, png or webp", ErrInvalidParam)
+	}
+
+	return EncodeOptions{Quality: o.Quality}.validate()
+}
+
+// Pyramid describes a generated tile pyramid. Width and Height are those of
+// the upright image at the top level.
+type Pyramid struct {
+	TileOptions
+	Width    int
+	Height   int
+	MaxLevel int
+	Tiles    int
+}
+
+// LevelSize returns the size of the image at level, each level down being
+// half the size of the one above, rounded up.
+func (p Pyramid) LevelSize(level int) image.Point {
+	scale := math.Pow(2, float64(p.MaxLevel-level))
+	return image.Pt(int(math.Ceil(float64(p.Width)/scale)), int(math.Ceil(float64(p.Height)/scale)))
+}
+
+// Grid returns the number of tile columns and rows at level.
+func (p Pyramid) Grid(level int) (cols, rows int) {
+	size := p.LevelSize(level)
+	return (size.X + p.Size - 1) / p.Size, (size.Y + p.Size - 1) / p.Size
+}
+
+// Tile is one encoded tile. Col and Row count from the top left corner.
+type Tile struct {
+	Level int
+	Col   int
+	Row   int
+	Buf   []byte
+}
+
+// Tiles cuts buf into a tile pyramid, passing every tile to fn as soon as it
+// is encoded, from the top level down. Only the decode goes through backend;
+// the levels are scaled and cut in Go from a single frame, turned upright and
+// without metadata.
+func Tiles(backend Backend, buf []byte, o TileOptions, fn func(Tile) error) (Pyramid, error) {
+	o = o.WithDefaults()
+	if err := o.Validate(); err != nil {
+		return Pyramid{}, err
+	}
+
+	c, err := backend.Decode(buf)
+	if err != nil {
+		return Pyramid{}, err
+	}
+
+	if orientation := readMetadata(buf).orientation(); orientation > 1 {
+		if err := autoOrient(c, orientation); err != nil {
+			return Pyramid{}, err
+		}
+	}
+
+	img, err := c.Image()
+	if err != nil {
+		return Pyramid{}, err
+	}
+
+	level := &nativeCanvas{frames: []frame{{img: img}}, format: c.Format()}
+	size := level.Size()
+
+	p := Pyramid{TileOptions: o, Width: size.X, Height: size.Y, MaxLevel: maxTileLevel(size, o)}
+	enc := EncodeOptions{Quality: o.Quality, StripMetadata: true}
+
+	for l := p.MaxLevel; l >= 0; l-- {
+		levelSize := p.LevelSize(l)
+		if l != p.MaxLevel {
+			if err := level.Resize(levelSize.X, levelSize.Y); err != nil {
+				return p, err
+			}
+		}
+
+		cols, rows := p.Grid(l)
+		for row := 0; row < rows; row++ {
+			for col := 0; col < cols; col++ {
+				tile := level.Clone()
+				if err := tile.Extract(tileBounds(col, row, levelSize, o)); err != nil {
+					return p, err
+				}
+
+				out, err := tile.Encode(o.Format, enc)
+				if err != nil {
+					return p, err
+				}
+
+				if err := fn(Tile{Level: l, Col: col, Row: row, Buf: out}); err != nil {
+					return p, err
+				}
+				p.Tiles++
+			}
+		}
+	}
+
+	return p, nil
+}
+
+// maxTileLevel returns the level of the full size image. Deep Zoom halves the
+// image down to a single pixel, XYZ only until it fits in one tile.
+func maxTileLevel(size image.Point, o TileOptions) int {
+	longest := float64(max(size.X, size.Y))
+	if o.Layout == TileLayoutXYZ {
+		return max(0, int(math.Ceil(math.Log2(longest/float64(o.Size)))))
+	}
+
+	return int(math.Ceil(math.Log2(longest)))
+}
+
+// tileBounds returns the area of a tile within its level, including the
+// overlap with its neighbours.
+func tileBounds(col, row int, level image.Point, o TileOptions) image.Rectangle {
+	r := image.Rect(col*o.Size, row*o.Size, (col+1)*o.Size, (row+1)*o.Size)
+	r = r.Inset(-o.Overlap)
+
+	return r.Intersect(image.Rectangle{Max: level})
+}
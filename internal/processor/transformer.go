@@ -1,285 +1,275 @@
 package processor
 
 import (
-	"bytes"
 	"errors"
+	"fmt"
 	"image"
-	"image/jpeg"
-	"image/png"
 	"log"
 
 	"github.com/disintegration/gift"
-	"github.com/h2non/bimg"
-	"github.com/kolesa-team/go-webp/encoder"
-	"github.com/kolesa-team/go-webp/webp"
-	"golang.org/x/image/tiff"
 )
 
 var (
 	ErrInvalidParam = errors.New("invalid param value")
 )
 
+// Limits on the images an operation may produce, whatever the entry point.
+// Decoded, a MaxPixels image takes about 160 MB as NRGBA.
+const (
+	MaxDimension = 8192
+	MaxPixels    = 40_000_000
+)
+
+// checkOutputSize rejects results wider or taller than MaxDimension, or
+// larger than MaxPixels.
+func checkOutputSize(size image.Point) error {
+	if size.X > MaxDimension || size.Y > MaxDimension {
+		return fmt.Errorf("%w: result of %dx%d exceeds the maximum of %d pixels per side", ErrInvalidParam, size.X, size.Y, MaxDimension)
+	}
+	if int64(size.X)*int64(size.Y) > MaxPixels {
+		return fmt.Errorf("%w: result of %dx%d exceeds the maximum of %d pixels", ErrInvalidParam, size.X, size.Y, MaxPixels)
+	}
+
+	return nil
+}
+
 type ImageTransformer struct {
-	buf     []byte
-	options Transformer
+	backend   Backend
+	buf       []byte
+	ops       []Operation
+	opts      Options
+	resources Resources
 }
 
 type Transformer struct {
 	Resize struct {
-		Width  int
-		Height int
+		Width              int
+		Height             int
+		Fit                string
+		Background         string
+		Gravity            string
+		Percent            float32
+		WithoutEnlargement bool
 	}
 	Crop struct {
-		Width  int
-		Height int
+		Width       int
+		Height      int
+		X           *int
+		Y           *int
+		Gravity     string
+		AspectRatio string
 	}
+	Frame   int
 	Mirror  bool
 	Flip    bool
 	Rotate  int
 	Quality int
 	Format  string
+	Encoder struct {
+		Progressive      bool
+		Lossless         bool
+		CompressionLevel int
+		Subsampling      string
+		TIFFCompression  string
+	}
 	Filters struct {
-		Grayscale    bool
-		Sepia        bool
-		Gamma        float32
-		GaussianBlur float32
+		Grayscale     bool
+		Sepia         bool
+		SepiaStrength float32
+		Gamma         float32
+		GaussianBlur  float32
+		Brightness    float32
+		Contrast      float32
+		Saturation    float32
+		Hue           float32
+		Sharpen       struct {
+			Sigma     float32
+			Amount    float32
+			Threshold float32
+		}
+		Invert   bool
+		Colorize struct {
+			Hue        float32
+			Saturation float32
+			Amount     float32
+		}
+		Pixelate    int
+		Convolution struct {
+			Kernel    []float32
+			Normalize bool
+		}
+		LUT          string
+		LUTIntensity *float32 //nil grades at full intensity
+	}
+	Watermark struct {
+		ImageID int64
+		Text    string
+		Color   string
+		Gravity string
+		Margin  int
+		Opacity float32
+		Scale   float32
+		Tile    bool
 	}
 }
 
+// Process validates the pipeline, runs its operations in order on a single
+// decoded canvas and encodes the result once. The source metadata is copied
+// to the result as allowed by the options.
 func (it *ImageTransformer) Process() ([]byte, error) {
-	imgQuality := it.options.Quality
-	if imgQuality <= 0 {
-		imgQuality = 75 //default value
-	}
-
-	bimgOpts := bimg.Options{
-		Rotate:  bimg.Angle(it.options.Rotate),
-		Flop:    it.options.Flip,
-		Flip:    it.options.Mirror,
-		Quality: imgQuality,
+	if err := Validate(it.ops); err != nil {
+		return nil, err
 	}
-
-	newBuf, err := bimg.NewImage(it.buf).Process(bimgOpts)
-	if err != nil {
+	if err := it.opts.Validate(); err != nil {
 		return nil, err
 	}
 
-	// apply resize if neccessary
-	rWidth := it.options.Resize.Width
-	rHeight := it.options.Resize.Height
-	if rWidth > 0 && rHeight > 0 {
-		newBuf, err = bimg.NewImage(newBuf).Process(bimg.Options{
-			Width:  rWidth,
-			Height: rHeight,
-		})
-		if err != nil {
-			return nil, err
-		}
-		log.Println("resizing done")
-		// return nil, ErrInvalidParam
-	}
+	meta := readMetadata(it.buf)
 
-	// apply crop if neccessary
-	cWidth := it.options.Crop.Width
-	cHeight := it.options.Crop.Height
+	orientation := meta.orientation()
+	orient := it.opts.AutoOrient && orientation > 1
+	if orient {
+		orientation = 1
+	}
 
-	if cWidth > 0 && cHeight > 0 {
-		newBuf, err = bimg.NewImage(newBuf).Process(bimg.Options{
-			Width:   cWidth,
-			Height:  cHeight,
-			Gravity: bimg.GravityCentre,
-		})
-		if err != nil {
-			return nil, err
+	if len(it.ops) == 0 && !orient {
+		if !it.opts.Metadata.Strip {
+			return it.buf, nil
+		}
+		// rewrite the metadata alone instead of re-encoding the pixels
+		if canWriteMetadata(DetectFormat(it.buf)) {
+			return writeMetadata(it.buf, meta.filter(it.opts.Metadata, orientation))
 		}
-		log.Println("crop done")
-		// return nil, ErrInvalidParam
 	}
 
-	//apply conversion if neccessary
-	newType := it.options.Format
-	if newType == "jpg" {
-		newType = "jpeg"
-	}
-	if newType == "tif" {
-		newType = "tiff"
+	c, err := it.backend.Decode(it.buf)
+	if err != nil {
+		return nil, err
 	}
 
-	bimgImgType, ok := ImageTypes[newType]
-	if !ok && newType != "" {
-		return nil, errors.New("unsorported image format")
+	if orient {
+		if err := autoOrient(c, meta.orientation()); err != nil {
+			return nil, err
+		}
 	}
 
-	if newType != "" {
-		newBuf, err = bimg.NewImage(newBuf).Convert(bimgImgType)
-		if err != nil {
-			return nil, err
+	var (
+		format string
+		opts   EncodeOptions
+	)
+
+	for i := 0; i < len(it.ops); i++ {
+		op := it.ops[i]
+
+		var err error
+		switch {
+		case isFilter(op.Op):
+			// consecutive filters share a single pass over the pixels
+			j := i + 1
+			for j < len(it.ops) && isFilter(it.ops[j].Op) {
+				j++
+			}
+
+			err = addFilters(c, it.ops[i:j])
+			i = j - 1
+		case op.Op == OpConvert:
+			// conversion only changes how the final result is encoded
+			if op.Format != "" {
+				format = normalizeFormat(op.Format)
+			}
+			opts = opts.merge(op.encodeOptions())
+		case op.Op == OpWatermark:
+			err = watermark(c, op, it.resources)
+		case op.Op == OpLUT:
+			err = applyLUT(c, op, it.resources)
+		default:
+			err = apply(c, op)
 		}
 
-		if bimg.DetermineImageTypeName(newBuf) != newType {
-			return nil, errors.New("unknown conversion error")
+		if err != nil {
+			return nil, &StepError{Index: i, Op: op.Op, Err: err}
 		}
-		log.Println("format conversion done")
+		log.Printf("%s done", op.Op)
 	}
 
-	//add filters if neccessary
-	newBuf, err = addFilters(newBuf, it.options)
+	// encoders that cannot be rewritten afterwards must drop the metadata
+	// themselves, including a now stale orientation
+	opts.StripMetadata = it.opts.Metadata.Strip || orient
+
+	buf, err := c.Encode(format, opts)
 	if err != nil {
 		return nil, err
 	}
-	// log.Println("filters application done")
 
-	return newBuf, nil
+	return writeMetadata(buf, meta.filter(it.opts.Metadata, orientation))
 }
 
-func (it *ImageTransformer) Resize(width, height int) ([]byte, error) {
-	newBuf, err := bimg.NewImage(it.buf).Resize(width, height)
-	if err != nil {
-		return nil, err
+func apply(c Canvas, op Operation) error {
+	switch op.Op {
+	case OpResize:
+		return resize(c, op)
+	case OpCrop:
+		return crop(c, op)
+	case OpRotate:
+		return c.Rotate(op.Angle)
+	case OpFlip:
+		return c.Flip()
+	case OpMirror:
+		return c.Mirror()
+	case OpFrame:
+		return c.KeepFrame(op.Frame - 1)
 	}
 
-	return newBuf, nil
+	return fmt.Errorf("%w: unknown op %q", ErrInvalidParam, op.Op)
 }
 
-func (it *ImageTransformer) Crop(width, height int) ([]byte, error) {
-	newBuf, err := bimg.NewImage(it.buf).Crop(width, height, bimg.GravityCentre) //Third parameter is Gravity
-	if err != nil {
-		return nil, err
-	}
+// single runs one operation outside of a pipeline.
+func (it *ImageTransformer) single(op Operation) ([]byte, error) {
+	return (&ImageTransformer{backend: it.backend, buf: it.buf, ops: []Operation{op}, opts: it.opts}).Process()
+}
 
-	return newBuf, nil
+func (it *ImageTransformer) Resize(width, height int) ([]byte, error) {
+	return it.single(Operation{Op: OpResize, Width: width, Height: height})
 }
 
-func (it *ImageTransformer) Rotate(a bimg.Angle) ([]byte, error) {
-	newBuf, err := bimg.NewImage(it.buf).Rotate(a)
-	if err != nil {
-		return nil, err
-	}
+func (it *ImageTransformer) Crop(width, height int) ([]byte, error) {
+	return it.single(Operation{Op: OpCrop, Width: width, Height: height})
+}
 
-	return newBuf, nil
+func (it *ImageTransformer) Rotate(angle int) ([]byte, error) {
+	return it.single(Operation{Op: OpRotate, Angle: angle})
 }
 
 func (it *ImageTransformer) Flip() ([]byte, error) { //Reverse across horizontal axis
-	newBuf, err := bimg.NewImage(it.buf).Flop()
-	if err != nil {
-		return nil, err
-	}
-
-	return newBuf, nil
+	return it.single(Operation{Op: OpFlip})
 }
 
 func (it *ImageTransformer) Mirror() ([]byte, error) { //Reverse across vertical axis
-	newBuf, err := bimg.NewImage(it.buf).Flip()
-	if err != nil {
-		return nil, err
-	}
-
-	return newBuf, nil
+	return it.single(Operation{Op: OpMirror})
 }
 
 func (it *ImageTransformer) Compress(value int) ([]byte, error) {
-	newBuf, err := bimg.NewImage(it.buf).Process(bimg.Options{
-		Quality: value,
-	})
-
-	if err != nil {
-		return nil, err
-	}
-
-	return newBuf, nil
+	return it.single(Operation{Op: OpConvert, Quality: value})
 }
 
 func (it *ImageTransformer) Convert(t string) ([]byte, error) {
-	imgType := bimg.DetermineImageTypeName(it.buf)
-
-	if imgType == t {
+	if DetectFormat(it.buf) == normalizeFormat(t) {
 		return it.buf, nil
 	}
 
-	newType, ok := ImageTypes[t]
-	if !ok {
-		return nil, errors.New("unsorported image format")
-	}
-
-	convertedImg, err := bimg.NewImage(it.buf).Convert(newType)
-	if err != nil {
-		return nil, err
-	}
-
-	if bimg.DetermineImageTypeName(convertedImg) != t {
-		return nil, errors.New("unknown conversion error")
-	}
-
-	return convertedImg, nil
+	return it.single(Operation{Op: OpConvert, Format: t})
 }
 
-func addFilters(buf []byte, options Transformer) ([]byte, error) {
-	imageType := bimg.DetermineImageTypeName(buf)
-	filters := options.Filters
-
+func addFilters(c Canvas, ops []Operation) error {
 	g := gift.New()
 
-	if filters.Grayscale {
-		g.Add(gift.Grayscale())
-	}
-
-	if filters.Sepia {
-		g.Add(gift.Sepia(50))
-	}
-
-	gamma := filters.Gamma
-	if gamma > 0 {
-		g.Add(gift.Gamma(gamma))
-	}
-
-	sigma := filters.GaussianBlur
-	if sigma > 0 {
-		g.Add(gift.GaussianBlur(sigma))
+	for _, op := range ops {
+		g.Add(giftFilter(op))
 	}
 
-	src, _, err := image.Decode(bytes.NewReader(buf))
-	if err != nil {
-		return nil, err
-	}
-
-	dst := image.NewNRGBA(g.Bounds(src.Bounds()))
-	g.Draw(dst, src)
-
-	newBuf, err := encodeImage(dst, imageType)
-	if err != nil {
-		return nil, err
-	}
-
-	return newBuf, nil
-}
-
-func encodeImage(dst image.Image, format string) ([]byte, error) {
-	bufWriter := new(bytes.Buffer)
-
-	switch format {
-	case "jpeg", "jpg":
-		if err := jpeg.Encode(bufWriter, dst, nil); err != nil {
-			return nil, err
-		}
-	case "png":
-		if err := png.Encode(bufWriter, dst); err != nil {
-			return nil, err
-		}
-	case "webp":
-		options, err := encoder.NewLossyEncoderOptions(encoder.PresetDefault, 75)
-		if err != nil {
-			return nil, err
-		}
-		if err := webp.Encode(bufWriter, dst, options); err != nil {
-			return nil, err
-		}
-	case "tiff", "tif":
-		if err := tiff.Encode(bufWriter, dst, nil); err != nil {
-			return nil, err
-		}
-	default:
-		return nil, errors.New("unsuported/bad image format")
-	}
-
-	return bufWriter.Bytes(), nil
+	return c.Each(func(src image.Image) (image.Image, error) {
+		dst := image.NewNRGBA(g.Bounds(src.Bounds()))
+		g.Draw(dst, src)
+		return dst, nil
+	})
 }
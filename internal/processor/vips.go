@@ -0,0 +1,286 @@
+//go:build cgo && !novips
+
+package processor
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+
+	"github.com/h2non/bimg"
+)
+
+var vipsTypes = map[string]bimg.ImageType{
+	"jpeg": bimg.JPEG,
+	"png":  bimg.PNG,
+	"webp": bimg.WEBP,
+	"tiff": bimg.TIFF,
+	"gif":  bimg.GIF,
+	"avif": bimg.AVIF,
+	"heif": bimg.HEIF,
+}
+
+func init() {
+	backends[BackendVips] = func() Backend { return VipsBackend{} }
+	DefaultBackend = BackendVips
+}
+
+// VipsBackend processes images with libvips through bimg.
+type VipsBackend struct{}
+
+func (VipsBackend) Name() string {
+	return BackendVips
+}
+
+func (VipsBackend) Encodes(format string) bool {
+	t, ok := vipsTypes[normalizeFormat(format)]
+	return ok && bimg.IsTypeSupportedSave(t)
+}
+
+func (VipsBackend) Decode(buf []byte) (Canvas, error) {
+	// bimg only ever loads the first page, so animations are handled in Go
+	if c, ok, err := decodeAnimation(buf); ok || err != nil {
+		if err != nil {
+			return nil, err
+		}
+		return &vipsAnimation{c}, nil
+	}
+
+	format := DetectFormat(buf)
+	t, ok := vipsTypes[format]
+	if !ok {
+		return nil, image.ErrFormat
+	}
+	if !bimg.IsTypeSupported(t) {
+		return nil, fmt.Errorf("%w: libvips was built without %s support", ErrUnsupportedFormat, format)
+	}
+
+	// the EXIF orientation is left to the pipeline, every call below passes
+	// NoAutoRotate so libvips does not apply it behind its back
+	c := &vipsCanvas{buf: buf, format: format}
+	return c, c.updateSize()
+}
+
+// vipsCanvas keeps the image as an encoded buffer, since bimg re-encodes after
+// every call. Once touched, the pixels are kept as lossless PNG, so that only
+// the final Encode compresses them in the target format.
+type vipsCanvas struct {
+	buf    []byte
+	format string
+	size   image.Point
+}
+
+func (c *vipsCanvas) updateSize() error {
+	size, err := bimg.Size(c.buf)
+	if err != nil {
+		return err
+	}
+
+	c.size = image.Pt(size.Width, size.Height)
+	return nil
+}
+
+func (c *vipsCanvas) process(o bimg.Options) error {
+	o.NoAutoRotate = true
+	// bimg would otherwise save in the source format, lossy for JPEG and WebP
+	o.Type = bimg.PNG
+
+	buf, err := bimg.NewImage(c.buf).Process(o)
+	if err != nil {
+		return err
+	}
+
+	c.buf = buf
+	return c.updateSize()
+}
+
+func (c *vipsCanvas) Size() image.Point {
+	return c.size
+}
+
+func (c *vipsCanvas) Format() string {
+	return c.format
+}
+
+func (c *vipsCanvas) Frames() int {
+	return 1
+}
+
+func (c *vipsCanvas) Each(fn func(image.Image) (image.Image, error)) error {
+	img, err := c.Image()
+	if err != nil {
+		return err
+	}
+
+	if img, err = fn(img); err != nil {
+		return err
+	}
+
+	return c.SetImage(img)
+}
+
+func (c *vipsCanvas) KeepFrame(n int) error {
+	if n != 0 {
+		return fmt.Errorf("%w: frame %d out of range, image has 1", ErrInvalidParam, n+1)
+	}
+
+	return nil
+}
+
+func (c *vipsCanvas) Resize(width, height int) error {
+	return c.process(bimg.Options{Width: width, Height: height, Force: true})
+}
+
+func (c *vipsCanvas) Extract(r image.Rectangle) error {
+	return c.process(bimg.Options{
+		Top:        r.Min.Y,
+		Left:       r.Min.X,
+		AreaWidth:  r.Dx(),
+		AreaHeight: r.Dy(),
+	})
+}
+
+func (c *vipsCanvas) Embed(width, height int, background color.NRGBA) error {
+	return c.process(bimg.Options{
+		Width:      width,
+		Height:     height,
+		Embed:      true,
+		Extend:     bimg.ExtendBackground,
+		Background: bimg.Color{R: background.R, G: background.G, B: background.B},
+	})
+}
+
+func (c *vipsCanvas) Rotate(angle int) error {
+	return c.process(bimg.Options{Rotate: bimg.Angle((angle%360 + 360) % 360)})
+}
+
+func (c *vipsCanvas) Flip() error {
+	return c.process(bimg.Options{Flop: true})
+}
+
+func (c *vipsCanvas) Mirror() error {
+	return c.process(bimg.Options{Flip: true})
+}
+
+func (c *vipsCanvas) Clone() Canvas {
+	clone := *c
+	return &clone
+}
+
+func (c *vipsCanvas) Image() (image.Image, error) {
+	img, _, err := image.Decode(bytes.NewReader(c.buf))
+	if errors.Is(err, image.ErrFormat) {
+		// let libvips decode what Go cannot
+		buf, err := bimg.NewImage(c.buf).Process(bimg.Options{Type: bimg.PNG, NoAutoRotate: true})
+		if err != nil {
+			return nil, err
+		}
+		return png.Decode(bytes.NewReader(buf))
+	}
+
+	return img, err
+}
+
+func (c *vipsCanvas) SetImage(img image.Image) error {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return err
+	}
+
+	c.buf = buf.Bytes()
+	return c.updateSize()
+}
+
+func (c *vipsCanvas) Encode(format string, opts EncodeOptions) ([]byte, error) {
+	if format == "" {
+		format = c.format
+	}
+
+	format = normalizeFormat(format)
+	if format == DetectFormat(c.buf) && opts == (EncodeOptions{}) {
+		return c.buf, nil
+	}
+
+	// bimg has no TIFF compression setting, the Go encoder does
+	if format == "tiff" && opts.TIFFCompression != "" {
+		img, err := c.Image()
+		if err != nil {
+			return nil, err
+		}
+		return encodeImage(img, format, opts)
+	}
+
+	if format == "jpeg" && opts.Subsampling != "" {
+		if err := vipsSubsampling(opts); err != nil {
+			return nil, err
+		}
+	}
+
+	t, ok := vipsTypes[format]
+	if !ok {
+		return nil, ErrUnsupportedFormat
+	}
+	if !bimg.IsTypeSupportedSave(t) {
+		return nil, fmt.Errorf("%w: libvips was built without %s support", ErrUnsupportedFormat, format)
+	}
+
+	return bimg.NewImage(c.buf).Process(bimg.Options{
+		Type:          t,
+		Quality:       opts.Quality,
+		Interlace:     opts.Progressive,
+		Lossless:      opts.Lossless,
+		Compression:   opts.CompressionLevel,
+		StripMetadata: opts.StripMetadata,
+		NoAutoRotate:  true,
+	})
+}
+
+// vipsSubsampling checks that the requested chroma subsampling matches what
+// libvips will pick: bimg cannot set it explicitly, and libvips keeps full
+// chroma resolution only at quality 90 and above.
+func vipsSubsampling(opts EncodeOptions) error {
+	quality := opts.Quality
+	if quality == 0 {
+		quality = bimg.Quality
+	}
+
+	switch {
+	case opts.Subsampling == Subsampling444 && quality < 90:
+		return fmt.Errorf("%w: %s chroma needs quality 90 or above with libvips", ErrInvalidParam, Subsampling444)
+	case opts.Subsampling == Subsampling420 && quality >= 90:
+		return fmt.Errorf("%w: %s chroma needs quality below 90 with libvips", ErrInvalidParam, Subsampling420)
+	}
+
+	return nil
+}
+
+// vipsAnimation is an animated image processed frame by frame in Go. When the
+// result is a still image, the first frame is handed to libvips for encoding.
+type vipsAnimation struct {
+	*nativeCanvas
+}
+
+func (c *vipsAnimation) Clone() Canvas {
+	return &vipsAnimation{c.nativeCanvas.Clone().(*nativeCanvas)}
+}
+
+func (c *vipsAnimation) Encode(format string, opts EncodeOptions) ([]byte, error) {
+	if format == "" {
+		format = c.format
+	}
+	format = normalizeFormat(format)
+
+	if c.Frames() > 1 && isAnimatedFormat(format) {
+		return c.nativeCanvas.Encode(format, opts)
+	}
+
+	still := &vipsCanvas{format: c.format}
+	if err := still.SetImage(c.frames[0].img); err != nil {
+		return nil, err
+	}
+
+	return still.Encode(format, opts)
+}
@@ -0,0 +1,197 @@
+package processor
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"sync"
+
+	"github.com/disintegration/gift"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/gofont/goregular"
+	"golang.org/x/image/font/opentype"
+	"golang.org/x/image/math/fixed"
+)
+
+// Resources gives operations access to assets stored outside the pipeline,
+// such as previously uploaded images used as watermarks and colour grading
+// LUTs.
+type Resources interface {
+	Image(id int64) ([]byte, error)
+	LUT(name string) ([]byte, error) //.cube file
+}
+
+var ErrNoResources = errors.New("operation references a resource but none are available")
+
+const (
+	defaultWatermarkScale   = 0.25
+	defaultWatermarkGravity = GravitySouthEast
+	watermarkFontSize       = 96 //text is rendered large and scaled down like an image overlay
+	watermarkMaxText        = 200
+)
+
+var watermarkFont = sync.OnceValues(func() (*opentype.Font, error) {
+	return opentype.Parse(goregular.TTF)
+})
+
+func validateWatermark(op Operation) error {
+	if (op.ImageID > 0) == (op.Text != "") {
+		return fmt.Errorf("%w: exactly one of image_id or text is required", ErrInvalidParam)
+	}
+	if len(op.Text) > watermarkMaxText {
+		return fmt.Errorf("%w: text must be at most %d characters", ErrInvalidParam, watermarkMaxText)
+	}
+	if !validGravity(op.Gravity) {
+		return fmt.Errorf("%w: unknown gravity %q", ErrInvalidParam, op.Gravity)
+	}
+	if op.Margin < 0 {
+		return fmt.Errorf("%w: margin must not be negative", ErrInvalidParam)
+	}
+	if op.Opacity < 0 || op.Opacity > 1 {
+		return fmt.Errorf("%w: opacity must be between 0 and 1", ErrInvalidParam)
+	}
+	if op.Scale < 0 || op.Scale > 1 {
+		return fmt.Errorf("%w: scale must be between 0 and 1", ErrInvalidParam)
+	}
+	if op.Color != "" {
+		if _, err := parseColor(op.Color); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// watermark draws an image or text overlay on top of the canvas. The overlay
+// width is Scale times the base width (default 0.25), Opacity defaults to 1,
+// and with Tile set the overlay is repeated across the whole image, Margin
+// pixels apart.
+func watermark(c Canvas, op Operation, res Resources) error {
+	var (
+		overlay image.Image
+		err     error
+	)
+	if op.Text != "" {
+		overlay, err = textOverlay(op.Text, op.Color)
+	} else {
+		overlay, err = imageOverlay(op.ImageID, res)
+	}
+	if err != nil {
+		return err
+	}
+
+	return c.Each(func(base image.Image) (image.Image, error) {
+		return drawWatermark(base, overlay, op), nil
+	})
+}
+
+func drawWatermark(base, overlay image.Image, op Operation) *image.NRGBA {
+	b := base.Bounds()
+	dst := image.NewNRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(dst, dst.Bounds(), base, b.Min, draw.Src)
+
+	scale := op.Scale
+	if scale == 0 {
+		scale = defaultWatermarkScale
+	}
+
+	ob := overlay.Bounds()
+	ow := int(float32(b.Dx()) * scale)
+	oh := ob.Dy() * ow / max(ob.Dx(), 1)
+	if ow < 1 || oh < 1 {
+		return dst
+	}
+
+	g := gift.New(gift.Resize(ow, oh, gift.LanczosResampling))
+	scaled := image.NewNRGBA(g.Bounds(ob))
+	g.Draw(scaled, overlay)
+
+	opacity := op.Opacity
+	if opacity == 0 {
+		opacity = 1
+	}
+	mask := image.NewUniform(color.Alpha{A: uint8(opacity * 255)})
+
+	stamp := func(pt image.Point) {
+		r := image.Rectangle{Min: pt, Max: pt.Add(image.Pt(ow, oh))}
+		draw.DrawMask(dst, r, scaled, image.Point{}, mask, image.Point{}, draw.Over)
+	}
+
+	if !op.Tile {
+		gravity := op.Gravity
+		if gravity == "" {
+			gravity = defaultWatermarkGravity
+		}
+		stamp(anchor(gravity, dst.Bounds(), ow, oh, op.Margin))
+		return dst
+	}
+
+	for y := op.Margin; y < dst.Bounds().Dy(); y += oh + op.Margin {
+		for x := op.Margin; x < dst.Bounds().Dx(); x += ow + op.Margin {
+			stamp(image.Pt(x, y))
+		}
+	}
+
+	return dst
+}
+
+func imageOverlay(id int64, res Resources) (image.Image, error) {
+	if res == nil {
+		return nil, ErrNoResources
+	}
+
+	buf, err := res.Image(id)
+	if err != nil {
+		return nil, err
+	}
+
+	overlay, _, err := image.Decode(bytes.NewReader(buf))
+	if err != nil {
+		return nil, err
+	}
+
+	return overlay, nil
+}
+
+func textOverlay(text, hex string) (image.Image, error) {
+	c := color.NRGBA{R: 0xff, G: 0xff, B: 0xff, A: 0xff}
+	if hex != "" {
+		var err error
+		if c, err = parseColor(hex); err != nil {
+			return nil, err
+		}
+	}
+
+	f, err := watermarkFont()
+	if err != nil {
+		return nil, err
+	}
+
+	face, err := opentype.NewFace(f, &opentype.FaceOptions{
+		Size:    watermarkFontSize,
+		DPI:     72,
+		Hinting: font.HintingFull,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer face.Close()
+
+	metrics := face.Metrics()
+	d := &font.Drawer{
+		Src:  image.NewUniform(c),
+		Face: face,
+	}
+
+	width := d.MeasureString(text).Ceil()
+	height := (metrics.Ascent + metrics.Descent).Ceil()
+
+	d.Dst = image.NewNRGBA(image.Rect(0, 0, max(width, 1), max(height, 1)))
+	d.Dot = fixed.P(0, metrics.Ascent.Ceil())
+	d.DrawString(text)
+
+	return d.Dst, nil
+}
@@ -0,0 +1,33 @@
+//go:build cgo
+
+package processor
+
+import (
+	"image"
+	"io"
+
+	"github.com/kolesa-team/go-webp/encoder"
+	"github.com/kolesa-team/go-webp/webp"
+)
+
+const webpLosslessLevel = 6 //libwebp default: 0 fastest to 9 smallest
+
+// nativeWebPEncoder tells whether encodeWebP works: libwebp is linked in.
+const nativeWebPEncoder = true
+
+func encodeWebP(w io.Writer, img image.Image, opts EncodeOptions) error {
+	var (
+		options *encoder.Options
+		err     error
+	)
+	if opts.Lossless {
+		options, err = encoder.NewLosslessEncoderOptions(encoder.PresetDefault, webpLosslessLevel)
+	} else {
+		options, err = encoder.NewLossyEncoderOptions(encoder.PresetDefault, float32(opts.quality()))
+	}
+	if err != nil {
+		return err
+	}
+
+	return webp.Encode(w, img, options)
+}
@@ -0,0 +1,19 @@
+//go:build !cgo
+
+package processor
+
+import (
+	"fmt"
+	"image"
+	"io"
+
+	_ "golang.org/x/image/webp" // decoder only; encoding needs libwebp
+)
+
+// nativeWebPEncoder tells whether encodeWebP works: without cgo webp images
+// can be read but not written.
+const nativeWebPEncoder = false
+
+func encodeWebP(w io.Writer, img image.Image, opts EncodeOptions) error {
+	return fmt.Errorf("%w: webp encoding requires cgo", ErrUnsupportedFormat)
+}
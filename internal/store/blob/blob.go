@@ -0,0 +1,112 @@
+// Package blob stores objects such as images behind a backend-neutral
+// interface, with implementations for the local filesystem, S3-compatible
+// services, Supabase storage and memory.
+package blob
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// Backend names accepted by New.
+const (
+	BackendLocal    = "local"
+	BackendMemory   = "memory"
+	BackendS3       = "s3"
+	BackendSupabase = "supabase"
+)
+
+var (
+	ErrNotFound   = errors.New("object not found")
+	ErrInvalidKey = errors.New("invalid object key")
+)
+
+// Store holds objects under slash separated keys such as "image1/tiles/0.jpg".
+type Store interface {
+	// Put stores size bytes read from r under key, replacing any existing
+	// object. size is -1 when unknown.
+	Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error
+	// Get opens the object for reading. The caller closes it.
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	// Update replaces an existing object, failing with ErrNotFound otherwise.
+	Update(ctx context.Context, key string, r io.Reader, size int64, contentType string) error
+	// Delete removes the object; deleting a missing object is not an error.
+	Delete(ctx context.Context, key string) error
+	// Move renames the object at src to dst, which should not exist; not
+	// every backend replaces it.
+	Move(ctx context.Context, src, dst string) error
+	Stat(ctx context.Context, key string) (ObjectInfo, error)
+	// List returns the objects whose key starts with prefix, sorted by key.
+	List(ctx context.Context, prefix string) ([]ObjectInfo, error)
+	// SignedURL returns a URL granting read access to the object for ttl.
+	SignedURL(ctx context.Context, key string, ttl time.Duration) (string, error)
+}
+
+type ObjectInfo struct {
+	Key         string
+	Size        int64
+	ContentType string
+	ModTime     time.Time
+}
+
+// Config selects and configures a backend. Only the settings of the chosen
+// backend are read.
+type Config struct {
+	Backend string
+
+	LocalDir string //root directory of the local backend
+
+	S3 S3Config
+
+	SupabaseProject string
+	SupabaseKey     string
+	SupabaseBucket  string
+}
+
+// New returns the configured store. Local and memory stores cannot sign URLs
+// themselves; theirs are signed with urls and served by the API.
+func New(cfg Config, urls URLs) (Store, error) {
+	switch cfg.Backend {
+	case BackendLocal:
+		return NewLocal(cfg.LocalDir, urls)
+	case BackendMemory:
+		return NewMemory(urls), nil
+	case BackendS3:
+		return NewS3(cfg.S3)
+	case BackendSupabase:
+		return NewSupabase(cfg.SupabaseProject, cfg.SupabaseKey, cfg.SupabaseBucket), nil
+	}
+
+	return nil, fmt.Errorf("unknown blob backend %q (have %s, %s, %s, %s)", cfg.Backend, BackendLocal, BackendMemory, BackendS3, BackendSupabase)
+}
+
+// ReadAll reads a whole object into memory.
+func ReadAll(ctx context.Context, s Store, key string) ([]byte, error) {
+	r, err := s.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	return io.ReadAll(r)
+}
+
+// validateKey rejects keys that could escape the store, such as absolute
+// paths and ".." segments.
+func validateKey(key string) error {
+	if key == "" || strings.HasPrefix(key, "/") || strings.Contains(key, "\\") {
+		return fmt.Errorf("%w: %q", ErrInvalidKey, key)
+	}
+
+	for _, segment := range strings.Split(key, "/") {
+		if segment == "" || segment == "." || segment == ".." {
+			return fmt.Errorf("%w: %q", ErrInvalidKey, key)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,252 @@
+package blob
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"path"
+	"time"
+
+	"github.com/xbanchon/image-processing-service/internal/processor"
+)
+
+const (
+	urlDuration = 6 * time.Hour
+
+	// inspectHeadSize bounds the leading bytes of a streamed upload kept for
+	// inspection, enough for the headers and metadata of most images.
+	inspectHeadSize = 1 << 20
+)
+
+// ImageBucket stores images in a Store under their filenames.
+type ImageBucket struct {
+	store Store
+}
+
+// UploadImage stores content of the user under its content key, named after
+// its sniffed format, and returns the key and a signed URL for it. Content
+// the user already has in the bucket is not written again.
+func (b ImageBucket) UploadImage(userID int64, buf []byte) (string, string, error) {
+	format, ok := processor.LookupFormat(processor.DetectFormat(buf))
+	if !ok {
+		return "", "", processor.ErrUnsupportedFormat
+	}
+
+	key := ContentKey(userID, buf, format.Extension)
+	if err := b.EnsureImage(key, buf); err != nil {
+		return "", "", err
+	}
+
+	signedURL, err := b.store.SignedURL(context.Background(), key, urlDuration)
+	if err != nil {
+		return "", "", err
+	}
+
+	return key, signedURL, nil
+}
+
+// EnsureImage writes buf under filename unless an object is already there,
+// which for content keys means the same bytes.
+func (b ImageBucket) EnsureImage(filename string, buf []byte) error {
+	_, err := b.store.Stat(context.Background(), filename)
+	if !errors.Is(err, ErrNotFound) {
+		return err
+	}
+
+	return b.WriteImage(filename, buf)
+}
+
+// StagedImage is an upload streamed into the bucket under a temporary key,
+// on its way to its content key.
+type StagedImage struct {
+	Key     string //content key
+	Staging string //temporary key, empty once moved to Key
+	Format  string
+	Size    int64
+	Head    []byte //leading bytes, at most inspectHeadSize
+}
+
+// Complete reports whether Head holds the whole upload.
+func (s *StagedImage) Complete() bool {
+	return int64(len(s.Head)) == s.Size
+}
+
+// StageImage streams an upload of the user into the bucket, sniffing its
+// format from the first bytes and hashing it on the way, without holding
+// more than its head in memory.
+func (b ImageBucket) StageImage(ctx context.Context, userID int64, r io.Reader) (*StagedImage, error) {
+	br := bufio.NewReaderSize(r, 512)
+	sniff, err := br.Peek(512)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	format, ok := processor.LookupFormat(processor.DetectFormat(sniff))
+	if !ok {
+		return nil, processor.ErrUnsupportedFormat
+	}
+
+	var id [16]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return nil, err
+	}
+
+	staged := &StagedImage{
+		Staging: UserPrefix(userID) + "staging/" + hex.EncodeToString(id[:]) + "." + format.Extension,
+		Format:  format.Name,
+	}
+
+	hash := sha256.New()
+	head := &headWriter{limit: inspectHeadSize}
+	counter := &countWriter{}
+
+	body := io.TeeReader(br, io.MultiWriter(hash, head, counter))
+	if err := b.store.Put(ctx, staged.Staging, body, -1, format.MIMEType); err != nil {
+		_ = b.store.Delete(context.Background(), staged.Staging)
+		return nil, err
+	}
+
+	staged.Key = hashKey(userID, hash.Sum(nil), format.Extension)
+	staged.Size = counter.n
+	staged.Head = head.buf
+
+	return staged, nil
+}
+
+// CommitImage moves the staged copy to its content key, or drops it when the
+// key already holds the same content. It must only be called once the
+// content is referenced, so that the object is collected with its last
+// reference; failed uploads are discarded with DiscardImage instead.
+func (b ImageBucket) CommitImage(staged *StagedImage) error {
+	if err := b.restore(staged); err != nil {
+		return err
+	}
+
+	if staged.Staging == "" {
+		return nil
+	}
+
+	if err := b.store.Delete(context.Background(), staged.Staging); err != nil {
+		return err
+	}
+	staged.Staging = ""
+
+	return nil
+}
+
+// DiscardImage deletes the staged copy of an upload that was not recorded.
+func (b ImageBucket) DiscardImage(staged *StagedImage) error {
+	if staged.Staging == "" {
+		return nil
+	}
+
+	if err := b.store.Delete(context.Background(), staged.Staging); err != nil {
+		return err
+	}
+	staged.Staging = ""
+
+	return nil
+}
+
+// restore moves the staged copy to the content key unless an object is there.
+func (b ImageBucket) restore(staged *StagedImage) error {
+	if staged.Staging == "" {
+		return nil
+	}
+
+	ctx := context.Background()
+
+	_, err := b.store.Stat(ctx, staged.Key)
+	if !errors.Is(err, ErrNotFound) {
+		return err
+	}
+
+	if err := b.store.Move(ctx, staged.Staging, staged.Key); err != nil {
+		return err
+	}
+	staged.Staging = ""
+
+	return nil
+}
+
+// WriteImage stores buf under the exact filename given, for objects that are
+// only ever served through the API.
+func (b ImageBucket) WriteImage(filename string, buf []byte) error {
+	contentType, err := imageContentType(filename, buf)
+	if err != nil {
+		return err
+	}
+
+	return b.store.Put(context.Background(), filename, bytes.NewReader(buf), int64(len(buf)), contentType)
+}
+
+func (b ImageBucket) GetNewSignedImageURL(filename string, duration int) (string, error) {
+	return b.store.SignedURL(context.Background(), filename, time.Duration(duration)*time.Second)
+}
+
+func (b ImageBucket) UpdateImage(filename string, buf []byte) error {
+	contentType, err := imageContentType(filename, buf)
+	if err != nil {
+		return err
+	}
+
+	return b.store.Update(context.Background(), filename, bytes.NewReader(buf), int64(len(buf)), contentType)
+}
+
+func (b ImageBucket) StreamImage(filename string) ([]byte, error) {
+	return ReadAll(context.Background(), b.store, filename)
+}
+
+// DeleteImages removes the objects, typically those left without references.
+func (b ImageBucket) DeleteImages(filenames []string) error {
+	for _, filename := range filenames {
+		if err := b.store.Delete(context.Background(), filename); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// headWriter keeps the first bytes written to it, up to limit.
+type headWriter struct {
+	buf   []byte
+	limit int
+}
+
+func (w *headWriter) Write(p []byte) (int, error) {
+	if n := min(len(p), w.limit-len(w.buf)); n > 0 {
+		w.buf = append(w.buf, p[:n]...)
+	}
+
+	return len(p), nil
+}
+
+// countWriter counts the bytes written to it.
+type countWriter struct {
+	n int64
+}
+
+func (w *countWriter) Write(p []byte) (int, error) {
+	w.n += int64(len(p))
+	return len(p), nil
+}
+
+// imageContentType returns the MIME type of the sniffed image format, falling
+// back to the filename extension for content that cannot be sniffed.
+func imageContentType(filename string, buf []byte) (string, error) {
+	format, ok := processor.LookupFormat(processor.DetectFormat(buf))
+	if !ok {
+		format, ok = processor.LookupFormat(path.Ext(filename))
+	}
+	if !ok {
+		return "", processor.ErrUnsupportedFormat
+	}
+
+	return format.MIMEType, nil
+}
@@ -0,0 +1,43 @@
+package blob
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// UserPrefix is the key prefix of every object owned by a user.
+func UserPrefix(userID int64) string {
+	return fmt.Sprintf("users/%d/", userID)
+}
+
+// ContentKey returns the key of content owned by the user, named after the
+// SHA-256 of its bytes: users/7/9f86...0a08.jpg. Identical uploads of a user
+// map to the same object, and ext should come from the sniffed content rather
+// than the uploaded filename.
+//
+// Deduplication is per user: the key stays under the user's prefix, so the
+// same bytes uploaded by two users are stored twice. This keeps every object
+// of a user under UserPrefix, where it can be listed or removed on its own.
+func ContentKey(userID int64, buf []byte, ext string) string {
+	sum := sha256.Sum256(buf)
+
+	return hashKey(userID, sum[:], ext)
+}
+
+func hashKey(userID int64, sum []byte, ext string) string {
+	return UserPrefix(userID) + hex.EncodeToString(sum) + "." + strings.TrimPrefix(ext, ".")
+}
+
+// TilePrefix is the key prefix of the tile pyramids cut from an image, each
+// under a folder of its own.
+func TilePrefix(userID, imageID int64) string {
+	return fmt.Sprintf("%stiles/%d/", UserPrefix(userID), imageID)
+}
+
+// UploadPrefix is the key prefix of the chunks of a resumable upload, kept
+// until the upload becomes an image or expires.
+func UploadPrefix(userID, uploadID int64) string {
+	return fmt.Sprintf("%suploads/%d/", UserPrefix(userID), uploadID)
+}
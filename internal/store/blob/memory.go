@@ -0,0 +1,141 @@
+package blob
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Memory keeps objects in a map. It is meant for tests and local runs; the
+// contents are lost when the process exits.
+type Memory struct {
+	mu      sync.RWMutex
+	objects map[string]memoryObject
+	urls    URLs
+}
+
+type memoryObject struct {
+	data        []byte
+	contentType string
+	modTime     time.Time
+}
+
+func NewMemory(urls URLs) *Memory {
+	return &Memory{objects: make(map[string]memoryObject), urls: urls}
+}
+
+func (s *Memory) Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error {
+	if err := validateKey(key); err != nil {
+		return err
+	}
+
+	data, err := io.ReadAll(contextReader{ctx, r})
+	if err != nil {
+		return err
+	}
+
+	if contentType == "" {
+		contentType = contentTypeByExtension(key)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.objects[key] = memoryObject{data: data, contentType: contentType, modTime: time.Now()}
+
+	return nil
+}
+
+func (s *Memory) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	obj, ok := s.objects[key]
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	// stored slices are never written to again, so readers can share them
+	return io.NopCloser(bytes.NewReader(obj.data)), nil
+}
+
+func (s *Memory) Update(ctx context.Context, key string, r io.Reader, size int64, contentType string) error {
+	if _, err := s.Stat(ctx, key); err != nil {
+		return err
+	}
+
+	return s.Put(ctx, key, r, size, contentType)
+}
+
+func (s *Memory) Delete(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.objects, key)
+
+	return nil
+}
+
+func (s *Memory) Move(ctx context.Context, src, dst string) error {
+	if err := validateKey(dst); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	obj, ok := s.objects[src]
+	if !ok {
+		return ErrNotFound
+	}
+
+	obj.modTime = time.Now()
+	s.objects[dst] = obj
+	delete(s.objects, src)
+
+	return nil
+}
+
+func (s *Memory) Stat(ctx context.Context, key string) (ObjectInfo, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	obj, ok := s.objects[key]
+	if !ok {
+		return ObjectInfo{}, ErrNotFound
+	}
+
+	return obj.info(key), nil
+}
+
+func (s *Memory) List(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var objects []ObjectInfo
+	for key, obj := range s.objects {
+		if strings.HasPrefix(key, prefix) {
+			objects = append(objects, obj.info(key))
+		}
+	}
+
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Key < objects[j].Key })
+
+	return objects, nil
+}
+
+func (s *Memory) SignedURL(ctx context.Context, key string, ttl time.Duration) (string, error) {
+	if _, err := s.Stat(ctx, key); err != nil {
+		return "", err
+	}
+
+	return s.urls.SignedURL(key, ttl)
+}
+
+func (o memoryObject) info(key string) ObjectInfo {
+	return ObjectInfo{Key: key, Size: int64(len(o.data)), ContentType: o.contentType, ModTime: o.modTime}
+}
@@ -0,0 +1,534 @@
+package blob
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	s3Algorithm       = "AWS4-HMAC-SHA256"
+	s3UnsignedPayload = "UNSIGNED-PAYLOAD"
+	s3TimeFormat      = "20060102T150405Z"
+	s3MaxPresign      = 7 * 24 * time.Hour
+	s3PartSize        = 8 << 20 //parts of multipart uploads, at least 5 MiB
+)
+
+// S3Config points at an S3-compatible service such as AWS S3 or MinIO.
+type S3Config struct {
+	Endpoint  string //e.g. https://s3.eu-west-1.amazonaws.com or http://localhost:9000
+	Region    string
+	Bucket    string
+	AccessKey string
+	SecretKey string
+	PathStyle bool //address the bucket in the path rather than the host, as MinIO expects
+}
+
+// S3 talks to an S3-compatible service over its REST API, signing requests
+// with AWS Signature Version 4. Bodies are not hashed (UNSIGNED-PAYLOAD).
+type S3 struct {
+	cfg      S3Config
+	endpoint *url.URL
+	client   *http.Client
+}
+
+func NewS3(cfg S3Config) (*S3, error) {
+	if cfg.Endpoint == "" || cfg.Bucket == "" {
+		return nil, errors.New("blob: s3 backend needs an endpoint and a bucket")
+	}
+	if cfg.Region == "" {
+		cfg.Region = "us-east-1"
+	}
+
+	endpoint, err := url.Parse(strings.TrimSuffix(cfg.Endpoint, "/"))
+	if err != nil {
+		return nil, fmt.Errorf("blob: invalid s3 endpoint: %w", err)
+	}
+	if endpoint.Scheme != "http" && endpoint.Scheme != "https" {
+		return nil, fmt.Errorf("blob: s3 endpoint %q must be an http or https url", cfg.Endpoint)
+	}
+
+	return &S3{cfg: cfg, endpoint: endpoint, client: &http.Client{}}, nil
+}
+
+// objectURL returns the URL of key, or of the bucket when key is empty.
+func (s *S3) objectURL(key string, query url.Values) *url.URL {
+	u := *s.endpoint
+
+	p, raw := "/"+key, "/"+s3Escape(key, false)
+	if s.cfg.PathStyle {
+		p, raw = "/"+s.cfg.Bucket+p, "/"+s.cfg.Bucket+raw
+	} else {
+		u.Host = s.cfg.Bucket + "." + u.Host
+	}
+	u.Path, u.RawPath = s.endpoint.Path+p, s.endpoint.EscapedPath()+raw
+	u.RawQuery = s3Query(query)
+
+	return &u
+}
+
+func (s *S3) do(ctx context.Context, method, key string, query url.Values, body io.Reader, size int64, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, s.objectURL(key, query).String(), body)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if body != nil {
+		req.ContentLength = size
+		if size == 0 {
+			req.Body = http.NoBody
+		}
+	}
+
+	s.sign(req, time.Now().UTC())
+
+	res, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if res.StatusCode >= 300 {
+		defer res.Body.Close()
+		return nil, s3Error(res, method, key)
+	}
+
+	return res, nil
+}
+
+func (s *S3) Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error {
+	if err := validateKey(key); err != nil {
+		return err
+	}
+
+	// S3 rejects chunked uploads, so bodies of unknown length are sent in
+	// one request when they fit in a part, and as a multipart upload otherwise
+	if size < 0 {
+		part := make([]byte, s3PartSize)
+		n, err := io.ReadFull(r, part)
+		switch {
+		case err == io.EOF || err == io.ErrUnexpectedEOF:
+			r, size = bytes.NewReader(part[:n]), int64(n)
+		case err != nil:
+			return err
+		default:
+			return s.putMultipart(ctx, key, part, r, contentType)
+		}
+	}
+
+	header := http.Header{}
+	if contentType != "" {
+		header.Set("Content-Type", contentType)
+	}
+
+	res, err := s.do(ctx, http.MethodPut, key, nil, r, size, header)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+
+	return nil
+}
+
+type s3Part struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+// putMultipart uploads buf, a full first part, followed by the rest of r in
+// parts of the same size read into buf in turn. The upload is aborted on
+// failure so no parts are left behind.
+func (s *S3) putMultipart(ctx context.Context, key string, buf []byte, r io.Reader, contentType string) error {
+	header := http.Header{}
+	if contentType != "" {
+		header.Set("Content-Type", contentType)
+	}
+
+	res, err := s.do(ctx, http.MethodPost, key, url.Values{"uploads": {""}}, nil, 0, header)
+	if err != nil {
+		return err
+	}
+
+	var initiated struct {
+		UploadID string `xml:"UploadId"`
+	}
+	err = xml.NewDecoder(res.Body).Decode(&initiated)
+	res.Body.Close()
+	if err != nil {
+		return fmt.Errorf("blob: decoding s3 multipart upload: %w", err)
+	}
+
+	upload := url.Values{"uploadId": {initiated.UploadID}}
+
+	err = func() error {
+		var parts []s3Part
+		for number, n := 1, len(buf); ; number++ {
+			if number > 1 {
+				var err error
+				n, err = io.ReadFull(r, buf)
+				if err == io.EOF {
+					break
+				}
+				if err != nil && err != io.ErrUnexpectedEOF {
+					return err
+				}
+			}
+
+			query := url.Values{"partNumber": {strconv.Itoa(number)}, "uploadId": upload["uploadId"]}
+			res, err := s.do(ctx, http.MethodPut, key, query, bytes.NewReader(buf[:n]), int64(n), nil)
+			if err != nil {
+				return err
+			}
+			res.Body.Close()
+
+			parts = append(parts, s3Part{PartNumber: number, ETag: res.Header.Get("ETag")})
+			if n < len(buf) {
+				break
+			}
+		}
+
+		body, err := xml.Marshal(struct {
+			XMLName xml.Name `xml:"CompleteMultipartUpload"`
+			Parts   []s3Part `xml:"Part"`
+		}{Parts: parts})
+		if err != nil {
+			return err
+		}
+
+		res, err := s.do(ctx, http.MethodPost, key, upload, bytes.NewReader(body), int64(len(body)), nil)
+		if err != nil {
+			return err
+		}
+		defer res.Body.Close()
+
+		// errors after the upload started come back with a 200 status
+		return s3CompleteError(res, key)
+	}()
+	if err != nil {
+		if res, abortErr := s.do(context.Background(), http.MethodDelete, key, upload, nil, 0, nil); abortErr == nil {
+			res.Body.Close()
+		}
+		return err
+	}
+
+	return nil
+}
+
+func (s *S3) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	if err := validateKey(key); err != nil {
+		return nil, err
+	}
+
+	res, err := s.do(ctx, http.MethodGet, key, nil, nil, 0, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return res.Body, nil
+}
+
+// Update checks the object exists before overwriting it. S3 has no
+// conditional PUT everywhere, so a concurrent delete can still race it.
+func (s *S3) Update(ctx context.Context, key string, r io.Reader, size int64, contentType string) error {
+	if _, err := s.Stat(ctx, key); err != nil {
+		return err
+	}
+
+	return s.Put(ctx, key, r, size, contentType)
+}
+
+func (s *S3) Delete(ctx context.Context, key string) error {
+	if err := validateKey(key); err != nil {
+		return err
+	}
+
+	res, err := s.do(ctx, http.MethodDelete, key, nil, nil, 0, nil)
+	if errors.Is(err, ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+
+	return nil
+}
+
+// Move copies the object server-side, then deletes the source.
+func (s *S3) Move(ctx context.Context, src, dst string) error {
+	if err := validateKey(src); err != nil {
+		return err
+	}
+	if err := validateKey(dst); err != nil {
+		return err
+	}
+
+	header := http.Header{}
+	header.Set("X-Amz-Copy-Source", "/"+s.cfg.Bucket+"/"+s3Escape(src, false))
+
+	res, err := s.do(ctx, http.MethodPut, dst, nil, nil, 0, header)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if err := s3CompleteError(res, dst); err != nil {
+		return err
+	}
+
+	return s.Delete(ctx, src)
+}
+
+func (s *S3) Stat(ctx context.Context, key string) (ObjectInfo, error) {
+	if err := validateKey(key); err != nil {
+		return ObjectInfo{}, err
+	}
+
+	res, err := s.do(ctx, http.MethodHead, key, nil, nil, 0, nil)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	res.Body.Close()
+
+	modTime, _ := http.ParseTime(res.Header.Get("Last-Modified"))
+
+	return ObjectInfo{
+		Key:         key,
+		Size:        res.ContentLength,
+		ContentType: res.Header.Get("Content-Type"),
+		ModTime:     modTime,
+	}, nil
+}
+
+type s3ListResult struct {
+	Contents []struct {
+		Key          string    `xml:"Key"`
+		Size         int64     `xml:"Size"`
+		LastModified time.Time `xml:"LastModified"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+// List pages through ListObjectsV2. Listings carry no content types.
+func (s *S3) List(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	var objects []ObjectInfo
+
+	query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+	for {
+		res, err := s.do(ctx, http.MethodGet, "", query, nil, 0, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		var page s3ListResult
+		err = xml.NewDecoder(res.Body).Decode(&page)
+		res.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("blob: decoding s3 listing: %w", err)
+		}
+
+		for _, c := range page.Contents {
+			objects = append(objects, ObjectInfo{Key: c.Key, Size: c.Size, ModTime: c.LastModified})
+		}
+
+		if !page.IsTruncated || page.NextContinuationToken == "" {
+			break
+		}
+		query.Set("continuation-token", page.NextContinuationToken)
+	}
+
+	return objects, nil
+}
+
+// SignedURL presigns a GET request. S3 caps the lifetime at seven days.
+func (s *S3) SignedURL(ctx context.Context, key string, ttl time.Duration) (string, error) {
+	if err := validateKey(key); err != nil {
+		return "", err
+	}
+	if ttl <= 0 || ttl > s3MaxPresign {
+		return "", fmt.Errorf("blob: s3 signed urls must expire within %s", s3MaxPresign)
+	}
+
+	return s.presign(key, ttl, time.Now().UTC()), nil
+}
+
+func (s *S3) presign(key string, ttl time.Duration, now time.Time) string {
+	query := url.Values{
+		"X-Amz-Algorithm":     {s3Algorithm},
+		"X-Amz-Credential":    {s.cfg.AccessKey + "/" + s.scope(now)},
+		"X-Amz-Date":          {now.Format(s3TimeFormat)},
+		"X-Amz-Expires":       {strconv.Itoa(int(ttl.Seconds()))},
+		"X-Amz-SignedHeaders": {"host"},
+	}
+
+	u := s.objectURL(key, query)
+	canonical := strings.Join([]string{
+		http.MethodGet,
+		u.EscapedPath(),
+		u.RawQuery,
+		"host:" + u.Host + "\n",
+		"host",
+		s3UnsignedPayload,
+	}, "\n")
+
+	u.RawQuery += "&X-Amz-Signature=" + s.signature(now, canonical)
+
+	return u.String()
+}
+
+// sign adds the SigV4 Authorization header to req.
+func (s *S3) sign(req *http.Request, now time.Time) {
+	req.Header.Set("X-Amz-Date", now.Format(s3TimeFormat))
+	req.Header.Set("X-Amz-Content-Sha256", s3UnsignedPayload)
+
+	canonical, signed := canonicalRequest(req)
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s3Algorithm, s.cfg.AccessKey, s.scope(now), signed, s.signature(now, canonical)))
+}
+
+// canonicalRequest returns the SigV4 canonical form of req and the list of
+// headers it signs.
+func canonicalRequest(req *http.Request) (string, string) {
+	// sign every x-amz-* header, as S3 requires, and the content type
+	headers := []string{"host"}
+	for name := range req.Header {
+		name = strings.ToLower(name)
+		if strings.HasPrefix(name, "x-amz-") || name == "content-type" {
+			headers = append(headers, name)
+		}
+	}
+	sort.Strings(headers)
+
+	var canonicalHeaders strings.Builder
+	for _, h := range headers {
+		v := req.URL.Host
+		if h != "host" {
+			v = strings.TrimSpace(req.Header.Get(h))
+		}
+		canonicalHeaders.WriteString(h + ":" + v + "\n")
+	}
+	signed := strings.Join(headers, ";")
+
+	canonical := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signed,
+		s3UnsignedPayload,
+	}, "\n")
+
+	return canonical, signed
+}
+
+func (s *S3) scope(now time.Time) string {
+	return now.Format("20060102") + "/" + s.cfg.Region + "/s3/aws4_request"
+}
+
+func (s *S3) signature(now time.Time, canonicalRequest string) string {
+	hash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{
+		s3Algorithm,
+		now.Format(s3TimeFormat),
+		s.scope(now),
+		hex.EncodeToString(hash[:]),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+s.cfg.SecretKey), now.Format("20060102"))
+	for _, part := range []string{s.cfg.Region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+
+	return hex.EncodeToString(hmacSHA256(key, stringToSign))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// s3Escape percent-encodes everything but unreserved characters, as SigV4
+// canonical requests require. Slashes are kept in paths.
+func s3Escape(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~', c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+
+	return b.String()
+}
+
+// s3Query encodes query values sorted by name, which is also their canonical
+// form.
+func s3Query(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var parts []string
+	for _, k := range keys {
+		for _, v := range query[k] {
+			parts = append(parts, s3Escape(k, true)+"="+s3Escape(v, true))
+		}
+	}
+
+	return strings.Join(parts, "&")
+}
+
+type s3ErrorBody struct {
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+// s3CompleteError reports the error S3 can return in the body of a 200
+// response to CompleteMultipartUpload and CopyObject.
+func s3CompleteError(res *http.Response, key string) error {
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+
+	var e s3ErrorBody
+	if xml.Unmarshal(body, &e) == nil && e.Code != "" {
+		return fmt.Errorf("blob: s3 %q: %s: %s", key, e.Code, e.Message)
+	}
+
+	return nil
+}
+
+func s3Error(res *http.Response, method, key string) error {
+	if res.StatusCode == http.StatusNotFound {
+		return ErrNotFound
+	}
+
+	var body s3ErrorBody
+	if err := xml.NewDecoder(res.Body).Decode(&body); err != nil || body.Code == "" {
+		return fmt.Errorf("blob: s3 %s %q: %s", method, key, res.Status)
+	}
+
+	return fmt.Errorf("blob: s3 %s %q: %s: %s", method, key, body.Code, body.Message)
+}
@@ -0,0 +1,29 @@
+package blob
+
+import (
+	"context"
+	"io"
+)
+
+type Storage struct {
+	Blobs  Store
+	Images interface {
+		UploadImage(userID int64, buf []byte) (string, string, error)
+		EnsureImage(filename string, buf []byte) error
+		StageImage(ctx context.Context, userID int64, r io.Reader) (*StagedImage, error)
+		CommitImage(staged *StagedImage) error
+		DiscardImage(staged *StagedImage) error
+		WriteImage(filename string, buf []byte) error
+		GetNewSignedImageURL(filename string, duration int) (string, error)
+		UpdateImage(filename string, buf []byte) error
+		StreamImage(filename string) ([]byte, error)
+		DeleteImages(filenames []string) error
+	}
+}
+
+func NewStorage(s Store) Storage {
+	return Storage{
+		Blobs:  s,
+		Images: &ImageBucket{s},
+	}
+}
@@ -0,0 +1,222 @@
+package blob
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	sc "github.com/supabase-community/storage-go"
+)
+
+// DefaultSupabaseBucket is the bucket images have always been stored in.
+const DefaultSupabaseBucket = "transformed-images"
+
+const supabaseListLimit = 1000
+
+// Supabase stores objects in a Supabase storage bucket. The client does not
+// take contexts, so requests run to completion once sent.
+type Supabase struct {
+	bucket string
+	sc     *sc.Client
+}
+
+func NewSupabaseClient(project_id, api_key string) *sc.Client {
+	api_url := fmt.Sprintf("https://%s.supabase.co/storage/v1", project_id)
+	return sc.NewClient(api_url, api_key, nil)
+}
+
+func NewSupabase(project_id, api_key, bucket string) *Supabase {
+	if bucket == "" {
+		bucket = DefaultSupabaseBucket
+	}
+
+	return &Supabase{bucket: bucket, sc: NewSupabaseClient(project_id, api_key)}
+}
+
+func (s *Supabase) Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error {
+	if err := validateKey(key); err != nil {
+		return err
+	}
+
+	upsert := true
+	_, err := s.sc.UploadFile(s.bucket, key, r, s.fileOptions(key, contentType, &upsert))
+	return supabaseError(err)
+}
+
+func (s *Supabase) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	if err := validateKey(key); err != nil {
+		return nil, err
+	}
+
+	buf, err := s.sc.DownloadFile(s.bucket, key)
+	if err != nil {
+		return nil, supabaseError(err)
+	}
+
+	return io.NopCloser(bytes.NewReader(buf)), nil
+}
+
+func (s *Supabase) Update(ctx context.Context, key string, r io.Reader, size int64, contentType string) error {
+	if err := validateKey(key); err != nil {
+		return err
+	}
+
+	_, err := s.sc.UpdateFile(s.bucket, key, r, s.fileOptions(key, contentType, nil))
+	return supabaseError(err)
+}
+
+func (s *Supabase) Delete(ctx context.Context, key string) error {
+	if err := validateKey(key); err != nil {
+		return err
+	}
+
+	_, err := s.sc.RemoveFile(s.bucket, []string{key})
+	if err = supabaseError(err); errors.Is(err, ErrNotFound) {
+		return nil
+	}
+
+	return err
+}
+
+func (s *Supabase) Move(ctx context.Context, src, dst string) error {
+	if err := validateKey(src); err != nil {
+		return err
+	}
+	if err := validateKey(dst); err != nil {
+		return err
+	}
+
+	_, err := s.sc.MoveFile(s.bucket, src, dst)
+	return supabaseError(err)
+}
+
+// Stat looks the object up in the listing of its folder, the only place the
+// storage API reports sizes and content types.
+func (s *Supabase) Stat(ctx context.Context, key string) (ObjectInfo, error) {
+	if err := validateKey(key); err != nil {
+		return ObjectInfo{}, err
+	}
+
+	dir, name := path.Split(key)
+	files, err := s.sc.ListFiles(s.bucket, strings.TrimSuffix(dir, "/"), sc.FileSearchOptions{
+		Limit:         supabaseListLimit,
+		SortByOptions: sc.SortBy{Column: "name", Order: "asc"},
+	})
+	if err != nil {
+		return ObjectInfo{}, supabaseError(err)
+	}
+
+	// the prefix is also matched as a search term, so filter exact names
+	for _, f := range files {
+		if f.Name == name && f.Id != "" {
+			return supabaseInfo(key, f), nil
+		}
+	}
+
+	return ObjectInfo{}, ErrNotFound
+}
+
+// List walks the folders below the folder of prefix, since the storage API
+// lists one level at a time.
+func (s *Supabase) List(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	var objects []ObjectInfo
+
+	dir := prefix[:strings.LastIndex(prefix, "/")+1]
+	folders := []string{strings.TrimSuffix(dir, "/")}
+	for len(folders) > 0 {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		folder := folders[0]
+		folders = folders[1:]
+
+		for offset := 0; ; offset += supabaseListLimit {
+			files, err := s.sc.ListFiles(s.bucket, folder, sc.FileSearchOptions{
+				Limit:         supabaseListLimit,
+				Offset:        offset,
+				SortByOptions: sc.SortBy{Column: "name", Order: "asc"},
+			})
+			if err != nil {
+				return nil, supabaseError(err)
+			}
+
+			for _, f := range files {
+				key := f.Name
+				if folder != "" {
+					key = folder + "/" + f.Name
+				}
+
+				switch {
+				case f.Id == "": //folders have no id
+					if strings.HasPrefix(key+"/", prefix) || strings.HasPrefix(prefix, key+"/") {
+						folders = append(folders, key)
+					}
+				case strings.HasPrefix(key, prefix):
+					objects = append(objects, supabaseInfo(key, f))
+				}
+			}
+
+			if len(files) < supabaseListLimit {
+				break
+			}
+		}
+	}
+
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Key < objects[j].Key })
+
+	return objects, nil
+}
+
+// SignedURL signs with whole seconds, the resolution of the storage API.
+func (s *Supabase) SignedURL(ctx context.Context, key string, ttl time.Duration) (string, error) {
+	if err := validateKey(key); err != nil {
+		return "", err
+	}
+
+	res, err := s.sc.CreateSignedUrl(s.bucket, key, int(ttl.Seconds()))
+	if err != nil {
+		return "", supabaseError(err)
+	}
+
+	return res.SignedURL, nil
+}
+
+func (s *Supabase) fileOptions(key, contentType string, upsert *bool) sc.FileOptions {
+	if contentType == "" {
+		contentType = contentTypeByExtension(key)
+	}
+
+	return sc.FileOptions{ContentType: &contentType, Upsert: upsert}
+}
+
+func supabaseInfo(key string, f sc.FileObject) ObjectInfo {
+	info := ObjectInfo{Key: key}
+
+	if meta, ok := f.Metadata.(map[string]interface{}); ok {
+		if size, ok := meta["size"].(float64); ok {
+			info.Size = int64(size)
+		}
+		info.ContentType, _ = meta["mimetype"].(string)
+	}
+	info.ModTime, _ = time.Parse(time.RFC3339, f.UpdatedAt)
+
+	return info
+}
+
+// supabaseError maps the "not found" errors of the storage API to
+// ErrNotFound. The client does not keep the status code.
+func supabaseError(err error) error {
+	var se *sc.StorageError
+	if errors.As(err, &se) && strings.Contains(strings.ToLower(se.Message), "not found") {
+		return ErrNotFound
+	}
+
+	return err
+}
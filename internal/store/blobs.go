@@ -0,0 +1,142 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// Bucket objects are keyed by the hash of their bytes under the prefix of
+// their owner (see blob.ContentKey), so image versions and derivatives of a
+// user with identical content share one object; identical content of two
+// users does not. The blobs table counts the rows referencing each object, and
+// an object goes away with its last reference.
+//
+// Transactions releasing references leave the rows of orphaned keys at zero
+// and return the keys. Once committed, Collect removes each object while
+// holding its row, so an upload racing the removal either takes its reference
+// first or waits for the row to go and writes the object again. A removal
+// that fails leaves the row at zero, for a later Collect to retry.
+
+type BlobStore struct {
+	db *sql.DB
+}
+
+// acquireBlob adds n references to the object.
+func acquireBlob(ctx context.Context, tx *sql.Tx, key string, n int) error {
+	query := `
+			INSERT INTO blobs (key, refs)
+			VALUES ($1, $2)
+			ON CONFLICT (key) DO UPDATE SET refs = blobs.refs + EXCLUDED.refs
+	`
+
+	_, err := tx.ExecContext(ctx, query, key, n)
+	return err
+}
+
+// releaseBlobs drops one reference per occurrence of each key and returns the
+// keys left unreferenced. Keys are locked in order so concurrent releases
+// cannot deadlock.
+func releaseBlobs(ctx context.Context, tx *sql.Tx, keys []string) ([]string, error) {
+	counts := make(map[string]int)
+	for _, key := range keys {
+		counts[key]++
+	}
+
+	sorted := make([]string, 0, len(counts))
+	for key := range counts {
+		sorted = append(sorted, key)
+	}
+	sort.Strings(sorted)
+
+	var orphans []string
+	for _, key := range sorted {
+		var refs int
+		err := tx.QueryRowContext(
+			ctx,
+			`UPDATE blobs SET refs = GREATEST(refs - $2, 0) WHERE key = $1 RETURNING refs`,
+			key,
+			counts[key],
+		).Scan(&refs)
+		if err != nil {
+			switch {
+			case errors.Is(err, sql.ErrNoRows):
+				continue //never counted, leave the object alone
+			default:
+				return nil, err
+			}
+		}
+
+		if refs == 0 {
+			orphans = append(orphans, key)
+		}
+	}
+
+	return orphans, nil
+}
+
+// Collect removes the objects of the given keys that are still unreferenced,
+// one at a time, and forgets them. Keys referenced again meanwhile are kept.
+func (s BlobStore) Collect(ctx context.Context, keys []string, remove func([]string) error) error {
+	var errs []error
+	for _, key := range keys {
+		err := withTx(s.db, ctx, func(tx *sql.Tx) error {
+			ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuration)
+			defer cancel()
+
+			var refs int
+			err := tx.QueryRowContext(ctx, `SELECT refs FROM blobs WHERE key = $1 FOR UPDATE`, key).Scan(&refs)
+			if err != nil {
+				switch {
+				case errors.Is(err, sql.ErrNoRows):
+					return nil //collected already
+				default:
+					return err
+				}
+			}
+
+			if refs > 0 {
+				return nil
+			}
+
+			if err := remove([]string{key}); err != nil {
+				return err
+			}
+
+			_, err = tx.ExecContext(ctx, `DELETE FROM blobs WHERE key = $1`, key)
+			return err
+		})
+		if err != nil {
+			errs = append(errs, fmt.Errorf("collecting %s: %w", key, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// GetOrphans lists keys left unreferenced by releases whose removal has not
+// happened yet.
+func (s BlobStore) GetOrphans(ctx context.Context, limit int) ([]string, error) {
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuration)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx, `SELECT key FROM blobs WHERE refs = 0 ORDER BY key LIMIT $1`, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys []string
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return nil, err
+		}
+
+		keys = append(keys, key)
+	}
+
+	return keys, rows.Err()
+}
@@ -0,0 +1,143 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+)
+
+// Derivative is a resized rendition of an image, generated from the version
+// that was current at the time as part of a responsive image set.
+type Derivative struct {
+	ID        int64  `json:"id"`
+	ImageID   int64  `json:"image_id"`
+	Version   int    `json:"version"`
+	Width     int    `json:"width"`
+	Height    int    `json:"height"`
+	Format    string `json:"format"`
+	Size      int64  `json:"size"`
+	Filename  string `json:"filename"`
+	URL       string `json:"url"`
+	Options   string `json:"options"` //render options of its signed delivery URL
+	CreatedAt string `json:"created_at"`
+}
+
+type DerivativeStore struct {
+	db *sql.DB
+}
+
+// Replace swaps the derivatives of an image for a newly generated set, and
+// returns the keys of the old set no longer referenced, for Blobs.Collect.
+func (s DerivativeStore) Replace(ctx context.Context, imageID int64, derivatives []Derivative) ([]string, error) {
+	var orphans []string
+	err := withTx(s.db, ctx, func(tx *sql.Tx) error {
+		ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuration)
+		defer cancel()
+
+		rows, err := tx.QueryContext(ctx, `DELETE FROM image_derivatives WHERE image_id = $1 RETURNING filename`, imageID)
+		if err != nil {
+			return err
+		}
+
+		var released []string
+		for rows.Next() {
+			var filename string
+			if err := rows.Scan(&filename); err != nil {
+				rows.Close()
+				return err
+			}
+
+			released = append(released, filename)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		query := `
+			INSERT INTO image_derivatives (image_id, version, width, height, format, size, filename, url, options)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+			RETURNING id, created_at
+		`
+
+		for i := range derivatives {
+			d := &derivatives[i]
+			d.ImageID = imageID
+
+			err := tx.QueryRowContext(
+				ctx,
+				query,
+				d.ImageID,
+				d.Version,
+				d.Width,
+				d.Height,
+				d.Format,
+				d.Size,
+				d.Filename,
+				d.URL,
+				d.Options,
+			).Scan(
+				&d.ID,
+				&d.CreatedAt,
+			)
+			if err != nil {
+				return err
+			}
+
+			if err := acquireBlob(ctx, tx, d.Filename, 1); err != nil {
+				return err
+			}
+		}
+
+		orphans, err = releaseBlobs(ctx, tx, released)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return orphans, nil
+}
+
+func (s DerivativeStore) GetByImageID(ctx context.Context, imageID int64) ([]Derivative, error) {
+	query := `
+			SELECT id, image_id, version, width, height, format, size, filename, url, options, created_at
+			FROM image_derivatives
+			WHERE image_id = $1
+			ORDER BY width, id
+	`
+
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuration)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx, query, imageID)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	var derivatives []Derivative
+	for rows.Next() {
+		var d Derivative
+		err := rows.Scan(
+			&d.ID,
+			&d.ImageID,
+			&d.Version,
+			&d.Width,
+			&d.Height,
+			&d.Format,
+			&d.Size,
+			&d.Filename,
+			&d.URL,
+			&d.Options,
+			&d.CreatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		derivatives = append(derivatives, d)
+	}
+
+	return derivatives, rows.Err()
+}
@@ -3,40 +3,94 @@ package store
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
 	"errors"
+
+	"github.com/lib/pq"
 )
 
 type Image struct {
-	ID        int64  `json:"id"`
-	URL       string `json:"url"`
-	Filename  string `json:"filename"`
-	UserID    int64  `json:"user_id"`
-	CreatedAt string `json:"created_at"`
-	UpdatedAt string `json:"updated_at"`
+	ID           int64         `json:"id"`
+	URL          string        `json:"url"`
+	Filename     string        `json:"filename"`
+	OriginalName string        `json:"original_filename"` //as uploaded, never used as a key
+	UserID       int64         `json:"user_id"`
+	Version      int           `json:"version"`
+	AutoOriented bool          `json:"auto_oriented"`
+	MetadataKept []string      `json:"metadata_kept"` //nil when all metadata was kept
+	Metadata     ImageMetadata `json:"metadata"`
+	CreatedAt    string        `json:"created_at"`
+	UpdatedAt    string        `json:"updated_at"`
+}
+
+// ImageMetadata describes the file behind an image or one of its versions.
+// Images uploaded before it was recorded have zero values.
+type ImageMetadata struct {
+	Width       int             `json:"width"`
+	Height      int             `json:"height"`
+	Format      string          `json:"format"`
+	Size        int64           `json:"size"`
+	ColorSpace  string          `json:"color_space"`
+	HasAlpha    bool            `json:"has_alpha"`
+	Orientation int             `json:"orientation"`
+	EXIF        json.RawMessage `json:"exif,omitempty"` //camera, lens, capture time and GPS position
 }
 
 type ImageStore struct {
 	db *sql.DB
 }
 
+// Create inserts the image together with its first version, which keeps a
+// reference to the original upload.
 func (s ImageStore) Create(ctx context.Context, image *Image) error {
+	return withTx(s.db, ctx, func(tx *sql.Tx) error {
+		if err := s.create(ctx, tx, image); err != nil {
+			return err
+		}
+
+		version := &ImageVersion{
+			ImageID:  image.ID,
+			Version:  image.Version,
+			Filename: image.Filename,
+			URL:      image.URL,
+			Metadata: image.Metadata,
+		}
+
+		return createVersion(ctx, tx, version)
+	})
+}
+
+func (s ImageStore) create(ctx context.Context, tx *sql.Tx, image *Image) error {
 	query := `
-			INSERT INTO images (url, filename, user_id)
-			VALUES ($1, $2, $3)
-			RETURNING id, created_at, updated_at
+			INSERT INTO images (url, filename, original_filename, user_id, width, height, format, size, color_space, has_alpha, orientation, exif)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)
+			RETURNING id, version, auto_oriented, metadata_kept, created_at, updated_at
 	`
 
 	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuration)
 	defer cancel()
 
-	err := s.db.QueryRowContext(
+	m := image.Metadata
+	err := tx.QueryRowContext(
 		ctx,
 		query,
 		image.URL,
 		image.Filename,
+		image.OriginalName,
 		image.UserID,
+		m.Width,
+		m.Height,
+		m.Format,
+		m.Size,
+		m.ColorSpace,
+		m.HasAlpha,
+		m.Orientation,
+		nullableJSON(m.EXIF),
 	).Scan(
 		&image.ID,
+		&image.Version,
+		&image.AutoOriented,
+		pq.Array(&image.MetadataKept),
 		&image.CreatedAt,
 		&image.UpdatedAt,
 	)
@@ -49,7 +103,9 @@ func (s ImageStore) Create(ctx context.Context, image *Image) error {
 
 func (s ImageStore) GetByID(ctx context.Context, id int64) (*Image, error) {
 	query := `
-			SELECT id, url, filename, user_id, created_at, updated_at
+			SELECT id, url, filename, original_filename, user_id, version, auto_oriented, metadata_kept,
+				width, height, format, size, color_space, has_alpha, orientation, exif,
+				created_at, updated_at
 			FROM images
 			WHERE id = $1
 	`
@@ -59,18 +115,7 @@ func (s ImageStore) GetByID(ctx context.Context, id int64) (*Image, error) {
 
 	image := &Image{}
 
-	err := s.db.QueryRowContext(
-		ctx,
-		query,
-		id,
-	).Scan(
-		&image.ID,
-		&image.URL,
-		&image.Filename,
-		&image.UserID,
-		&image.CreatedAt,
-		&image.UpdatedAt,
-	)
+	err := scanImage(s.db.QueryRowContext(ctx, query, id), image)
 	if err != nil {
 		switch {
 		case errors.Is(err, sql.ErrNoRows):
@@ -85,7 +130,9 @@ func (s ImageStore) GetByID(ctx context.Context, id int64) (*Image, error) {
 
 func (s ImageStore) GetUserImages(ctx context.Context, userID int64, pp PaginationParams) ([]Image, error) {
 	query := `
-			SELECT id, url, filename, user_id, created_at, updated_at
+			SELECT id, url, filename, original_filename, user_id, version, auto_oriented, metadata_kept,
+				width, height, format, size, color_space, has_alpha, orientation, exif,
+				created_at, updated_at
 			FROM images
 			WHERE user_id = $1
 			ORDER BY created_at
@@ -106,15 +153,7 @@ func (s ImageStore) GetUserImages(ctx context.Context, userID int64, pp Paginati
 	var images []Image
 	for rows.Next() {
 		var i Image
-		err := rows.Scan(
-			&i.ID,
-			&i.URL,
-			&i.Filename,
-			&i.UserID,
-			&i.CreatedAt,
-			&i.UpdatedAt,
-		)
-		if err != nil {
+		if err := scanImage(rows, &i); err != nil {
 			return nil, err
 		}
 
@@ -158,28 +197,133 @@ func (s ImageStore) Update(ctx context.Context, image *Image) error {
 	return nil
 }
 
-func (s ImageStore) Delete(ctx context.Context, id int64) error {
-	query := `
-			DELETE FROM images
-			WHERE id = $1
-	`
+// SetURL records the signed URL of the image on it and its current version,
+// for images whose object was only put in place after they were created.
+func (s ImageStore) SetURL(ctx context.Context, image *Image) error {
+	return withTx(s.db, ctx, func(tx *sql.Tx) error {
+		ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuration)
+		defer cancel()
 
-	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuration)
-	defer cancel()
+		res, err := tx.ExecContext(ctx, `UPDATE images SET url = $1 WHERE id = $2`, image.URL, image.ID)
+		if err != nil {
+			return err
+		}
 
-	res, err := s.db.ExecContext(ctx, query, id)
-	if err != nil {
+		rows, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+
+		if rows == 0 {
+			return ErrNotFound
+		}
+
+		_, err = tx.ExecContext(
+			ctx,
+			`UPDATE image_versions SET url = $1 WHERE image_id = $2 AND version = $3`,
+			image.URL,
+			image.ID,
+			image.Version,
+		)
+		return err
+	})
+}
+
+// Delete removes the image with its versions and derivatives, and returns the
+// keys of the objects no other image references, for Blobs.Collect.
+func (s ImageStore) Delete(ctx context.Context, id int64) ([]string, error) {
+	var orphans []string
+	err := withTx(s.db, ctx, func(tx *sql.Tx) error {
+		ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuration)
+		defer cancel()
+
+		query := `
+			SELECT filename FROM image_versions WHERE image_id = $1
+			UNION ALL
+			SELECT filename FROM image_derivatives WHERE image_id = $1
+		`
+
+		rows, err := tx.QueryContext(ctx, query, id)
+		if err != nil {
+			return err
+		}
+
+		var released []string
+		for rows.Next() {
+			var filename string
+			if err := rows.Scan(&filename); err != nil {
+				rows.Close()
+				return err
+			}
+
+			released = append(released, filename)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		res, err := tx.ExecContext(ctx, `DELETE FROM images WHERE id = $1`, id)
+		if err != nil {
+			return err
+		}
+
+		n, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+
+		if n == 0 {
+			return ErrNotFound
+		}
+
+		orphans, err = releaseBlobs(ctx, tx, released)
 		return err
+	})
+	if err != nil {
+		return nil, err
 	}
 
-	rows, err := res.RowsAffected()
+	return orphans, nil
+}
+
+func scanImage(row interface{ Scan(...any) error }, image *Image) error {
+	var exif []byte
+
+	err := row.Scan(
+		&image.ID,
+		&image.URL,
+		&image.Filename,
+		&image.OriginalName,
+		&image.UserID,
+		&image.Version,
+		&image.AutoOriented,
+		pq.Array(&image.MetadataKept),
+		&image.Metadata.Width,
+		&image.Metadata.Height,
+		&image.Metadata.Format,
+		&image.Metadata.Size,
+		&image.Metadata.ColorSpace,
+		&image.Metadata.HasAlpha,
+		&image.Metadata.Orientation,
+		&exif,
+		&image.CreatedAt,
+		&image.UpdatedAt,
+	)
 	if err != nil {
 		return err
 	}
 
-	if rows == 0 {
-		return ErrNotFound
+	image.Metadata.EXIF = exif
+	return nil
+}
+
+// nullableJSON stores empty documents as NULL.
+func nullableJSON(raw json.RawMessage) *string {
+	if len(raw) == 0 {
+		return nil
 	}
 
-	return nil
+	s := string(raw)
+	return &s
 }
@@ -0,0 +1,291 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+type JobStatus string
+
+const (
+	JobQueued    JobStatus = "queued"
+	JobRunning   JobStatus = "running"
+	JobSucceeded JobStatus = "succeeded"
+	JobFailed    JobStatus = "failed" //waiting for a retry
+	JobDead      JobStatus = "dead"   //retries exhausted, needs manual requeue
+)
+
+type Job struct {
+	ID          int64           `json:"id"`
+	Type        string          `json:"type"`
+	UserID      int64           `json:"user_id"`
+	Status      JobStatus       `json:"status"`
+	Payload     json.RawMessage `json:"payload"`
+	Result      json.RawMessage `json:"result,omitempty"`
+	Error       string          `json:"error,omitempty"`
+	Attempts    int             `json:"attempts"`
+	MaxAttempts int             `json:"max_attempts"`
+	RunAt       string          `json:"run_at"`
+	CreatedAt   string          `json:"created_at"`
+	UpdatedAt   string          `json:"updated_at"`
+}
+
+type JobStore struct {
+	db *sql.DB
+}
+
+const jobColumns = `id, type, user_id, status, payload, result, error, attempts, max_attempts, run_at, created_at, updated_at`
+
+func scanJob(row interface{ Scan(...any) error }, job *Job) error {
+	var payload, result []byte
+
+	err := row.Scan(
+		&job.ID,
+		&job.Type,
+		&job.UserID,
+		&job.Status,
+		&payload,
+		&result,
+		&job.Error,
+		&job.Attempts,
+		&job.MaxAttempts,
+		&job.RunAt,
+		&job.CreatedAt,
+		&job.UpdatedAt,
+	)
+	if err != nil {
+		return err
+	}
+
+	job.Payload = payload
+	job.Result = result
+
+	return nil
+}
+
+func (s JobStore) Create(ctx context.Context, job *Job) error {
+	query := `
+			INSERT INTO jobs (type, user_id, payload, max_attempts, run_at)
+			VALUES ($1, $2, $3, $4, COALESCE($5, NOW()))
+			RETURNING ` + jobColumns
+
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuration)
+	defer cancel()
+
+	var runAt *string
+	if job.RunAt != "" {
+		runAt = &job.RunAt
+	}
+
+	row := s.db.QueryRowContext(
+		ctx,
+		query,
+		job.Type,
+		job.UserID,
+		string(job.Payload),
+		job.MaxAttempts,
+		runAt,
+	)
+
+	return scanJob(row, job)
+}
+
+func (s JobStore) GetByID(ctx context.Context, id int64) (*Job, error) {
+	query := `SELECT ` + jobColumns + ` FROM jobs WHERE id = $1`
+
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuration)
+	defer cancel()
+
+	job := &Job{}
+
+	err := scanJob(s.db.QueryRowContext(ctx, query, id), job)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return job, nil
+}
+
+func (s JobStore) GetByStatus(ctx context.Context, status JobStatus, pp PaginationParams) ([]Job, error) {
+	query := `
+			SELECT ` + jobColumns + `
+			FROM jobs
+			WHERE status = $1
+			ORDER BY updated_at DESC
+			LIMIT $2 OFFSET $3
+	`
+
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuration)
+	defer cancel()
+
+	offset := (pp.PageID - 1) * pp.Limit
+	rows, err := s.db.QueryContext(ctx, query, status, pp.Limit, offset)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	var jobs []Job
+	for rows.Next() {
+		var j Job
+		if err := scanJob(rows, &j); err != nil {
+			return nil, err
+		}
+
+		jobs = append(jobs, j)
+	}
+
+	return jobs, rows.Err()
+}
+
+// Claim leases the next runnable job: a queued job, a failed job whose retry
+// time has come, or a running job whose lease expired because its worker died.
+// Jobs whose worker died on their last attempt, such as a job that crashes the
+// process every time, are buried instead. It returns ErrNotFound when there is
+// nothing to run.
+func (s JobStore) Claim(ctx context.Context, lease time.Duration) (*Job, error) {
+	bury := `
+			UPDATE jobs
+			SET status = 'dead', error = 'lease expired on the last attempt', locked_until = NULL, updated_at = NOW()
+			WHERE status = 'running' AND locked_until < NOW() AND attempts >= max_attempts
+	`
+
+	query := `
+			UPDATE jobs
+			SET status = 'running',
+				attempts = attempts + 1,
+				locked_until = NOW() + make_interval(secs => $1),
+				updated_at = NOW()
+			WHERE id = (
+				SELECT id FROM jobs
+				WHERE (status IN ('queued', 'failed') AND run_at <= NOW())
+					OR (status = 'running' AND locked_until < NOW() AND attempts < max_attempts)
+				ORDER BY run_at
+				LIMIT 1
+				FOR UPDATE SKIP LOCKED
+			)
+			RETURNING ` + jobColumns
+
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuration)
+	defer cancel()
+
+	if _, err := s.db.ExecContext(ctx, bury); err != nil {
+		return nil, err
+	}
+
+	job := &Job{}
+
+	err := scanJob(s.db.QueryRowContext(ctx, query, lease.Seconds()), job)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return job, nil
+}
+
+// The updates below only apply to the attempt of the job the caller claimed,
+// and return ErrNotFound once the lease was lost to another worker.
+
+// Extend renews the lease of a running job.
+func (s JobStore) Extend(ctx context.Context, job *Job, lease time.Duration) error {
+	query := `
+			UPDATE jobs
+			SET locked_until = NOW() + make_interval(secs => $1)
+			WHERE id = $2 AND status = 'running' AND attempts = $3
+	`
+
+	return s.exec(ctx, query, lease.Seconds(), job.ID, job.Attempts)
+}
+
+func (s JobStore) Succeed(ctx context.Context, job *Job, result json.RawMessage) error {
+	query := `
+			UPDATE jobs
+			SET status = 'succeeded', result = $1, error = '', locked_until = NULL, updated_at = NOW()
+			WHERE id = $2 AND status = 'running' AND attempts = $3
+	`
+
+	return s.exec(ctx, query, string(result), job.ID, job.Attempts)
+}
+
+// Retry records a failed attempt and schedules the job to run again at runAt.
+func (s JobStore) Retry(ctx context.Context, job *Job, errMsg string, runAt time.Time) error {
+	query := `
+			UPDATE jobs
+			SET status = 'failed', error = $1, run_at = $2, locked_until = NULL, updated_at = NOW()
+			WHERE id = $3 AND status = 'running' AND attempts = $4
+	`
+
+	return s.exec(ctx, query, errMsg, runAt, job.ID, job.Attempts)
+}
+
+// Bury moves a job to the dead-letter state.
+func (s JobStore) Bury(ctx context.Context, job *Job, errMsg string) error {
+	query := `
+			UPDATE jobs
+			SET status = 'dead', error = $1, locked_until = NULL, updated_at = NOW()
+			WHERE id = $2 AND status = 'running' AND attempts = $3
+	`
+
+	return s.exec(ctx, query, errMsg, job.ID, job.Attempts)
+}
+
+// Requeue puts a dead job back in the queue with a fresh attempt counter.
+func (s JobStore) Requeue(ctx context.Context, id int64) (*Job, error) {
+	query := `
+			UPDATE jobs
+			SET status = 'queued', attempts = 0, run_at = NOW(), locked_until = NULL, updated_at = NOW()
+			WHERE id = $1 AND status = 'dead'
+			RETURNING ` + jobColumns
+
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuration)
+	defer cancel()
+
+	job := &Job{}
+
+	err := scanJob(s.db.QueryRowContext(ctx, query, id), job)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return job, nil
+}
+
+func (s JobStore) exec(ctx context.Context, query string, args ...any) error {
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuration)
+	defer cancel()
+
+	res, err := s.db.ExecContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+
+	rows, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rows == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
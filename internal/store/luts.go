@@ -0,0 +1,153 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+)
+
+// LUT is a named colour grading table uploaded by a user as a .cube file.
+type LUT struct {
+	ID        int64  `json:"id"`
+	UserID    int64  `json:"user_id"`
+	Name      string `json:"name"`
+	Title     string `json:"title"`
+	Size      int    `json:"size"`
+	Data      []byte `json:"-"`
+	CreatedAt string `json:"created_at"`
+}
+
+type LUTStore struct {
+	db *sql.DB
+}
+
+func (s LUTStore) Create(ctx context.Context, lut *LUT) error {
+	query := `
+		INSERT INTO luts (user_id, name, title, size, data)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING id, created_at
+	`
+
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuration)
+	defer cancel()
+
+	err := s.db.QueryRowContext(
+		ctx,
+		query,
+		lut.UserID,
+		lut.Name,
+		lut.Title,
+		lut.Size,
+		string(lut.Data),
+	).Scan(
+		&lut.ID,
+		&lut.CreatedAt,
+	)
+	if err != nil {
+		switch {
+		case err.Error() == `pq: duplicate key value violates unique constraint "luts_user_id_name_key"`:
+			return ErrConflict
+		default:
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s LUTStore) GetByName(ctx context.Context, userID int64, name string) (*LUT, error) {
+	query := `
+		SELECT id, user_id, name, title, size, data, created_at
+		FROM luts
+		WHERE user_id = $1 AND name = $2
+	`
+
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuration)
+	defer cancel()
+
+	lut := &LUT{}
+	var data string
+
+	err := s.db.QueryRowContext(ctx, query, userID, name).Scan(
+		&lut.ID,
+		&lut.UserID,
+		&lut.Name,
+		&lut.Title,
+		&lut.Size,
+		&data,
+		&lut.CreatedAt,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	lut.Data = []byte(data)
+
+	return lut, nil
+}
+
+// GetUserLUTs lists the LUTs of a user without their tables.
+func (s LUTStore) GetUserLUTs(ctx context.Context, userID int64) ([]LUT, error) {
+	query := `
+		SELECT id, user_id, name, title, size, created_at
+		FROM luts
+		WHERE user_id = $1
+		ORDER BY name
+	`
+
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuration)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	luts := []LUT{}
+	for rows.Next() {
+		var lut LUT
+		err := rows.Scan(
+			&lut.ID,
+			&lut.UserID,
+			&lut.Name,
+			&lut.Title,
+			&lut.Size,
+			&lut.CreatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		luts = append(luts, lut)
+	}
+
+	return luts, rows.Err()
+}
+
+func (s LUTStore) Delete(ctx context.Context, userID int64, name string) error {
+	query := `DELETE FROM luts WHERE user_id = $1 AND name = $2`
+
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuration)
+	defer cancel()
+
+	res, err := s.db.ExecContext(ctx, query, userID, name)
+	if err != nil {
+		return err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
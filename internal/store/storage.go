@@ -3,6 +3,7 @@ package store
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
 	"errors"
 	"time"
 )
@@ -25,14 +26,65 @@ type Storage struct {
 		GetUserImages(context.Context, int64, PaginationParams) ([]Image, error)
 		GetByID(context.Context, int64) (*Image, error)
 		Update(context.Context, *Image) error
-		// Delete(context.Context, int64) error
+		SetURL(context.Context, *Image) error
+		Delete(context.Context, int64) ([]string, error)
+	}
+	Versions interface {
+		Create(context.Context, *Image, *ImageVersion) error
+		GetByImageID(context.Context, int64) ([]ImageVersion, error)
+		Get(context.Context, int64, int) (*ImageVersion, error)
+		GetOutsidePrefix(context.Context, string) ([]VersionObject, error)
+		Rename(context.Context, int64, string, string, string) ([]string, error)
+	}
+	Derivatives interface {
+		Replace(context.Context, int64, []Derivative) ([]string, error)
+		GetByImageID(context.Context, int64) ([]Derivative, error)
+	}
+	Blobs interface {
+		Collect(context.Context, []string, func([]string) error) error
+		GetOrphans(context.Context, int) ([]string, error)
+	}
+	Tiles interface {
+		Save(context.Context, *TilePyramid) (string, error)
+		GetByImageID(context.Context, int64) (*TilePyramid, error)
+	}
+	LUTs interface {
+		Create(context.Context, *LUT) error
+		GetByName(context.Context, int64, string) (*LUT, error)
+		GetUserLUTs(context.Context, int64) ([]LUT, error)
+		Delete(context.Context, int64, string) error
+	}
+	Uploads interface {
+		Create(context.Context, *Upload) error
+		GetByID(context.Context, int64) (*Upload, error)
+		Append(context.Context, *Upload, string, int64, time.Time) error
+		Complete(context.Context, *Upload, int64) error
+		Delete(context.Context, int64) error
+	}
+	Jobs interface {
+		Create(context.Context, *Job) error
+		GetByID(context.Context, int64) (*Job, error)
+		GetByStatus(context.Context, JobStatus, PaginationParams) ([]Job, error)
+		Claim(context.Context, time.Duration) (*Job, error)
+		Extend(context.Context, *Job, time.Duration) error
+		Succeed(context.Context, *Job, json.RawMessage) error
+		Retry(context.Context, *Job, string, time.Time) error
+		Bury(context.Context, *Job, string) error
+		Requeue(context.Context, int64) (*Job, error)
 	}
 }
 
 func NewStorage(db *sql.DB) Storage {
 	return Storage{
-		Users:  &UserStore{db},
-		Images: &ImageStore{db},
+		Users:       &UserStore{db},
+		Images:      &ImageStore{db},
+		Versions:    &VersionStore{db},
+		Derivatives: &DerivativeStore{db},
+		Blobs:       &BlobStore{db},
+		Tiles:       &TileStore{db},
+		LUTs:        &LUTStore{db},
+		Uploads:     &UploadStore{db},
+		Jobs:        &JobStore{db},
 	}
 }
 
@@ -0,0 +1,109 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+)
+
+// TilePyramid records the tile pyramid generated for an image. Tiles are
+// stored in the bucket under Prefix.
+type TilePyramid struct {
+	ImageID   int64  `json:"image_id"`
+	Version   int    `json:"version"` //image version the tiles were cut from
+	Layout    string `json:"layout"`
+	TileSize  int    `json:"tile_size"`
+	Overlap   int    `json:"overlap"`
+	Format    string `json:"format"`
+	Width     int    `json:"width"`
+	Height    int    `json:"height"`
+	MaxLevel  int    `json:"max_level"`
+	Tiles     int    `json:"tiles"`
+	Prefix    string `json:"-"`
+	CreatedAt string `json:"created_at"`
+}
+
+type TileStore struct {
+	db *sql.DB
+}
+
+// Save records pyramid as the tiles of its image, replacing earlier ones. It
+// returns the prefix of the pyramid it replaced, empty when there was none.
+func (s TileStore) Save(ctx context.Context, pyramid *TilePyramid) (string, error) {
+	query := `
+			WITH old AS (
+				SELECT prefix FROM image_tiles WHERE image_id = $1 FOR UPDATE
+			)
+			INSERT INTO image_tiles (image_id, version, layout, tile_size, overlap, format, width, height, max_level, tiles, prefix)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
+			ON CONFLICT (image_id) DO UPDATE
+			SET version = EXCLUDED.version, layout = EXCLUDED.layout, tile_size = EXCLUDED.tile_size,
+				overlap = EXCLUDED.overlap, format = EXCLUDED.format, width = EXCLUDED.width,
+				height = EXCLUDED.height, max_level = EXCLUDED.max_level, tiles = EXCLUDED.tiles,
+				prefix = EXCLUDED.prefix, created_at = NOW()
+			RETURNING created_at, COALESCE((SELECT prefix FROM old), '')
+	`
+
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuration)
+	defer cancel()
+
+	var replaced string
+	err := s.db.QueryRowContext(
+		ctx,
+		query,
+		pyramid.ImageID,
+		pyramid.Version,
+		pyramid.Layout,
+		pyramid.TileSize,
+		pyramid.Overlap,
+		pyramid.Format,
+		pyramid.Width,
+		pyramid.Height,
+		pyramid.MaxLevel,
+		pyramid.Tiles,
+		pyramid.Prefix,
+	).Scan(&pyramid.CreatedAt, &replaced)
+	if err != nil {
+		return "", err
+	}
+
+	return replaced, nil
+}
+
+func (s TileStore) GetByImageID(ctx context.Context, imageID int64) (*TilePyramid, error) {
+	query := `
+			SELECT image_id, version, layout, tile_size, overlap, format, width, height, max_level, tiles, prefix, created_at
+			FROM image_tiles
+			WHERE image_id = $1
+	`
+
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuration)
+	defer cancel()
+
+	p := &TilePyramid{}
+
+	err := s.db.QueryRowContext(ctx, query, imageID).Scan(
+		&p.ImageID,
+		&p.Version,
+		&p.Layout,
+		&p.TileSize,
+		&p.Overlap,
+		&p.Format,
+		&p.Width,
+		&p.Height,
+		&p.MaxLevel,
+		&p.Tiles,
+		&p.Prefix,
+		&p.CreatedAt,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return p, nil
+}
@@ -0,0 +1,181 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Upload is a resumable upload. Its data is received in chunks stored as
+// separate objects, listed in order in Parts, until Offset reaches Length.
+type Upload struct {
+	ID        int64     `json:"id"`
+	UserID    int64     `json:"user_id"`
+	Length    int64     `json:"length"`
+	Offset    int64     `json:"offset"`
+	Metadata  string    `json:"metadata"` //Upload-Metadata header as sent by the client
+	Filename  string    `json:"filename"`
+	Parts     []string  `json:"-"`
+	ImageID   *int64    `json:"image_id"` //set once the upload is an image
+	ExpiresAt time.Time `json:"expires_at"`
+	CreatedAt string    `json:"created_at"`
+}
+
+type UploadStore struct {
+	db *sql.DB
+}
+
+func (s UploadStore) Create(ctx context.Context, upload *Upload) error {
+	query := `
+		INSERT INTO uploads (user_id, upload_length, metadata, filename, expires_at)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING id, created_at
+	`
+
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuration)
+	defer cancel()
+
+	return s.db.QueryRowContext(
+		ctx,
+		query,
+		upload.UserID,
+		upload.Length,
+		upload.Metadata,
+		upload.Filename,
+		upload.ExpiresAt,
+	).Scan(
+		&upload.ID,
+		&upload.CreatedAt,
+	)
+}
+
+func (s UploadStore) GetByID(ctx context.Context, id int64) (*Upload, error) {
+	query := `
+		SELECT id, user_id, upload_length, upload_offset, metadata, filename, parts, image_id, expires_at, created_at
+		FROM uploads
+		WHERE id = $1
+	`
+
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuration)
+	defer cancel()
+
+	upload := &Upload{}
+	err := s.db.QueryRowContext(ctx, query, id).Scan(
+		&upload.ID,
+		&upload.UserID,
+		&upload.Length,
+		&upload.Offset,
+		&upload.Metadata,
+		&upload.Filename,
+		pq.Array(&upload.Parts),
+		&upload.ImageID,
+		&upload.ExpiresAt,
+		&upload.CreatedAt,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return upload, nil
+}
+
+// Append records a chunk of size bytes stored under part at the current
+// offset of the upload, and pushes its expiry back. It fails with
+// ErrConflict when another chunk was appended meanwhile.
+func (s UploadStore) Append(ctx context.Context, upload *Upload, part string, size int64, expiresAt time.Time) error {
+	query := `
+		UPDATE uploads
+		SET upload_offset = upload_offset + $3, parts = array_append(parts, $4), expires_at = $5
+		WHERE id = $1 AND upload_offset = $2 AND image_id IS NULL
+		RETURNING upload_offset, parts, expires_at
+	`
+
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuration)
+	defer cancel()
+
+	err := s.db.QueryRowContext(
+		ctx,
+		query,
+		upload.ID,
+		upload.Offset,
+		size,
+		part,
+		expiresAt,
+	).Scan(
+		&upload.Offset,
+		pq.Array(&upload.Parts),
+		&upload.ExpiresAt,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrConflict
+		default:
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Complete links a finished upload to the image made from it. The chunks
+// are no longer needed afterwards and are forgotten. It fails with
+// ErrConflict when the upload was already completed.
+func (s UploadStore) Complete(ctx context.Context, upload *Upload, imageID int64) error {
+	query := `
+		UPDATE uploads
+		SET image_id = $2, parts = '{}'
+		WHERE id = $1 AND image_id IS NULL
+	`
+
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuration)
+	defer cancel()
+
+	res, err := s.db.ExecContext(ctx, query, upload.ID, imageID)
+	if err != nil {
+		return err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrConflict
+	}
+
+	upload.ImageID = &imageID
+	upload.Parts = nil
+
+	return nil
+}
+
+func (s UploadStore) Delete(ctx context.Context, id int64) error {
+	query := `DELETE FROM uploads WHERE id = $1`
+
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuration)
+	defer cancel()
+
+	res, err := s.db.ExecContext(ctx, query, id)
+	if err != nil {
+		return err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
@@ -16,6 +16,7 @@ type User struct {
 	ID        int64    `json:"id"`
 	Username  string   `json:"username"`
 	Password  password `json:"-"`
+	IsAdmin   bool     `json:"is_admin"`
 	CreatedAt string   `json:"created_at"`
 }
 
@@ -87,7 +88,7 @@ func (s UserStore) create(ctx context.Context, tx *sql.Tx, user *User) error {
 
 func (s UserStore) GetByUsername(ctx context.Context, username string) (*User, error) {
 	query := `
-			SELECT id, username, password, created_at
+			SELECT id, username, password, is_admin, created_at
 			FROM users
 			WHERE username = $1 
 		`
@@ -105,6 +106,7 @@ func (s UserStore) GetByUsername(ctx context.Context, username string) (*User, e
 		&user.ID,
 		&user.Username,
 		&user.Password.hash,
+		&user.IsAdmin,
 		&user.CreatedAt,
 	)
 	if err != nil {
@@ -121,7 +123,7 @@ func (s UserStore) GetByUsername(ctx context.Context, username string) (*User, e
 
 func (s UserStore) GetByID(ctx context.Context, userID int64) (*User, error) {
 	query := `
-			SELECT id, username, password, created_at
+			SELECT id, username, password, is_admin, created_at
 			FROM users
 			WHERE id = $1
 	`
@@ -139,6 +141,7 @@ func (s UserStore) GetByID(ctx context.Context, userID int64) (*User, error) {
 		&user.ID,
 		&user.Username,
 		&user.Password.hash,
+		&user.IsAdmin,
 		&user.CreatedAt,
 	)
 	if err != nil {
@@ -0,0 +1,356 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+
+	"github.com/lib/pq"
+)
+
+// ImageVersion is an immutable snapshot of an image. Every transformation or
+// revert appends a new version; version 1 is always the original upload.
+type ImageVersion struct {
+	ID              int64           `json:"id"`
+	ImageID         int64           `json:"image_id"`
+	Version         int             `json:"version"`
+	Filename        string          `json:"filename"`
+	URL             string          `json:"url"`
+	Transformations json.RawMessage `json:"transformations,omitempty"`
+	RevertedFrom    *int            `json:"reverted_from,omitempty"`
+	AutoOriented    bool            `json:"auto_oriented"`
+	MetadataKept    []string        `json:"metadata_kept"` //nil when all metadata was kept
+	Metadata        ImageMetadata   `json:"metadata"`
+	CreatedAt       string          `json:"created_at"`
+}
+
+type VersionStore struct {
+	db *sql.DB
+}
+
+// Create appends version to the image history and makes it the current one.
+func (s VersionStore) Create(ctx context.Context, image *Image, version *ImageVersion) error {
+	return withTx(s.db, ctx, func(tx *sql.Tx) error {
+		ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuration)
+		defer cancel()
+
+		// lock the image row so concurrent writers get distinct version numbers
+		var current int
+		err := tx.QueryRowContext(
+			ctx,
+			`SELECT version FROM images WHERE id = $1 FOR UPDATE`,
+			image.ID,
+		).Scan(&current)
+		if err != nil {
+			switch {
+			case errors.Is(err, sql.ErrNoRows):
+				return ErrNotFound
+			default:
+				return err
+			}
+		}
+
+		err = tx.QueryRowContext(
+			ctx,
+			`SELECT COALESCE(MAX(version), 0) + 1 FROM image_versions WHERE image_id = $1`,
+			image.ID,
+		).Scan(&version.Version)
+		if err != nil {
+			return err
+		}
+
+		version.ImageID = image.ID
+		if err := createVersion(ctx, tx, version); err != nil {
+			return err
+		}
+
+		query := `
+			UPDATE images
+			SET url = $1, filename = $2, version = $3, auto_oriented = $4, metadata_kept = $5,
+				width = $6, height = $7, format = $8, size = $9, color_space = $10, has_alpha = $11,
+				orientation = $12, exif = $13, updated_at = NOW()
+			WHERE id = $14
+			RETURNING updated_at
+		`
+
+		m := version.Metadata
+		err = tx.QueryRowContext(
+			ctx,
+			query,
+			version.URL,
+			version.Filename,
+			version.Version,
+			version.AutoOriented,
+			pq.Array(version.MetadataKept),
+			m.Width,
+			m.Height,
+			m.Format,
+			m.Size,
+			m.ColorSpace,
+			m.HasAlpha,
+			m.Orientation,
+			nullableJSON(m.EXIF),
+			image.ID,
+		).Scan(&image.UpdatedAt)
+		if err != nil {
+			return err
+		}
+
+		image.URL = version.URL
+		image.Filename = version.Filename
+		image.Version = version.Version
+		image.AutoOriented = version.AutoOriented
+		image.MetadataKept = version.MetadataKept
+		image.Metadata = version.Metadata
+
+		return nil
+	})
+}
+
+// createVersion inserts the version and takes a reference to its object.
+func createVersion(ctx context.Context, tx *sql.Tx, version *ImageVersion) error {
+	if err := acquireBlob(ctx, tx, version.Filename, 1); err != nil {
+		return err
+	}
+
+	query := `
+			INSERT INTO image_versions (
+				image_id, version, filename, url, transformations, reverted_from, auto_oriented, metadata_kept,
+				width, height, format, size, color_space, has_alpha, orientation, exif
+			)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16)
+			RETURNING id, created_at
+	`
+
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuration)
+	defer cancel()
+
+	m := version.Metadata
+	return tx.QueryRowContext(
+		ctx,
+		query,
+		version.ImageID,
+		version.Version,
+		version.Filename,
+		version.URL,
+		nullableJSON(version.Transformations),
+		version.RevertedFrom,
+		version.AutoOriented,
+		pq.Array(version.MetadataKept),
+		m.Width,
+		m.Height,
+		m.Format,
+		m.Size,
+		m.ColorSpace,
+		m.HasAlpha,
+		m.Orientation,
+		nullableJSON(m.EXIF),
+	).Scan(
+		&version.ID,
+		&version.CreatedAt,
+	)
+}
+
+func (s VersionStore) GetByImageID(ctx context.Context, imageID int64) ([]ImageVersion, error) {
+	query := `
+			SELECT id, image_id, version, filename, url, transformations, reverted_from, auto_oriented, metadata_kept,
+				width, height, format, size, color_space, has_alpha, orientation, exif, created_at
+			FROM image_versions
+			WHERE image_id = $1
+			ORDER BY version
+	`
+
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuration)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx, query, imageID)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	var versions []ImageVersion
+	for rows.Next() {
+		var v ImageVersion
+		if err := scanVersion(rows, &v); err != nil {
+			return nil, err
+		}
+
+		versions = append(versions, v)
+	}
+
+	return versions, rows.Err()
+}
+
+func (s VersionStore) Get(ctx context.Context, imageID int64, version int) (*ImageVersion, error) {
+	query := `
+			SELECT id, image_id, version, filename, url, transformations, reverted_from, auto_oriented, metadata_kept,
+				width, height, format, size, color_space, has_alpha, orientation, exif, created_at
+			FROM image_versions
+			WHERE image_id = $1 AND version = $2
+	`
+
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuration)
+	defer cancel()
+
+	v := &ImageVersion{}
+
+	err := scanVersion(s.db.QueryRowContext(ctx, query, imageID, version), v)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return v, nil
+}
+
+func scanVersion(row interface{ Scan(...any) error }, v *ImageVersion) error {
+	var (
+		transformations []byte
+		revertedFrom    sql.NullInt32
+		exif            []byte
+	)
+
+	err := row.Scan(
+		&v.ID,
+		&v.ImageID,
+		&v.Version,
+		&v.Filename,
+		&v.URL,
+		&transformations,
+		&revertedFrom,
+		&v.AutoOriented,
+		pq.Array(&v.MetadataKept),
+		&v.Metadata.Width,
+		&v.Metadata.Height,
+		&v.Metadata.Format,
+		&v.Metadata.Size,
+		&v.Metadata.ColorSpace,
+		&v.Metadata.HasAlpha,
+		&v.Metadata.Orientation,
+		&exif,
+		&v.CreatedAt,
+	)
+	if err != nil {
+		return err
+	}
+
+	v.Transformations = transformations
+	v.Metadata.EXIF = exif
+	if revertedFrom.Valid {
+		n := int(revertedFrom.Int32)
+		v.RevertedFrom = &n
+	}
+
+	return nil
+}
+
+// VersionObject is a bucket object referenced by one or more versions of an
+// image.
+type VersionObject struct {
+	ImageID  int64
+	UserID   int64
+	Filename string
+}
+
+// GetOutsidePrefix returns the objects whose key does not start with prefix,
+// once per image.
+func (s VersionStore) GetOutsidePrefix(ctx context.Context, prefix string) ([]VersionObject, error) {
+	query := `
+			SELECT DISTINCT v.image_id, i.user_id, v.filename
+			FROM image_versions v
+			JOIN images i ON i.id = v.image_id
+			WHERE left(v.filename, length($1)) <> $1
+			ORDER BY v.image_id, v.filename
+	`
+
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuration)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx, query, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	var objects []VersionObject
+	for rows.Next() {
+		var o VersionObject
+		if err := rows.Scan(&o.ImageID, &o.UserID, &o.Filename); err != nil {
+			return nil, err
+		}
+
+		objects = append(objects, o)
+	}
+
+	return objects, rows.Err()
+}
+
+// Rename points every version of the image stored as oldFilename, and the
+// image itself when that is its current object, at filename. The references
+// move along, and the old key is returned for Blobs.Collect when none are
+// left.
+func (s VersionStore) Rename(ctx context.Context, imageID int64, oldFilename, filename, url string) ([]string, error) {
+	var orphans []string
+	err := withTx(s.db, ctx, func(tx *sql.Tx) error {
+		ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuration)
+		defer cancel()
+
+		res, err := tx.ExecContext(
+			ctx,
+			`UPDATE image_versions SET filename = $1, url = $2 WHERE image_id = $3 AND filename = $4`,
+			filename,
+			url,
+			imageID,
+			oldFilename,
+		)
+		if err != nil {
+			return err
+		}
+
+		rows, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+
+		if rows == 0 {
+			return ErrNotFound
+		}
+
+		_, err = tx.ExecContext(
+			ctx,
+			`UPDATE images SET filename = $1, url = $2 WHERE id = $3 AND filename = $4`,
+			filename,
+			url,
+			imageID,
+			oldFilename,
+		)
+		if err != nil {
+			return err
+		}
+
+		if err := acquireBlob(ctx, tx, filename, int(rows)); err != nil {
+			return err
+		}
+
+		released := make([]string, rows)
+		for i := range released {
+			released[i] = oldFilename
+		}
+
+		orphans, err = releaseBlobs(ctx, tx, released)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return orphans, nil
+}
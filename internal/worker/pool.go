@@ -0,0 +1,264 @@
+package worker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/xbanchon/image-processing-service/internal/store"
+	"go.uber.org/zap"
+)
+
+type Pool struct {
+	sync.RWMutex
+	cfg      Config
+	jobs     JobStore
+	logger   *zap.SugaredLogger
+	handlers map[string]HandlerFunc
+	wake     chan struct{}
+	quit     chan struct{}
+	wg       sync.WaitGroup
+	ctx      context.Context
+	cancel   context.CancelFunc
+}
+
+func NewPool(jobs JobStore, cfg Config, logger *zap.SugaredLogger) *Pool {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	return &Pool{
+		cfg:      cfg,
+		jobs:     jobs,
+		logger:   logger,
+		handlers: make(map[string]HandlerFunc),
+		wake:     make(chan struct{}, cfg.Workers),
+		quit:     make(chan struct{}),
+		ctx:      ctx,
+		cancel:   cancel,
+	}
+}
+
+// Handle registers the function executed for jobs of the given type.
+// Handlers must be registered before Start is called.
+func (p *Pool) Handle(jobType string, fn HandlerFunc) {
+	p.Lock()
+	defer p.Unlock()
+
+	p.handlers[jobType] = fn
+}
+
+func (p *Pool) Start() {
+	for i := 0; i < p.cfg.Workers; i++ {
+		p.wg.Add(1)
+		go p.work(i)
+	}
+
+	p.logger.Infow("worker pool started", "workers", p.cfg.Workers)
+}
+
+// Shutdown stops claiming new jobs and waits for the running ones to finish.
+// If ctx expires first, running jobs are cancelled and left leased, so they
+// are picked up again once their lease runs out.
+func (p *Pool) Shutdown(ctx context.Context) error {
+	close(p.quit)
+
+	done := make(chan struct{})
+	go func() {
+		p.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		p.cancel()
+		return nil
+	case <-ctx.Done():
+		p.cancel()
+		return ctx.Err()
+	}
+}
+
+func (p *Pool) Enqueue(ctx context.Context, jobType string, userID int64, payload any) (*store.Job, error) {
+	return p.EnqueueAt(ctx, jobType, userID, payload, time.Time{})
+}
+
+// EnqueueAt schedules a job to run no earlier than runAt, or right away for
+// the zero time.
+func (p *Pool) EnqueueAt(ctx context.Context, jobType string, userID int64, payload any, runAt time.Time) (*store.Job, error) {
+	p.RLock()
+	_, ok := p.handlers[jobType]
+	p.RUnlock()
+	if !ok {
+		return nil, ErrUnknownJobType
+	}
+
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	job := &store.Job{
+		Type:        jobType,
+		UserID:      userID,
+		Payload:     data,
+		MaxAttempts: p.cfg.MaxAttempts,
+	}
+	if !runAt.IsZero() {
+		job.RunAt = runAt.UTC().Format(time.RFC3339)
+	}
+
+	if err := p.jobs.Create(ctx, job); err != nil {
+		return nil, err
+	}
+
+	// poke an idle worker so the job does not wait for the next poll
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+
+	return job, nil
+}
+
+func (p *Pool) Get(ctx context.Context, id int64) (*store.Job, error) {
+	return p.jobs.GetByID(ctx, id)
+}
+
+func (p *Pool) work(n int) {
+	defer p.wg.Done()
+
+	ticker := time.NewTicker(p.cfg.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.quit:
+			return
+		default:
+		}
+
+		job, err := p.jobs.Claim(p.ctx, p.cfg.Lease)
+		switch {
+		case err == nil:
+			p.run(n, job)
+			continue
+		case errors.Is(err, store.ErrNotFound):
+		default:
+			p.logger.Errorw("job claim failed", "worker", n, "error", err.Error())
+		}
+
+		select {
+		case <-p.quit:
+			return
+		case <-p.wake:
+		case <-ticker.C:
+		}
+	}
+}
+
+func (p *Pool) run(n int, job *store.Job) {
+	p.RLock()
+	handler, ok := p.handlers[job.Type]
+	p.RUnlock()
+
+	p.logger.Infow("job started", "worker", n, "job_id", job.ID, "type", job.Type, "attempt", job.Attempts)
+
+	var (
+		result json.RawMessage
+		err    error
+	)
+	if !ok {
+		err = Permanent(ErrUnknownJobType)
+	} else {
+		result, err = p.execute(handler, job)
+	}
+
+	// the pool is being torn down: keep the lease so the job is retried later
+	// instead of counting the cancellation as a failure
+	if p.ctx.Err() != nil {
+		p.logger.Warnw("job interrupted by shutdown", "worker", n, "job_id", job.ID)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var permanent *permanentError
+	switch {
+	case err == nil:
+		err = p.jobs.Succeed(ctx, job, result)
+		p.logger.Infow("job succeeded", "worker", n, "job_id", job.ID, "type", job.Type)
+	case errors.As(err, &permanent), job.Attempts >= job.MaxAttempts:
+		p.logger.Errorw("job dead", "worker", n, "job_id", job.ID, "type", job.Type, "attempt", job.Attempts, "error", err.Error())
+		err = p.jobs.Bury(ctx, job, err.Error())
+	default:
+		retryAt := time.Now().Add(p.backoff(job.Attempts))
+		p.logger.Warnw("job failed", "worker", n, "job_id", job.ID, "type", job.Type, "attempt", job.Attempts, "retry_at", retryAt, "error", err.Error())
+		err = p.jobs.Retry(ctx, job, err.Error(), retryAt)
+	}
+
+	switch {
+	case errors.Is(err, store.ErrNotFound):
+		// another worker reclaimed the job meanwhile, its outcome stands
+		p.logger.Warnw("job lease lost", "worker", n, "job_id", job.ID, "attempt", job.Attempts)
+	case err != nil:
+		p.logger.Errorw("job state update failed", "worker", n, "job_id", job.ID, "error", err.Error())
+	}
+}
+
+func (p *Pool) execute(handler HandlerFunc, job *store.Job) (result json.RawMessage, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("job panicked: %v", r)
+		}
+	}()
+
+	ctx, cancel := context.WithCancel(p.ctx)
+	defer cancel()
+
+	if p.cfg.JobTimeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, p.cfg.JobTimeout)
+		defer cancel()
+	}
+
+	go p.heartbeat(ctx, job)
+
+	res, err := handler(ctx, job)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(res)
+}
+
+// heartbeat keeps the lease of a running job alive until ctx is done.
+func (p *Pool) heartbeat(ctx context.Context, job *store.Job) {
+	ticker := time.NewTicker(p.cfg.Lease / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := p.jobs.Extend(ctx, job, p.cfg.Lease); err != nil && ctx.Err() == nil {
+				p.logger.Warnw("job lease renewal failed", "job_id", job.ID, "error", err.Error())
+			}
+		}
+	}
+}
+
+func (p *Pool) backoff(attempt int) time.Duration {
+	d := p.cfg.Backoff
+	for i := 1; i < attempt && d < p.cfg.MaxBackoff; i++ {
+		d *= 2
+	}
+
+	if d > p.cfg.MaxBackoff {
+		d = p.cfg.MaxBackoff
+	}
+
+	return d
+}
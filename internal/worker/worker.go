@@ -0,0 +1,51 @@
+package worker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/xbanchon/image-processing-service/internal/store"
+)
+
+var (
+	ErrUnknownJobType = errors.New("unknown job type")
+)
+
+// HandlerFunc executes a job. The returned value is stored as the job result.
+type HandlerFunc func(ctx context.Context, job *store.Job) (any, error)
+
+type JobStore interface {
+	Create(context.Context, *store.Job) error
+	GetByID(context.Context, int64) (*store.Job, error)
+	Claim(context.Context, time.Duration) (*store.Job, error)
+	Extend(context.Context, *store.Job, time.Duration) error
+	Succeed(context.Context, *store.Job, json.RawMessage) error
+	Retry(context.Context, *store.Job, string, time.Time) error
+	Bury(context.Context, *store.Job, string) error
+}
+
+type Config struct {
+	Workers      int
+	PollInterval time.Duration //how often idle workers look for due retries
+	Lease        time.Duration //how long a claimed job is reserved without a heartbeat
+	MaxAttempts  int
+	Backoff      time.Duration //delay before the first retry, doubled on each attempt
+	MaxBackoff   time.Duration
+	JobTimeout   time.Duration
+}
+
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string { return e.err.Error() }
+
+func (e *permanentError) Unwrap() error { return e.err }
+
+// Permanent marks an error as not worth retrying; the job goes straight to
+// the dead-letter state.
+func Permanent(err error) error {
+	return &permanentError{err}
+}